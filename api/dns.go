@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 )
 
 func (client *Client) DNSDomain() (string, error) {
@@ -10,8 +11,44 @@ func (client *Client) DNSDomain() (string, error) {
 }
 
 func (client *Client) RegisterWithDNS(ID string, fqdn string, ip string) error {
+	return client.RegisterWithDNSTTL(ID, fqdn, ip, 0)
+}
+
+// RegisterWithDNSTTL is like RegisterWithDNS, but asks for the record
+// to be served with the given TTL in seconds; 0 means weaveDNS's default.
+func (client *Client) RegisterWithDNSTTL(ID string, fqdn string, ip string, ttl int) error {
+	return client.RegisterWithDNSOptions(ID, fqdn, ip, DNSRegistration{TTL: ttl})
+}
+
+// RegisterAliasWithDNS registers an additional name for the
+// container, which resolves to ip but is never given out for reverse
+// lookups of it.
+func (client *Client) RegisterAliasWithDNS(ID string, fqdn string, ip string, ttl int) error {
+	return client.RegisterWithDNSOptions(ID, fqdn, ip, DNSRegistration{TTL: ttl, Alias: true})
+}
+
+// DNSRegistration is how a name registered with weaveDNS should be
+// served, and what it should be tagged with.
+type DNSRegistration struct {
+	TTL   int    // in seconds; 0 means weaveDNS's default
+	Alias bool   // as for RegisterAliasWithDNS
+	Host  string // the host registering it, shown when listing records; may be empty
+}
+
+// RegisterWithDNSOptions registers fqdn for the container at ip,
+// served and tagged as opts says.
+func (client *Client) RegisterWithDNSOptions(ID string, fqdn string, ip string, opts DNSRegistration) error {
 	data := url.Values{}
 	data.Add("fqdn", fqdn)
+	if opts.TTL > 0 {
+		data.Add("ttl", strconv.Itoa(opts.TTL))
+	}
+	if opts.Alias {
+		data.Add("alias", "true")
+	}
+	if opts.Host != "" {
+		data.Add("host", opts.Host)
+	}
 	_, err := client.httpVerb("PUT", fmt.Sprintf("/name/%s/%s", ID, ip), data)
 	return err
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
@@ -44,6 +45,23 @@ func (client *Client) AllocateIPInSubnet(ID string, subnet *net.IPNet, checkAliv
 	return parseIP(ip)
 }
 
+// AllocateRandomIP is like AllocateIPInSubnet, or AllocateIP if subnet
+// is nil, but asks for a fresh address to be picked at random rather
+// than being the next free one. Routers which predate that hand out
+// the next free one anyway.
+func (client *Client) AllocateRandomIP(ID string, subnet *net.IPNet, checkAlive bool) (*net.IPNet, error) {
+	values := ipamValues(checkAlive)
+	values.Set("random", "true")
+	if subnet == nil {
+		return client.ipamOp(ID, "POST", values)
+	}
+	ip, err := client.httpVerb("POST", fmt.Sprintf("/ip/%s/%s", ID, subnet), values)
+	if err != nil {
+		return nil, err
+	}
+	return parseIP(ip)
+}
+
 // returns an IP for the ID given, or nil if one has not been
 // allocated
 func (client *Client) LookupIP(ID string) (*net.IPNet, error) {
@@ -56,6 +74,34 @@ func (client *Client) ClaimIP(ID string, cidr *net.IPNet, checkAlive bool) error
 	return err
 }
 
+// returns every address allocated so far, by the ID owning it
+func (client *Client) OwnedIPs() (map[string][]*net.IPNet, error) {
+	body, err := client.httpVerb("GET", "/ip", nil)
+	if err != nil {
+		return nil, err
+	}
+	var mappings struct {
+		Owned []struct {
+			ContainerID string   `json:"containerid"`
+			Addrs       []string `json:"addrs"`
+		} `json:"owned"`
+	}
+	if err := json.Unmarshal([]byte(body), &mappings); err != nil {
+		return nil, err
+	}
+	owned := make(map[string][]*net.IPNet)
+	for _, m := range mappings.Owned {
+		for _, addr := range m.Addrs {
+			ipnet, err := parseIP(addr)
+			if err != nil {
+				return nil, err
+			}
+			owned[m.ContainerID] = append(owned[m.ContainerID], ipnet)
+		}
+	}
+	return owned, nil
+}
+
 // release all IPs owned by an ID
 func (client *Client) ReleaseIPsFor(ID string) error {
 	_, err := client.httpVerb("DELETE", fmt.Sprintf("/ip/%s", ID), nil)
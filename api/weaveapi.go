@@ -17,8 +17,15 @@ const (
 )
 
 type Client struct {
-	baseURL string
-	log     Logger
+	baseURL    string
+	log        Logger
+	httpClient *http.Client
+}
+
+// SetHTTPClient makes the client issue its requests via httpClient,
+// e.g. to impose a timeout, rather than via http.DefaultClient.
+func (client *Client) SetHTTPClient(httpClient *http.Client) {
+	client.httpClient = httpClient
 }
 
 func (client *Client) httpVerb(verb string, url string, values url.Values) (string, error) {
@@ -35,7 +42,11 @@ func (client *Client) httpVerb(verb string, url string, values url.Values) (stri
 	if values != nil {
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
-	resp, err := http.DefaultClient.Do(req)
+	httpClient := client.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -61,6 +61,21 @@ func NewVersionedClient(apiPath string, apiVersionString string) (*Client, error
 	return client, client.checkWorking()
 }
 
+// NewVersionedTLSClient is like NewVersionedClient, but authenticates
+// to Docker with the given client certificate and CA
+func NewVersionedTLSClient(apiPath, cert, key, ca string, apiVersionString string) (*Client, error) {
+	if !strings.Contains(apiPath, "://") {
+		apiPath = "tcp://" + apiPath
+	}
+	dc, err := docker.NewVersionedTLSClient(apiPath, cert, key, ca, apiVersionString)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{dc}
+
+	return client, client.checkWorking()
+}
+
 func NewVersionedClientFromEnv(apiVersionString string) (*Client, error) {
 	dc, err := docker.NewVersionedClientFromEnv(apiVersionString)
 	if err != nil {
@@ -54,6 +54,20 @@ func SetLogLevel(levelname string) {
 	Log.Level = level
 }
 
+// SetLogFormat sets how log entries are written: "text", the default,
+// or "json", one object per line with any fields as keys, for log
+// aggregators.
+func SetLogFormat(format string) {
+	switch format {
+	case "text":
+		Log.Formatter = standardTextFormatter
+	case "json":
+		Log.Formatter = &logrus.JSONFormatter{}
+	default:
+		Log.Fatalf("invalid log format %q: must be text or json", format)
+	}
+}
+
 func CheckFatal(e error) {
 	if e != nil {
 		Log.Fatal(e)
@@ -17,6 +17,7 @@ type allocate struct {
 	ident            string       // a container ID, something like "weave:expose", or api.NoContainerID
 	r                address.CIDR // Subnet we are trying to allocate within
 	isContainer      bool         // true if ident is a container ID
+	random           bool         // pick any free address at random, not the lowest
 	hasBeenCancelled func() bool
 }
 
@@ -41,7 +42,11 @@ func (g *allocate) Try(alloc *Allocator) bool {
 
 	alloc.establishRing()
 
-	if ok, addr := alloc.space.Allocate(g.r.HostRange()); ok {
+	allocateIn := alloc.space.Allocate
+	if g.random {
+		allocateIn = alloc.space.AllocateRandom
+	}
+	if ok, addr := allocateIn(g.r.HostRange()); ok {
 		// If caller hasn't supplied a unique ID, file it under the IP address
 		// which lets the caller then release the address using DELETE /ip/address
 		if g.ident == api.NoContainerID {
@@ -303,12 +303,19 @@ func (alloc *Allocator) Prime() {
 // Allocate (Sync) - get new IP address for container with given name in range
 // if there isn't any space in that range we block indefinitely
 func (alloc *Allocator) Allocate(ident string, r address.CIDR, isContainer bool, hasBeenCancelled func() bool) (address.Address, error) {
+	return alloc.allocate(ident, r, isContainer, false, hasBeenCancelled)
+}
+
+// allocate is Allocate, optionally picking the address at random from
+// the free space we own in that range, so that it can't be predicted
+func (alloc *Allocator) allocate(ident string, r address.CIDR, isContainer, random bool, hasBeenCancelled func() bool) (address.Address, error) {
 	resultChan := make(chan allocateResult)
 	op := &allocate{
 		resultChan:       resultChan,
 		ident:            ident,
 		r:                r,
 		isContainer:      isContainer,
+		random:           random,
 		hasBeenCancelled: hasBeenCancelled,
 	}
 	alloc.doOperation(op, &alloc.pendingAllocates)
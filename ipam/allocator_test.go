@@ -100,6 +100,41 @@ func TestAllocFree(t *testing.T) {
 	require.Equal(t, address.Count(spaceSize+1), alloc.NumFreeAddresses(subnet.Range()))
 }
 
+func TestAllocRandom(t *testing.T) {
+	const (
+		universe  = "10.0.3.0/26"
+		spaceSize = 62 // 64 IP addresses in /26, minus .0 and .63
+	)
+
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", universe, 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	seen := make(map[address.Address]string)
+	sequential := 0
+	var last address.Address
+	for i := 0; i < spaceSize; i++ {
+		container := fmt.Sprintf("c%d", i)
+		addr, err := alloc.allocate(container, subnet, true, true, returnFalse)
+		require.NoError(t, err)
+		require.True(t, subnet.HostRange().Contains(addr), "%s outside %s", addr, subnet)
+		if owner, found := seen[addr]; found {
+			t.Fatalf("%s given to %s was already given to %s", addr, container, owner)
+		}
+		seen[addr] = container
+		if addr == last+1 {
+			sequential++
+		}
+		last = addr
+	}
+	require.True(t, sequential < spaceSize/2, "%d of %d addresses followed the one before", sequential, spaceSize)
+
+	// Asking again for the same container gets the same address
+	addr, err := alloc.allocate("c0", subnet, true, true, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, "c0", seen[addr])
+}
+
 func TestBootstrap(t *testing.T) {
 	const (
 		donateSize     = 5
@@ -2,7 +2,9 @@ package space
 
 import (
 	"bytes"
+	"crypto/rand"
 	"fmt"
+	"math/big"
 	"sort"
 
 	"github.com/weaveworks/weave/common"
@@ -78,6 +80,32 @@ func (s *Space) Allocate(r address.Range) (bool, address.Address) {
 	}), result
 }
 
+// AllocateRandom is like Allocate, but takes an address picked at
+// random from all those free in r, so that the next one is hard to
+// guess.
+func (s *Space) AllocateRandom(r address.Range) (bool, address.Address) {
+	free := s.NumFreeAddressesInRange(r)
+	if free == 0 {
+		return false, 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(free)))
+	if err != nil {
+		return s.Allocate(r)
+	}
+	skip := address.Count(n.Int64())
+	var result address.Address
+	return s.walkFree(r, func(chunk address.Range) bool {
+		if skip >= chunk.Size() {
+			skip -= chunk.Size()
+			return false
+		}
+		result = address.Add(chunk.Start, address.Offset(skip))
+		s.ours = add(s.ours, result, result+1)
+		s.free = subtract(s.free, result, result+1)
+		return true
+	}), result
+}
+
 func (s *Space) Claim(addr address.Address) error {
 	if !contains(s.free, addr) {
 		return fmt.Errorf("Address %v is not free to claim", addr)
@@ -127,6 +127,38 @@ func TestSpaceAllocate(t *testing.T) {
 	space1.assertInvariants()
 }
 
+func TestSpaceAllocateRandom(t *testing.T) {
+	// we own two chunks of a much bigger range, some of it already used
+	space := makeSpace(ip("10.0.3.0"), 64)
+	space.Add(ip("10.0.5.0"), 64)
+	for i := 0; i < 4; i++ {
+		ok, _ := space.Allocate(address.NewRange(ip("10.0.3.0"), 64))
+		require.True(t, ok)
+	}
+	subnet := address.NewRange(ip("10.0.0.0"), 65536)
+
+	seen := map[address.Address]bool{}
+	var last address.Address
+	sequential := 0
+	for i := 0; i < 124; i++ {
+		ok, addr := space.AllocateRandom(subnet)
+		require.True(t, ok, "Failed to get address")
+		require.True(t, address.NewRange(ip("10.0.3.4"), 60).Contains(addr) || address.NewRange(ip("10.0.5.0"), 64).Contains(addr), "%s is not free space of ours", addr)
+		require.False(t, seen[addr], "%s given out twice", addr)
+		seen[addr] = true
+		if addr == last+1 {
+			sequential++
+		}
+		last = addr
+	}
+	require.True(t, sequential < 40, "%d of 124 addresses followed the one before", sequential)
+	space.assertInvariants()
+
+	ok, _ := space.AllocateRandom(subnet)
+	require.False(t, ok, "Should have failed to get address")
+	require.Equal(t, address.Count(0), space.NumFreeAddresses())
+}
+
 func TestSpaceFree(t *testing.T) {
 	const (
 		testAddr1   = "10.0.3.16"
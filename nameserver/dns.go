@@ -187,8 +187,8 @@ func (h *handler) handleLocal(w dns.ResponseWriter, req *dns.Msg) {
 		hostname = hostname + h.domain
 	}
 
-	addrs := h.ns.Lookup(hostname)
-	if len(addrs) == 0 {
+	entries := h.ns.lookupEntries(hostname)
+	if len(entries) == 0 {
 		h.nameError(w, req)
 		return
 	}
@@ -205,10 +205,13 @@ func (h *handler) handleLocal(w dns.ResponseWriter, req *dns.Msg) {
 		Class:  dns.ClassINET,
 		Ttl:    h.ttl,
 	}
-	answers := make([]dns.RR, len(addrs))
-	for i, addr := range addrs {
-		ip := addr.IP4()
-		answers[i] = &dns.A{Hdr: header, A: ip}
+	answers := make([]dns.RR, len(entries))
+	for i, entry := range entries {
+		hdr := header
+		if entry.TTL > 0 {
+			hdr.Ttl = entry.TTL
+		}
+		answers[i] = &dns.A{Hdr: hdr, A: entry.Addr.IP4()}
 	}
 	shuffleAnswers(&answers)
 
@@ -22,7 +22,15 @@ type Entry struct {
 	Hostname    string // as supplied
 	lHostname   string // lowercased (not exported, so not encoded by gob)
 	Version     int
-	Tombstone   int64 // timestamp of when it was deleted
+	Tombstone   int64  // timestamp of when it was deleted
+	TTL         uint32 // in seconds; 0 means use the server's default
+	Alias       bool   // answers forward lookups only, never PTR queries
+	// Host is what the registering client said identifies its host, e.g.
+	// the proxy's --host-id, to help trace stale entries. Origin is only
+	// the peer whose HTTP API took the registration, which may not be on
+	// the client's host and has a MAC-style name rather than one an
+	// operator would recognise.
+	Host string
 }
 
 type Entries []Entry
@@ -93,6 +101,9 @@ func (e1 *Entry) merge(e2 *Entry) bool {
 	if e2.Version > e1.Version {
 		e1.Version = e2.Version
 		e1.Tombstone = e2.Tombstone
+		e1.TTL = e2.TTL
+		e1.Alias = e2.Alias
+		e1.Host = e2.Host
 		return true
 	} else if e2.Version == e1.Version && e2.Tombstone > e1.Tombstone {
 		e1.Tombstone = e2.Tombstone
@@ -141,17 +152,20 @@ func (es *Entries) checkAndPanic() *Entries {
 	return es
 }
 
-func (es *Entries) add(hostname, containerid string, origin mesh.PeerName, addr address.Address) Entry {
+func (es *Entries) add(hostname, containerid string, origin mesh.PeerName, addr address.Address, ttl uint32, alias bool, host string) Entry {
 	defer es.checkAndPanic().checkAndPanic()
 
 	entry := Entry{Hostname: hostname, lHostname: strings.ToLower(hostname),
-		Origin: origin, ContainerID: containerid, Addr: addr}
+		Origin: origin, ContainerID: containerid, Addr: addr, TTL: ttl, Alias: alias, Host: host}
 	i := sort.Search(len(*es), func(i int) bool {
 		return !(*es)[i].insensitiveLess(&entry)
 	})
 	if i < len(*es) && (*es)[i].equal(entry) {
-		if (*es)[i].Tombstone > 0 {
+		if (*es)[i].Tombstone > 0 || (*es)[i].TTL != ttl || (*es)[i].Alias != alias || (*es)[i].Host != host {
 			(*es)[i].Tombstone = 0
+			(*es)[i].TTL = ttl
+			(*es)[i].Alias = alias
+			(*es)[i].Host = host
 			(*es)[i].Version++
 		}
 	} else {
@@ -28,7 +28,7 @@ func TestAdd(t *testing.T) {
 	now = func() int64 { return 1234 }
 
 	entries := Entries{}
-	entries.add("A", "", mesh.UnknownPeerName, address.Address(0))
+	entries.add("A", "", mesh.UnknownPeerName, address.Address(0), 0, false, "")
 	expected := l(Entries{
 		Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0)},
 	})
@@ -40,11 +40,32 @@ func TestAdd(t *testing.T) {
 	})
 	require.Equal(t, entries, expected)
 
-	entries.add("A", "", mesh.UnknownPeerName, address.Address(0))
+	entries.add("A", "", mesh.UnknownPeerName, address.Address(0), 0, false, "")
 	expected = l(Entries{
 		Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0), Version: 2},
 	})
 	require.Equal(t, entries, expected)
+
+	// registering again with a different TTL updates it for everyone
+	entries.add("A", "", mesh.UnknownPeerName, address.Address(0), 5, false, "")
+	expected = l(Entries{
+		Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0), Version: 3, TTL: 5},
+	})
+	require.Equal(t, entries, expected)
+
+	// and likewise for whether it is only an alias
+	entries.add("A", "", mesh.UnknownPeerName, address.Address(0), 5, true, "")
+	expected = l(Entries{
+		Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0), Version: 4, TTL: 5, Alias: true},
+	})
+	require.Equal(t, entries, expected)
+
+	// and the host which registered it
+	entries.add("A", "", mesh.UnknownPeerName, address.Address(0), 5, true, "host1")
+	expected = l(Entries{
+		Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0), Version: 5, TTL: 5, Alias: true, Host: "host1"},
+	})
+	require.Equal(t, entries, expected)
 }
 
 func TestMerge(t *testing.T) {
@@ -58,6 +79,12 @@ func TestMerge(t *testing.T) {
 
 	diff = e1.merge(e1)
 	require.Equal(t, Entries{}, diff)
+
+	// registered again from another host
+	e3 := l(Entries{Entry{Hostname: "A", Host: "host1"}})
+	diff = e3.merge(l(Entries{Entry{Hostname: "A", Version: 1, Host: "host2"}}))
+	require.Equal(t, l(Entries{Entry{Hostname: "A", Version: 1, Host: "host2"}}), diff)
+	require.Equal(t, l(Entries{Entry{Hostname: "A", Version: 1, Host: "host2"}}), e3)
 }
 
 func TestOldMerge(t *testing.T) {
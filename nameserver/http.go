@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/miekg/dns"
@@ -29,13 +30,20 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 			ipStr     = vars["ip"]
 			fqdn      = r.FormValue("fqdn")
 			ip, err   = address.ParseIP(ipStr)
+			ttl       uint64
 		)
 		if err != nil {
 			n.badRequest(w, err)
 			return
 		}
+		if ttlStr := r.FormValue("ttl"); ttlStr != "" {
+			if ttl, err = strconv.ParseUint(ttlStr, 10, 32); err != nil {
+				n.badRequest(w, fmt.Errorf("invalid ttl %q", ttlStr))
+				return
+			}
+		}
 
-		n.AddEntryFQDN(fqdn, container, n.ourName, ip)
+		n.addEntryFQDN(fqdn, container, n.ourName, ip, uint32(ttl), r.FormValue("alias") == "true", r.FormValue("host"))
 
 		if r.FormValue("check-alive") == "true" && dockerCli != nil && dockerCli.IsContainerNotRunning(container) {
 			n.infof("container '%s' is not running: removing", container)
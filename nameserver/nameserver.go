@@ -84,35 +84,63 @@ func (n *Nameserver) broadcastEntries(es ...Entry) {
 }
 
 func (n *Nameserver) AddEntry(hostname, containerid string, origin mesh.PeerName, addr address.Address) {
+	n.addEntry(hostname, containerid, origin, addr, 0, false, "")
+}
+
+func (n *Nameserver) addEntry(hostname, containerid string, origin mesh.PeerName, addr address.Address, ttl uint32, alias bool, host string) {
 	n.Lock()
 	n.infof("adding entry for %s: %s -> %s", containerid, hostname, addr.String())
-	entry := n.entries.add(hostname, containerid, origin, addr)
+	entry := n.entries.add(hostname, containerid, origin, addr, ttl, alias, host)
 	n.Unlock()
 	n.broadcastEntries(entry)
 }
 
-func (n *Nameserver) AddEntryFQDN(fqdn, containerid string, origin mesh.PeerName, addr address.Address) {
+// AddEntryFQDN adds an entry for a name in our domain; ttl is in
+// seconds, with 0 meaning the server's default.
+func (n *Nameserver) AddEntryFQDN(fqdn, containerid string, origin mesh.PeerName, addr address.Address, ttl uint32) {
+	n.addEntryFQDN(fqdn, containerid, origin, addr, ttl, false, "")
+}
+
+// AddAliasFQDN is like AddEntryFQDN, but the name only answers
+// forward lookups; reverse lookups of addr keep returning the
+// container's own name.
+func (n *Nameserver) AddAliasFQDN(fqdn, containerid string, origin mesh.PeerName, addr address.Address, ttl uint32) {
+	n.addEntryFQDN(fqdn, containerid, origin, addr, ttl, true, "")
+}
+
+// addEntryFQDN is AddEntryFQDN, or AddAliasFQDN if alias, recording
+// host as where the entry came from.
+func (n *Nameserver) addEntryFQDN(fqdn, containerid string, origin mesh.PeerName, addr address.Address, ttl uint32, alias bool, host string) {
 	hostname := dns.Fqdn(fqdn)
 	if !dns.IsSubDomain(n.domain, hostname) {
 		n.infof("Ignoring registration %s %s %s (not a subdomain of %s)", hostname, addr.String(), containerid, n.domain)
 		return
 	}
-	n.AddEntry(hostname, containerid, origin, addr)
+	n.addEntry(hostname, containerid, origin, addr, ttl, alias, host)
 }
 
 func (n *Nameserver) Lookup(hostname string) []address.Address {
+	entries := n.lookupEntries(hostname)
+	result := make([]address.Address, len(entries))
+	for i, e := range entries {
+		result[i] = e.Addr
+	}
+	return result
+}
+
+// lookupEntries returns copies of the live entries for hostname
+func (n *Nameserver) lookupEntries(hostname string) Entries {
 	n.RLock()
 	defer n.RUnlock()
 
-	entries := n.entries.lookup(hostname)
-	result := []address.Address{}
-	for _, e := range entries {
+	result := Entries{}
+	for _, e := range n.entries.lookup(hostname) {
 		if e.Tombstone > 0 {
 			continue
 		}
-		result = append(result, e.Addr)
+		result = append(result, e)
 	}
-	n.debugf("lookup %s -> %s", hostname, &result)
+	n.debugf("lookup %s -> %v", hostname, result)
 	return result
 }
 
@@ -121,7 +149,7 @@ func (n *Nameserver) ReverseLookup(ip address.Address) (string, error) {
 	defer n.RUnlock()
 
 	match, err := n.entries.first(func(e *Entry) bool {
-		return e.Tombstone == 0 && e.Addr == ip
+		return e.Tombstone == 0 && e.Addr == ip && !e.Alias
 	})
 	if err != nil {
 		return "", err
@@ -236,6 +236,30 @@ func TestContainerAndPeerDeath(t *testing.T) {
 	require.Equal(t, []address.Address{}, nameserver.Lookup("hostname"))
 }
 
+func TestReverseLookupAliases(t *testing.T) {
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	nameserver := New(peername, "weave.local", func(mesh.PeerName) bool { return true })
+	addr, err := address.ParseIP("10.32.0.1")
+	require.Nil(t, err)
+
+	// aliases sort ahead of the container's name, but must not
+	// displace it in PTR answers
+	nameserver.AddEntryFQDN("web_1.weave.local", "containerid", peername, addr, 0)
+	nameserver.AddAliasFQDN("app.weave.local", "containerid", peername, addr, 0)
+	require.Equal(t, []address.Address{addr}, nameserver.Lookup("web_1.weave.local."))
+	require.Equal(t, []address.Address{addr}, nameserver.Lookup("app.weave.local."))
+	hostname, err := nameserver.ReverseLookup(addr)
+	require.Nil(t, err)
+	require.Equal(t, "web_1.weave.local.", hostname)
+
+	// both go when the container does
+	nameserver.ContainerDied("containerid")
+	require.Equal(t, []address.Address{}, nameserver.Lookup("app.weave.local."))
+	_, err = nameserver.ReverseLookup(addr)
+	require.NotNil(t, err)
+}
+
 func TestTombstoneDeletion(t *testing.T) {
 	oldNow := now
 	defer func() { now = oldNow }()
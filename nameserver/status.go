@@ -15,6 +15,7 @@ type EntryStatus struct {
 	Address     string
 	Version     int
 	Tombstone   int64
+	Host        string
 }
 
 func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
@@ -33,7 +34,8 @@ func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
 			entry.ContainerID,
 			entry.Addr.String(),
 			entry.Version,
-			entry.Tombstone})
+			entry.Tombstone,
+			entry.Host})
 	}
 
 	upstreamConfig, _ := dnsServer.upstream.Config()
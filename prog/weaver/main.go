@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -35,6 +36,8 @@ var version = "unreleased"
 
 var Log = common.Log
 
+const proxyShutdownTimeout = 10 * time.Second
+
 type ipamConfig struct {
 	IPRangeCIDR   string
 	IPSubnetCIDR  string
@@ -142,6 +145,7 @@ func main() {
 		password           string
 		pktdebug           bool
 		logLevel           = "info"
+		logFormat          = "text"
 		prof               string
 		bufSzMB            int
 		noDiscovery        bool
@@ -160,6 +164,7 @@ func main() {
 		token              string
 		advertiseAddress   string
 		pluginConfig       plugin.Config
+		proxyConfigFile    string
 		defaultDockerHost  = getenvOrDefault("DOCKER_HOST", "unix:///var/run/docker.sock")
 	)
 
@@ -176,6 +181,7 @@ func main() {
 	mflag.StringVar(&nickName, []string{"-nickname"}, "", "nickname of peer (defaults to hostname)")
 	mflag.StringVar(&password, []string{"-password"}, "", "network password")
 	mflag.StringVar(&logLevel, []string{"-log-level"}, "info", "logging level (debug, info, warning, error)")
+	mflag.StringVar(&logFormat, []string{"-log-format"}, "text", "logging format: 'text', or 'json' for one object per line, with fields such as the container name, image and WEAVE_CIDR")
 	mflag.BoolVar(&pktdebug, []string{"-pkt-debug"}, false, "enable per-packet debug logging")
 	mflag.StringVar(&prof, []string{"-profile"}, "", "enable profiling and write profiles to given path")
 	mflag.IntVar(&config.ConnLimit, []string{"-conn-limit"}, 30, "connection limit (0 for unlimited)")
@@ -214,6 +220,7 @@ func main() {
 	mflag.StringVar(&pluginConfig.MeshSocket, []string{"-plugin-mesh-socket"}, "/run/docker/plugins/weavemesh.sock", "plugin socket on which to listen in mesh mode")
 
 	proxyConfig := newProxyConfig()
+	mflag.StringVar(&proxyConfigFile, []string{"-config"}, "", "proxy: YAML or JSON file of proxy options, keyed by their flag names, e.g. 'wait-timeout: 30s'; flags given on the command line take precedence")
 
 	// crude way of detecting that we probably have been started in a
 	// container, with `weave launch` --> suppress misleading paths in
@@ -235,6 +242,16 @@ func main() {
 		os.Exit(0)
 	}
 
+	if proxyConfigFile != "" {
+		given := options()
+		flagGiven := func(key string) bool {
+			_, found := given[key]
+			return found
+		}
+		if err := weaveproxy.LoadConfigFile(proxyConfigFile, proxyConfig, flagGiven); err != nil {
+			Log.Fatalf("Unable to load proxy config: %s", err)
+		}
+	}
 	proxyConfig.DockerHost = dockerAPI
 	if bridgeConfig.AWSVPC {
 		proxyConfig.NoMulticastRoute = true
@@ -247,6 +264,7 @@ func main() {
 	}
 
 	common.SetLogLevel(logLevel)
+	common.SetLogFormat(logFormat)
 	Log.Println("Command line options:", options())
 	Log.Infoln("weave ", version)
 
@@ -273,6 +291,15 @@ func main() {
 			Log.Fatalf("Could not start proxy: %s", err)
 		}
 		defer proxy.Stop()
+		defer func() {
+			// Let container creations already under way finish
+			// setting up, rather than leave them half-done
+			ctx, cancel := context.WithTimeout(context.Background(), proxyShutdownTimeout)
+			defer cancel()
+			if err := proxy.Shutdown(ctx); err != nil {
+				Log.Warningf("Proxy did not finish intercepting requests: %s", err)
+			}
+		}()
 		listeners := proxy.Listen()
 		proxy.AttachExistingContainers()
 		go proxy.Serve(listeners, waitReady.Add())
@@ -450,7 +477,7 @@ func main() {
 		router.HandleHTTP(muxRouter)
 		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, proxy, plugin, &waitReady)
 		HandleHTTPPeer(muxRouter, allocator, discoveryEndpoint, token, name.String())
-		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver))
+		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver, proxy))
 		if proxy != nil {
 			muxRouter.Methods("GET").Path("/proxyaddrs").HandlerFunc(proxy.StatusHTTP)
 		}
@@ -462,7 +489,7 @@ func main() {
 	if statusAddr != "" {
 		muxRouter := mux.NewRouter()
 		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, proxy, plugin, &waitReady)
-		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver))
+		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver, proxy))
 		statusMux := http.NewServeMux()
 		statusMux.Handle("/", muxRouter)
 		Log.Println("Listening for metrics requests on", statusAddr)
@@ -540,19 +567,72 @@ func newProxyConfig() *weaveproxy.Config {
 	}
 	mflag.BoolVar(&proxyConfig.Enabled, []string{"-proxy"}, false, "instruct Weave Net to start its Docker proxy")
 	mflagext.ListVar(&proxyConfig.ListenAddrs, []string{"H"}, nil, "addresses on which to listen for Docker proxy")
+	mflag.StringVar(&proxyConfig.Socket, []string{"-socket"}, "", "proxy: path of a unix socket of its own on which to listen, e.g. to mount into containers, rather than a symlink to weave.sock")
+	mflag.StringVar(&proxyConfig.SocketMode, []string{"-socket-mode"}, "0660", "proxy: octal permissions for the --socket file")
 	mflag.StringVar(&proxyConfig.HostnameFromLabel, []string{"-hostname-from-label"}, "", "Key of container label from which to obtain the container's hostname")
 	mflag.StringVar(&proxyConfig.HostnameMatch, []string{"-hostname-match"}, "(.*)", "Regexp pattern to apply on container names (e.g. '^aws-[0-9]+-(.*)$')")
 	mflag.StringVar(&proxyConfig.HostnameReplacement, []string{"-hostname-replacement"}, "$1", "Expression to generate hostnames based on matches from --hostname-match (e.g. 'my-app-$1')")
+	mflag.StringVar(&proxyConfig.HostnameTemplate, []string{"-hostname-template"}, "", "Go template to generate hostnames from .Name, .Image, .Labels, .Domain and .Index, instead of the container name (e.g. '{{.Name}}-{{.Index}}.{{.Domain}}')")
+	mflag.StringVar(&proxyConfig.HostnameCollision, []string{"-hostname-collision"}, "allow", "proxy: what to do when a container would get the weaveDNS hostname of another: 'allow' it, 'warn', or 'suffix' it with -2, -3, ...")
 	mflag.BoolVar(&proxyConfig.RewriteInspect, []string{"-rewrite-inspect"}, false, "Rewrite 'inspect' calls to return the weave network settings (if attached)")
 	mflag.BoolVar(&proxyConfig.NoDefaultIPAM, []string{"-no-default-ipalloc"}, false, "proxy: do not automatically allocate addresses for containers without a WEAVE_CIDR")
+	mflag.StringVar(&proxyConfig.IPAMUnavailable, []string{"-ipam-unavailable"}, "fail", "proxy: what to do when IPAM can't be reached to give a container its addresses: 'fail' the container, or 'wait' for up to --ipam-wait-timeout")
+	mflag.DurationVar(&proxyConfig.IPAMWaitTimeout, []string{"-ipam-wait-timeout"}, 30*time.Second, "proxy: how long to keep asking IPAM for addresses with --ipam-unavailable=wait")
+	mflag.StringVar(&proxyConfig.IPAllocation, []string{"-ip-allocation"}, "sequential", "proxy: how to pick addresses for containers which don't ask for one: 'sequential', as IPAM hands them out, or 'random', picked by IPAM from the free addresses this host owns in the subnet")
 	mflag.BoolVar(&proxyConfig.NoRewriteHosts, []string{"-no-rewrite-hosts"}, false, "proxy: do not automatically rewrite /etc/hosts. Use if you need the docker IP to remain in /etc/hosts")
 	mflag.StringVar(&proxyConfig.TLSConfig.CACert, []string{"-tlscacert"}, "", "Trust certs signed only by this CA")
 	mflag.StringVar(&proxyConfig.TLSConfig.Cert, []string{"-tlscert"}, "", "Path to TLS certificate file")
 	mflag.BoolVar(&proxyConfig.TLSConfig.Enabled, []string{"-tls"}, false, "Use TLS; implied by --tlsverify")
 	mflag.StringVar(&proxyConfig.TLSConfig.Key, []string{"-tlskey"}, "", "Path to TLS key file")
 	mflag.BoolVar(&proxyConfig.TLSConfig.Verify, []string{"-tlsverify"}, false, "Use TLS and verify the remote")
-	mflag.BoolVar(&proxyConfig.WithoutDNS, []string{"-without-dns"}, false, "proxy: instruct created containers to never use weaveDNS as their nameserver")
+	mflag.StringVar(&proxyConfig.DockerTLSConfig.CACert, []string{"-docker-tlscacert"}, "", "proxy: trust the Docker daemon only if its cert is signed by this CA")
+	mflag.StringVar(&proxyConfig.DockerTLSConfig.Cert, []string{"-docker-tlscert"}, "", "proxy: path to TLS client certificate file for connecting to the Docker daemon")
+	mflag.StringVar(&proxyConfig.DockerTLSConfig.Key, []string{"-docker-tlskey"}, "", "proxy: path to TLS client key file for connecting to the Docker daemon")
+	mflag.BoolVar(&proxyConfig.WithoutDNS, []string{"-without-dns"}, false, "proxy: instruct created containers not to use weaveDNS as their nameserver, unless they set WEAVE_DNS=on")
 	mflag.BoolVar(&proxyConfig.NoMulticastRoute, []string{"-no-multicast-route"}, false, "proxy: do not add a multicast route via the weave interface when attaching containers")
+	mflag.StringVar(&proxyConfig.WeaveWaitMountPath, []string{"-wait-mount"}, "/w", "proxy: path inside containers at which to mount the weavewait volume")
+	mflagext.ListVar(&proxyConfig.ArchWaitVolumes, []string{"-arch-wait-volume"}, nil, "proxy: arch=wait-volume:noop-volume:nomcast-volume, to mount those volumes, holding the builds of weavewait for waiting, for containers on another's network, and for --no-multicast-route, in containers whose image is for that architecture, e.g. 'arm64=weavewait-arm64:weavewait-noop-arm64:weavewait-nomcast-arm64' (may be repeated)")
+	mflag.DurationVar(&proxyConfig.WaitTimeout, []string{"-wait-timeout"}, 0, "proxy: how long weavewait in containers waits for the weave interface before failing, unless the container or its image has a works.weave.wait-timeout label (0 for no limit)")
+	mflag.StringVar(&proxyConfig.WaitEntrypoint, []string{"-wait-entrypoint"}, "", "proxy: binary, with any arguments, to run in containers to wait for the weave interface before their own entrypoint (default: weavewait from --wait-mount)")
+	mflag.StringVar(&proxyConfig.WaitPosition, []string{"-wait-position"}, "prepend", "proxy: how to put weavewait in front of containers' commands: 'prepend' to their entrypoint, or 'wrap' for weavewait as the entrypoint, given their entrypoint and command as arguments")
+	mflag.BoolVar(&proxyConfig.WaitForDNS, []string{"-wait-for-dns"}, false, "proxy: make weavewait in containers also wait until their name resolves in weaveDNS before running their command")
+	mflagext.ListVar(&proxyConfig.ExtraHosts, []string{"-extra-host"}, nil, "proxy: host:ip entry to add to /etc/hosts in containers on the weave network, unless they give an address for that host themselves (may be repeated)")
+	mflagext.ListVar(&proxyConfig.CapAdd, []string{"-cap-add"}, nil, "proxy: capability, e.g. NET_ADMIN, to add to containers on the weave network unless they ask for it themselves (may be repeated)")
+	mflagext.ListVar(&proxyConfig.Ulimits, []string{"-ulimit"}, nil, "proxy: ulimit, as name=soft:hard, to set in containers on the weave network unless they set it themselves, e.g. 'nofile=65536:65536' (may be repeated)")
+	mflag.StringVar(&proxyConfig.ReadonlyTmpfs, []string{"-readonly-tmpfs"}, "", "proxy: tmpfs, as path[:options], to mount in containers on the weave network with a read-only root filesystem, e.g. '/run/weave:rw,size=1m'")
+	mflag.BoolVar(&proxyConfig.Init, []string{"-init"}, false, "proxy: run an init process (Docker's --init) in containers on the weave network, to reap zombies, unless they say otherwise")
+	mflagext.ListVar(&proxyConfig.Sysctls, []string{"-sysctl"}, nil, "proxy: sysctl, as key=value, to set in containers on the weave network unless they set it themselves, e.g. 'net.ipv4.ip_forward=1' (may be repeated)")
+	mflagext.ListVar(&proxyConfig.ExecEnv, []string{"-exec-env"}, nil, "proxy: environment variable, as NAME=value, to set in execs in containers on the weave network unless the exec sets it (may be repeated)")
+	mflagext.ListVar(&proxyConfig.Env, []string{"-env"}, nil, "proxy: environment variable, as NAME=value, other than one the proxy reads such as WEAVE_CIDR, to set in containers on the weave network unless they set it (may be repeated)")
+	mflag.StringVar(&proxyConfig.DockerBridgeIPv6, []string{"-docker-bridge-ipv6"}, "", "proxy: IPv6 address of the Docker bridge, given to containers as a DNS server alongside the IPv4 one")
+	mflag.DurationVar(&proxyConfig.DNSServerRefresh, []string{"-dns-server-refresh"}, 0, "proxy: how often to look up the docker bridge IP again, for the DNS server given to containers, in case the Docker daemon has changed it (0 for only at startup)")
+	mflagext.ListVar(&proxyConfig.DNSServers, []string{"-dns-server"}, nil, "proxy: DNS server to give containers using weaveDNS, instead of the docker bridge IP (may be repeated; used in order)")
+	mflag.StringVar(&proxyConfig.DNSServerCheck, []string{"-dns-server-check"}, "off", "proxy: check at startup that the docker bridge IP given to containers as their DNS server is a local address they can reach: 'off', 'warn', or 'strict' to refuse to start if not")
+	mflag.StringVar(&proxyConfig.DNSSearchMode, []string{"-dns-search-mode"}, "fqdn", "proxy: DNS search path for containers which don't give one: 'fqdn' for '.' if they have a hostname and the weaveDNS domain otherwise, 'domain' for always the weaveDNS domain, 'none' to leave it alone")
+	mflag.StringVar(&proxyConfig.HostID, []string{"-host-id"}, "", "proxy: identifier of this host to tag the weaveDNS records of containers with (default: the hostname)")
+	mflagext.ListVar(&proxyConfig.DNSSearch, []string{"-dns-search"}, nil, "proxy: DNS search domain for containers which don't give their own, instead of those from --dns-search-mode, in the order given; '@weave' for the weaveDNS domain (may be repeated)")
+	mflagext.ListVar(&proxyConfig.DNSOptions, []string{"-dns-option"}, nil, "proxy: DNS resolver option to give containers using weaveDNS, e.g. 'ndots:0' (may be repeated)")
+	mflag.BoolVar(&proxyConfig.DNSUseTCP, []string{"-dns-use-tcp"}, false, "proxy: give containers using weaveDNS the 'use-vc' resolver option, to query over TCP, for names with more addresses than fit in a UDP answer")
+	mflag.BoolVar(&proxyConfig.PublishOnWeave, []string{"-publish-on-weave"}, false, "proxy: bind the published ports of containers with an address given in WEAVE_CIDR to that address, rather than to all of the host's")
+	mflag.BoolVar(&proxyConfig.DeriveMAC, []string{"-derive-mac"}, false, "proxy: give containers with an explicit WEAVE_CIDR address a MAC address derived from it (02:57 followed by the IPv4 address)")
+	mflag.StringVar(&proxyConfig.AttachNetwork, []string{"-attach-network"}, "", "proxy: attach containers to weave on 'docker network connect' to this network, and detach them on disconnect")
+	mflag.StringVar(&proxyConfig.AuditLog, []string{"-audit-log"}, "", "proxy: file to which to append a JSON line for each container created and attached, instead of the main log")
+	mflag.StringVar(&proxyConfig.AttachWebhook, []string{"-attach-webhook"}, "", "proxy: URL to POST a JSON description of each container to, with its addresses, once it is attached to the weave network")
+	mflag.BoolVar(&proxyConfig.DryRun, []string{"-dry-run"}, false, "proxy: log how container creation requests would be changed, but pass them on untouched")
+	mflag.BoolVar(&proxyConfig.FailClosed, []string{"-fail-closed"}, false, "proxy: refuse to create containers which would otherwise be left off the weave network because of an invalid WEAVE_CIDR")
+	mflag.StringVar(&proxyConfig.DNSDrainSignal, []string{"-dns-drain-signal"}, "", "proxy: signal, e.g. USR1, on which to deregister from weaveDNS the names of all containers it attached, as when decommissioning the host")
+	mflag.IntVar(&proxyConfig.DNSTTL, []string{"-proxy-dns-ttl"}, 0, "proxy: TTL in seconds of the weaveDNS records for containers it attaches (default: as --dns-ttl)")
+	mflagext.ListVar(&proxyConfig.IncludeImages, []string{"-include-image"}, nil, "proxy: only put containers on the weave network if their image matches this glob, e.g. 'myorg/*' (may be repeated)")
+	mflagext.ListVar(&proxyConfig.ExcludeImages, []string{"-exclude-image"}, nil, "proxy: never put containers on the weave network if their image matches this glob, even if it matches --include-image (may be repeated)")
+	mflagext.ListVar(&proxyConfig.SkipLabels, []string{"-skip-label"}, nil, "proxy: never put containers on the weave network if they have this label, as key=value, or key for any value (may be repeated; any one matching is enough)")
+	mflag.StringVar(&proxyConfig.WeaveContainer, []string{"-weave-container"}, "weave", "proxy: name of the weave container, whose weavewait volumes to mount in containers")
+	mflag.StringVar(&proxyConfig.WeaveContainerLabel, []string{"-weave-container-label"}, "", "proxy: find the weave container by this label, as key=value or key, falling back to --weave-container if none has it")
+	mflag.IntVar(&proxyConfig.ImageInspectRetries, []string{"-image-inspect-retries"}, 0, "proxy: times to ask Docker again, backing off from 100ms, for an image it says does not exist, in case it is still being pulled")
+	mflag.IntVar(&proxyConfig.MaxConcurrentCreates, []string{"-max-concurrent-creates"}, 0, "proxy: most container creations to work on at once, queueing the rest, to spare the Docker daemon during bursts (0 for no limit)")
+	mflag.Int64Var(&proxyConfig.MaxBodyBytes, []string{"-max-body-bytes"}, 10<<20, "proxy: largest body, in bytes, of a request the proxy rewrites, e.g. a container creation, refusing longer ones with 413")
+	mflag.DurationVar(&proxyConfig.DNSDomainTimeout, []string{"-dns-domain-timeout"}, 2*time.Second, "proxy: timeout for looking up the weaveDNS domain when creating containers")
+	mflag.IntVar(&proxyConfig.WeaveDNSHTTPPort, []string{"-weavedns-http-port"}, 0, "proxy: port of weaveDNS's HTTP API, on the router's host, if not the router's own (0 for the router's)")
+	mflag.IntVar(&proxyConfig.WeaveDNSIdleConns, []string{"-weavedns-max-idle-conns"}, 2, "proxy: maximum idle connections to weaveDNS's HTTP API kept open for reuse")
 	return &proxyConfig
 }
 
@@ -10,13 +10,17 @@ import (
 	"github.com/weaveworks/weave/ipam"
 	"github.com/weaveworks/weave/nameserver"
 	"github.com/weaveworks/weave/net/address"
+	weaveproxy "github.com/weaveworks/weave/proxy"
 	weave "github.com/weaveworks/weave/router"
 )
 
-func metricsHandler(router *weave.NetworkRouter, allocator *ipam.Allocator, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) http.Handler {
+func metricsHandler(router *weave.NetworkRouter, allocator *ipam.Allocator, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, proxy *weaveproxy.Proxy) http.Handler {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(prometheus.NewProcessCollector(os.Getpid(), ""))
 	reg.MustRegister(newMetrics(router, allocator, ns, dnsserver))
+	if proxy != nil {
+		reg.MustRegister(proxy.Metrics())
+	}
 	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
 }
 
@@ -2,6 +2,6 @@
 
 package main
 
-func checkNetwork() error {
+func checkNetwork(mcastRoute bool) error {
 	return nil
 }
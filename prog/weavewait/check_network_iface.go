@@ -6,7 +6,7 @@ import (
 	weavenet "github.com/weaveworks/weave/net"
 )
 
-func checkNetwork() error {
+func checkNetwork(mcastRoute bool) error {
 	_, err := weavenet.EnsureInterface(weavenet.VethName)
 	return err
 }
@@ -6,7 +6,11 @@ import (
 	weavenet "github.com/weaveworks/weave/net"
 )
 
-func checkNetwork() error {
+func checkNetwork(mcastRoute bool) error {
+	if !mcastRoute {
+		_, err := weavenet.EnsureInterface(weavenet.VethName)
+		return err
+	}
 	_, err := weavenet.EnsureInterfaceAndMcastRoute(weavenet.VethName)
 	return err
 }
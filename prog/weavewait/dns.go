@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsPollInterval = 100 * time.Millisecond
+	// How long to wait for the container's name without --wait-timeout
+	dnsWaitLimit = 2 * time.Minute
+)
+
+// waitForDNS polls until name resolves, which it does once the proxy
+// has attached the container and registered it with weaveDNS, giving
+// up after limit. It asks the nameservers in resolvConf itself, rather
+// than going through the resolver, which would find the name at once in
+// /etc/hosts, where Docker and the proxy put it.
+func waitForDNS(name, resolvConf string, limit time.Duration) error {
+	servers, err := resolvConfServers(resolvConf)
+	if err != nil {
+		return err
+	}
+	return waitForName(name, servers, limit)
+}
+
+// resolvConfServers returns the nameservers in resolvConf, as host:port.
+func resolvConfServers(resolvConf string) ([]string, error) {
+	config, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Servers) == 0 {
+		return nil, fmt.Errorf("no nameservers in %s to wait for a name in", resolvConf)
+	}
+	servers := make([]string, len(config.Servers))
+	for i, server := range config.Servers {
+		servers[i] = net.JoinHostPort(server, config.Port)
+	}
+	return servers, nil
+}
+
+func waitForName(name string, servers []string, limit time.Duration) error {
+	client := &dns.Client{Net: "udp", ReadTimeout: dnsPollInterval}
+	deadline := time.Now().Add(limit)
+	for {
+		for _, server := range servers {
+			if resolves(client, server, name) {
+				return nil
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("gave up after %s waiting for %s to resolve", limit, name)
+		}
+		time.Sleep(dnsPollInterval)
+	}
+}
+
+// resolves tells whether server has an address of either kind for name.
+func resolves(client *dns.Client, server, name string) bool {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := &dns.Msg{}
+		query.SetQuestion(dns.Fqdn(name), qtype)
+		if reply, _, err := client.Exchange(query, server); err == nil && reply.Rcode == dns.RcodeSuccess && len(reply.Answer) > 0 {
+			return true
+		}
+	}
+	return false
+}
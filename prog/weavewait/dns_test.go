@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWeaveDNS answers for the names registered with it, and nothing
+// else, over UDP on a port of its own.
+type fakeWeaveDNS struct {
+	sync.Mutex
+	names map[string]net.IP
+}
+
+func (f *fakeWeaveDNS) register(name string, ip net.IP) {
+	f.Lock()
+	defer f.Unlock()
+	f.names[dns.Fqdn(name)] = ip
+}
+
+func (f *fakeWeaveDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	f.Lock()
+	defer f.Unlock()
+	m := &dns.Msg{}
+	m.SetReply(r)
+	q := r.Question[0]
+	if ip, found := f.names[q.Name]; found && q.Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1}, A: ip})
+	} else if !found {
+		m.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(m)
+}
+
+func startFakeWeaveDNS(t *testing.T) (*fakeWeaveDNS, string, func()) {
+	f := &fakeWeaveDNS{names: map[string]net.IP{}}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{PacketConn: pc, Handler: f}
+	go server.ActivateAndServe()
+	return f, pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestWaitForNameSkipsHosts(t *testing.T) {
+	weaveDNS, addr, stop := startFakeWeaveDNS(t)
+	defer stop()
+
+	// localhost is in /etc/hosts, as a container's own name is, so the
+	// resolver would find it at once; weaveDNS doesn't have it yet
+	addrs, err := net.LookupHost("localhost")
+	require.NoError(t, err)
+	require.NotEmpty(t, addrs)
+	err = waitForName("localhost", []string{addr}, 300*time.Millisecond)
+	assert.EqualError(t, err, "gave up after 300ms waiting for localhost to resolve")
+
+	// so it waits until the name is registered
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		weaveDNS.register("localhost", net.ParseIP("10.32.0.5"))
+	}()
+	assert.NoError(t, waitForName("localhost", []string{addr}, 5*time.Second))
+}
+
+func TestResolvConfServers(t *testing.T) {
+	f, err := ioutil.TempFile("", "resolv.conf")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("nameserver 172.17.0.1\nnameserver 8.8.8.8\nsearch weave.local.\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	servers, err := resolvConfServers(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"172.17.0.1:53", "8.8.8.8:53"}, servers)
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("search weave.local.\n"), 0644))
+	_, err = resolvConfServers(f.Name())
+	assert.Error(t, err)
+}
@@ -5,19 +5,70 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var (
 	ErrNoCommandSpecified = errors.New("No command specified")
 )
 
+const (
+	// Put in front of the command by the proxy, for containers which
+	// should give up on the weave interface after a while
+	timeoutArg = "--wait-timeout="
+	// Put in front of the command by the proxy, for containers which
+	// should not run until their name is registered with weaveDNS
+	dnsArg = "--wait-dns="
+	// Put in front of the command by the proxy, for containers which
+	// are attached without a multicast route, so should not wait for one
+	noMcastArg = "--no-multicast-route"
+
+	resolvConf = "/etc/resolv.conf"
+)
+
 func main() {
 	var (
 		args = os.Args[1:]
 	)
 
-	checkErr(checkNetwork())
+	var (
+		timeout    time.Duration
+		dnsName    string
+		mcastRoute = true
+	)
+	for ; len(args) > 0; args = args[1:] {
+		if strings.HasPrefix(args[0], timeoutArg) {
+			var err error
+			timeout, err = time.ParseDuration(strings.TrimPrefix(args[0], timeoutArg))
+			checkErr(err)
+		} else if strings.HasPrefix(args[0], dnsArg) {
+			dnsName = strings.TrimPrefix(args[0], dnsArg)
+		} else if args[0] == noMcastArg {
+			mcastRoute = false
+		} else {
+			break
+		}
+	}
+
+	what := "the weave network"
+	if dnsName != "" {
+		what += " and " + dnsName + " in weaveDNS"
+	}
+	checkErr(within(timeout, what, func() error {
+		if err := checkNetwork(mcastRoute); err != nil {
+			return err
+		}
+		if dnsName != "" {
+			limit := timeout
+			if limit == 0 {
+				limit = dnsWaitLimit
+			}
+			return waitForDNS(dnsName, resolvConf, limit)
+		}
+		return nil
+	}))
 
 	if len(args) == 0 {
 		checkErr(ErrNoCommandSpecified)
@@ -29,6 +80,22 @@ func main() {
 	checkErr(syscall.Exec(binary, args, os.Environ()))
 }
 
+// within runs check, giving up after timeout, unless that is zero, on
+// waiting for what.
+func within(timeout time.Duration, what string, check func() error) error {
+	if timeout == 0 {
+		return check()
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- check() }()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s waiting for %s", timeout, what)
+	}
+}
+
 func checkErr(err error) {
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"regexp"
+	"strconv"
+)
+
+var apiVersionRegexp = regexp.MustCompile("^/v([0-9]+)\\.([0-9]+)/")
+
+// apiVersion is the Docker API version a request was made against. The
+// zero value stands for a request which named no version, and so gets
+// whatever the daemon's latest is.
+type apiVersion struct {
+	major, minor int
+}
+
+func requestAPIVersion(path string) apiVersion {
+	subs := apiVersionRegexp.FindStringSubmatch(path)
+	if subs == nil {
+		return apiVersion{}
+	}
+	major, err1 := strconv.Atoi(subs[1])
+	minor, err2 := strconv.Atoi(subs[2])
+	if err1 != nil || err2 != nil {
+		return apiVersion{}
+	}
+	return apiVersion{major, minor}
+}
+
+func (v apiVersion) atLeast(major, minor int) bool {
+	if v == (apiVersion{}) {
+		return true
+	}
+	return v.major > major || (v.major == major && v.minor >= minor)
+}
+
+// Fields which only exist from some API version on; the daemon ignores
+// them in requests made against an earlier version.
+func (v apiVersion) hasDNSOptions() bool { return v.atLeast(1, 21) }
+func (v apiVersion) hasTmpfs() bool      { return v.atLeast(1, 22) }
+func (v apiVersion) hasSysctls() bool    { return v.atLeast(1, 24) }
+func (v apiVersion) hasAutoRemove() bool { return v.atLeast(1, 25) }
+func (v apiVersion) hasInit() bool       { return v.atLeast(1, 25) }
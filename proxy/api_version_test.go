@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestAPIVersion(t *testing.T) {
+	for path, version := range map[string]apiVersion{
+		"/v1.21/containers/create": {1, 21},
+		"/v1.24/containers/create": {1, 24},
+		"/v2.0/containers/create":  {2, 0},
+		"/containers/create":       {},
+		"/v1/containers/create":    {},
+	} {
+		assert.Equal(t, version, requestAPIVersion(path), path)
+	}
+
+	assert.True(t, apiVersion{1, 21}.atLeast(1, 21))
+	assert.False(t, apiVersion{1, 20}.atLeast(1, 21))
+	assert.True(t, apiVersion{2, 0}.atLeast(1, 25))
+	assert.True(t, apiVersion{}.atLeast(1, 25), "unversioned requests get the latest API")
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// auditEntry records what we were asked to create, so that it can be
+// logged once Docker has told us the container's ID.
+type auditEntry struct {
+	id, name, image string
+	cidrs           []string
+}
+
+// newAuditLog returns a logger writing JSON lines to the named file,
+// or nil to send audit entries to the main log.
+func newAuditLog(path string) (*logrus.Logger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	auditLog := logrus.New()
+	auditLog.Out = f
+	auditLog.Formatter = &logrus.JSONFormatter{}
+	return auditLog, nil
+}
+
+func (proxy *Proxy) audit() *logrus.Logger {
+	if proxy.auditLog == nil {
+		return Log
+	}
+	return proxy.auditLog
+}
+
+// auditCreate logs the WEAVE_CIDR a container was created with. The
+// addresses themselves are only allocated when it starts; see
+// auditAttach.
+func (proxy *Proxy) auditCreate(entry *auditEntry) {
+	proxy.audit().WithFields(logrus.Fields{
+		"event":      "create",
+		"id":         entry.id,
+		"name":       strings.TrimPrefix(entry.name, "/"),
+		"image":      entry.image,
+		"weave_cidr": strings.Join(entry.cidrs, " "),
+	}).Info("Created container with weave networking")
+}
+
+func (proxy *Proxy) auditAttach(container *docker.Container, ips []*net.IPNet) {
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	proxy.audit().WithFields(logrus.Fields{
+		"event": "attach",
+		"id":    container.ID,
+		"name":  strings.TrimPrefix(container.Name, "/"),
+		"image": container.Config.Image,
+		"ips":   strings.Join(addrs, " "),
+	}).Info("Attached container to weave network")
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+)
+
+// defaultMaxBodyBytes bounds the bodies of the requests the proxy
+// intercepts, which it buffers whole to rewrite; the JSON Docker is sent
+// to create a container is a few kilobytes.
+const defaultMaxBodyBytes = 10 << 20
+
+// ErrBodyTooLarge is returned for requests with a body longer than
+// Config.MaxBodyBytes, which the proxy refuses to buffer.
+type ErrBodyTooLarge struct {
+	Limit int64
+}
+
+func (err *ErrBodyTooLarge) Error() string {
+	return fmt.Sprintf("request body is larger than the proxy's limit of %d bytes", err.Limit)
+}
+
+// limitedBody reads a request body, failing with ErrBodyTooLarge once
+// more than limit bytes have been read from it.
+type limitedBody struct {
+	io.ReadCloser
+	limit, remaining int64
+}
+
+func newLimitedBody(body io.ReadCloser, limit int64) *limitedBody {
+	return &limitedBody{ReadCloser: body, limit: limit, remaining: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, &ErrBodyTooLarge{b.limit}
+	}
+	// Read one byte past the limit, to tell a body of exactly the
+	// limit from a longer one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), &ErrBodyTooLarge{b.limit}
+	}
+	return n, err
+}
+
+// buffersBody reports whether i may read a request's body whole. An
+// image import, say, streams a tarball, which we leave alone.
+func buffersBody(i Interceptor) bool {
+	switch i.(type) {
+	case *nullInterceptor, *imagesCreateInterceptor:
+		return false
+	}
+	return true
+}
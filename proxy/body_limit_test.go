@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedBody(t *testing.T) {
+	body, err := ioutil.ReadAll(newLimitedBody(ioutil.NopCloser(strings.NewReader("0123456789")), 10))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(body), "a body of exactly the limit")
+
+	body, err = ioutil.ReadAll(newLimitedBody(ioutil.NopCloser(strings.NewReader("0123456789a")), 10))
+	assert.Equal(t, &ErrBodyTooLarge{10}, err)
+	assert.Len(t, body, 10)
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, MaxBodyBytes: 128})
+	proxy := i.proxy
+
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`))
+	r.Body = newLimitedBody(r.Body, proxy.MaxBodyBytes)
+	require.NoError(t, i.InterceptRequest(r))
+
+	oversized := `{"Image": "nginx", "Env": ["` + strings.Repeat("x", 128) + `"]}`
+	r = httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(oversized))
+	r.Body = newLimitedBody(r.Body, proxy.MaxBodyBytes)
+	err := i.InterceptRequest(r)
+	assert.IsType(t, &ErrBodyTooLarge{}, errors.Cause(err))
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(oversized)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "limit of 128 bytes")
+
+	assert.Equal(t, int64(defaultMaxBodyBytes), newTestCreateInterceptor(Config{}).proxy.MaxBodyBytes)
+	_, err = newTestProxy(Config{MaxBodyBytes: -1}, nil)
+	assert.Error(t, err)
+}
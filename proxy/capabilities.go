@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The capabilities Docker accepts in CapAdd, without their CAP_ prefix
+var knownCapabilities = map[string]struct{}{}
+
+func init() {
+	for _, capability := range []string{
+		"ALL",
+		"AUDIT_CONTROL", "AUDIT_READ", "AUDIT_WRITE", "BLOCK_SUSPEND",
+		"CHOWN", "DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER", "FSETID",
+		"IPC_LOCK", "IPC_OWNER", "KILL", "LEASE", "LINUX_IMMUTABLE",
+		"MAC_ADMIN", "MAC_OVERRIDE", "MKNOD", "NET_ADMIN", "NET_BIND_SERVICE",
+		"NET_BROADCAST", "NET_RAW", "SETFCAP", "SETGID", "SETPCAP", "SETUID",
+		"SYS_ADMIN", "SYS_BOOT", "SYS_CHROOT", "SYS_MODULE", "SYS_NICE",
+		"SYS_PACCT", "SYS_PTRACE", "SYS_RAWIO", "SYS_RESOURCE", "SYS_TIME",
+		"SYS_TTY_CONFIG", "SYSLOG", "WAKE_ALARM",
+	} {
+		knownCapabilities[capability] = struct{}{}
+	}
+}
+
+// canonicalCapability gives capability as Docker writes it, e.g.
+// NET_ADMIN for cap_net_admin.
+func canonicalCapability(capability string) string {
+	return strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+}
+
+// parseCapabilities checks capabilities to add to containers on the
+// weave network, e.g. NET_ADMIN, and returns them as Docker writes them.
+func parseCapabilities(entries []string) ([]string, error) {
+	var capabilities []string
+	for _, entry := range entries {
+		capability := canonicalCapability(entry)
+		if _, known := knownCapabilities[capability]; !known {
+			return nil, fmt.Errorf("invalid capability %q: must be e.g. NET_ADMIN", entry)
+		}
+		capabilities = append(capabilities, capability)
+	}
+	return capabilities, nil
+}
+
+// Add our capabilities to the user's, except for those the user has
+// asked for already, however they wrote them.
+func mergeCapabilities(user, ours []string) []string {
+	requested := make(map[string]struct{}, len(user))
+	for _, capability := range user {
+		requested[canonicalCapability(capability)] = struct{}{}
+	}
+	if _, all := requested["ALL"]; all {
+		return user
+	}
+	merged := user
+	for _, capability := range ours {
+		if _, found := requested[capability]; !found {
+			requested[capability] = struct{}{}
+			merged = append(merged, capability)
+		}
+	}
+	return merged
+}
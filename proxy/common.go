@@ -2,41 +2,90 @@ package proxy
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/weaveworks/weave/common"
-	weavedocker "github.com/weaveworks/weave/common/docker"
 )
 
 var (
-	containerIDRegexp   = regexp.MustCompile("^(/v[0-9\\.]*)?/containers/([^/]*)/.*")
-	weaveWaitEntrypoint = []string{"/w/w"}
-	weaveEntrypoint     = "/home/weave/weaver"
-	weaveContainerName  = "/weave"
+	containerIDRegexp  = regexp.MustCompile("^(/v[0-9\\.]*)?/containers/([^/]*)/.*")
+	networkIDRegexp    = regexp.MustCompile("^(/v[0-9\\.]*)?/networks/([^/]*)/(dis)?connect$")
+	containerRmRegexp  = regexp.MustCompile("^(/v[0-9\\.]*)?/containers/([^/]*)$")
+	weaveEntrypoint    = "/home/weave/weaver"
+	weaveContainerName = "/weave"
+	weaveCIDRLabel     = "works.weave.cidr"
+	weaveNoWaitLabel   = "works.weave.no-wait"
+
+	// How long weavewait should wait for the weave interface, for
+	// images which take more or less time than most to attach
+	weaveWaitTimeoutLabel = "works.weave.wait-timeout"
+
+	// Labels we put on the containers we create on the weave network
+	weaveManagedLabel     = "works.weave.managed"
+	weaveManagedCIDRLabel = "works.weave.managed.cidr"
+
+	// Response header telling the client the same
+	weaveCIDRHeader = "X-Weave-CIDR"
 
 	Log = common.Log
 )
 
-func unmarshalRequestBody(r *http.Request, target interface{}) error {
+// readRequestBody reads the whole of the request body, leaving the
+// request with a body that will return the same bytes when forwarded.
+// A gzip-encoded body is returned decompressed.
+func readRequestBody(r *http.Request) ([]byte, error) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	Log.Debugf("->requestBody: %s", body)
 	if err := r.Body.Close(); err != nil {
-		return err
+		return nil, err
 	}
 	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if isGzipped(r.Header) {
+		if body, err = gunzip(body); err != nil {
+			return nil, err
+		}
+	}
+	Log.Debugf("->requestBody: %s", body)
+	return body, nil
+}
 
+func unmarshalRequestBody(r *http.Request, target interface{}) error {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return err
+	}
+	return unmarshalBody(body, target)
+}
+
+// ErrMalformedBody is returned for requests whose body is not the JSON
+// the Docker API expects.
+type ErrMalformedBody struct {
+	Body []byte
+	Err  error
+}
+
+func (err *ErrMalformedBody) Error() string {
+	return "malformed request body: " + err.Err.Error()
+}
+
+func unmarshalBody(body []byte, target interface{}) error {
 	d := json.NewDecoder(bytes.NewReader(body))
 	d.UseNumber() // don't want large numbers in scientific format
-	return d.Decode(&target)
+	if err := d.Decode(&target); err != nil {
+		return &ErrMalformedBody{body, err}
+	}
+	return nil
 }
 
 func marshalRequestBody(r *http.Request, body interface{}) error {
@@ -44,12 +93,87 @@ func marshalRequestBody(r *http.Request, body interface{}) error {
 	if err != nil {
 		return err
 	}
+	return setRequestBody(r, newBody)
+}
+
+// mergeRequestBody is like marshalRequestBody, but leaves everything
+// we did not change exactly as it was in original; see mergeJSON.
+func mergeRequestBody(r *http.Request, original []byte, body interface{}) error {
+	newBody, err := mergeJSON(original, body)
+	if err != nil {
+		return err
+	}
+	return setRequestBody(r, newBody)
+}
+
+func setRequestBody(r *http.Request, newBody []byte) error {
 	Log.Debugf("<-requestBody: %s", newBody)
+	if isGzipped(r.Header) {
+		var err error
+		if newBody, err = gzipBytes(newBody); err != nil {
+			return err
+		}
+	}
 	r.Body = ioutil.NopCloser(bytes.NewReader(newBody))
 	r.ContentLength = int64(len(newBody))
 	return nil
 }
 
+func isGzipped(h http.Header) bool {
+	return strings.EqualFold(h.Get("Content-Encoding"), "gzip")
+}
+
+// acceptsGzip tells whether a request's Accept-Encoding allows a
+// gzip-encoded response, e.g. "gzip, deflate" but not "gzip;q=0". A
+// weight given for gzip itself takes precedence over one for "*".
+func acceptsGzip(h http.Header) bool {
+	gzipOK, anyOK := -1, -1
+	for _, value := range h["Accept-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			params := strings.Split(coding, ";")
+			accepted := 1
+			for _, param := range params[1:] {
+				if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+					if weight, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err != nil || weight <= 0 {
+						accepted = 0
+					}
+				}
+			}
+			switch name := strings.TrimSpace(params[0]); {
+			case strings.EqualFold(name, "gzip"):
+				gzipOK = accepted
+			case name == "*":
+				anyOK = accepted
+			}
+		}
+	}
+	if gzipOK >= 0 {
+		return gzipOK == 1
+	}
+	return anyOK == 1
+}
+
+func gunzip(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func unmarshalResponseBody(r *http.Response, target interface{}) error {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -72,14 +196,27 @@ func marshalResponseBody(r *http.Response, body interface{}) error {
 		return err
 	}
 	Log.Debugf("<-responseBody: %s", newBody)
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+	// The body is ours now, so it's up to us to compress it for a
+	// client which would like that
+	if r.Request != nil && acceptsGzip(r.Request.Header) && r.Header.Get("Content-Encoding") == "" {
+		if newBody, err = gzipBytes(newBody); err != nil {
+			return err
+		}
+		r.Header.Set("Content-Encoding", "gzip")
+		r.Header.Add("Vary", "Accept-Encoding")
+	}
 	r.Body = ioutil.NopCloser(bytes.NewReader(newBody))
 	r.ContentLength = int64(len(newBody))
+	r.Header.Set("Content-Length", strconv.Itoa(len(newBody)))
 	// Stop it being chunked, because that hangs
 	r.TransferEncoding = nil
 	return nil
 }
 
-func inspectContainerInPath(client *weavedocker.Client, path string) (*docker.Container, error) {
+func inspectContainerInPath(ctx context.Context, client DockerClient, path string) (*docker.Container, error) {
 	subs := containerIDRegexp.FindStringSubmatch(path)
 	if subs == nil {
 		err := fmt.Errorf("No container id found in request with path %s", path)
@@ -88,11 +225,37 @@ func inspectContainerInPath(client *weavedocker.Client, path string) (*docker.Co
 	}
 	containerID := subs[2]
 
-	container, err := client.InspectContainer(containerID)
+	// The inspection may outlive us if ctx is done first, so it hands
+	// its result over rather than writing to anything we return
+	inspected := make(chan *docker.Container, 1)
+	err := callWithContext(ctx, func() error {
+		container, err := client.InspectContainer(containerID)
+		inspected <- container
+		return err
+	})
 	if err != nil {
 		Log.Warningf("Error inspecting container %s: %v", containerID, err)
+		return nil, err
+	}
+	return <-inspected, nil
+}
+
+// callWithContext runs f, but gives up on it with ctx's error as soon
+// as ctx is done, e.g. because the client went away while we were
+// waiting on Docker. f is left to finish in the background, so it must
+// only write to variables the caller reads when it gets f's own result.
+func callWithContext(ctx context.Context, f func() error) error {
+	if ctx.Done() == nil {
+		return f()
+	}
+	result := make(chan error, 1)
+	go func() { result <- f() }()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return container, err
 }
 
 func addVolume(hostConfig jsonObject, source, target, mode string) error {
@@ -116,3 +279,21 @@ func addVolume(hostConfig jsonObject, source, target, mode string) error {
 	hostConfig["Binds"] = append(binds, bind)
 	return nil
 }
+
+// Containers can ask to keep their own entrypoint, in which case they
+// are attached to the weave network without waiting for it.
+func noWeaveWait(env []string, labels map[string]string) bool {
+	if _, found := labels[weaveNoWaitLabel]; found {
+		return true
+	}
+	return containsString(env, "WEAVE_NO_WAIT=1")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LoadConfigFile sets config from the YAML, or JSON, file at path,
+// whose keys are the names of the proxy's flags without their dashes,
+// e.g.
+//
+//	dns-server: [8.8.8.8]
+//	wait-timeout: 30s
+//
+// Keys for which given returns true are ignored, so that flags on the
+// command line take precedence over the file. Unknown keys are an
+// error, rather than a typo silently leaving an option unset.
+func LoadConfigFile(path string, config *Config, given func(key string) bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("reading config file %s: %s", path, err)
+	}
+	known := configFileKeys(reflect.TypeOf(*config))
+	var unknown []string
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		} else if given(key) {
+			delete(values, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("config file %s: unknown option(s) %s", path, strings.Join(unknown, ", "))
+	}
+	// Decode again, now into the Config, so that yaml does the
+	// conversions, e.g. of durations, as if the file had been read
+	// straight into it.
+	remaining, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(remaining, config); err != nil {
+		return fmt.Errorf("config file %s: %s", path, err)
+	}
+	return nil
+}
+
+// configFileKeys returns the yaml keys of the fields of a Config, and
+// of the structs inlined into it.
+func configFileKeys(t reflect.Type) map[string]bool {
+	keys := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("yaml")
+		if tag == "-" || tag == "" {
+			continue
+		}
+		if tag == ",inline" {
+			for key := range configFileKeys(field.Type) {
+				keys[key] = true
+			}
+			continue
+		}
+		keys[tag] = true
+	}
+	return keys
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	dir, err := ioutil.TempDir("", "weave-proxy-config")
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func noFlagsGiven(string) bool { return false }
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, "proxy.yaml", `
+without-dns: true
+wait-timeout: 30s
+dns-server: [8.8.8.8, 8.8.4.4]
+skip-label:
+  - tenant=internal
+max-concurrent-creates: 4
+init: true
+dns-search-mode: domain
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config := Config{WeaveWaitMountPath: "/w", DNSServers: []string{"1.1.1.1"}}
+	require.NoError(t, LoadConfigFile(path, &config, noFlagsGiven))
+	proxy := newStubProxy(t, config)
+
+	assert.True(t, proxy.WithoutDNS)
+	assert.Equal(t, 30*time.Second, proxy.WaitTimeout)
+	assert.Equal(t, []string{"8.8.8.8", "8.8.4.4"}, proxy.DNSServers, "replacing, not adding to, the default")
+	assert.Equal(t, []labelSelector{{key: "tenant", value: "internal", hasValue: true}}, proxy.skipLabels)
+	assert.Equal(t, 4, proxy.MaxConcurrentCreates)
+	assert.True(t, proxy.Init)
+	assert.Equal(t, "domain", proxy.DNSSearchMode)
+	assert.Equal(t, "/w", proxy.WeaveWaitMountPath, "left as it was")
+}
+
+func TestLoadConfigFileFlagsWin(t *testing.T) {
+	path := writeConfigFile(t, "proxy.json", `{"wait-timeout": "30s", "fail-closed": true, "dns-server": ["8.8.8.8"]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// as if given --wait-timeout=5s and --dns-server=1.1.1.1
+	config := Config{WaitTimeout: 5 * time.Second, DNSServers: []string{"1.1.1.1"}}
+	given := func(key string) bool { return key == "wait-timeout" || key == "dns-server" }
+	require.NoError(t, LoadConfigFile(path, &config, given))
+
+	assert.Equal(t, 5*time.Second, config.WaitTimeout)
+	assert.Equal(t, []string{"1.1.1.1"}, config.DNSServers)
+	assert.True(t, config.FailClosed)
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for _, contents := range []string{
+		"wait-timout: 30s\n",    // misspelt
+		"DockerHost: tcp://x\n", // not an option
+		"wait-timeout: soon\n",
+		"max-concurrent-creates: [1]\n",
+		"- not a map\n",
+	} {
+		path := writeConfigFile(t, "proxy.yaml", contents)
+		var config Config
+		assert.Error(t, LoadConfigFile(path, &config, noFlagsGiven), contents)
+		os.RemoveAll(filepath.Dir(path))
+	}
+
+	var config Config
+	assert.Error(t, LoadConfigFile("/does/not/exist.yaml", &config, noFlagsGiven))
+}
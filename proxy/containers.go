@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// What we know of a weave container, as listed by ContainersHTTP
+const (
+	containerCreated  = "created"  // created through us, but not attached yet
+	containerAttached = "attached" // on the weave network, with Addresses
+	containerDetached = "detached" // taken off it while still running, as by 'docker network disconnect'
+	containerSkipped  = "skipped"  // left off it, for the Reason given
+)
+
+// managedContainer is what ContainersHTTP says about a container on
+// the weave network, one created to be, or one left off it.
+type managedContainer struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name,omitempty"`
+	Image  string   `json:"image,omitempty"`
+	FQDN   string   `json:"fqdn,omitempty"` // its hostname in weaveDNS, if any
+	Status string   `json:"status"`
+	CIDRs  []string `json:"cidrs"`               // as asked for, in WEAVE_CIDR; empty for IPAM's default
+	Addrs  []string `json:"addresses,omitempty"` // as attached
+	Reason string   `json:"reason,omitempty"`    // why it was skipped
+}
+
+// trackCreated remembers a container created on the weave network,
+// with fqdn if it was given a hostname in weaveDNS.
+func (proxy *Proxy) trackCreated(entry *auditEntry, fqdn string) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	if proxy.managed == nil {
+		proxy.managed = make(map[string]*managedContainer)
+	}
+	proxy.managed[entry.id] = &managedContainer{
+		ID:     entry.id,
+		Name:   strings.TrimPrefix(entry.name, "/"),
+		Image:  entry.image,
+		FQDN:   fqdn,
+		Status: containerCreated,
+		CIDRs:  entry.cidrs,
+	}
+}
+
+// trackAttached records the addresses a container was attached with,
+// including one we didn't create, e.g. from before we started.
+func (proxy *Proxy) trackAttached(container *docker.Container, cidrs []string, ips []*net.IPNet) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	if proxy.managed == nil {
+		proxy.managed = make(map[string]*managedContainer)
+	}
+	managed, found := proxy.managed[container.ID]
+	if !found {
+		managed = &managedContainer{ID: container.ID, CIDRs: cidrs}
+		proxy.managed[container.ID] = managed
+	}
+	managed.Name = strings.TrimPrefix(container.Name, "/")
+	if container.Config != nil {
+		managed.Image = container.Config.Image
+		if container.Config.Hostname != "" && container.Config.Domainname != "" {
+			managed.FQDN = container.Config.Hostname + "." + container.Config.Domainname
+		}
+	}
+	managed.Status = containerAttached
+	managed.Reason = ""
+	managed.Addrs = make([]string, len(ips))
+	for i, ip := range ips {
+		managed.Addrs[i] = ip.String()
+	}
+}
+
+// trackSkipped records a container we left off the weave network, and
+// why, whether when it was created or when it started.
+func (proxy *Proxy) trackSkipped(containerID, name, image string, reason error) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	if proxy.managed == nil {
+		proxy.managed = make(map[string]*managedContainer)
+	}
+	managed, found := proxy.managed[containerID]
+	if !found {
+		managed = &managedContainer{ID: containerID}
+		proxy.managed[containerID] = managed
+	}
+	managed.Name = strings.TrimPrefix(name, "/")
+	managed.Image = image
+	managed.Status = containerSkipped
+	// not given once skipped, so nothing to show
+	managed.FQDN = ""
+	managed.CIDRs = nil
+	managed.Addrs = nil
+	managed.Reason = reason.Error()
+}
+
+func (proxy *Proxy) trackDetached(containerID string) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	if managed, found := proxy.managed[containerID]; found {
+		managed.Status = containerDetached
+		managed.Addrs = nil
+	}
+}
+
+// managedContainers lists the containers we know of, by ID.
+func (proxy *Proxy) managedContainers() []managedContainer {
+	proxy.Lock()
+	defer proxy.Unlock()
+	containers := make([]managedContainer, 0, len(proxy.managed))
+	for _, managed := range proxy.managed {
+		containers = append(containers, *managed)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	return containers
+}
+
+// ContainersHTTP lists, as JSON, the containers the proxy has created
+// on the weave network or attached to it, or skipped, and not yet seen
+// removed.
+func (proxy *Proxy) ContainersHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(proxy.managedContainers()); err != nil {
+		Log.Warning(err)
+	}
+}
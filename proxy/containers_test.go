@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listContainers(t *testing.T, proxy *Proxy) []managedContainer {
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/containers", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var containers []managedContainer
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&containers))
+	return containers
+}
+
+func TestContainersHTTP(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	proxy := i.proxy
+	assert.Empty(t, listContainers(t, proxy))
+
+	r := httptest.NewRequest("POST", "/v1.24/containers/create?name=web", strings.NewReader(`{"Image": "nginx", "Entrypoint": ["nginx"], "Env": ["WEAVE_CIDR=10.2.1.1/24"]}`))
+	require.NoError(t, i.InterceptRequest(r))
+	require.NoError(t, i.InterceptResponse(&http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"Id": "c1"}`)),
+		Request:    r,
+	}))
+	assert.Equal(t, []managedContainer{
+		{ID: "c1", Name: "web", Image: "nginx", Status: containerCreated, CIDRs: []string{"10.2.1.1/24"}},
+	}, listContainers(t, proxy))
+
+	_, ipnet, _ := net.ParseCIDR("10.2.1.1/24")
+	ipnet.IP = net.ParseIP("10.2.1.1")
+	proxy.trackAttached(&docker.Container{ID: "c1", Name: "/web", Config: &docker.Config{Image: "nginx"}}, []string{"10.2.1.1/24"}, []*net.IPNet{ipnet})
+	// one already running when we started
+	proxy.trackAttached(&docker.Container{ID: "b0", Name: "/db"}, nil, []*net.IPNet{ipnet})
+	assert.Equal(t, []managedContainer{
+		{ID: "b0", Name: "db", Status: containerAttached, Addrs: []string{"10.2.1.1/24"}},
+		{ID: "c1", Name: "web", Image: "nginx", Status: containerAttached, CIDRs: []string{"10.2.1.1/24"}, Addrs: []string{"10.2.1.1/24"}},
+	}, listContainers(t, proxy))
+
+	proxy.trackDetached("b0")
+	proxy.ContainerDestroyed("c1")
+	assert.Equal(t, []managedContainer{{ID: "b0", Name: "db", Status: containerDetached}}, listContainers(t, proxy))
+}
+
+func TestContainersHTTPSkipped(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	proxy := i.proxy
+
+	for _, tc := range []struct {
+		id, name, body string
+	}{
+		{"c1", "web", `{"Image": "nginx", "Entrypoint": ["nginx"], "HostConfig": {"NetworkMode": "host"}}`},
+		{"c2", "db", `{"Image": "postgres", "Entrypoint": ["postgres"], "Env": ["WEAVE_CIDR=none"]}`},
+	} {
+		i := &createContainerInterceptor{proxy: proxy}
+		r := httptest.NewRequest("POST", "/v1.24/containers/create?name="+tc.name, strings.NewReader(tc.body))
+		require.NoError(t, i.InterceptRequest(r))
+		require.NoError(t, i.InterceptResponse(&http.Response{
+			StatusCode: http.StatusCreated,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"Id": "` + tc.id + `"}`)),
+			Request:    r,
+		}))
+	}
+	// one skipped when it started, rather than when it was created,
+	// which no longer has the hostname or addresses it was created with
+	proxy.trackCreated(&auditEntry{id: "b0", name: "cache", image: "redis", cidrs: []string{"10.32.0.9/12"}}, "cache.weave.local")
+	require.NoError(t, proxy.attachContainer(context.Background(), &docker.Container{
+		ID:         "b0",
+		Name:       "/cache",
+		Config:     &docker.Config{Image: "redis", Env: []string{"WEAVE_CIDR=none"}},
+		HostConfig: &docker.HostConfig{},
+	}))
+	assert.Equal(t, []managedContainer{
+		{ID: "b0", Name: "cache", Image: "redis", Status: containerSkipped, Reason: ErrWeaveCIDRNone.Error()},
+		{ID: "c1", Name: "web", Image: "nginx", Status: containerSkipped, Reason: "the container has '--net=host'"},
+		{ID: "c2", Name: "db", Image: "postgres", Status: containerSkipped, Reason: ErrWeaveCIDRNone.Error()},
+	}, listContainers(t, proxy))
+
+	// a failed create leaves nothing to list
+	i = &createContainerInterceptor{proxy: proxy}
+	r := httptest.NewRequest("POST", "/v1.24/containers/create?name=gone", strings.NewReader(`{"Image": "nginx", "Entrypoint": ["nginx"], "HostConfig": {"NetworkMode": "none"}}`))
+	require.NoError(t, i.InterceptRequest(r))
+	require.NoError(t, i.InterceptResponse(&http.Response{
+		StatusCode: http.StatusConflict,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"message": "Conflict"}`)),
+		Request:    r,
+	}))
+
+	proxy.ContainerDestroyed("b0")
+	proxy.ContainerDestroyed("c1")
+	assert.Equal(t, []managedContainer{
+		{ID: "c2", Name: "db", Image: "postgres", Status: containerSkipped, Reason: ErrWeaveCIDRNone.Error()},
+	}, listContainers(t, proxy))
+}
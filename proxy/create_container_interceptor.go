@@ -1,20 +1,49 @@
 package proxy
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
 )
 
-const MaxDockerHostname = 64
+const (
+	MaxDNSLabel = 63  // bytes per DNS label
+	MaxDNSName  = 253 // bytes in a fully qualified name, without the trailing dot
+)
 
 var (
 	ErrNoCommandSpecified = errors.New("No command specified")
 )
 
-type createContainerInterceptor struct{ proxy *Proxy }
+type createContainerInterceptor struct {
+	proxy *Proxy
+	// set by InterceptRequest if weave networking was added, for the
+	// audit log entry written once Docker has given the container an ID
+	audit      *auditEntry
+	autoRemove bool
+	aliases    []string
+	// the hostname the container was given in weaveDNS, if any
+	fqdn string
+	// the platform the create asked for, if any
+	platform *platform
+	// what we know of the container, for the log
+	fields logrus.Fields
+	// set by leaveAlone, for the container to be listed as skipped
+	// once Docker has given it an ID
+	skipped error
+}
 
 // ErrNoSuchImage replaces docker.NoSuchImage, which does not contain the image
 // name, which in turn breaks docker clients post 1.7.0 since they expect the
@@ -27,11 +56,165 @@ func (err *ErrNoSuchImage) Error() string {
 	return "No such image: " + err.Name
 }
 
+// ErrNetworkMode is returned for containers whose network mode means
+// they must not be given a weave interface of their own.
+type ErrNetworkMode struct {
+	Mode string
+}
+
+func (err *ErrNetworkMode) Error() string {
+	return "the container has '--net=" + err.Mode + "'"
+}
+
+// ErrWindowsContainer is returned for containers which will run on
+// Windows, where neither weavewait nor the weave interface can go.
+type ErrWindowsContainer struct {
+	Reason string
+}
+
+func (err *ErrWindowsContainer) Error() string {
+	return "it is a Windows container, with " + err.Reason
+}
+
+// ErrAddressInUse is returned for containers asking for a specific
+// address which IPAM has already given to another container.
+type ErrAddressInUse struct {
+	Addr  string
+	Owner string
+}
+
+func (err *ErrAddressInUse) Error() string {
+	return fmt.Sprintf("the WEAVE_CIDR address %s is already in use by %s", err.Addr, err.Owner)
+}
+
+// ErrInvalidDNSName is returned for a hostname or domain which can't be
+// used in DNS, saying why.
+type ErrInvalidDNSName struct {
+	Name, Reason string
+}
+
+func (err *ErrInvalidDNSName) Error() string {
+	return fmt.Sprintf("invalid DNS name %q: %s", err.Name, err.Reason)
+}
+
+// ErrInvalidQueryParam is returned for requests carrying one of our
+// query parameters with a value we can't make sense of.
+type ErrInvalidQueryParam struct {
+	Name, Value string
+}
+
+func (err *ErrInvalidQueryParam) Error() string {
+	return fmt.Sprintf("invalid value %q for query parameter %s", err.Value, err.Name)
+}
+
+// ErrFailClosed is returned, when the proxy was started with
+// --fail-closed, instead of creating a container which was meant to be
+// on the weave network but cannot be.
+type ErrFailClosed struct {
+	Err error
+}
+
+func (err *ErrFailClosed) Error() string {
+	return "refusing to create container without weave networking, since the proxy was started with --fail-closed: " + err.Err.Error()
+}
+
+// Just the fields needed to decide whether we want to touch a
+// container at all, which is far cheaper to decode than the whole body
+// when, for instance, it carries a large environment.
+type createContainerPeek struct {
+	Image      string
+	Env        []string
+	Labels     map[string]string
+	Platform   string
+	HostConfig struct {
+		NetworkMode string
+		Isolation   string
+	}
+	NetworkingConfig struct {
+		EndpointsConfig map[string]struct {
+			IPAMConfig struct {
+				IPv4Address string
+			}
+		}
+	}
+}
+
 func (i *createContainerInterceptor) InterceptRequest(r *http.Request) error {
-	container := jsonObject{}
-	if err := unmarshalRequestBody(r, &container); err != nil {
+	done, err := i.proxy.limitCreates(r.Context())
+	if err != nil {
 		return err
 	}
+	defer done()
+
+	body, err := readRequestBody(r)
+	if err != nil {
+		return errors.Wrap(err, "reading create request")
+	}
+	i.fields = logrus.Fields{}
+	if name := r.URL.Query().Get("name"); name != "" {
+		i.fields["name"] = strings.TrimPrefix(name, "/")
+	}
+
+	// Without default IPAM, only containers which ask for an address
+	// are touched, so most creates in a mixed environment can be
+	// passed on having decoded no more than which image they are of.
+	if i.proxy.NoDefaultIPAM && !mayRequestAddress(body) {
+		var image struct{ Image string }
+		if json.Unmarshal(body, &image) == nil {
+			i.fields["image"] = image.Image
+			found := false
+			if image.Image != "" {
+				_, found = i.proxy.imageLabel(r.Context(), image.Image, weaveCIDRLabel)
+			}
+			if !found {
+				return i.leaveAlone(ErrNoDefaultIPAM)
+			}
+		}
+	}
+
+	// If the peek fails to decode, e.g. because Env was sent as a single
+	// string, fall through to the full decode, which says what is wrong.
+	var peek createContainerPeek
+	if json.Unmarshal(body, &peek) == nil {
+		i.fields["image"] = peek.Image
+		// Before anything which, with --fail-closed, would refuse it
+		if err := windowsContainer(r, peek.Platform, peek.HostConfig.Isolation); err != nil {
+			return i.leaveAlone(err)
+		}
+		if err := i.proxy.imageSelected(peek.Image); err != nil {
+			return i.leaveAlone(err)
+		}
+		if err := i.proxy.labelsSelected(peek.Labels); err != nil {
+			return i.leaveAlone(err)
+		}
+		// A static address only becomes a WEAVE_CIDR once checked
+		// against the subnet, below
+		static := peek.NetworkingConfig.EndpointsConfig[i.proxy.weaveNetwork()].IPAMConfig.IPv4Address
+		if static == "" {
+			if _, err := i.proxy.weaveCIDRs(r.Context(), peek.HostConfig.NetworkMode, peek.Image, peek.Env, peek.Labels); err != nil {
+				return i.leaveAlone(err)
+			}
+		}
+	}
+
+	container := jsonObject{}
+	if err := unmarshalBody(body, &container); err != nil {
+		return errors.Wrap(err, "decoding create request")
+	}
+	// Fields of the wrong type are for validateCreateBody to report,
+	// and only once we know the container is one for us
+	platform, _ := container.String("Platform")
+	isolation := ""
+	if typecast, ok := container["HostConfig"].(map[string]interface{}); ok {
+		hostConfig := jsonObject(typecast)
+		isolation, _ = hostConfig.String(hostConfig.keyFor("Isolation"))
+	}
+	if err := windowsContainer(r, platform, isolation); err != nil {
+		return i.leaveAlone(err)
+	}
+	if err := validateCreateBody(container); err != nil {
+		return errors.Wrap(err, "invalid create request")
+	}
 
 	hostConfig, err := container.Object("HostConfig")
 	if err != nil {
@@ -48,43 +231,369 @@ func (i *createContainerInterceptor) InterceptRequest(r *http.Request) error {
 		return err
 	}
 
-	if cidrs, err := i.proxy.weaveCIDRs(networkMode, env); err != nil {
-		Log.Infof("Leaving container alone because %s", err)
-	} else {
-		Log.Infof("Creating container with WEAVE_CIDR \"%s\"", strings.Join(cidrs, " "))
-		if i.proxy.NoMulticastRoute {
-			if err := addVolume(hostConfig, i.proxy.weaveWaitNomcastVolume, "/w", "ro"); err != nil {
+	labels, err := container.StringMap("Labels")
+	if err != nil {
+		return err
+	}
+
+	image, err := container.String("Image")
+	if err != nil {
+		return err
+	}
+	i.fields["image"] = image
+
+	if err := i.proxy.imageSelected(image); err != nil {
+		return i.leaveAlone(err)
+	}
+	if err := i.proxy.labelsSelected(labels); err != nil {
+		return i.leaveAlone(err)
+	}
+	// A static address from 'docker run --ip' goes in the label, so
+	// that the start interceptor claims it too
+	static, err := staticAddress(container, i.proxy.weaveNetwork())
+	if err != nil {
+		return err
+	}
+	if static != "" && !hasWeaveCIDR(env, labels) {
+		cidr, err := i.proxy.staticCIDR(r.Context(), static)
+		if err != nil {
+			return i.leaveAlone(err)
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[weaveCIDRLabel] = cidr
+	}
+	cidrs, err := i.proxy.weaveCIDRs(r.Context(), networkMode, image, env, labels)
+	if err != nil {
+		return i.leaveAlone(err)
+	}
+	if err := i.proxy.checkAddressesFree(r.Context(), cidrs); err != nil {
+		return i.leaveAlone(err)
+	}
+	// All changes are made to container, and only make it into the
+	// request once every one of them has succeeded
+	if err := addVolume(hostConfig, i.proxy.weaveWaitVolumeFor(r.Context(), image, false), i.proxy.WeaveWaitMountPath, "ro"); err != nil {
+		return err
+	}
+	if len(i.proxy.ExtraHosts) > 0 {
+		extraHostsKey := hostConfig.keyFor("ExtraHosts")
+		extraHosts, err := hostConfig.StringArray(extraHostsKey)
+		if err != nil {
+			return err
+		}
+		hostConfig[extraHostsKey] = mergeExtraHosts(extraHosts, i.proxy.ExtraHosts)
+	}
+	if len(i.proxy.sysctls) > 0 && requestAPIVersion(r.URL.Path).hasSysctls() {
+		sysctlsKey := hostConfig.keyFor("Sysctls")
+		sysctls, err := hostConfig.StringMap(sysctlsKey)
+		if err != nil {
+			return err
+		}
+		hostConfig[sysctlsKey] = mergeSysctls(sysctls, i.proxy.sysctls)
+	}
+	if len(i.proxy.capAdd) > 0 {
+		capAddKey := hostConfig.keyFor("CapAdd")
+		capAdd, err := hostConfig.StringArray(capAddKey)
+		if err != nil {
+			return err
+		}
+		hostConfig[capAddKey] = mergeCapabilities(capAdd, i.proxy.capAdd)
+	}
+	if len(i.proxy.ulimits) > 0 {
+		// checked by validateCreateBody to be an array, if anything
+		ulimitsKey := hostConfig.keyFor("Ulimits")
+		ulimits, _ := hostConfig[ulimitsKey].([]interface{})
+		hostConfig[ulimitsKey] = mergeUlimits(ulimits, i.proxy.ulimits)
+	}
+	if requestAPIVersion(r.URL.Path).hasTmpfs() {
+		if err := i.proxy.addReadonlyTmpfs(r.Context(), container, hostConfig); err != nil {
+			return err
+		}
+	}
+	if i.proxy.Init && requestAPIVersion(r.URL.Path).hasInit() {
+		// weavewait execs the container's own entrypoint, which then
+		// runs as PID 1 without reaping zombies unless there is an init
+		// in front of it; a container that says either way gets its way
+		initKey := hostConfig.keyFor("Init")
+		if value, set := hostConfig[initKey]; !set || value == nil {
+			hostConfig[initKey] = true
+		}
+	}
+	if len(i.proxy.Env) > 0 {
+		env = mergeEnv(env, i.proxy.Env)
+		container["Env"] = env
+	}
+	rawEntrypoint, err := rawEntrypointRequested(r)
+	if err != nil {
+		return err
+	}
+	// So that e.g. 'docker ps --filter label=works.weave.managed' finds
+	// them. Addresses from IPAM are only allocated on start, so the
+	// CIDR label has what was asked for.
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[weaveManagedLabel] = "true"
+	labels[weaveManagedCIDRLabel] = requestedCIDRs(cidrs)
+	container["Labels"] = labels
+	if rawEntrypoint {
+		// The same as if the user had labelled it no-wait, so that it
+		// is still attached when it starts
+		i.log().Infof("Leaving entrypoint alone as the request has '%s'", rawEntrypointParam)
+		labels[weaveNoWaitLabel] = ""
+	}
+	if i.platform, err = parsePlatform(r.URL.Query().Get("platform")); err != nil {
+		return err
+	}
+	if err := i.setWeaveWaitEntrypoint(r.Context(), container); err == ErrNoCommandSpecified {
+		// Let Docker reject the original request in its own words
+		i.log().Infof("Leaving container alone because %s", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if i.proxy.DeriveMAC {
+		if err := setDerivedMAC(container, cidrs); err != nil {
+			return err
+		}
+	}
+	if i.proxy.PublishOnWeave {
+		if err := publishOnWeave(hostConfig, requestedIP(cidrs)); err != nil {
+			return err
+		}
+	}
+	hostname, err := i.containerHostname(r, container)
+	if err != nil {
+		return err
+	}
+	if dnsDomain := i.proxy.containerDNSDomain(r.Context(), env); dnsDomain != "" {
+		if i.proxy.hostnameTemplate != nil {
+			hostname = i.templateHostname(hostname, r.URL.Query().Get("name"), image, labels, dnsDomain)
+		}
+		if i.proxy.HostnameCollision != "" && i.proxy.HostnameCollision != hostnameCollisionAllow {
+			if hostname, err = i.avoidHostnameCollision(container, hostname, dnsDomain); err != nil {
 				return err
 			}
-		} else {
-			if err := addVolume(hostConfig, i.proxy.weaveWaitVolume, "/w", "ro"); err != nil {
+		}
+		if err := i.setHostname(container, hostname, dnsDomain); err != nil {
+			return err
+		}
+		if i.fqdn, err = containerFQDN(container); err != nil {
+			return err
+		}
+		if err := i.proxy.setWeaveDNS(hostConfig, requestAPIVersion(r.URL.Path), hostname, dnsDomain); err != nil {
+			return err
+		}
+		if i.proxy.WaitForDNS {
+			if err := i.setWaitForDNS(container, i.fqdn); err != nil {
 				return err
 			}
 		}
-		if err := i.setWeaveWaitEntrypoint(container); err != nil {
+	}
+
+	// Lookups which failed because the client has gone away may have
+	// left the container half done, so don't pass it on
+	if err := r.Context().Err(); err != nil {
+		return err
+	}
+	if i.proxy.DryRun {
+		return logDryRun(body, container)
+	}
+	if err := mergeRequestBody(r, body, container); err != nil {
+		return errors.Wrap(err, "rewriting create request")
+	}
+	if rawEntrypoint {
+		query := r.URL.Query()
+		query.Del(rawEntrypointParam)
+		r.URL.RawQuery = query.Encode()
+	}
+
+	i.log().WithField("weave_cidr", strings.Join(cidrs, " ")).Infof("Creating container with WEAVE_CIDR \"%s\"", strings.Join(cidrs, " "))
+	i.audit = &auditEntry{name: r.URL.Query().Get("name"), image: image, cidrs: cidrs}
+	if requestAPIVersion(r.URL.Path).hasAutoRemove() {
+		if i.autoRemove, err = hostConfig.Bool(hostConfig.keyFor("AutoRemove")); err != nil {
 			return err
 		}
-		hostname, err := i.containerHostname(r, container)
+	}
+	i.aliases, err = networkAliases(container)
+	return err
+}
+
+// windowsContainer returns ErrWindowsContainer if the create asks, with
+// ?platform= or Platform in its body, for Windows, or for an isolation
+// only Windows has.
+func windowsContainer(r *http.Request, platform, isolation string) error {
+	if value := r.URL.Query().Get("platform"); isWindowsPlatform(value) {
+		return &ErrWindowsContainer{"platform " + value}
+	}
+	if isWindowsPlatform(platform) {
+		return &ErrWindowsContainer{"platform " + platform}
+	}
+	switch strings.ToLower(isolation) {
+	case "process", "hyperv":
+		return &ErrWindowsContainer{"isolation " + isolation}
+	}
+	return nil
+}
+
+func isWindowsPlatform(platform string) bool {
+	return strings.EqualFold(strings.SplitN(platform, "/", 2)[0], "windows")
+}
+
+// Operators debugging an image can ask for it to be run exactly as it
+// is, without the weavewait entrypoint, while still putting it on weave.
+const rawEntrypointParam = "weave-raw-entrypoint"
+
+func rawEntrypointRequested(r *http.Request) (bool, error) {
+	query := r.URL.Query()
+	if _, found := query[rawEntrypointParam]; !found {
+		return false, nil
+	}
+	value := query.Get(rawEntrypointParam)
+	raw, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &ErrInvalidQueryParam{rawEntrypointParam, value}
+	}
+	return raw, nil
+}
+
+// networkAliases returns the aliases, e.g. the service name given by
+// docker-compose, and DNSNames from every endpoint in the
+// NetworkingConfig, to register with weaveDNS as further names of the
+// container.
+func networkAliases(container jsonObject) ([]string, error) {
+	networkingConfig, err := container.Object("NetworkingConfig")
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := networkingConfig.Object("EndpointsConfig")
+	if err != nil {
+		return nil, err
+	}
+	networks := make([]string, 0, len(endpoints))
+	for network := range endpoints {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+
+	var aliases []string
+	for _, network := range networks {
+		endpoint, err := endpoints.Object(network)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if dnsDomain := i.proxy.getDNSDomain(); dnsDomain != "" {
-			if err := i.setHostname(container, hostname, dnsDomain); err != nil {
-				return err
+		for _, key := range []string{"Aliases", "DNSNames"} {
+			endpointAliases, err := endpoint.StringArray(key)
+			if err != nil {
+				return nil, err
 			}
-			if err := i.proxy.setWeaveDNS(hostConfig, hostname, dnsDomain); err != nil {
-				return err
+			for _, alias := range endpointAliases {
+				if !containsString(aliases, alias) {
+					aliases = append(aliases, alias)
+				}
 			}
 		}
+	}
+	return aliases, nil
+}
+
+// logDryRun logs how we would have changed the create request, which
+// is forwarded as it was sent.
+func logDryRun(original []byte, container jsonObject) error {
+	before := jsonObject{}
+	if err := unmarshalBody(original, &before); err != nil {
+		return err
+	}
+	changes, err := diffJSON("", before, container)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		Log.Infof("Dry run: would set %s", change)
+	}
+	return nil
+}
 
-		return marshalRequestBody(r, container)
+// diffJSON describes, in key order, each value in after which differs
+// from before, descending into nested objects such as HostConfig.
+func diffJSON(prefix string, before, after jsonObject) ([]string, error) {
+	keys := make([]string, 0, len(after))
+	for key := range after {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, key := range keys {
+		if a, ok := asJSONObject(after[key]); ok {
+			b, _ := asJSONObject(before[key])
+			nested, err := diffJSON(prefix+key+".", b, a)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, nested...)
+			continue
+		}
+		b, err := json.Marshal(before[key])
+		if err != nil {
+			return nil, err
+		}
+		a, err := json.Marshal(after[key])
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(a, b) {
+			changes = append(changes, fmt.Sprintf("%s%s to %s (was %s)", prefix, key, a, b))
+		}
 	}
+	return changes, nil
+}
 
+// leaveAlone passes on the create request untouched, or, with
+// --fail-closed, rejects it if that is not what the user asked for.
+func (i *createContainerInterceptor) leaveAlone(err error) error {
+	switch err.(type) {
+	case *ErrNetworkMode, *ErrImageNotSelected, *ErrLabelSkipped:
+		i.skipped = err
+		i.log().Debugf("Leaving container alone because %s", err)
+		return nil
+	case *ErrWindowsContainer:
+		i.skipped = err
+		i.log().Infof("Leaving container alone because %s", err)
+		return nil
+	}
+	if err != ErrWeaveCIDRNone && err != ErrNoDefaultIPAM {
+		i.proxy.metrics.weaveCIDRError()
+		if i.proxy.FailClosed {
+			return &ErrFailClosed{err}
+		}
+	}
+	i.skipped = err
+	i.log().Infof("Leaving container alone because %s", err)
 	return nil
 }
 
-func (i *createContainerInterceptor) setWeaveWaitEntrypoint(container jsonObject) error {
-	var entrypoint []string
+// log logs with what we know of the container as fields, e.g. for
+// --log-format=json.
+func (i *createContainerInterceptor) log() *logrus.Entry {
+	return Log.WithFields(i.fields)
+}
+
+func (i *createContainerInterceptor) setWeaveWaitEntrypoint(ctx context.Context, container jsonObject) error {
+	env, err := container.StringArray("Env")
+	if err != nil {
+		return err
+	}
+	labels, err := container.StringMap("Labels")
+	if err != nil {
+		return err
+	}
+	if noWeaveWait(env, labels) {
+		Log.Debugf("Leaving entrypoint alone as the container asked not to wait for weave")
+		return nil
+	}
+
 	entrypoint, err := container.StringArray("Entrypoint")
 	if err != nil {
 		return err
@@ -101,7 +610,7 @@ func (i *createContainerInterceptor) setWeaveWaitEntrypoint(container jsonObject
 			return err
 		}
 
-		image, err := i.proxy.client.InspectImage(containerImage)
+		image, err := i.proxy.inspectImageForPlatform(ctx, containerImage, i.platform)
 		if err == docker.ErrNoSuchImage {
 			return &ErrNoSuchImage{containerImage}
 		} else if err != nil {
@@ -123,13 +632,56 @@ func (i *createContainerInterceptor) setWeaveWaitEntrypoint(container jsonObject
 		return ErrNoCommandSpecified
 	}
 
-	if len(entrypoint) == 0 || entrypoint[0] != weaveWaitEntrypoint[0] {
-		container["Entrypoint"] = append(weaveWaitEntrypoint, entrypoint...)
+	if weaveWaitEntrypoint := i.proxy.weaveWaitEntrypoint(); len(entrypoint) == 0 || entrypoint[0] != weaveWaitEntrypoint[0] {
+		if timeout := i.proxy.waitTimeout(ctx, container, labels); timeout > 0 && i.proxy.ownWeaveWait() {
+			weaveWaitEntrypoint = append(weaveWaitEntrypoint, "--wait-timeout="+timeout.String())
+		}
+		if i.proxy.NoMulticastRoute && i.proxy.ownWeaveWait() {
+			// we attach it without the route, so it would wait in vain
+			weaveWaitEntrypoint = append(weaveWaitEntrypoint, noMulticastRouteArg)
+		}
+		if i.proxy.WaitPosition == waitPositionWrap {
+			// Docker passes Cmd to the entrypoint, so weavewait
+			// runs the container's entrypoint and command in turn
+			container["Entrypoint"] = weaveWaitEntrypoint
+			container["Cmd"] = append(append([]string{}, entrypoint...), cmd...)
+		} else {
+			container["Entrypoint"] = append(weaveWaitEntrypoint, entrypoint...)
+		}
 	}
 
 	return nil
 }
 
+// waitTimeout returns how long weavewait should wait for the weave
+// interface: as long as the container's label or, failing that, its
+// image's label says, or else Config.WaitTimeout. Zero means for ever.
+func (proxy *Proxy) waitTimeout(ctx context.Context, container jsonObject, labels map[string]string) time.Duration {
+	value, found := labels[weaveWaitTimeoutLabel]
+	if !found {
+		if image, err := container.String("Image"); err == nil && image != "" {
+			value, found = proxy.imageLabel(ctx, image, weaveWaitTimeoutLabel)
+		}
+	}
+	if !found {
+		return proxy.WaitTimeout
+	}
+	timeout, err := parseWaitTimeout(value)
+	if err != nil {
+		proxy.warnings.Warningf("Ignoring %s label: %s", weaveWaitTimeoutLabel, err)
+		return proxy.WaitTimeout
+	}
+	return timeout
+}
+
+func parseWaitTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid wait timeout %q: must be a duration, e.g. 30s", value)
+	}
+	return timeout, nil
+}
+
 func (i *createContainerInterceptor) setHostname(container jsonObject, name, dnsDomain string) error {
 	hostname, err := container.String("Hostname")
 	if err != nil {
@@ -138,8 +690,8 @@ func (i *createContainerInterceptor) setHostname(container jsonObject, name, dns
 	if hostname == "" && name != "" {
 		// Strip trailing period because it's unusual to see it used on the end of a host name
 		trimmedDNSDomain := strings.TrimSuffix(dnsDomain, ".")
-		if len(name)+1+len(trimmedDNSDomain) > MaxDockerHostname {
-			Log.Warningf("Container name [%s] too long to be used as hostname", name)
+		if err := checkHostname(name, trimmedDNSDomain); err != nil {
+			i.proxy.warnings.Warningf("Container name [%s] cannot be used as hostname: %s", name, err)
 		} else {
 			container["Hostname"] = name
 			container["Domainname"] = trimmedDNSDomain
@@ -149,7 +701,132 @@ func (i *createContainerInterceptor) setHostname(container jsonObject, name, dns
 	return nil
 }
 
+// containerFQDN is the name a container will be registered with in
+// weaveDNS, if it has a hostname and domain name.
+func containerFQDN(container jsonObject) (string, error) {
+	hostname, err := container.String("Hostname")
+	if err != nil {
+		return "", err
+	}
+	domainname, err := container.String("Domainname")
+	if err != nil || hostname == "" || domainname == "" {
+		return "", err
+	}
+	return hostname + "." + domainname, nil
+}
+
+// setWaitForDNS tells weavewait, if it is the container's entrypoint,
+// to wait for the container's name to resolve, which it does once the
+// container is attached and registered with weaveDNS, before running
+// the container's command. Containers without a name in the weaveDNS
+// domain have nothing to wait for, and a wait entrypoint of the user's
+// own choosing is not told at all.
+func (i *createContainerInterceptor) setWaitForDNS(container jsonObject, fqdn string) error {
+	if !i.proxy.ownWeaveWait() {
+		return nil
+	}
+	entrypoint, err := container.StringArray("Entrypoint")
+	if err != nil {
+		return err
+	}
+	weaveWaitEntrypoint := i.proxy.weaveWaitEntrypoint()
+	if fqdn == "" || len(entrypoint) < len(weaveWaitEntrypoint) || entrypoint[0] != weaveWaitEntrypoint[0] {
+		return nil
+	}
+	for _, arg := range entrypoint[len(weaveWaitEntrypoint):] {
+		if strings.HasPrefix(arg, waitDNSArg) {
+			return nil
+		}
+	}
+	waitDNS := waitDNSArg + fqdn
+	container["Entrypoint"] = append(append(append([]string{}, weaveWaitEntrypoint...), waitDNS), entrypoint[len(weaveWaitEntrypoint):]...)
+	return nil
+}
+
+// setDerivedMAC gives the container a MAC address derived from the
+// first address explicitly requested in its WEAVE_CIDR, unless the
+// user chose one themselves. Addresses allocated by IPAM are not known
+// until the container starts, so do not get one.
+func setDerivedMAC(container jsonObject, cidrs []string) error {
+	mac, err := container.String("MacAddress")
+	if err != nil || mac != "" {
+		return err
+	}
+	if ip := requestedIP(cidrs); ip != nil {
+		mac := derivedMAC(ip)
+		Log.Debugf("Using MAC address %s derived from %s", mac, ip)
+		container["MacAddress"] = mac.String()
+	}
+	return nil
+}
+
+// derivedMAC maps an IP address onto a MAC address: 02:57 followed by
+// the last four bytes of the address, i.e. the whole of an IPv4
+// address. 02 marks the address as locally administered and unicast;
+// 57 ('W') keeps it clear of the 02:42 prefix Docker uses for the
+// same scheme on its own bridge.
+func derivedMAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x02, 0x57, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// checkHostname verifies that hostname.domainname fits the DNS limits
+// of RFC 1035: at most MaxDNSLabel bytes per label and MaxDNSName bytes
+// overall.
+func checkHostname(hostname, domainname string) error {
+	fqdn := hostname
+	if domainname != "" {
+		fqdn += "." + domainname
+	}
+	if len(fqdn) > MaxDNSName {
+		return &ErrInvalidDNSName{fqdn, fmt.Sprintf("longer than %d bytes", MaxDNSName)}
+	}
+	for _, label := range strings.Split(fqdn, ".") {
+		if len(label) > MaxDNSLabel {
+			return &ErrInvalidDNSName{fqdn, fmt.Sprintf("label %q is longer than %d bytes", label, MaxDNSLabel)}
+		}
+	}
+	return nil
+}
+
+// requestedCIDRs describes the addresses a container will be attached
+// with: those in its WEAVE_CIDR, or IPAM's default subnet.
+func requestedCIDRs(cidrs []string) string {
+	if len(cidrs) == 0 {
+		return "net:default"
+	}
+	return strings.Join(cidrs, " ")
+}
+
 func (i *createContainerInterceptor) InterceptResponse(r *http.Response) error {
+	if (i.audit == nil && i.skipped == nil) || r.StatusCode != http.StatusCreated {
+		return nil
+	}
+	created := jsonObject{}
+	if err := unmarshalResponseBody(r, &created); err != nil {
+		return err
+	}
+	id, err := created.String("Id")
+	if err != nil {
+		return err
+	}
+	if i.audit == nil {
+		name, _ := i.fields["name"].(string)
+		image, _ := i.fields["image"].(string)
+		i.proxy.trackSkipped(id, name, image, i.skipped)
+		return nil
+	}
+	i.audit.id = id
+	i.proxy.auditCreate(i.audit)
+	i.proxy.trackCreated(i.audit, i.fqdn)
+	// So that the client can learn them without inspecting the container
+	r.Header.Set(weaveCIDRHeader, requestedCIDRs(i.audit.cidrs))
+	if i.autoRemove {
+		i.proxy.trackAutoRemove(id)
+	}
+	if len(i.aliases) > 0 {
+		i.proxy.rememberDNSAliases(id, i.aliases)
+	}
 	return nil
 }
 
@@ -159,9 +836,25 @@ func (i *createContainerInterceptor) containerHostname(r *http.Request, containe
 		hostname, err = i.hostnameFromLabel(hostname, container)
 	}
 	hostname = i.proxy.hostnameMatchRegexp.ReplaceAllString(hostname, i.proxy.HostnameReplacement)
+	if normalised := normaliseHostname(hostname); normalised != hostname {
+		Log.Infof("Using hostname %q for container name %q", normalised, hostname)
+		hostname = normalised
+	}
 	return
 }
 
+var invalidHostnameChars = regexp.MustCompile("[^A-Za-z0-9.-]+")
+
+// Container names may contain characters, such as the underscores in
+// names generated by docker-compose, which are not allowed in
+// hostnames by RFC 1123. Replace them and drop any leading or trailing
+// punctuation, e.g. "/myproject_web_1" becomes "myproject-web-1".
+func normaliseHostname(name string) string {
+	name = strings.TrimLeft(name, "/")
+	name = invalidHostnameChars.ReplaceAllString(name, "-")
+	return strings.Trim(name, "-.")
+}
+
 func (i *createContainerInterceptor) hostnameFromLabel(hostname string, container jsonObject) (string, error) {
 	labels, err := container.Object("Labels")
 	if err != nil {
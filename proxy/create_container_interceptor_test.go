@@ -0,0 +1,1536 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	weaveapi "github.com/weaveworks/weave/api"
+	"github.com/weaveworks/weave/common"
+	weavedocker "github.com/weaveworks/weave/common/docker"
+)
+
+var (
+	notFoundOnce sync.Once
+	notFound     *httptest.Server
+)
+
+// notFoundServer answers every request with a 404, standing in for
+// Docker and weave in tests that don't care what either would say
+func notFoundServer() *httptest.Server {
+	notFoundOnce.Do(func() {
+		notFound = httptest.NewServer(http.NotFoundHandler())
+	})
+	return notFound
+}
+
+func newTestCreateInterceptor(c Config) *createContainerInterceptor {
+	if c.WeaveWaitMountPath == "" {
+		c.WeaveWaitMountPath = "/w"
+	}
+	ts := notFoundServer()
+	dc, err := docker.NewClient(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	proxy, err := newTestProxy(c, &weavedocker.Client{Client: dc}, withWeave(strings.TrimPrefix(ts.URL, "http://")))
+	if err != nil {
+		panic(err)
+	}
+	return &createContainerInterceptor{proxy: proxy}
+}
+
+func interceptCreate(t *testing.T, i *createContainerInterceptor, body string) jsonObject {
+	r := httptest.NewRequest("POST", "/v1.24/containers/create?name=foo", strings.NewReader(body))
+	require.NoError(t, i.InterceptRequest(r))
+	container := jsonObject{}
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+	return container
+}
+
+func TestWeaveWaitMountPath(t *testing.T) {
+	proxy := &Proxy{Config: Config{WeaveWaitMountPath: "/weavewait"}, weaveWaitVolume: "/var/lib/weavewait"}
+	i := &createContainerInterceptor{proxy: proxy}
+
+	container := jsonObject{"Entrypoint": []string{"/bin/sh"}}
+	require.NoError(t, i.setWeaveWaitEntrypoint(context.Background(), container))
+	assert.Equal(t, []string{"/weavewait/w", "/bin/sh"}, container["Entrypoint"])
+
+	// already has the weavewait entrypoint
+	require.NoError(t, i.setWeaveWaitEntrypoint(context.Background(), container))
+	assert.Equal(t, []string{"/weavewait/w", "/bin/sh"}, container["Entrypoint"])
+
+	hostConfig := jsonObject{"Binds": []string{"/old:/weavewait:ro", "/w:/w"}}
+	require.NoError(t, addVolume(hostConfig, proxy.weaveWaitVolume, proxy.WeaveWaitMountPath, "ro"))
+	assert.Equal(t, []string{"/w:/w", "/var/lib/weavewait:/weavewait:ro"}, hostConfig["Binds"])
+}
+
+func TestNoMulticastRoute(t *testing.T) {
+	for _, test := range []struct {
+		config     Config
+		entrypoint interface{}
+		cmd        interface{}
+		binds      []interface{}
+	}{
+		{Config{}, []interface{}{"/w/w", "/bin/sh"}, nil, []interface{}{"/var/lib/weavewait:/w:ro"}},
+		{Config{NoMulticastRoute: true}, []interface{}{"/w/w", "--no-multicast-route", "/bin/sh"}, nil, []interface{}{"/var/lib/weavewait-nomcast:/w:ro"}},
+		{Config{NoMulticastRoute: true, WaitTimeout: time.Minute}, []interface{}{"/w/w", "--wait-timeout=1m0s", "--no-multicast-route", "/bin/sh"}, nil, []interface{}{"/var/lib/weavewait-nomcast:/w:ro"}},
+		{Config{NoMulticastRoute: true, WaitPosition: "wrap"}, []interface{}{"/w/w", "--no-multicast-route"}, []interface{}{"/bin/sh"}, []interface{}{"/var/lib/weavewait-nomcast:/w:ro"}},
+		// an entrypoint of the user's own may not understand it
+		{Config{NoMulticastRoute: true, WaitEntrypoint: "/usr/local/bin/mywait"}, []interface{}{"/usr/local/bin/mywait", "/bin/sh"}, nil, []interface{}{"/var/lib/weavewait-nomcast:/w:ro"}},
+	} {
+		test.config.WithoutDNS = true
+		i := newTestCreateInterceptor(test.config)
+		container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"]}`)
+		assert.Equal(t, test.entrypoint, container["Entrypoint"], "%+v", test.config)
+		if test.cmd != nil {
+			assert.Equal(t, test.cmd, container["Cmd"], "%+v", test.config)
+		}
+		hostConfig, err := container.Object("HostConfig")
+		require.NoError(t, err)
+		assert.Equal(t, test.binds, hostConfig["Binds"], "%+v", test.config)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/slowstart/json" {
+			fmt.Fprintf(w, `{"Id": "a1", "Config": {"Labels": {%q: "2m"}}}`, weaveWaitTimeoutLabel)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		config     Config
+		body       string
+		entrypoint []interface{}
+	}{
+		// waits for ever unless told otherwise
+		{Config{}, `{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/w", "/bin/sh"}},
+		{Config{WaitTimeout: 10 * time.Second}, `{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/w", "--wait-timeout=10s", "/bin/sh"}},
+		{Config{WaitTimeout: 10 * time.Second}, `{"Image": "slowstart", "Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/w", "--wait-timeout=2m0s", "/bin/sh"}},
+		// the container's label beats the image's
+		{Config{}, `{"Image": "slowstart", "Entrypoint": ["/bin/sh"], "Labels": {"works.weave.wait-timeout": "90s"}}`, []interface{}{"/w/w", "--wait-timeout=1m30s", "/bin/sh"}},
+		{Config{WaitTimeout: 10 * time.Second}, `{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Labels": {"works.weave.wait-timeout": "soon"}}`, []interface{}{"/w/w", "--wait-timeout=10s", "/bin/sh"}},
+		{Config{WaitTimeout: 10 * time.Second}, `{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Labels": {"works.weave.wait-timeout": "0s"}}`, []interface{}{"/w/w", "/bin/sh"}},
+		// our own argument means nothing to someone else's entrypoint
+		{Config{WaitTimeout: 10 * time.Second, WaitEntrypoint: "/w/mywait"}, `{"Image": "slowstart", "Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/mywait", "/bin/sh"}},
+		{Config{WaitTimeout: 10 * time.Second, WaitEntrypoint: "/w/mywait", WaitPosition: "wrap"}, `{"Image": "slowstart", "Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/mywait"}},
+	} {
+		test.config.WithoutDNS = true
+		i := newTestCreateInterceptor(test.config)
+		i.proxy.client = &weavedocker.Client{Client: dc}
+		container := interceptCreate(t, i, test.body)
+		assert.Equal(t, test.entrypoint, container["Entrypoint"], "%+v %s", test.config, test.body)
+	}
+
+	for value, valid := range map[string]bool{"30s": true, "0": true, "1h": true, "30": false, "-5s": false, "": false} {
+		_, err := parseWaitTimeout(value)
+		assert.Equal(t, valid, err == nil, value)
+	}
+}
+
+func TestArchWaitVolume(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/nginx-arm64/json":
+			fmt.Fprint(w, `{"Id": "a1", "Architecture": "arm64", "Config": {}}`)
+		case "/images/nginx-amd64/json":
+			fmt.Fprint(w, `{"Id": "b2", "Architecture": "amd64", "Config": {}}`)
+		case "/images/nginx-s390x/json":
+			fmt.Fprint(w, `{"Id": "c3", "Architecture": "s390x", "Config": {}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+
+	archVolumes := []string{
+		"arm64=/var/lib/weavewait-arm64:/var/lib/weavewait-noop-arm64:/var/lib/weavewait-nomcast-arm64",
+		"amd64=/var/lib/weavewait-amd64:/var/lib/weavewait-noop-amd64:/var/lib/weavewait-nomcast-amd64",
+	}
+	for _, noMulticastRoute := range []bool{false, true} {
+		i := newTestCreateInterceptor(Config{WithoutDNS: true, NoMulticastRoute: noMulticastRoute})
+		i.proxy.client = &weavedocker.Client{Client: dc}
+		i.proxy.archWaitVolumes, err = parseArchWaitVolumes(archVolumes)
+		require.NoError(t, err)
+
+		variant := ""
+		if noMulticastRoute {
+			variant = "-nomcast"
+		}
+		for image, volume := range map[string]string{
+			"nginx-arm64": "/var/lib/weavewait" + variant + "-arm64",
+			"nginx-amd64": "/var/lib/weavewait" + variant + "-amd64",
+			"nginx-s390x": "/var/lib/weavewait" + variant, // no mapping
+			"missing":     "/var/lib/weavewait" + variant, // can't inspect
+		} {
+			container := interceptCreate(t, i, `{"Image": "`+image+`", "Entrypoint": ["/bin/sh"]}`)
+			hostConfig, err := container.Object("HostConfig")
+			require.NoError(t, err)
+			assert.Equal(t, []interface{}{volume + ":/w:ro"}, hostConfig["Binds"], image)
+		}
+		assert.Equal(t, "/var/lib/weavewait-noop-arm64", i.proxy.weaveWaitVolumeFor(context.Background(), "nginx-arm64", true))
+		assert.Equal(t, "/var/lib/weavewait-noop", i.proxy.weaveWaitVolumeFor(context.Background(), "nginx-s390x", true))
+	}
+
+	for _, entry := range []string{"arm64", "=/var/lib/weavewait:/var/lib/noop:/var/lib/nomcast", "arm64=/var/lib/weavewait", "arm64=/var/lib/weavewait::/var/lib/nomcast"} {
+		_, err = parseArchWaitVolumes([]string{entry})
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestImageInspectRetries(t *testing.T) {
+	var mu sync.Mutex
+	inspections := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inspections[r.URL.Path]++
+		n := inspections[r.URL.Path]
+		mu.Unlock()
+		// being pulled: only there from the second inspect on
+		if r.URL.Path == "/images/pulling/json" && n > 1 {
+			fmt.Fprint(w, `{"Id": "sha256:4f1c7a", "Config": {"Cmd": ["nginx"]}}`)
+			return
+		}
+		if (r.URL.Path == "/images/labelled/json" || r.URL.Path == "/images/arm64/json") && n > 1 {
+			fmt.Fprint(w, `{"Id": "sha256:7d2e9b", "Architecture": "arm64", "Config": {"Labels": {"works.weave.cidr": "net:10.32.0.0/24"}}}`)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+
+	i := newTestCreateInterceptor(Config{ImageInspectRetries: 2})
+	i.proxy.client = &weavedocker.Client{Client: dc}
+
+	container := jsonObject{"Image": "pulling"}
+	require.NoError(t, i.setWeaveWaitEntrypoint(context.Background(), container))
+	assert.Equal(t, []string{"nginx"}, container["Cmd"])
+	assert.Equal(t, 2, inspections["/images/pulling/json"])
+
+	// really missing: given up on once the retries are used up
+	err = i.setWeaveWaitEntrypoint(context.Background(), jsonObject{"Image": "missing"})
+	assert.Equal(t, &ErrNoSuchImage{"missing"}, err)
+	assert.Equal(t, 3, inspections["/images/missing/json"])
+
+	// as do the image's labels and architecture, looked up on the way
+	value, found := i.proxy.imageLabel(context.Background(), "labelled", weaveCIDRLabel)
+	assert.True(t, found)
+	assert.Equal(t, "net:10.32.0.0/24", value)
+	assert.Equal(t, 2, inspections["/images/labelled/json"])
+	i.proxy.archWaitVolumes, err = parseArchWaitVolumes([]string{"arm64=/var/lib/weavewait-arm64:/var/lib/weavewait-noop-arm64:/var/lib/weavewait-nomcast-arm64"})
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/weavewait-arm64", i.proxy.weaveWaitVolumeFor(context.Background(), "arm64", false))
+	assert.Equal(t, 2, inspections["/images/arm64/json"])
+
+	// and no retries unless asked for
+	i.proxy.ImageInspectRetries = 0
+	err = i.setWeaveWaitEntrypoint(context.Background(), jsonObject{"Image": "absent"})
+	assert.Equal(t, &ErrNoSuchImage{"absent"}, err)
+	assert.Equal(t, 1, inspections["/images/absent/json"])
+}
+
+func TestCustomWaitEntrypoint(t *testing.T) {
+	proxy := &Proxy{Config: Config{WeaveWaitMountPath: "/w", WaitEntrypoint: "/w/w-slow  -timeout 60s"}}
+	i := &createContainerInterceptor{proxy: proxy}
+
+	container := jsonObject{"Entrypoint": []string{"/bin/sh"}}
+	require.NoError(t, i.setWeaveWaitEntrypoint(context.Background(), container))
+	assert.Equal(t, []string{"/w/w-slow", "-timeout", "60s", "/bin/sh"}, container["Entrypoint"])
+
+	// already has the custom entrypoint
+	require.NoError(t, i.setWeaveWaitEntrypoint(context.Background(), container))
+	assert.Equal(t, []string{"/w/w-slow", "-timeout", "60s", "/bin/sh"}, container["Entrypoint"])
+
+	assert.True(t, proxy.containerShouldAttach(&docker.Container{Config: &docker.Config{Entrypoint: []string{"/w/w-slow", "-timeout", "60s", "/bin/sh"}}}))
+}
+
+func TestWaitPosition(t *testing.T) {
+	for _, test := range []struct {
+		position, body  string
+		entrypoint, cmd []interface{}
+	}{
+		{"", `{"Image": "busybox", "Entrypoint": ["/init.sh"], "Cmd": ["serve"]}`, []interface{}{"/w/w", "/init.sh"}, []interface{}{"serve"}},
+		{"prepend", `{"Image": "busybox", "Entrypoint": ["/init.sh"], "Cmd": ["serve"]}`, []interface{}{"/w/w", "/init.sh"}, []interface{}{"serve"}},
+		{"wrap", `{"Image": "busybox", "Entrypoint": ["/init.sh"], "Cmd": ["serve"]}`, []interface{}{"/w/w"}, []interface{}{"/init.sh", "serve"}},
+		{"wrap", `{"Image": "busybox", "Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/w"}, []interface{}{"/bin/sh"}},
+		{"wrap", `{"Image": "busybox", "Entrypoint": ["/w/w"], "Cmd": ["/init.sh", "serve"]}`, []interface{}{"/w/w"}, []interface{}{"/init.sh", "serve"}},
+	} {
+		i := newTestCreateInterceptor(Config{WithoutDNS: true, WaitPosition: test.position})
+		container := interceptCreate(t, i, test.body)
+		assert.Equal(t, test.entrypoint, container["Entrypoint"], test.position+" "+test.body)
+		assert.Equal(t, test.cmd, container["Cmd"], test.position+" "+test.body)
+	}
+
+	_, err := newTestProxy(Config{WaitPosition: "append"}, nil)
+	assert.Error(t, err)
+}
+
+func TestWaitForDNS(t *testing.T) {
+	for _, test := range []struct {
+		config     Config
+		body       string
+		entrypoint []interface{}
+	}{
+		{Config{WaitForDNS: true}, `{"Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/w", "--wait-dns=foo.weave.local", "/bin/sh"}},
+		{Config{WaitForDNS: true, WaitTimeout: time.Minute}, `{"Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/w", "--wait-dns=foo.weave.local", "--wait-timeout=1m0s", "/bin/sh"}},
+		{Config{WaitForDNS: true, WaitPosition: "wrap"}, `{"Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/w", "--wait-dns=foo.weave.local"}},
+		{Config{WaitForDNS: true}, `{"Entrypoint": ["/bin/sh"], "Hostname": "web", "Domainname": "tenant.weave.local"}`, []interface{}{"/w/w", "--wait-dns=web.tenant.weave.local", "/bin/sh"}},
+		{Config{WaitForDNS: true}, `{"Entrypoint": ["/w/w", "--wait-dns=foo.weave.local", "/bin/sh"]}`, []interface{}{"/w/w", "--wait-dns=foo.weave.local", "/bin/sh"}},
+		{Config{WaitForDNS: true}, `{"Entrypoint": ["/bin/sh"], "Labels": {"works.weave.no-wait": "true"}}`, []interface{}{"/bin/sh"}},
+		{Config{}, `{"Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/w", "/bin/sh"}},
+		// our own arguments mean nothing to someone else's entrypoint
+		{Config{WaitForDNS: true, WaitTimeout: time.Minute, WaitEntrypoint: "/w/mywait"}, `{"Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/mywait", "/bin/sh"}},
+		{Config{WaitForDNS: true, WaitTimeout: time.Minute, WaitEntrypoint: "/w/mywait", WaitPosition: "wrap"}, `{"Entrypoint": ["/bin/sh"]}`, []interface{}{"/w/mywait"}},
+	} {
+		test.config.HostnameReplacement = "$1"
+		i := newTestCreateInterceptor(test.config)
+		i.proxy.dnsServers = []string{"172.17.0.1"}
+		i.proxy.dnsDomain.domain = "weave.local."
+		i.proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+		container := interceptCreate(t, i, test.body)
+		assert.Equal(t, test.entrypoint, container["Entrypoint"], test.body)
+	}
+
+	// nothing to wait for without weaveDNS
+	i := newTestCreateInterceptor(Config{WaitForDNS: true, WithoutDNS: true})
+	container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"]}`)
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, container["Entrypoint"])
+}
+
+func TestCreateWithEnv(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, Env: []string{"WEAVE_NODE=host1", "TZ=UTC"}})
+	for body, env := range map[string][]interface{}{
+		`{"Image": "busybox", "Entrypoint": ["/bin/sh"]}`:                                     {"WEAVE_NODE=host1", "TZ=UTC"},
+		`{"Image": "busybox", "Entrypoint": ["/bin/sh"], "Env": ["TZ=Europe/London", "A=1"]}`: {"TZ=Europe/London", "A=1", "WEAVE_NODE=host1"},
+		`{"Image": "busybox", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_NODE=", "TZ=UTC"]}`:   {"WEAVE_NODE=", "TZ=UTC"},
+		`{"Image": "busybox", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.1/24"]}`:  {"WEAVE_CIDR=10.2.1.1/24", "WEAVE_NODE=host1", "TZ=UTC"},
+	} {
+		container := interceptCreate(t, i, body)
+		assert.Equal(t, env, container["Env"], body)
+	}
+
+	// only containers on the weave network
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image": "busybox", "HostConfig": {"NetworkMode": "host"}}`))
+	require.NoError(t, i.InterceptRequest(r))
+	container := jsonObject{}
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+	assert.Nil(t, container["Env"])
+
+	_, err := newTestProxy(Config{Env: []string{"WEAVE_NODE"}}, nil)
+	assert.Error(t, err)
+	// which would change what we do with the container between its
+	// create and its start
+	for _, env := range []string{"WEAVE_CIDR=10.2.1.1/24", "WEAVE_DNS=off", "WEAVE_DNS_DOMAIN=tenant.local", "WEAVE_NO_WAIT=1"} {
+		_, err := newTestProxy(Config{Env: []string{env}}, nil)
+		assert.Error(t, err, env)
+	}
+}
+
+func TestCreateWindowsContainer(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, FailClosed: true})
+	for _, test := range []struct{ query, body string }{
+		{"?platform=windows", `{"Image": "mcr.microsoft.com/windows/nanoserver", "Cmd": ["cmd.exe"]}`},
+		{"", `{"Image": "nanoserver", "Platform": "windows/amd64", "Cmd": ["cmd.exe"]}`},
+		{"", `{"Image": "nanoserver", "Cmd": ["cmd.exe"], "HostConfig": {"Isolation": "hyperv", "Binds": ["C:\\data:C:\\data"]}}`},
+		{"", `{"Image": "nanoserver", "Cmd": ["cmd.exe"], "HostConfig": {"Isolation": "Process"}}`},
+		// whatever it may ask of weave, which is meaningless for it
+		{"", `{"Image": "nanoserver", "Platform": "windows/amd64", "Cmd": ["cmd.exe"], "Env": ["WEAVE_CIDR=10.2.1.300/24"]}`},
+		{"?platform=windows", `{"Image": "nanoserver", "Cmd": ["cmd.exe"], "Env": "WEAVE_CIDR=10.2.1.1/24"}`},
+	} {
+		r := httptest.NewRequest("POST", "/v1.24/containers/create"+test.query, strings.NewReader(test.body))
+		require.NoError(t, i.InterceptRequest(r), "left alone, even with --fail-closed")
+		forwarded, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, test.body, string(forwarded), test.query+" "+test.body)
+	}
+
+	container := interceptCreate(t, i, `{"Image": "busybox", "Entrypoint": ["/bin/sh"], "HostConfig": {"Isolation": "default"}}`)
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, container["Entrypoint"], "a Linux container")
+}
+
+func TestCreateLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(out io.Writer, level logrus.Level) {
+		Log.Out, Log.Level = out, level
+		common.SetLogFormat("text")
+	}(Log.Out, Log.Level)
+	Log.Out, Log.Level = &buf, logrus.InfoLevel
+	common.SetLogFormat("json")
+
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	interceptCreate(t, i, `{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.1/24"]}`)
+	// below the level, so not logged
+	interceptCreate(t, i, `{"Image": "busybox", "HostConfig": {"NetworkMode": "host"}}`)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1, buf.String())
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "foo", entry["name"])
+	assert.Equal(t, "nginx", entry["image"])
+	assert.Equal(t, "10.2.1.1/24", entry["weave_cidr"])
+	assert.Contains(t, entry["msg"], "Creating container")
+
+	buf.Reset()
+	Log.Level = logrus.DebugLevel
+	interceptCreate(t, i, `{"Image": "busybox", "HostConfig": {"NetworkMode": "host"}}`)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if strings.HasPrefix(entry["msg"].(string), "Leaving container alone") {
+			break
+		}
+	}
+	assert.Equal(t, "debug", entry["level"])
+	assert.Equal(t, "busybox", entry["image"])
+	assert.Contains(t, entry["msg"], "--net=host")
+}
+
+func TestValidateWaitEntrypoint(t *testing.T) {
+	assert.NoError(t, validateWaitEntrypoint(""))
+	assert.NoError(t, validateWaitEntrypoint("/w/w -timeout 60s"))
+	assert.Error(t, validateWaitEntrypoint("  "))
+}
+
+func TestSkipNetworkMode(t *testing.T) {
+	proxy := &Proxy{Config: Config{WeaveWaitMountPath: "/w"}}
+	i := &createContainerInterceptor{proxy: proxy}
+
+	for _, mode := range []string{"host", "container:abc123"} {
+		body := `{"Image":"busybox","Entrypoint":["/bin/sh"],"HostConfig":{"NetworkMode":"` + mode + `"}}`
+		r := httptest.NewRequest("POST", "/v1.24/containers/create?name=foo", strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r))
+		got, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(got), mode)
+	}
+}
+
+func TestNoWeaveWait(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, HostnameReplacement: "$1"})
+	for _, body := range []string{
+		`{"Image":"busybox","Entrypoint":["/sbin/tini","--"],"Labels":{"works.weave.no-wait":""}}`,
+		`{"Image":"busybox","Entrypoint":["/sbin/tini","--"],"Env":["WEAVE_NO_WAIT=1"]}`,
+	} {
+		container := interceptCreate(t, i, body)
+		assert.Equal(t, []interface{}{"/sbin/tini", "--"}, container["Entrypoint"], body)
+		hostConfig, err := container.Object("HostConfig")
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{"/var/lib/weavewait:/w:ro"}, hostConfig["Binds"], body)
+	}
+}
+
+func TestSkippedContainerIsNotFullyDecoded(t *testing.T) {
+	i := newTestCreateInterceptor(Config{})
+	binds := make([]string, 1000)
+	for n := range binds {
+		binds[n] = fmt.Sprintf("/data/%d:/data/%d:ro", n, n)
+	}
+	bindsJSON, _ := json.Marshal(binds)
+	body := `{"Image":"busybox","Env":["A=1"],"HostConfig":{"NetworkMode":"host","Binds":` + string(bindsJSON) + `}}`
+
+	skipped := testing.AllocsPerRun(10, func() {
+		r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r))
+		got, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, body, string(got))
+	})
+	decoded := testing.AllocsPerRun(10, func() {
+		container := jsonObject{}
+		require.NoError(t, unmarshalBody([]byte(body), &container))
+	})
+	t.Logf("allocations for a skipped container: %v, for decoding it in full: %v", skipped, decoded)
+	assert.True(t, skipped < decoded/2, "skipping a container should not cost a full decode")
+}
+
+func TestNormaliseHostname(t *testing.T) {
+	for name, hostname := range map[string]string{
+		"":                 "",
+		"web":              "web",
+		"myproject_web_1":  "myproject-web-1",
+		"/myproject_web_1": "myproject-web-1",
+		"//foo":            "foo",
+		"_foo_":            "foo",
+		"foo.bar":          "foo.bar",
+		"foo@bar!":         "foo-bar",
+	} {
+		assert.Equal(t, hostname, normaliseHostname(name), name)
+	}
+}
+
+func TestContainerHostnameIsNormalised(t *testing.T) {
+	i := newTestCreateInterceptor(Config{HostnameReplacement: "$1"})
+	r := httptest.NewRequest("POST", "/v1.24/containers/create?name=myproject_web_1", nil)
+	hostname, err := i.containerHostname(r, jsonObject{})
+	require.NoError(t, err)
+	assert.Equal(t, "myproject-web-1", hostname)
+}
+
+func TestCheckHostname(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	tests := []struct {
+		hostname, domainname string
+		ok                   bool
+	}{
+		{"foo", "weave.local", true},
+		{"foo", "", true},
+		// longer than the old 64-byte limit, but still valid
+		{label63, "weave.local", true},
+		{label63 + "a", "weave.local", false},
+		{"foo", label63 + "a.local", false},
+		{"foo", strings.Join([]string{label63, label63, label63}, "."), true},
+		{"foo", strings.Join([]string{label63, label63, label63, label63}, "."), false},
+	}
+	for _, test := range tests {
+		err := checkHostname(test.hostname, test.domainname)
+		assert.Equal(t, test.ok, err == nil, "%s.%s: %v", test.hostname, test.domainname, err)
+		if err != nil {
+			invalid, ok := err.(*ErrInvalidDNSName)
+			require.True(t, ok, "%T", err)
+			assert.Equal(t, strings.TrimSuffix(test.hostname+"."+test.domainname, "."), invalid.Name)
+		}
+	}
+}
+
+func TestSetHostnameLimits(t *testing.T) {
+	i := newTestCreateInterceptor(Config{})
+	long := strings.Repeat("a", 70)
+
+	container := jsonObject{}
+	require.NoError(t, i.setHostname(container, long[:63], "weave.local."))
+	assert.Equal(t, long[:63], container["Hostname"])
+	assert.Equal(t, "weave.local", container["Domainname"])
+
+	container = jsonObject{}
+	require.NoError(t, i.setHostname(container, long, "weave.local."))
+	assert.NotContains(t, container, "Hostname")
+	assert.NotContains(t, container, "Domainname")
+}
+
+func TestDerivedMAC(t *testing.T) {
+	for ip, mac := range map[string]string{
+		"10.32.0.1":   "02:57:0a:20:00:01",
+		"10.2.1.255":  "02:57:0a:02:01:ff",
+		"fd00::a01:1": "02:57:0a:01:00:01",
+	} {
+		assert.Equal(t, mac, derivedMAC(net.ParseIP(ip)).String(), ip)
+		assert.Equal(t, derivedMAC(net.ParseIP(ip)), derivedMAC(net.ParseIP(ip)), "same IP must always give the same MAC")
+	}
+	assert.NotEqual(t, derivedMAC(net.ParseIP("10.32.0.1")), derivedMAC(net.ParseIP("10.32.0.2")))
+}
+
+func TestSetDerivedMAC(t *testing.T) {
+	tests := []struct {
+		cidrs []string
+		user  string
+		mac   interface{}
+	}{
+		{[]string{"10.2.1.1/24"}, "", "02:57:0a:02:01:01"},
+		{[]string{"net:10.2.2.0/24", "ip:10.2.1.7/24"}, "", "02:57:0a:02:01:07"},
+		{[]string{"10.2.1.1/24"}, "02:00:00:00:00:01", "02:00:00:00:00:01"},
+		// allocated by IPAM later, so nothing to derive from yet
+		{nil, "", nil},
+		{[]string{"net:default"}, "", nil},
+	}
+	for _, test := range tests {
+		container := jsonObject{}
+		if test.user != "" {
+			container["MacAddress"] = test.user
+		}
+		require.NoError(t, setDerivedMAC(container, test.cidrs))
+		assert.Equal(t, test.mac, container["MacAddress"], "cidrs %q", test.cidrs)
+	}
+}
+
+func TestCreateAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	i.proxy.auditLog = logrus.New()
+	i.proxy.auditLog.Out = &buf
+	i.proxy.auditLog.Formatter = &logrus.JSONFormatter{}
+
+	r := httptest.NewRequest("POST", "/v1.24/containers/create?name=web", strings.NewReader(`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.1/24"]}`))
+	require.NoError(t, i.InterceptRequest(r))
+	assert.Equal(t, 0, buf.Len(), "nothing to log until the container exists")
+
+	resp := &http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"Id": "4f1c7a", "Warnings": null}`)),
+		Request:    r,
+	}
+	require.NoError(t, i.InterceptResponse(resp))
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "create", entry["event"])
+	assert.Equal(t, "4f1c7a", entry["id"])
+	assert.Equal(t, "web", entry["name"])
+	assert.Equal(t, "nginx", entry["image"])
+	assert.Equal(t, "10.2.1.1/24", entry["weave_cidr"])
+
+	// the client must still see Docker's response, and is told the
+	// container's addresses
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "4f1c7a")
+	assert.Equal(t, "10.2.1.1/24", resp.Header.Get("X-Weave-CIDR"))
+}
+
+func TestCreateCIDRHeader(t *testing.T) {
+	for body, header := range map[string]string{
+		`{"Entrypoint": ["/bin/sh"]}`: "net:default",
+		`{"Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.1/24 net:10.2.2.0/24"]}`: "10.2.1.1/24 net:10.2.2.0/24",
+		`{"Entrypoint": ["/bin/sh"], "Labels": {"works.weave.cidr": "ip:10.2.3.4/24"}}`:  "ip:10.2.3.4/24",
+		`{"Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=none"]}`:                        "", // not ours
+	} {
+		i := newTestCreateInterceptor(Config{WithoutDNS: true})
+		r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r))
+		resp := &http.Response{
+			StatusCode: http.StatusCreated,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"Id": "4f1c7a"}`)),
+			Request:    r,
+		}
+		require.NoError(t, i.InterceptResponse(resp))
+		assert.Equal(t, header, resp.Header.Get(weaveCIDRHeader), body)
+		_, present := resp.Header[http.CanonicalHeaderKey(weaveCIDRHeader)]
+		assert.Equal(t, header != "", present, body)
+	}
+}
+
+func TestCreateAuditLogSkipsUntouchedContainers(t *testing.T) {
+	var buf bytes.Buffer
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	i.proxy.auditLog = logrus.New()
+	i.proxy.auditLog.Out = &buf
+
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image": "nginx", "HostConfig": {"NetworkMode": "host"}}`))
+	require.NoError(t, i.InterceptRequest(r))
+	require.NoError(t, i.InterceptResponse(&http.Response{StatusCode: http.StatusCreated, Body: ioutil.NopCloser(strings.NewReader(`{"Id": "4f1c7a"}`))}))
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestGzippedCreateBody(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	gzipRequest := func(body string) *http.Request {
+		compressed, err := gzipBytes([]byte(body))
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", "/v1.24/containers/create", bytes.NewReader(compressed))
+		r.Header.Set("Content-Encoding", "gzip")
+		return r
+	}
+
+	r := gzipRequest(`{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`)
+	require.NoError(t, i.InterceptRequest(r))
+	assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+	compressed, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(compressed)), r.ContentLength)
+	body, err := gunzip(compressed)
+	require.NoError(t, err)
+	container := jsonObject{}
+	require.NoError(t, json.Unmarshal(body, &container))
+	entrypoint, err := container.StringArray("Entrypoint")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/w/w", "/bin/sh"}, entrypoint)
+	assert.Equal(t, "nginx", container["Image"])
+
+	// left alone: forwarded exactly as sent, still compressed
+	original, err := gzipBytes([]byte(`{"Image": "nginx", "HostConfig": {"NetworkMode": "host"}}`))
+	require.NoError(t, err)
+	r = gzipRequest(`{"Image": "nginx", "HostConfig": {"NetworkMode": "host"}}`)
+	require.NoError(t, i.InterceptRequest(r))
+	forwarded, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, original, forwarded)
+}
+
+func TestDryRun(t *testing.T) {
+	i := newTestCreateInterceptor(Config{DryRun: true, WithoutDNS: true})
+	for _, body := range []string{
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.1/24"]}`,
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "HostConfig": {"Binds": ["/tmp:/tmp"]}}`,
+	} {
+		r := httptest.NewRequest("POST", "/v1.24/containers/create?name=web", strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r))
+		forwarded, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(forwarded))
+		assert.Nil(t, i.audit, "nothing was changed, so nothing to audit")
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	before := jsonObject{"Image": "nginx", "Entrypoint": []interface{}{"/bin/sh"}, "HostConfig": map[string]interface{}{"Binds": []interface{}{"/tmp:/tmp"}}}
+	after := jsonObject{
+		"Image":      "nginx",
+		"Entrypoint": []string{"/w/w", "/bin/sh"},
+		"HostConfig": jsonObject{"Binds": []string{"/tmp:/tmp", "/var/lib/weavewait:/w:ro"}, "Dns": []string{"172.17.0.1"}},
+		"Hostname":   "web",
+	}
+	changes, err := diffJSON("", before, after)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`Entrypoint to ["/w/w","/bin/sh"] (was ["/bin/sh"])`,
+		`HostConfig.Binds to ["/tmp:/tmp","/var/lib/weavewait:/w:ro"] (was ["/tmp:/tmp"])`,
+		`HostConfig.Dns to ["172.17.0.1"] (was null)`,
+		`Hostname to "web" (was null)`,
+	}, changes)
+}
+
+func TestCreatePreservesUnknownFields(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image":"nginx","Entrypoint":["/bin/sh"],"FutureField":{"z":1,"a":[1.0]},"StopTimeout":10}`))
+	require.NoError(t, i.InterceptRequest(r))
+	forwarded, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"Image":"nginx","Entrypoint":["/w/w","/bin/sh"],"FutureField":{"z":1,"a":[1.0]},"StopTimeout":10,"HostConfig":{"Binds":["/var/lib/weavewait:/w:ro"]},"Labels":{"works.weave.managed":"true","works.weave.managed.cidr":"net:default"}}`, string(forwarded))
+}
+
+func TestCreatePreservesHostConfig(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	// FutureHostField is in no version of docker.HostConfig
+	hostConfig := `{"LogConfig":{"Type":"fluentd","Config":{"fluentd-address":"localhost:24224","tag":"docker.{{.Name}}"}},"FutureHostField":{"b":[2,1],"a":1e3},"Binds":["/data:/data"],"ShmSize":67108864}`
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image":"nginx","Entrypoint":["/bin/sh"],"HostConfig":`+hostConfig+`}`))
+	require.NoError(t, i.InterceptRequest(r))
+	forwarded, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(forwarded), `"HostConfig":{"LogConfig":{"Type":"fluentd","Config":{"fluentd-address":"localhost:24224","tag":"docker.{{.Name}}"}},"FutureHostField":{"b":[2,1],"a":1e3},"Binds":["/data:/data","/var/lib/weavewait:/w:ro"],"ShmSize":67108864}`)
+}
+
+func TestCreateWithWeaveCIDRNone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/sidecar/json" {
+			fmt.Fprintf(w, `{"Id": "a1", "Config": {"Cmd": ["envoy"], "Labels": {%q: "none"}}}`, weaveCIDRLabel)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+
+	// Everything the proxy might add to a container, were it going on weave
+	i := newTestCreateInterceptor(Config{HostnameReplacement: "$1", FailClosed: true, Init: true, ExtraHosts: []string{"db:10.32.0.9"}})
+	i.proxy.client = &weavedocker.Client{Client: dc}
+	i.proxy.dnsServers = []string{"172.17.0.1"}
+	i.proxy.dnsDomain.domain = "weave.local."
+	i.proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+
+	container := interceptCreate(t, i, `{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`)
+	require.Contains(t, container, "Hostname", "would have been changed without WEAVE_CIDR=none")
+
+	for _, body := range []string{
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=none"]}`,
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Labels": {"works.weave.cidr": "none"}}`,
+		`{"Image": "sidecar", "HostConfig": {"NetworkMode": "container:web"}}`,
+		`{"Image": "sidecar"}`,
+	} {
+		r := httptest.NewRequest("POST", "/v1.25/containers/create?name=foo", strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r), "deliberately left alone, so not refused even when failing closed")
+		forwarded, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(forwarded))
+	}
+}
+
+func TestCreateWithDNSDomainOverride(t *testing.T) {
+	i := newTestCreateInterceptor(Config{HostnameReplacement: "$1"})
+	i.proxy.dnsServers = []string{"172.17.0.1"}
+	i.proxy.dnsDomain.domain = "weave.local."
+	i.proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+
+	container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "Env": ["WEAVE_DNS_DOMAIN=tenant-a.weave.local"]}`)
+	assert.Equal(t, "foo", container["Hostname"])
+	assert.Equal(t, "tenant-a.weave.local", container["Domainname"])
+}
+
+func TestCreateWithWeaveDNSOverride(t *testing.T) {
+	for _, test := range []struct {
+		withoutDNS bool
+		servers    []string
+		env        []string
+		usesDNS    bool
+	}{
+		{false, []string{"172.17.0.1"}, nil, true},
+		{false, []string{"172.17.0.1"}, []string{"WEAVE_DNS=off"}, false},
+		{false, []string{"172.17.0.1"}, []string{"WEAVE_DNS=maybe"}, true},
+		{true, []string{"172.17.0.1"}, nil, false},
+		{true, []string{"172.17.0.1"}, []string{"WEAVE_DNS=on"}, true},
+		{true, []string{"172.17.0.1"}, []string{"WEAVE_DNS=ON"}, true},
+		// Docker keeps the last of duplicates
+		{true, []string{"172.17.0.1"}, []string{"WEAVE_DNS=off", "WEAVE_DNS=on"}, true},
+		{false, []string{"172.17.0.1"}, []string{"WEAVE_DNS=on", "WEAVE_DNS=off"}, false},
+		// nowhere to point the container at
+		{true, nil, []string{"WEAVE_DNS=on"}, false},
+	} {
+		i := newTestCreateInterceptor(Config{HostnameReplacement: "$1", WithoutDNS: test.withoutDNS})
+		i.proxy.dnsServers = test.servers
+		i.proxy.dnsDomain.domain = "weave.local."
+		i.proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+
+		body := `{"Entrypoint": ["/bin/sh"]}`
+		if test.env != nil {
+			body = `{"Entrypoint": ["/bin/sh"], "Env": ["` + strings.Join(test.env, `", "`) + `"]}`
+		}
+		container := interceptCreate(t, i, body)
+		hostConfig, err := container.Object("HostConfig")
+		require.NoError(t, err)
+		context := fmt.Sprintf("without-dns %v, %q", test.withoutDNS, test.env)
+		if test.usesDNS {
+			assert.Equal(t, "weave.local", container["Domainname"], context)
+			assert.Equal(t, []interface{}{"172.17.0.1"}, hostConfig["Dns"], context)
+		} else {
+			assert.NotContains(t, container, "Domainname", context)
+			assert.NotContains(t, hostConfig, "Dns", context)
+		}
+	}
+}
+
+func TestInterceptCreateTwice(t *testing.T) {
+	// e.g. a proxy in front of another proxy: the second must find
+	// nothing left to do
+	for _, body := range []string{
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`,
+		`{"Image": "nginx", "Entrypoint": ["nginx"], "HostConfig": {"Binds": ["/data:/data"], "Dns": ["8.8.8.8"], "DnsSearch": ["corp.example.com"]}}`,
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Hostname": "web", "Env": ["WEAVE_CIDR=10.2.1.1/24"]}`,
+	} {
+		i := newTestCreateInterceptor(Config{HostnameReplacement: "$1", DNSOptions: []string{"ndots:0"}, ExtraHosts: []string{"db:10.32.0.9"}, DeriveMAC: true})
+		i.proxy.dnsServers = []string{"172.17.0.1", "fd00::1"}
+		i.proxy.dnsDomain.domain = "weave.local."
+		i.proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+
+		r := httptest.NewRequest("POST", "/v1.24/containers/create?name=foo", strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r))
+		once, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		i = &createContainerInterceptor{proxy: i.proxy}
+		r = httptest.NewRequest("POST", "/v1.24/containers/create?name=foo", bytes.NewReader(once))
+		require.NoError(t, i.InterceptRequest(r))
+		twice, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, string(once), string(twice), body)
+	}
+}
+
+func TestManagedLabels(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, ExcludeImages: []string{"postgres"}})
+	for body, labels := range map[string]map[string]interface{}{
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`: {
+			weaveManagedLabel: "true", weaveManagedCIDRLabel: "net:default",
+		},
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.1/24 net:10.2.2.0/24"], "Labels": {"app": "web"}}`: {
+			"app": "web", weaveManagedLabel: "true", weaveManagedCIDRLabel: "10.2.1.1/24 net:10.2.2.0/24",
+		},
+		// left alone, so not ours
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=none"]}`:             nil,
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "HostConfig": {"NetworkMode": "host"}}`:  nil,
+		`{"Image": "postgres", "Entrypoint": ["/bin/sh"], "Labels": {"app": "db"}}`:             {"app": "db"},
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Labels": {"works.weave.cidr": "none"}}`: {weaveCIDRLabel: "none"},
+	} {
+		container := interceptCreate(t, i, body)
+		if labels == nil {
+			assert.NotContains(t, container, "Labels", body)
+		} else {
+			assert.Equal(t, labels, container["Labels"], body)
+		}
+	}
+}
+
+func TestCreateClientGoesAway(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `{"Id": "sha256:4f1c7a", "Config": {"Cmd": ["nginx"]}}`)
+	}))
+	defer ts.Close()
+	defer close(release)
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	i.proxy.client = &weavedocker.Client{Client: dc}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image": "nginx"}`)).WithContext(ctx)
+	errs := make(chan error, 1)
+	go func() { errs <- i.InterceptRequest(r) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errs:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("interception carried on waiting for Docker after the client went away")
+	}
+}
+
+func TestFailClosed(t *testing.T) {
+	const invalid = `{"Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.300/24"]}`
+
+	// fail open: the container is created, off the weave network
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(invalid))
+	require.NoError(t, i.InterceptRequest(r))
+	forwarded, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, invalid, string(forwarded))
+
+	// fail closed: the create is refused, saying why
+	i = newTestCreateInterceptor(Config{WithoutDNS: true, FailClosed: true})
+	r = httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(invalid))
+	err = i.InterceptRequest(r)
+	require.IsType(t, &ErrFailClosed{}, err)
+	assert.Equal(t, &ErrInvalidCIDR{"10.2.1.300/24"}, err.(*ErrFailClosed).Err)
+	assert.Contains(t, err.Error(), "--fail-closed")
+	assert.Contains(t, err.Error(), `invalid WEAVE_CIDR entry "10.2.1.300/24"`)
+
+	// opting out of weave is still honoured when failing closed
+	for _, body := range []string{
+		`{"Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=none"]}`,
+		`{"Entrypoint": ["/bin/sh"], "HostConfig": {"NetworkMode": "host"}}`,
+	} {
+		r = httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+		assert.NoError(t, i.InterceptRequest(r), body)
+	}
+}
+
+func TestNoCommandLeavesBodyUnchanged(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// an image with neither Entrypoint nor Cmd
+		fmt.Fprint(w, `{"Id": "sha256:4f1c7a", "Config": {}}`)
+	}))
+	defer ts.Close()
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+
+	i := newTestCreateInterceptor(Config{HostnameReplacement: "$1"})
+	i.proxy.client = &weavedocker.Client{Client: dc}
+	i.proxy.dnsServers = []string{"172.17.0.1"}
+	i.proxy.dnsDomain.domain = "weave.local."
+	i.proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+
+	const body = `{"Image": "scratch-based", "HostConfig": {"Binds": ["/tmp:/tmp"]}}`
+	r := httptest.NewRequest("POST", "/v1.24/containers/create?name=foo", strings.NewReader(body))
+	require.NoError(t, i.InterceptRequest(r))
+	forwarded, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(forwarded), "no volume, DNS or hostname changes may leak through")
+	assert.Nil(t, i.audit)
+}
+
+func TestDNSAliasRegistration(t *testing.T) {
+	var mu sync.Mutex
+	var registered []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		mu.Lock()
+		entry := r.URL.Path + " " + r.Form.Get("fqdn")
+		if r.Form.Get("alias") == "true" {
+			entry += " (alias)"
+		}
+		registered = append(registered, entry)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	proxy := i.proxy
+	proxy.weave = weaveapi.NewClient(strings.TrimPrefix(ts.URL, "http://"), Log)
+	proxy.aliases = make(map[string][]string)
+
+	create := func(id, body string) {
+		i := &createContainerInterceptor{proxy: proxy}
+		r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r))
+		require.NoError(t, i.InterceptResponse(&http.Response{
+			StatusCode: http.StatusCreated,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"Id": "` + id + `"}`)),
+			Request:    r,
+		}))
+	}
+	create("web1", `{"Entrypoint": ["/bin/sh"], "NetworkingConfig": {"EndpointsConfig": {"default": {"Aliases": ["web", "frontend"], "DNSNames": ["project_web_1", "web", "web1"]}}}}`)
+	create("web2", `{"Entrypoint": ["/bin/sh"], "NetworkingConfig": {"EndpointsConfig": {"default": {"Aliases": ["web"]}}}}`)
+	assert.Equal(t, []string{"web", "frontend", "project_web_1", "web1"}, proxy.dnsAliases("web1"))
+
+	_, ip1, _ := net.ParseCIDR("10.32.0.1/12")
+	_, ip2, _ := net.ParseCIDR("10.32.0.2/12")
+	ip1.IP, ip2.IP = net.ParseIP("10.32.0.1"), net.ParseIP("10.32.0.2")
+	require.NoError(t, proxy.registerWithDNS("web1", "project_web_1.weave.local", "weave.local", []*net.IPNet{ip1}))
+	require.NoError(t, proxy.registerWithDNS("web2", "project_web_2.weave.local", "weave.local", []*net.IPNet{ip2}))
+
+	// "web" is registered by both, so resolves round-robin to either;
+	// reverse lookups give the containers' own names
+	assert.Equal(t, []string{
+		"/name/web1/10.32.0.1 project_web_1.weave.local",
+		"/name/web1/10.32.0.1 web.weave.local (alias)",
+		"/name/web1/10.32.0.1 frontend.weave.local (alias)",
+		"/name/web1/10.32.0.1 web1.weave.local (alias)",
+		"/name/web2/10.32.0.2 project_web_2.weave.local",
+		"/name/web2/10.32.0.2 web.weave.local (alias)",
+	}, registered)
+
+	proxy.ContainerDestroyed("web1")
+	assert.Empty(t, proxy.dnsAliases("web1"))
+}
+
+func TestNetworkAliases(t *testing.T) {
+	for body, aliases := range map[string][]string{
+		`{}`: nil,
+		`{"NetworkingConfig": {"EndpointsConfig": {"b": {"Aliases": ["web", "db"]}, "a": {"Aliases": ["web", "cache"]}}}}`: {"web", "cache", "db"},
+		`{"NetworkingConfig": {"EndpointsConfig": {"a": {"Aliases": null}}}}`:                                              nil,
+		`{"NetworkingConfig": {"EndpointsConfig": {"a": {"Aliases": ["web"], "DNSNames": ["web_1", "3e5f9b0a", "web"]}}}}`: {"web", "web_1", "3e5f9b0a"},
+		`{"NetworkingConfig": {"EndpointsConfig": {"a": {"DNSNames": ["db", "db_1"]}, "b": {"DNSNames": ["db_1"]}}}}`:      {"db", "db_1"},
+	} {
+		container := jsonObject{}
+		require.NoError(t, unmarshalBody([]byte(body), &container))
+		got, err := networkAliases(container)
+		require.NoError(t, err)
+		assert.Equal(t, aliases, got, body)
+	}
+}
+
+func TestAddressInUse(t *testing.T) {
+	weave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/ip", r.URL.Path)
+		fmt.Fprint(w, `{"owned": [{"containerid": "4f1c7a", "addrs": ["10.2.1.1/24", "fd00::1/64"]}, {"containerid": "9b2e3d", "addrs": ["10.2.1.2/24"]}]}`)
+	}))
+	defer weave.Close()
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	i.proxy.weave = weaveapi.NewClient(strings.TrimPrefix(weave.URL, "http://"), Log)
+
+	for _, cidr := range []string{"10.2.1.1/24", "ip:10.2.1.2/24", "net:10.2.3.0/24 fd00::1/64"} {
+		body := `{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=` + cidr + `"]}`
+
+		// Left off weave, rather than given a duplicate address...
+		i.proxy.FailClosed = false
+		r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r))
+		forwarded, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(forwarded), cidr)
+
+		// ...or refused, if so configured
+		i.proxy.FailClosed = true
+		err = i.InterceptRequest(httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body)))
+		require.IsType(t, &ErrFailClosed{}, err, cidr)
+		assert.IsType(t, &ErrAddressInUse{}, err.(*ErrFailClosed).Err, cidr)
+	}
+
+	err := i.InterceptRequest(httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.2/24"]}`)))
+	assert.EqualError(t, err.(*ErrFailClosed).Err, "the WEAVE_CIDR address 10.2.1.2 is already in use by 9b2e3d")
+
+	// Free addresses and whole subnets are fine
+	for _, cidr := range []string{"10.2.1.3/24", "net:10.2.1.0/24"} {
+		container := interceptCreate(t, i, `{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=`+cidr+`"]}`)
+		assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, container["Entrypoint"], cidr)
+	}
+}
+
+func TestCreateByAPIVersion(t *testing.T) {
+	i := newTestCreateInterceptor(Config{HostnameReplacement: "$1", DNSOptions: []string{"ndots:0"}})
+	i.proxy.dnsServers = []string{"172.17.0.1"}
+	i.proxy.dnsDomain.domain = "weave.local."
+	i.proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+
+	without := jsonObject{"Dns": []interface{}{"172.17.0.1"}, "DnsSearch": []interface{}{"."}}
+	with := jsonObject{"Dns": []interface{}{"172.17.0.1"}, "DnsOptions": []interface{}{"ndots:0"}, "DnsSearch": []interface{}{"."}}
+	for _, test := range []struct {
+		path       string
+		hostConfig jsonObject
+		autoRemove bool
+	}{
+		// DnsOptions arrived in 1.21, AutoRemove in 1.25
+		{"/v1.20/containers/create", without, false},
+		{"/v1.21/containers/create", with, false},
+		{"/v1.24/containers/create", with, false},
+		{"/v1.25/containers/create", with, true},
+		{"/containers/create", with, true},
+	} {
+		r := httptest.NewRequest("POST", test.path+"?name=foo", strings.NewReader(`{"Entrypoint": ["/bin/sh"], "HostConfig": {"AutoRemove": true}}`))
+		require.NoError(t, i.InterceptRequest(r))
+		container := jsonObject{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+		hostConfig, err := container.Object("HostConfig")
+		require.NoError(t, err)
+		delete(hostConfig, "Binds")
+		delete(hostConfig, "AutoRemove")
+		assert.Equal(t, test.hostConfig, hostConfig, test.path)
+		assert.Equal(t, test.autoRemove, i.autoRemove, test.path)
+	}
+
+	// Docker matches field names case-insensitively, and so must we
+	container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "HostConfig": {"DNS": ["8.8.8.8"], "DNSSearch": ["example.com"]}}`)
+	hostConfig, err := container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"8.8.8.8", "172.17.0.1"}, hostConfig["DNS"])
+	assert.Equal(t, []interface{}{"example.com", "weave.local."}, hostConfig["DNSSearch"])
+	assert.NotContains(t, hostConfig, "Dns")
+	assert.NotContains(t, hostConfig, "DnsSearch")
+}
+
+func TestMergeExtraHosts(t *testing.T) {
+	ours := []string{"registry:10.32.0.1", "metrics:10.32.0.2"}
+	for _, test := range []struct {
+		user, merged []string
+	}{
+		{nil, []string{"registry:10.32.0.1", "metrics:10.32.0.2"}},
+		{[]string{"db:10.40.0.1"}, []string{"db:10.40.0.1", "registry:10.32.0.1", "metrics:10.32.0.2"}},
+		{[]string{"registry:192.168.1.5"}, []string{"registry:192.168.1.5", "metrics:10.32.0.2"}},
+	} {
+		assert.Equal(t, test.merged, mergeExtraHosts(test.user, ours), "user hosts %q", test.user)
+	}
+	assert.Equal(t, []string{"registry:10.32.0.1"}, mergeExtraHosts(nil, []string{"registry:10.32.0.1", "registry:10.32.0.9"}))
+}
+
+func TestCreateWithExtraHosts(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, ExtraHosts: []string{"registry:10.32.0.1", "metrics:fd00::2"}})
+	container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "HostConfig": {"ExtraHosts": ["metrics:192.168.1.5"]}}`)
+	hostConfig, err := container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"metrics:192.168.1.5", "registry:10.32.0.1"}, hostConfig["ExtraHosts"])
+
+	// containers kept off weave get nothing
+	container = interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=none"]}`)
+	assert.NotContains(t, container, "HostConfig")
+}
+
+func TestValidateExtraHosts(t *testing.T) {
+	assert.NoError(t, validateExtraHosts([]string{"registry:10.32.0.1", "metrics:fd00::2"}))
+	for _, entry := range []string{"registry", "registry:", ":10.32.0.1", "registry:10.32.0.300"} {
+		assert.Error(t, validateExtraHosts([]string{entry}), entry)
+	}
+}
+
+func TestCreateWithSysctls(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	var err error
+	i.proxy.sysctls, err = parseSysctls([]string{"net.ipv4.ip_forward=1", "net.ipv4.conf.all.rp_filter=0"})
+	require.NoError(t, err)
+
+	container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"]}`)
+	hostConfig, err := container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"net.ipv4.ip_forward": "1", "net.ipv4.conf.all.rp_filter": "0"}, hostConfig["Sysctls"])
+
+	// the user's own values win
+	container = interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "HostConfig": {"Sysctls": {"net.ipv4.ip_forward": "0", "net.core.somaxconn": "1024"}}}`)
+	hostConfig, err = container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"net.ipv4.ip_forward": "0", "net.core.somaxconn": "1024", "net.ipv4.conf.all.rp_filter": "0"}, hostConfig["Sysctls"])
+
+	// not before API 1.24, which had no Sysctls
+	r := httptest.NewRequest("POST", "/v1.23/containers/create", strings.NewReader(`{"Entrypoint": ["/bin/sh"]}`))
+	require.NoError(t, i.InterceptRequest(r))
+	container = jsonObject{}
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+	hostConfig, err = container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.NotContains(t, hostConfig, "Sysctls")
+}
+
+func TestCreateWithInit(t *testing.T) {
+	create := func(i *createContainerInterceptor, path, body string) jsonObject {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r))
+		container := jsonObject{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+		hostConfig, err := container.Object("HostConfig")
+		require.NoError(t, err)
+		return hostConfig
+	}
+
+	// off by default
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	assert.NotContains(t, create(i, "/v1.25/containers/create", `{"Entrypoint": ["/bin/sh"]}`), "Init")
+
+	i = newTestCreateInterceptor(Config{WithoutDNS: true, Init: true})
+	for _, test := range []struct {
+		path, body string
+		init       interface{}
+	}{
+		{"/v1.25/containers/create", `{"Entrypoint": ["/bin/sh"]}`, true},
+		{"/containers/create", `{"Entrypoint": ["/bin/sh"]}`, true},
+		{"/v1.25/containers/create", `{"Entrypoint": ["/bin/sh"], "HostConfig": {"Init": null}}`, true},
+		{"/v1.25/containers/create", `{"Entrypoint": ["/bin/sh"], "HostConfig": {"Init": false}}`, false},
+		{"/v1.25/containers/create", `{"Entrypoint": ["/bin/sh"], "HostConfig": {"Init": true}}`, true},
+		{"/v1.24/containers/create", `{"Entrypoint": ["/bin/sh"]}`, nil}, // no Init before 1.25
+	} {
+		hostConfig := create(i, test.path, test.body)
+		if test.init == nil {
+			assert.NotContains(t, hostConfig, "Init", test.path)
+		} else {
+			assert.Equal(t, test.init, hostConfig["Init"], "%s %s", test.path, test.body)
+		}
+	}
+}
+
+func TestCreateWithStaticAddress(t *testing.T) {
+	weave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ipinfo/defaultsubnet" {
+			fmt.Fprint(w, "10.32.0.0/12")
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer weave.Close()
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	i.proxy.weave = weaveapi.NewClient(strings.TrimPrefix(weave.URL, "http://"), Log)
+
+	withStatic := func(network, addr string) string {
+		return fmt.Sprintf(`"NetworkingConfig": {"EndpointsConfig": {%q: {"IPAMConfig": {"IPv4Address": %q}}}}`, network, addr)
+	}
+	for _, test := range []struct {
+		body string
+		cidr interface{}
+	}{
+		{`{"Entrypoint": ["/bin/sh"], ` + withStatic("weave", "10.32.0.7") + `}`, "10.32.0.7/12"},
+		// WEAVE_CIDR says what it wants itself
+		{`{"Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.1/24"], ` + withStatic("weave", "10.32.0.7") + `}`, nil},
+		// only the weave network's endpoint counts
+		{`{"Entrypoint": ["/bin/sh"], ` + withStatic("bridge", "172.17.0.9") + `}`, nil},
+		{`{"Entrypoint": ["/bin/sh"], "NetworkingConfig": {"EndpointsConfig": {"weave": {"IPAMConfig": null}}}}`, nil},
+	} {
+		container := interceptCreate(t, i, test.body)
+		labels, err := container.StringMap("Labels")
+		require.NoError(t, err)
+		if test.cidr == nil {
+			assert.NotContains(t, labels, weaveCIDRLabel, test.body)
+		} else {
+			assert.Equal(t, test.cidr, labels[weaveCIDRLabel], test.body)
+			assert.Equal(t, test.cidr, labels[weaveManagedCIDRLabel], test.body)
+		}
+	}
+
+	// Outside the subnet, it gets the same treatment as a bad WEAVE_CIDR
+	for _, addr := range []string{"192.168.1.7", "fd00::7"} {
+		container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], `+withStatic("weave", addr)+`}`)
+		assert.NotContains(t, container, "Labels", addr)
+	}
+	i.proxy.FailClosed = true
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Entrypoint": ["/bin/sh"], `+withStatic("weave", "192.168.1.7")+`}`))
+	assert.Equal(t, &ErrFailClosed{&ErrStaticAddress{Addr: "192.168.1.7", Subnet: "10.32.0.0/12"}}, i.InterceptRequest(r))
+	i.proxy.FailClosed = false
+
+	// Without default IPAM, a static address is enough to be attached
+	i.proxy.NoDefaultIPAM = true
+	i.proxy.AttachNetwork = "mynet"
+	container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], `+withStatic("mynet", "10.32.0.8")+`}`)
+	labels, err := container.StringMap("Labels")
+	require.NoError(t, err)
+	assert.Equal(t, "10.32.0.8/12", labels[weaveCIDRLabel])
+}
+
+func TestCreateBodyValidation(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	for body, message := range map[string]string{
+		`{"Image": "nginx", "Env": "PATH=/bin"}`:      "Wrong type for Env field, expected array of strings, but got a string",
+		`{"Image": "nginx", "Env": ["PATH=/bin", 5]}`: "Wrong type for Env field, expected array of strings, but got an array",
+		`{"Image": 5}`: "Wrong type for Image field, expected string, but got a number",
+		`{"Image": "nginx", "Labels": ["app=web"]}`:                                                  "Wrong type for Labels field, expected object of strings, but got an array",
+		`{"Image": "nginx", "HostConfig": "host"}`:                                                   "Wrong type for HostConfig field, expected object, but got a string",
+		`{"Image": "nginx", "HostConfig": {"NetworkMode": true}}`:                                    "Wrong type for HostConfig.NetworkMode field, expected string, but got a boolean",
+		`{"Image": "nginx", "HostConfig": {"dns": "8.8.8.8"}}`:                                       "Wrong type for HostConfig.dns field, expected array of strings, but got a string",
+		`{"Image": "nginx", "HostConfig": {"RestartPolicy": {"Name": 1}}}`:                           "Wrong type for HostConfig.RestartPolicy.Name field, expected string, but got a number",
+		`{"Image": "nginx", "HostConfig": {"Ulimits": ["nofile=1024"]}}`:                             "Wrong type for HostConfig.Ulimits field, expected array of objects, but got an array",
+		`{"Image": "nginx", "NetworkingConfig": {"EndpointsConfig": {"weave": 1}}}`:                  "Wrong type for NetworkingConfig.EndpointsConfig.weave field, expected object, but got a number",
+		`{"Image": "nginx", "NetworkingConfig": {"EndpointsConfig": {"weave": {"Aliases": "web"}}}}`: "Wrong type for NetworkingConfig.EndpointsConfig.weave.Aliases field, expected array of strings, but got a string",
+		`{"Image": "nginx", "NetworkingConfig": {"EndpointsConfig": {"weave": {"DNSNames": [1]}}}}`:  "Wrong type for NetworkingConfig.EndpointsConfig.weave.DNSNames field, expected array of strings, but got an array",
+	} {
+		r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+		err := i.InterceptRequest(r)
+		require.Error(t, err, body)
+		_, ok := errors.Cause(err).(*UnmarshalWrongTypeError)
+		assert.True(t, ok, "%s: %T", body, errors.Cause(err))
+		assert.Equal(t, "invalid create request: "+message, err.Error(), body)
+	}
+
+	// Lenient about anything we don't look at, and about what Docker
+	// itself accepts in more than one form
+	for _, body := range []string{
+		`{"Image": "nginx", "Entrypoint": "/bin/sh", "Cmd": null, "Volumes": {"/data": {}}, "Healthcheck": {"Test": ["NONE"]}}`,
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh", "-c"], "Cmd": ["nginx", "-g", "daemon off;"], "Env": null, "Labels": {}, "HostConfig": {"Memory": 1024}}`,
+		`{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Cmd": "nginx", "NetworkingConfig": {"EndpointsConfig": {"weave": {"IPAMConfig": null, "Links": null}}}}`,
+	} {
+		interceptCreate(t, i, body)
+	}
+}
+
+func TestParseSysctls(t *testing.T) {
+	sysctls, err := parseSysctls([]string{"net.ipv4.ip_forward=1", "net.ipv4.conf.eth0.rp_filter=2", "kernel.msgmax=65536"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"net.ipv4.ip_forward": "1", "net.ipv4.conf.eth0.rp_filter": "2", "kernel.msgmax": "65536"}, sysctls)
+	for _, entry := range []string{"net.ipv4.ip_forward", "net.ipv4.ip_forward=", "=1", "ip_forward=1", "net..ip_forward=1", "net.ipv4 .ip_forward=1"} {
+		_, err := parseSysctls([]string{entry})
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestCreateWithCapAdd(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	var err error
+	i.proxy.capAdd, err = parseCapabilities([]string{"NET_ADMIN", "cap_net_raw"})
+	require.NoError(t, err)
+
+	container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"]}`)
+	hostConfig, err := container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"NET_ADMIN", "NET_RAW"}, hostConfig["CapAdd"])
+
+	// however the user wrote those they asked for, they are not repeated
+	container = interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "HostConfig": {"CapAdd": ["SYS_TIME", "net_admin"]}}`)
+	hostConfig, err = container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"SYS_TIME", "net_admin", "NET_RAW"}, hostConfig["CapAdd"])
+
+	container = interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "HostConfig": {"CapAdd": ["ALL"]}}`)
+	hostConfig, err = container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"ALL"}, hostConfig["CapAdd"])
+}
+
+func TestParseCapabilities(t *testing.T) {
+	capabilities, err := parseCapabilities([]string{"NET_ADMIN", "cap_sys_time", "Net_Raw", "NET_ADMIN"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"NET_ADMIN", "SYS_TIME", "NET_RAW", "NET_ADMIN"}, capabilities)
+	assert.Equal(t, []string{"NET_ADMIN", "SYS_TIME", "NET_RAW"}, mergeCapabilities(nil, capabilities))
+
+	for _, entry := range []string{"", "NET_ADMN", "CAP_", "NET ADMIN"} {
+		_, err := parseCapabilities([]string{entry})
+		assert.Error(t, err, "capability %q", entry)
+	}
+}
+
+func TestCreateWithUlimits(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	var err error
+	i.proxy.ulimits, err = parseUlimits([]string{"nofile=65536:65536", "nproc=4096"})
+	require.NoError(t, err)
+
+	container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"]}`)
+	hostConfig, err := container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"Name": "nofile", "Soft": 65536.0, "Hard": 65536.0},
+		map[string]interface{}{"Name": "nproc", "Soft": 4096.0, "Hard": 4096.0},
+	}, hostConfig["Ulimits"])
+
+	// the user's own limits win
+	container = interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "HostConfig": {"Ulimits": [{"Name": "nofile", "Soft": 1024, "Hard": 2048}, {"Name": "core", "Soft": 0, "Hard": 0}]}}`)
+	hostConfig, err = container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"Name": "nofile", "Soft": 1024.0, "Hard": 2048.0},
+		map[string]interface{}{"Name": "core", "Soft": 0.0, "Hard": 0.0},
+		map[string]interface{}{"Name": "nproc", "Soft": 4096.0, "Hard": 4096.0},
+	}, hostConfig["Ulimits"])
+}
+
+func TestParseUlimits(t *testing.T) {
+	ulimits, err := parseUlimits([]string{"nofile=1024:65536", "nproc=4096", "core=0:0"})
+	require.NoError(t, err)
+	assert.Equal(t, []docker.ULimit{{Name: "nofile", Soft: 1024, Hard: 65536}, {Name: "nproc", Soft: 4096, Hard: 4096}, {Name: "core", Soft: 0, Hard: 0}}, ulimits)
+
+	for _, entry := range []string{"", "nofile", "nofile=", "files=1024", "nofile=lots", "nofile=1024:", "nofile=-1", "nofile=2048:1024", "nofile=1:2:3"} {
+		_, err := parseUlimits([]string{entry})
+		assert.Error(t, err, "ulimit %q", entry)
+	}
+	_, err = parseUlimits([]string{"nofile=1024", "nofile=2048"})
+	assert.Error(t, err, "the same ulimit twice")
+}
+
+func TestCreateWithReadonlyTmpfs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/stateful/json" {
+			fmt.Fprint(w, `{"Id": "a1", "Config": {"Volumes": {"/run/weave/": {}}}}`)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, ReadonlyTmpfs: "/run/weave:rw,size=1m"})
+	i.proxy.client = &weavedocker.Client{Client: dc}
+	for _, test := range []struct {
+		path, container, hostConfig string
+		tmpfs                       interface{}
+	}{
+		{"/v1.24", "", `{}`, nil},
+		{"/v1.24", "", `{"ReadonlyRootfs": false}`, nil},
+		{"/v1.24", "", `{"ReadonlyRootfs": true}`, map[string]interface{}{"/run/weave": "rw,size=1m"}},
+		{"/v1.24", "", `{"ReadonlyRootfs": true, "Tmpfs": {"/tmp": ""}}`, map[string]interface{}{"/run/weave": "rw,size=1m", "/tmp": ""}},
+		// the container's own mounts win
+		{"/v1.24", "", `{"ReadonlyRootfs": true, "Tmpfs": {"/run/weave": "size=2m"}}`, map[string]interface{}{"/run/weave": "size=2m"}},
+		{"/v1.24", "", `{"ReadonlyRootfs": true, "Binds": ["/srv/run:/run/weave"]}`, nil},
+		{"/v1.25", "", `{"ReadonlyRootfs": true, "Mounts": [{"Type": "volume", "Source": "run", "Target": "/run/weave"}]}`, nil},
+		{"/v1.25", "", `{"ReadonlyRootfs": true, "Mounts": [{"Type": "volume", "Source": "data", "Target": "/data"}]}`, map[string]interface{}{"/run/weave": "rw,size=1m"}},
+		{"/v1.24", `"Volumes": {"/run/weave": {}}, `, `{"ReadonlyRootfs": true}`, nil},
+		// as do its image's volumes
+		{"/v1.24", `"Image": "stateful", `, `{"ReadonlyRootfs": true}`, nil},
+		{"/v1.24", `"Image": "nginx", `, `{"ReadonlyRootfs": true}`, map[string]interface{}{"/run/weave": "rw,size=1m"}},
+		// not before API 1.22, which had no Tmpfs
+		{"/v1.21", "", `{"ReadonlyRootfs": true}`, nil},
+	} {
+		body := `{` + test.container + `"Entrypoint": ["/bin/sh"], "HostConfig": ` + test.hostConfig + `}`
+		r := httptest.NewRequest("POST", test.path+"/containers/create?name=foo", strings.NewReader(body))
+		require.NoError(t, i.InterceptRequest(r))
+		container := jsonObject{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+		hostConfig, err := container.Object("HostConfig")
+		require.NoError(t, err)
+		assert.Equal(t, test.tmpfs, hostConfig["Tmpfs"], "%s %s %s", test.path, test.container, test.hostConfig)
+	}
+}
+
+func TestParseTmpfs(t *testing.T) {
+	for entry, expected := range map[string]*tmpfsMount{
+		"":                      nil,
+		"/run/weave":            {path: "/run/weave"},
+		"/run/weave:rw,size=1m": {path: "/run/weave", options: "rw,size=1m"},
+	} {
+		mount, err := parseTmpfs(entry)
+		require.NoError(t, err, entry)
+		assert.Equal(t, expected, mount, entry)
+	}
+	for _, entry := range []string{"run", "/", "/run/", "/run/../etc", ":rw"} {
+		_, err := parseTmpfs(entry)
+		assert.Error(t, err, "tmpfs %q", entry)
+	}
+	_, err := newTestProxy(Config{ReadonlyTmpfs: "/w"}, nil)
+	assert.Error(t, err, "over weavewait")
+}
+
+func TestRawEntrypoint(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	r := httptest.NewRequest("POST", "/v1.24/containers/create?name=foo&weave-raw-entrypoint=1", strings.NewReader(`{"Entrypoint": ["/bin/sh"], "Labels": {"app": "web"}}`))
+	require.NoError(t, i.InterceptRequest(r))
+	container := jsonObject{}
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+	assert.Equal(t, []interface{}{"/bin/sh"}, container["Entrypoint"])
+	assert.Equal(t, map[string]interface{}{"app": "web", weaveNoWaitLabel: "", weaveManagedLabel: "true", weaveManagedCIDRLabel: "net:default"}, container["Labels"], "must still be attached on start")
+	hostConfig, err := container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"/var/lib/weavewait:/w:ro"}, hostConfig["Binds"])
+	assert.Equal(t, "name=foo", r.URL.RawQuery, "the parameter is ours, not Docker's")
+
+	for _, query := range []string{"", "?weave-raw-entrypoint=false"} {
+		r := httptest.NewRequest("POST", "/v1.24/containers/create"+query, strings.NewReader(`{"Entrypoint": ["/bin/sh"]}`))
+		require.NoError(t, i.InterceptRequest(r))
+		container := jsonObject{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+		assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, container["Entrypoint"], query)
+	}
+
+	r = httptest.NewRequest("POST", "/v1.24/containers/create?weave-raw-entrypoint=please", strings.NewReader(`{"Entrypoint": ["/bin/sh"]}`))
+	assert.Equal(t, &ErrInvalidQueryParam{"weave-raw-entrypoint", "please"}, i.InterceptRequest(r))
+}
+
+func TestMaxConcurrentCreates(t *testing.T) {
+	const limit, creates = 2, 6
+	var (
+		mu                  sync.Mutex
+		inFlight, maxFlight int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxFlight {
+			maxFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if r.URL.Path == "/images/broken/json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"Id": "sha256:4f1c7a", "Config": {"Cmd": ["nginx"]}}`)
+	}))
+	defer ts.Close()
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	i.proxy.client = &weavedocker.Client{Client: dc}
+	i.proxy.createSlots = make(chan struct{}, limit)
+
+	var wg sync.WaitGroup
+	for n := 0; n < creates; n++ {
+		// half of them fail, which must free their slot just the same
+		image := "nginx"
+		if n%2 == 0 {
+			image = "broken"
+		}
+		wg.Add(1)
+		go func(image string) {
+			defer wg.Done()
+			i := &createContainerInterceptor{proxy: i.proxy}
+			i.InterceptRequest(httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image": "`+image+`"}`)))
+		}(image)
+	}
+	wg.Wait()
+	assert.Equal(t, limit, maxFlight)
+	assert.Empty(t, i.proxy.createSlots)
+}
+
+func TestLimitCreatesGivesUpWithClient(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	i.proxy.createSlots = make(chan struct{}, 1)
+	done, err := i.proxy.limitCreates(context.Background())
+	require.NoError(t, err)
+
+	// queued behind the one in progress, then the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image": "nginx"}`)).WithContext(ctx)
+	result := make(chan error, 1)
+	go func() { result <- (&createContainerInterceptor{proxy: i.proxy}).InterceptRequest(r) }()
+	cancel()
+	select {
+	case err := <-result:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("create still queued after its client went away")
+	}
+
+	done()
+	assert.Empty(t, i.proxy.createSlots, "gave up without taking a slot")
+}
+
+func TestCreateWithNullConfigs(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	container := interceptCreate(t, i, `{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": null, "Labels": null, "HostConfig": null}`)
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, container["Entrypoint"])
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
 )
@@ -13,16 +14,16 @@ func (i *createExecInterceptor) InterceptRequest(r *http.Request) error {
 		return err
 	}
 
-	container, err := inspectContainerInPath(i.proxy.client, r.URL.Path)
+	container, err := inspectContainerInPath(r.Context(), i.proxy.client, r.URL.Path)
 	if err != nil {
 		return err
 	}
 
-	if _, hasWeaveWait := container.Volumes["/w"]; !hasWeaveWait {
+	if _, hasWeaveWait := container.Volumes[i.proxy.WeaveWaitMountPath]; !hasWeaveWait {
 		return nil
 	}
 
-	cidrs, err := i.proxy.weaveCIDRs(container.HostConfig.NetworkMode, container.Config.Env)
+	cidrs, err := i.proxy.weaveCIDRsFromConfig(r.Context(), container.Config, container.HostConfig)
 	if err != nil {
 		Log.Infof("Leaving container %s alone because %s", container.ID, err)
 		return nil
@@ -34,11 +35,68 @@ func (i *createExecInterceptor) InterceptRequest(r *http.Request) error {
 	}
 
 	Log.Infof("Exec in container %s with WEAVE_CIDR \"%s\"", container.ID, strings.Join(cidrs, " "))
-	options["Cmd"] = append(weaveWaitEntrypoint, cmd...)
+	options["Cmd"] = append(i.proxy.weaveWaitEntrypoint(), cmd...)
+
+	if len(i.proxy.ExecEnv) > 0 {
+		env, err := options.StringArray("Env")
+		if err != nil {
+			return err
+		}
+		options["Env"] = mergeEnv(env, i.proxy.ExecEnv)
+	}
 
 	return marshalRequestBody(r, options)
 }
 
+// mergeEnv adds to env each of extra whose variable it doesn't already
+// set, so that anything given explicitly wins.
+func mergeEnv(env, extra []string) []string {
+	merged := env
+	for _, e := range extra {
+		name := e[:strings.Index(e, "=")+1]
+		found := false
+		for _, existing := range env {
+			if strings.HasPrefix(existing, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+func validateExecEnv(env []string) error {
+	return validateEnv(env, "exec environment variable")
+}
+
+func validateEnv(env []string, what string) error {
+	for _, e := range env {
+		if strings.Index(e, "=") < 1 {
+			return fmt.Errorf("invalid %s %q: must be NAME=value", what, e)
+		}
+	}
+	return nil
+}
+
+// The variables by which a container tells us what to do with it. They
+// are decided on from what the container was created with, before
+// --env is merged in, and again from what it runs with, after, so
+// --env must not set them or the two would differ.
+var weaveControlEnv = []string{"WEAVE_CIDR", "WEAVE_DNS", "WEAVE_DNS_DOMAIN", "WEAVE_NO_WAIT"}
+
+func validateNoControlEnv(env []string) error {
+	for _, e := range env {
+		name := strings.SplitN(e, "=", 2)[0]
+		if containsString(weaveControlEnv, name) {
+			return fmt.Errorf("invalid environment variable %q: %s is for containers to set themselves", e, name)
+		}
+	}
+	return nil
+}
+
 func (i *createExecInterceptor) InterceptResponse(r *http.Response) error {
 	return nil
 }
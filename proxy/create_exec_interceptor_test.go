@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateExec(t *testing.T) {
+	client := &fakeDockerClient{containers: map[string]*docker.Container{
+		"weavey": {
+			ID:         "weavey",
+			Config:     &docker.Config{Env: []string{"WEAVE_CIDR=10.2.1.1/24"}},
+			HostConfig: &docker.HostConfig{},
+			Volumes:    map[string]string{"/w": "/var/lib/weavewait"},
+		},
+		"plain": {ID: "plain", Config: &docker.Config{}, HostConfig: &docker.HostConfig{}},
+	}}
+	proxy := &Proxy{
+		Config: Config{WeaveWaitMountPath: "/w", ExecEnv: []string{"WEAVE_EXEC=1", "TERM=xterm"}},
+		client: client,
+	}
+	i := &createExecInterceptor{proxy}
+
+	const body = `{"Cmd": ["/bin/sh"], "Env": ["TERM=dumb"]}`
+	r := httptest.NewRequest("POST", "/v1.24/containers/plain/exec", strings.NewReader(body))
+	require.NoError(t, i.InterceptRequest(r))
+	forwarded, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(forwarded), "execs in containers not on weave are untouched")
+
+	r = httptest.NewRequest("POST", "/v1.24/containers/weavey/exec", strings.NewReader(body))
+	require.NoError(t, i.InterceptRequest(r))
+	options := jsonObject{}
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&options))
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, options["Cmd"])
+	assert.Equal(t, []interface{}{"TERM=dumb", "WEAVE_EXEC=1"}, options["Env"])
+}
+
+func TestValidateExecEnv(t *testing.T) {
+	assert.NoError(t, validateExecEnv(nil))
+	assert.NoError(t, validateExecEnv([]string{"WEAVE_EXEC=1", "EMPTY="}))
+	assert.Error(t, validateExecEnv([]string{"WEAVE_EXEC"}))
+	assert.Error(t, validateExecEnv([]string{"=1"}))
+}
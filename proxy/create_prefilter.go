@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// What a create body must contain, as its raw bytes, to ask for an
+// address: WEAVE_CIDR in its Env, the label, or a static address from
+// 'docker run --ip'. The full decode matches all of them exactly.
+var addressTokens = [][]byte{
+	[]byte("WEAVE_CIDR"),
+	[]byte(weaveCIDRLabel),
+	[]byte("IPv4Address"),
+}
+
+// mayRequestAddress looks through a raw create body for any way of
+// asking for an address, far more cheaply than decoding it. It may
+// say yes wrongly, e.g. for "WEAVE_CIDR" in a Cmd, which only costs
+// the decode, but never no: a token spelt out with JSON escapes also
+// counts as one.
+func mayRequestAddress(body []byte) bool {
+	for _, token := range addressTokens {
+		if bytes.Contains(body, token) {
+			return true
+		}
+	}
+	return escapesTokenChar(body)
+}
+
+// escapesTokenChar says whether body has a \u escape of a character
+// which could be part of a token. Go's encoder, as used by the Docker
+// client, escapes '<', '>' and '&', which could not, so shell commands
+// in a Cmd don't lose the fast path.
+func escapesTokenChar(body []byte) bool {
+	for rest := body; ; {
+		i := bytes.Index(rest, []byte(`\u`))
+		if i < 0 {
+			return false
+		}
+		if i+6 > len(rest) {
+			// Not valid JSON; leave it to the decoder to say so
+			return true
+		}
+		r, err := strconv.ParseUint(string(rest[i+2:i+6]), 16, 16)
+		if err != nil || isTokenChar(rune(r)) {
+			return true
+		}
+		rest = rest[i+6:]
+	}
+}
+
+func isTokenChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.'
+}
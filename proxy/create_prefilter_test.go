@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMayRequestAddress(t *testing.T) {
+	for body, may := range map[string]bool{
+		`{"Image": "nginx", "Env": ["PATH=/bin"]}`:                                                           false,
+		`{"Image": "nginx", "Env": ["WEAVE_CIDR=10.2.1.1/24"]}`:                                              true,
+		`{"Image": "nginx", "Labels": {"works.weave.cidr": "10.2.1.1/24"}}`:                                  true,
+		`{"NetworkingConfig": {"EndpointsConfig": {"weave": {"IPAMConfig": {"IPv4Address": "10.32.0.5"}}}}}`: true,
+		// fooled, which only costs the decode
+		`{"Image": "nginx", "Cmd": ["echo", "WEAVE_CIDR"]}`: true,
+		// a token spelt out with escapes
+		`{"Env": ["WEAVE\u005fCIDR=10.2.1.1/24"]}`:             true,
+		`{"Labels": {"works\u002eweave.cidr": "10.2.1.1/24"}}`: true,
+		`{"IPAMConfig": {"IPv4Addr\u0065ss": "10.32.0.5"}}`:    true,
+		`{"Env": ["X=\u`: true,
+		// as Go's encoder escapes shell commands
+		`{"Cmd": ["sh", "-c", "make \u0026\u0026 make install \u003e/dev/null"]}`: false,
+	} {
+		assert.Equal(t, may, mayRequestAddress([]byte(body)), "body %s", body)
+	}
+}
+
+func TestCreatePrefilter(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, NoDefaultIPAM: true})
+	i.proxy.images.images = map[string]cachedImage{
+		"nginx":    {image: &docker.Image{Config: &docker.Config{}}, expires: time.Now().Add(time.Hour)},
+		"withcidr": {image: &docker.Image{Config: &docker.Config{Labels: map[string]string{weaveCIDRLabel: "10.2.5.1/24"}}}, expires: time.Now().Add(time.Hour)},
+	}
+
+	const body = `{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+	require.NoError(t, i.InterceptRequest(r))
+	forwarded, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(forwarded))
+
+	// Not in the body, but still asked for by a label on the image
+	container := interceptCreate(t, i, `{"Image": "withcidr", "Entrypoint": ["/bin/sh"]}`)
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, container["Entrypoint"])
+
+	container = interceptCreate(t, i, `{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.1/24"]}`)
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, container["Entrypoint"])
+}
+
+// A create as 'docker run' sends it, with enough environment to make
+// decoding it cost something.
+var benchmarkCreateBody = `{"Hostname": "", "Domainname": "", "User": "", "AttachStdin": false,
+"AttachStdout": true, "AttachStderr": true, "Tty": false, "OpenStdin": false, "StdinOnce": false,
+"Env": ["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "NGINX_VERSION=1.13.0",
+"APP_ENV=production", "APP_PORT=8080", "APP_LOG_LEVEL=info", "APP_DB_HOST=db.example.com", "APP_DB_PORT=5432",
+"APP_CACHE_HOST=cache.example.com", "APP_CACHE_TTL=300", "APP_FEATURE_FLAGS=a,b,c,d,e,f,g,h"],
+"Cmd": ["sh", "-c", "nginx -g 'daemon off;' && echo done"], "Image": "nginx", "Volumes": {},
+"WorkingDir": "", "Entrypoint": ["/docker-entrypoint.sh"], "OnBuild": null,
+"Labels": {"com.example.team": "web", "com.example.tier": "frontend", "com.example.version": "1.4.2"},
+"HostConfig": {"Binds": ["/srv/www:/usr/share/nginx/html:ro"], "ContainerIDFile": "", "LogConfig": {"Type": "", "Config": {}},
+"NetworkMode": "default", "PortBindings": {"80/tcp": [{"HostIp": "", "HostPort": "8080"}]},
+"RestartPolicy": {"Name": "no", "MaximumRetryCount": 0}, "AutoRemove": false, "VolumeDriver": "", "VolumesFrom": null,
+"CapAdd": null, "CapDrop": null, "Dns": [], "DnsOptions": [], "DnsSearch": [], "ExtraHosts": null, "GroupAdd": null,
+"IpcMode": "", "Cgroup": "", "Links": null, "OomScoreAdj": 0, "PidMode": "", "Privileged": false,
+"PublishAllPorts": false, "ReadonlyRootfs": false, "SecurityOpt": null, "UTSMode": "", "UsernsMode": "",
+"ShmSize": 0, "ConsoleSize": [0, 0], "Isolation": "", "CpuShares": 0, "Memory": 0, "CgroupParent": "",
+"BlkioWeight": 0, "Devices": [], "DiskQuota": 0, "KernelMemory": 0, "MemoryReservation": 0, "MemorySwap": 0,
+"OomKillDisable": false, "PidsLimit": 0, "Ulimits": null}, "NetworkingConfig": {"EndpointsConfig": {}}}`
+
+// BenchmarkCreateWithoutAddress compares a create which asks for no
+// address, prefiltered, with the same create where "WEAVE_CIDR" in its
+// Cmd fools the prefilter, so that it is decoded as before.
+func BenchmarkCreateWithoutAddress(b *testing.B) {
+	defer func(level logrus.Level) { Log.Level = level }(Log.Level)
+	Log.Level = logrus.WarnLevel
+
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, NoDefaultIPAM: true})
+	i.proxy.images.images = map[string]cachedImage{
+		"nginx": {image: &docker.Image{Config: &docker.Config{}}, expires: time.Now().Add(time.Hour)},
+	}
+	for name, body := range map[string]string{
+		"prefiltered": benchmarkCreateBody,
+		"decoded":     strings.Replace(benchmarkCreateBody, "echo done", "echo WEAVE_CIDR", 1),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+				if err := i.InterceptRequest(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
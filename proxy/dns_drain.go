@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+var drainSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+}
+
+// parseDrainSignal returns the signal named by Config.DNSDrainSignal,
+// e.g. USR1 or SIGUSR1, or nil if there is none.
+func parseDrainSignal(name string) (os.Signal, error) {
+	if name == "" {
+		return nil, nil
+	}
+	sig, found := drainSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !found {
+		return nil, fmt.Errorf("Invalid DNS drain signal '%s': must be one of HUP, USR1, USR2 or TERM", name)
+	}
+	return sig, nil
+}
+
+// dnsRecord is what registerWithDNS was asked to register for a
+// container.
+type dnsRecord struct {
+	fqdn       string
+	domainname string
+	ips        []*net.IPNet
+}
+
+// trackDNS notes the name and addresses under which a container was
+// registered with weaveDNS, so they can be drained, or registered
+// again, later.
+func (proxy *Proxy) trackDNS(containerID, fqdn, domainname string, ips []*net.IPNet) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	if proxy.dnsRecords == nil {
+		proxy.dnsRecords = make(map[string]*dnsRecord)
+	}
+	proxy.dnsRecords[containerID] = &dnsRecord{fqdn: fqdn, domainname: domainname, ips: ips}
+}
+
+// forgetDNS stops tracking a container's weaveDNS records, returning
+// whether there were any.
+func (proxy *Proxy) forgetDNS(containerID string) bool {
+	proxy.Lock()
+	defer proxy.Unlock()
+	_, found := proxy.dnsRecords[containerID]
+	delete(proxy.dnsRecords, containerID)
+	return found
+}
+
+// DrainDNS deregisters from weaveDNS every name this proxy registered,
+// so that clients stop resolving them to containers on a host which is
+// being decommissioned, before the containers themselves go.
+func (proxy *Proxy) DrainDNS() {
+	proxy.Lock()
+	records := proxy.dnsRecords
+	proxy.dnsRecords = nil
+	proxy.Unlock()
+
+	Log.Infof("Draining weaveDNS records of %d containers", len(records))
+	for containerID, record := range records {
+		for _, ip := range record.ips {
+			if err := proxy.weave.DeregisterWithDNS(containerID, ip.IP.String()); err != nil {
+				Log.Warningf("unable to deregister %s from weaveDNS: %s", containerID, err)
+			}
+		}
+	}
+}
+
+// drainDNSOn drains weaveDNS each time the process receives sig, until
+// the proxy is stopped.
+func (proxy *Proxy) drainDNSOn(sig os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				proxy.DrainDNS()
+			case <-proxy.quit:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	weaveapi "github.com/weaveworks/weave/api"
+)
+
+// fakeWeaveDNS records the names registered and deregistered through
+// the weave API
+type fakeWeaveDNS struct {
+	sync.Mutex
+	registered []string
+	deleted    []string
+}
+
+func (f *fakeWeaveDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch r.Method {
+	case "PUT":
+		f.registered = append(f.registered, r.URL.Path+" "+r.FormValue("fqdn"))
+	case "DELETE":
+		f.deleted = append(f.deleted, r.URL.Path)
+	}
+}
+
+func (f *fakeWeaveDNS) registeredNames() []string {
+	f.Lock()
+	defer f.Unlock()
+	registered := append([]string(nil), f.registered...)
+	sort.Strings(registered)
+	return registered
+}
+
+func (f *fakeWeaveDNS) deletedNames() []string {
+	f.Lock()
+	defer f.Unlock()
+	deleted := append([]string(nil), f.deleted...)
+	sort.Strings(deleted)
+	return deleted
+}
+
+func newDrainTestProxy(t *testing.T) (*Proxy, *fakeWeaveDNS, func()) {
+	dns := &fakeWeaveDNS{}
+	ts := httptest.NewServer(dns)
+	proxy := &Proxy{
+		weave: weaveapi.NewClient(strings.TrimPrefix(ts.URL, "http://"), Log),
+		quit:  make(chan struct{}),
+	}
+	for containerID, cidr := range map[string]string{"c1": "10.32.0.5/12", "c2": "10.32.0.6/12"} {
+		ip, ipnet, _ := net.ParseCIDR(cidr)
+		ipnet.IP = ip
+		require.NoError(t, proxy.registerWithDNS(containerID, containerID+".weave.local", "weave.local", []*net.IPNet{ipnet}))
+	}
+	return proxy, dns, ts.Close
+}
+
+func TestDrainDNS(t *testing.T) {
+	proxy, dns, done := newDrainTestProxy(t)
+	defer done()
+
+	proxy.DrainDNS()
+	assert.Equal(t, []string{"/name/c1/10.32.0.5", "/name/c2/10.32.0.6"}, dns.deletedNames())
+
+	// once drained, there is nothing left to deregister
+	proxy.DrainDNS()
+	assert.Len(t, dns.deletedNames(), 2)
+}
+
+func TestDrainDNSForgetsDestroyed(t *testing.T) {
+	proxy, dns, done := newDrainTestProxy(t)
+	defer done()
+
+	proxy.ContainerDestroyed("c1")
+	proxy.DrainDNS()
+	assert.Equal(t, []string{"/name/c2/10.32.0.6"}, dns.deletedNames())
+}
+
+func TestDrainDNSOnSignal(t *testing.T) {
+	proxy, dns, done := newDrainTestProxy(t)
+	defer done()
+	defer close(proxy.quit)
+
+	proxy.drainDNSOn(syscall.SIGUSR2)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+	for start := time.Now(); len(dns.deletedNames()) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("weaveDNS was not drained on the signal")
+		}
+	}
+	assert.Equal(t, []string{"/name/c1/10.32.0.5", "/name/c2/10.32.0.6"}, dns.deletedNames())
+}
+
+func TestParseDrainSignal(t *testing.T) {
+	for name, expected := range map[string]os.Signal{"": nil, "USR1": syscall.SIGUSR1, "sigterm": syscall.SIGTERM} {
+		sig, err := parseDrainSignal(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, sig, name)
+	}
+	_, err := parseDrainSignal("KILL")
+	assert.Error(t, err)
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+type dnsReregistration struct {
+	Containers int      `json:"containers"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// ReregisterDNS registers with weaveDNS again the names and addresses
+// of every container this proxy registered and has not seen go, e.g.
+// after weaveDNS restarted and lost them. It carries on past a
+// container which fails, and returns how many were registered along
+// with the errors of those which weren't.
+func (proxy *Proxy) ReregisterDNS() (int, []error) {
+	proxy.Lock()
+	records := make(map[string]dnsRecord, len(proxy.dnsRecords))
+	for containerID, record := range proxy.dnsRecords {
+		records[containerID] = *record
+	}
+	proxy.Unlock()
+
+	containerIDs := make([]string, 0, len(records))
+	for containerID := range records {
+		containerIDs = append(containerIDs, containerID)
+	}
+	sort.Strings(containerIDs)
+
+	Log.Infof("Re-registering weaveDNS records of %d containers", len(records))
+	var errs []error
+	for _, containerID := range containerIDs {
+		record := records[containerID]
+		if err := proxy.registerWithDNS(containerID, record.fqdn, record.domainname, record.ips); err != nil {
+			Log.Warning(err)
+			errs = append(errs, err)
+		}
+	}
+	return len(records) - len(errs), errs
+}
+
+// ReregisterDNSHTTP runs ReregisterDNS for a POST to /dns/reregister,
+// answering with how many containers were re-registered.
+func (proxy *Proxy) ReregisterDNSHTTP(w http.ResponseWriter, r *http.Request) {
+	registered, errs := proxy.ReregisterDNS()
+	result := dnsReregistration{Containers: registered}
+	for _, err := range errs {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		Log.Warning(err)
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReregisterDNS(t *testing.T) {
+	proxy, dns, done := newDrainTestProxy(t)
+	defer done()
+	registered := dns.registeredNames()
+	require.Len(t, registered, 2)
+
+	n, errs := proxy.ReregisterDNS()
+	assert.Equal(t, 2, n)
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{
+		"/name/c1/10.32.0.5 c1.weave.local", "/name/c1/10.32.0.5 c1.weave.local",
+		"/name/c2/10.32.0.6 c2.weave.local", "/name/c2/10.32.0.6 c2.weave.local",
+	}, dns.registeredNames(), "one registration per tracked container")
+
+	proxy.ContainerDestroyed("c1")
+	n, errs = proxy.ReregisterDNS()
+	assert.Equal(t, 1, n)
+	assert.Empty(t, errs)
+	assert.Len(t, dns.registeredNames(), 5)
+
+	// nothing is left to re-register once drained
+	proxy.DrainDNS()
+	n, errs = proxy.ReregisterDNS()
+	assert.Equal(t, 0, n)
+	assert.Empty(t, errs)
+	assert.Len(t, dns.registeredNames(), 5)
+}
+
+func TestReregisterDNSHTTP(t *testing.T) {
+	proxy, dns, done := newDrainTestProxy(t)
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("POST", "/dns/reregister", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	result := dnsReregistration{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, dnsReregistration{Containers: 2}, result)
+	assert.Len(t, dns.registeredNames(), 4)
+
+	// with weaveDNS gone, every container fails
+	done()
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("POST", "/dns/reregister", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	result = dnsReregistration{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, 0, result.Containers)
+	assert.Len(t, result.Errors, 2)
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// What to do at startup about a DNS server found from the Docker
+// bridge which containers could not reach
+const (
+	dnsServerCheckOff    = "off"    // don't check
+	dnsServerCheckWarn   = "warn"   // log a warning, and carry on
+	dnsServerCheckStrict = "strict" // refuse to start
+)
+
+// An empty policy is taken as dnsServerCheckOff, the default
+func validateDNSServerCheck(policy string) error {
+	switch policy {
+	case "", dnsServerCheckOff, dnsServerCheckWarn, dnsServerCheckStrict:
+		return nil
+	}
+	return fmt.Errorf("Invalid DNS server check '%s': must be one of %s, %s or %s", policy, dnsServerCheckOff, dnsServerCheckWarn, dnsServerCheckStrict)
+}
+
+// ErrUnreachableDNSServer is returned by a strict DNS server check for
+// a server containers would be given but could not query.
+type ErrUnreachableDNSServer struct {
+	Server string
+	Reason string
+}
+
+func (err *ErrUnreachableDNSServer) Error() string {
+	return fmt.Sprintf("DNS server %s would not be reachable from containers: %s", err.Server, err.Reason)
+}
+
+// localAddr is an address of one of this host's interfaces
+type localAddr struct {
+	ip    net.IP
+	iface string
+	up    bool
+}
+
+// Overridden in tests
+var localAddrs = func() ([]localAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []localAddr
+	for _, iface := range ifaces {
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range ifaceAddrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				addrs = append(addrs, localAddr{ip: ipnet.IP, iface: iface.Name, up: iface.Flags&net.FlagUp != 0})
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// checkDNSServer tells whether server is an address containers can
+// send queries to: one of this host's own, on an interface which is up,
+// and neither loopback nor unspecified, which mean something else
+// inside a container.
+func checkDNSServer(server string, addrs []localAddr) error {
+	ip := net.ParseIP(server)
+	switch {
+	case ip == nil:
+		return &ErrUnreachableDNSServer{server, "not an IP address"}
+	case ip.IsUnspecified():
+		return &ErrUnreachableDNSServer{server, "unspecified address"}
+	case ip.IsLoopback():
+		return &ErrUnreachableDNSServer{server, "loopback address, which is the container's own"}
+	}
+	for _, addr := range addrs {
+		if addr.ip.Equal(ip) {
+			if !addr.up {
+				return &ErrUnreachableDNSServer{server, fmt.Sprintf("interface %s is down", addr.iface)}
+			}
+			return nil
+		}
+	}
+	return &ErrUnreachableDNSServer{server, "not an address of this host"}
+}
+
+// checkDNSServers applies the proxy's DNS server check to servers found
+// from the Docker bridge, returning an error only if it is strict.
+func (proxy *Proxy) checkDNSServers(servers []string) error {
+	if proxy.DNSServerCheck == "" || proxy.DNSServerCheck == dnsServerCheckOff {
+		return nil
+	}
+	addrs, err := localAddrs()
+	if err != nil {
+		return fmt.Errorf("unable to check DNS servers: %s", err)
+	}
+	for _, server := range servers {
+		if err := checkDNSServer(server, addrs); err != nil {
+			if proxy.DNSServerCheck == dnsServerCheckStrict {
+				return err
+			}
+			Log.Warningf("*** %s; name resolution will fail in containers using weaveDNS ***", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testLocalAddrs = []localAddr{
+	{ip: net.ParseIP("127.0.0.1"), iface: "lo", up: true},
+	{ip: net.ParseIP("172.17.0.1"), iface: "docker0", up: true},
+	{ip: net.ParseIP("fd00::1"), iface: "docker0", up: true},
+	{ip: net.ParseIP("172.18.0.1"), iface: "br-down", up: false},
+}
+
+func TestCheckDNSServer(t *testing.T) {
+	for server, reason := range map[string]string{
+		"172.17.0.1":  "",
+		"fd00::1":     "",
+		"docker0":     "not an IP address",
+		"0.0.0.0":     "unspecified address",
+		"127.0.0.1":   "loopback address, which is the container's own",
+		"::1":         "loopback address, which is the container's own",
+		"10.99.0.1":   "not an address of this host",
+		"172.18.0.1":  "interface br-down is down",
+		"172.17.0.10": "not an address of this host",
+	} {
+		err := checkDNSServer(server, testLocalAddrs)
+		if reason == "" {
+			assert.NoError(t, err, server)
+			continue
+		}
+		require.IsType(t, &ErrUnreachableDNSServer{}, err, server)
+		assert.Equal(t, reason, err.(*ErrUnreachableDNSServer).Reason, server)
+	}
+}
+
+func TestCheckDNSServers(t *testing.T) {
+	defer func(f func() ([]localAddr, error)) { localAddrs = f }(localAddrs)
+	localAddrs = func() ([]localAddr, error) { return testLocalAddrs, nil }
+
+	for _, policy := range []string{"", "off", "warn", "strict"} {
+		proxy, err := newTestProxy(Config{DNSServerCheck: policy}, nil)
+		require.NoError(t, err)
+		buf, restore := captureLog()
+		assert.NoError(t, proxy.checkDNSServers([]string{"172.17.0.1"}), policy)
+		err = proxy.checkDNSServers([]string{"172.17.0.1", "10.99.0.1"})
+		restore()
+
+		switch policy {
+		case "strict":
+			assert.IsType(t, &ErrUnreachableDNSServer{}, err)
+			assert.Empty(t, logLines(buf))
+		case "warn":
+			assert.NoError(t, err)
+			lines := logLines(buf)
+			require.Len(t, lines, 1)
+			assert.Contains(t, lines[0], "DNS server 10.99.0.1 would not be reachable from containers")
+		default:
+			assert.NoError(t, err, policy)
+			assert.Empty(t, logLines(buf), policy)
+		}
+	}
+
+	_, err := newTestProxy(Config{DNSServerCheck: "loud"}, nil)
+	assert.Error(t, err)
+}
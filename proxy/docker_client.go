@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	docker "github.com/fsouza/go-dockerclient"
+
+	weavedocker "github.com/weaveworks/weave/common/docker"
+)
+
+// DockerClient is what the proxy asks of Docker itself, as opposed to
+// the requests it passes on, and so all another container runtime would
+// have to provide. *weavedocker.Client is the real thing; tests may give
+// newTestProxy a fake.
+type DockerClient interface {
+	Ping() error
+	Info() string
+	AddObserver(ob weavedocker.ContainerObserver) error
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	InspectContainer(id string) (*docker.Container, error)
+	InspectImage(name string) (*docker.Image, error)
+	NetworkInfo(id string) (*docker.Network, error)
+	CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error)
+	StartContainer(id string, hostConfig *docker.HostConfig) error
+	AttachToContainer(opts docker.AttachToContainerOptions) error
+	WaitContainer(id string) (int, error)
+	KillContainer(opts docker.KillContainerOptions) error
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+}
+
+var _ DockerClient = &weavedocker.Client{}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// fakeDockerClient answers inspections from what it was given, without a
+// Docker daemon. Anything else it is asked panics, through the nil
+// DockerClient embedded for the methods it doesn't implement.
+type fakeDockerClient struct {
+	DockerClient
+	containers map[string]*docker.Container
+	images     map[string]*docker.Image
+	networks   map[string]*docker.Network
+}
+
+func (f *fakeDockerClient) Ping() error {
+	return nil
+}
+
+// ListContainers lists the containers given, matching only label
+// filters, in no particular order.
+func (f *fakeDockerClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	var selectors []labelSelector
+	for _, entry := range opts.Filters["label"] {
+		selector, _ := parseLabelSelector(entry)
+		selectors = append(selectors, selector)
+	}
+	matches := func(labels map[string]string) bool {
+		for _, selector := range selectors {
+			if !selector.matches(labels) {
+				return false
+			}
+		}
+		return true
+	}
+	var containers []docker.APIContainers
+	for id, container := range f.containers {
+		var labels map[string]string
+		if container.Config != nil {
+			labels = container.Config.Labels
+		}
+		if matches(labels) {
+			containers = append(containers, docker.APIContainers{ID: id, Names: []string{"/" + container.Name}, Labels: labels})
+		}
+	}
+	return containers, nil
+}
+
+func (f *fakeDockerClient) InspectContainer(id string) (*docker.Container, error) {
+	if container, found := f.containers[id]; found {
+		return container, nil
+	}
+	return nil, &docker.NoSuchContainer{ID: id}
+}
+
+func (f *fakeDockerClient) InspectImage(name string) (*docker.Image, error) {
+	if image, found := f.images[name]; found {
+		return image, nil
+	}
+	return nil, docker.ErrNoSuchImage
+}
+
+func (f *fakeDockerClient) NetworkInfo(id string) (*docker.Network, error) {
+	if network, found := f.networks[id]; found {
+		return network, nil
+	}
+	return nil, &docker.NoSuchNetwork{ID: id}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type proxyHealth struct {
+	Ready    bool   `json:"ready"`
+	Docker   string `json:"docker"`
+	WeaveDNS string `json:"weavedns"`
+	Domain   string `json:"domain,omitempty"`
+}
+
+// HealthHTTP reports whether the proxy can reach the Docker daemon and,
+// unless it runs without it, weaveDNS; for readiness probes. The DNS
+// domain lookup is the cached one used on container creation, so
+// frequent probing does not add to the load on weaveDNS.
+func (proxy *Proxy) HealthHTTP(w http.ResponseWriter, r *http.Request) {
+	health := proxyHealth{Ready: true, Docker: "ok", WeaveDNS: "disabled"}
+	if err := proxy.client.Ping(); err != nil {
+		health.Ready = false
+		health.Docker = err.Error()
+	}
+	if !proxy.WithoutDNS {
+		if health.Domain = proxy.getDNSDomain(r.Context()); health.Domain != "" {
+			health.WeaveDNS = "ok"
+		} else {
+			health.Ready = false
+			health.WeaveDNS = "unreachable"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		Log.Warning(err)
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	weavedocker "github.com/weaveworks/weave/common/docker"
+)
+
+func healthCheck(t *testing.T, proxy *Proxy) (int, proxyHealth) {
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var health proxyHealth
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&health))
+	return w.Code, health
+}
+
+func TestHealthHTTP(t *testing.T) {
+	pings := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_ping", r.URL.Path)
+		pings++
+		fmt.Fprint(w, "OK")
+	}))
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+	proxy := &Proxy{client: &weavedocker.Client{Client: dc}}
+	proxy.dnsDomain.domain = "weave.local."
+	proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+
+	code, health := healthCheck(t, proxy)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, proxyHealth{Ready: true, Docker: "ok", WeaveDNS: "ok", Domain: "weave.local."}, health)
+	assert.Equal(t, 1, pings)
+
+	proxy.WithoutDNS = true
+	code, health = healthCheck(t, proxy)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, proxyHealth{Ready: true, Docker: "ok", WeaveDNS: "disabled"}, health)
+
+	// Docker has gone away
+	ts.Close()
+	code, health = healthCheck(t, proxy)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, health.Ready)
+	assert.NotEqual(t, "ok", health.Docker)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What to do about a container given the same hostname as another we
+// know of, which weaveDNS would answer for with both their addresses
+const (
+	hostnameCollisionAllow  = "allow"  // nothing, e.g. for replicas meant to share a name
+	hostnameCollisionWarn   = "warn"   // log a warning
+	hostnameCollisionSuffix = "suffix" // append "-2", "-3", ... until the name is free
+)
+
+// An empty policy is taken as hostnameCollisionAllow, the default
+func validateHostnameCollision(policy string) error {
+	switch policy {
+	case "", hostnameCollisionAllow, hostnameCollisionWarn, hostnameCollisionSuffix:
+		return nil
+	}
+	return fmt.Errorf("Invalid hostname collision policy '%s': must be one of %s, %s or %s", policy, hostnameCollisionAllow, hostnameCollisionWarn, hostnameCollisionSuffix)
+}
+
+// hostnameOwner returns the name of a container we created or attached
+// which has fqdn and is still on the weave network, if any: of several,
+// that with the lowest ID, so that it is the same one each time.
+func (proxy *Proxy) hostnameOwner(fqdn string) (string, bool) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	var owner *managedContainer
+	for _, managed := range proxy.managed {
+		if managed.Status != containerDetached && managed.Status != containerSkipped && strings.EqualFold(managed.FQDN, fqdn) {
+			if owner == nil || managed.ID < owner.ID {
+				owner = managed
+			}
+		}
+	}
+	if owner == nil {
+		return "", false
+	}
+	return owner.Name, true
+}
+
+// avoidHostnameCollision applies the proxy's collision policy to the
+// hostname a container is about to be given in dnsDomain. Containers
+// which set their own hostname keep it. Two creates racing for the same
+// name may both get it; this only sees containers already created.
+func (i *createContainerInterceptor) avoidHostnameCollision(container jsonObject, hostname, dnsDomain string) (string, error) {
+	ownHostname, err := container.String("Hostname")
+	if err != nil || ownHostname != "" || hostname == "" {
+		return hostname, err
+	}
+	domain := strings.TrimSuffix(dnsDomain, ".")
+	owner, found := i.proxy.hostnameOwner(hostname + "." + domain)
+	if !found {
+		return hostname, nil
+	}
+	switch i.proxy.HostnameCollision {
+	case hostnameCollisionWarn:
+		i.proxy.warnings.Warningf("Hostname %s.%s of container %s is already that of container %s; weaveDNS will answer with the addresses of both", hostname, domain, i.fields["name"], owner)
+	case hostnameCollisionSuffix:
+		for n := 2; ; n++ {
+			candidate := fmt.Sprintf("%s-%d", hostname, n)
+			if _, found := i.proxy.hostnameOwner(candidate + "." + domain); !found {
+				i.log().Infof("Using hostname %q, since %q is already that of container %s", candidate, hostname, owner)
+				return candidate, nil
+			}
+		}
+	}
+	return hostname, nil
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCollisionTestInterceptor(policy string) *createContainerInterceptor {
+	i := newTestCreateInterceptor(Config{HostnameMatch: "^(.*)_[0-9]+$", HostnameReplacement: "$1", HostnameCollision: policy})
+	i.proxy.dnsServers = []string{"172.17.0.1"}
+	i.proxy.dnsDomain.domain = "weave.local."
+	i.proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+	return i
+}
+
+// createNamed creates a container through i, as Docker would, returning
+// the hostname it was given.
+func createNamed(t *testing.T, i *createContainerInterceptor, name, body string) interface{} {
+	r := httptest.NewRequest("POST", "/v1.24/containers/create?name="+name, strings.NewReader(body))
+	require.NoError(t, i.InterceptRequest(r))
+	container := jsonObject{}
+	require.NoError(t, unmarshalRequestBody(r, &container))
+	require.NoError(t, i.InterceptResponse(&http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"Id": "` + name + `"}`)),
+		Request:    r,
+	}))
+	return container["Hostname"]
+}
+
+func TestHostnameCollision(t *testing.T) {
+	for _, test := range []struct {
+		policy    string
+		hostnames []interface{}
+		warnings  int
+	}{
+		{"", []interface{}{"web", "web", "web"}, 0},
+		{"allow", []interface{}{"web", "web", "web"}, 0},
+		{"warn", []interface{}{"web", "web", "web"}, 2},
+		{"suffix", []interface{}{"web", "web-2", "web-3"}, 0},
+	} {
+		buf, restore := captureLog()
+		i := newCollisionTestInterceptor(test.policy)
+		var hostnames []interface{}
+		for _, name := range []string{"web_1", "web_2", "web_3"} {
+			hostnames = append(hostnames, createNamed(t, &createContainerInterceptor{proxy: i.proxy}, name, `{"Entrypoint": ["/bin/sh"]}`))
+		}
+		restore()
+		assert.Equal(t, test.hostnames, hostnames, test.policy)
+		warnings := 0
+		for _, line := range logLines(buf) {
+			if strings.Contains(line, "is already that of container web_1") {
+				warnings++
+			}
+		}
+		assert.Equal(t, test.warnings, warnings, test.policy)
+	}
+
+	_, err := newTestProxy(Config{HostnameCollision: "rename"}, nil)
+	assert.Error(t, err)
+}
+
+func TestHostnameCollisionSuffixSkipsTakenNames(t *testing.T) {
+	i := newCollisionTestInterceptor("suffix")
+	// attached before we started, so only known from inspecting it
+	i.proxy.trackAttached(&docker.Container{ID: "a", Name: "/web_7", Config: &docker.Config{Hostname: "web", Domainname: "weave.local"}}, nil, nil)
+	i.proxy.trackAttached(&docker.Container{ID: "b", Name: "/other", Config: &docker.Config{Hostname: "web-2", Domainname: "weave.local"}}, nil, nil)
+	// left off the network when it restarted, so not holding its name
+	i.proxy.trackAttached(&docker.Container{ID: "c", Name: "/old", Config: &docker.Config{Hostname: "web-3", Domainname: "weave.local"}}, nil, nil)
+	i.proxy.trackSkipped("c", "/old", "", ErrWeaveCIDRNone)
+	assert.Equal(t, "web-3", createNamed(t, i, "web_1", `{"Entrypoint": ["/bin/sh"]}`))
+
+	// no longer on the network, so its name is free again
+	i.proxy.trackDetached("a")
+	assert.Equal(t, "web", createNamed(t, &createContainerInterceptor{proxy: i.proxy}, "web_2", `{"Entrypoint": ["/bin/sh"]}`))
+
+	// containers which choose their own hostname keep it
+	assert.Equal(t, "web", createNamed(t, &createContainerInterceptor{proxy: i.proxy}, "web_3", `{"Entrypoint": ["/bin/sh"], "Hostname": "web", "Domainname": "weave.local"}`))
+}
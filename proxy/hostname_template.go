@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Label docker-compose numbers the containers of a scaled service with
+const composeContainerNumberLabel = "com.docker.compose.container-number"
+
+// hostnameTemplateData is what a --hostname-template is evaluated
+// against, e.g. "{{.Name}}-{{.Index}}.{{.Domain}}" or
+// "{{index .Labels \"app\"}}".
+type hostnameTemplateData struct {
+	Name   string            // the container's name, without a leading "/"
+	Image  string            // the image the container is created from
+	Labels map[string]string // the container's labels
+	Domain string            // the weaveDNS domain, without a trailing "."
+	Index  string            // the container's number within its compose service, if any
+}
+
+func parseHostnameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	// Missing labels come out empty, rather than as "<no value>"
+	tmpl, err := template.New("hostname").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Incorrect hostname template '%s': %s", text, err)
+	}
+	// Parsing does not catch references to fields we don't have
+	if err := tmpl.Execute(&bytes.Buffer{}, hostnameTemplateData{}); err != nil {
+		return nil, fmt.Errorf("Incorrect hostname template '%s': %s", text, err)
+	}
+	return tmpl, nil
+}
+
+// templateHostname evaluates the proxy's hostname template for a
+// container, giving the hostname it should have in dnsDomain. The
+// template may give a fully-qualified name in that domain, in which
+// case the domain is taken off again. Should the template fail, the
+// container keeps the hostname it would have had without it.
+func (i *createContainerInterceptor) templateHostname(hostname, name, image string, labels map[string]string, dnsDomain string) string {
+	domain := strings.TrimSuffix(dnsDomain, ".")
+	data := hostnameTemplateData{
+		Name:   strings.TrimLeft(name, "/"),
+		Image:  image,
+		Labels: labels,
+		Domain: domain,
+		Index:  labels[composeContainerNumberLabel],
+	}
+	var buf bytes.Buffer
+	if err := i.proxy.hostnameTemplate.Execute(&buf, data); err != nil {
+		i.proxy.warnings.Warningf("Unable to use hostname template: %s", err)
+		return hostname
+	}
+	templated := strings.TrimSuffix(strings.TrimSpace(buf.String()), ".")
+	templated = strings.TrimSuffix(templated, "."+domain)
+	if normalised := normaliseHostname(templated); normalised != "" {
+		return normalised
+	}
+	return hostname
+}
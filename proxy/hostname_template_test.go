@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHostnameTemplate(t *testing.T) {
+	for text, valid := range map[string]bool{
+		"":                                 true,
+		"{{.Name}}-{{.Index}}.{{.Domain}}": true,
+		`{{index .Labels "app"}}`:          true,
+		"{{.Labels.app}}-{{.Image}}":       true,
+		"{{.Name":                          false,
+		"{{.Hostname}}":                    false,
+		"{{.Name | nosuchfunc}}":           false,
+	} {
+		_, err := parseHostnameTemplate(text)
+		assert.Equal(t, valid, err == nil, text)
+	}
+
+	_, err := newTestProxy(Config{HostnameTemplate: "{{.Nmae}}"}, nil)
+	assert.Error(t, err)
+}
+
+func TestCreateWithHostnameTemplate(t *testing.T) {
+	for _, test := range []struct {
+		template, body, hostname string
+	}{
+		{"{{.Name}}-{{.Index}}.{{.Domain}}", `{"Entrypoint": ["/bin/sh"], "Labels": {"com.docker.compose.container-number": "2"}}`, "foo-2"},
+		{"{{.Labels.app}}-{{.Labels.tier}}", `{"Entrypoint": ["/bin/sh"], "Labels": {"app": "shop", "tier": "web"}}`, "shop-web"},
+		{`{{index .Labels "com.example/service"}}.{{.Domain}}.`, `{"Entrypoint": ["/bin/sh"], "Labels": {"com.example/service": "db"}}`, "db"},
+		{"{{.Image}}_{{.Name}}", `{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`, "nginx-foo"},
+		// nothing left once normalised, so the container name it is
+		{"{{.Labels.app}}-{{.Index}}", `{"Entrypoint": ["/bin/sh"]}`, "foo"},
+	} {
+		i := newTestCreateInterceptor(Config{HostnameReplacement: "$1", HostnameTemplate: test.template})
+		i.proxy.dnsServers = []string{"172.17.0.1"}
+		i.proxy.dnsDomain.domain = "weave.local."
+		i.proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+
+		container := interceptCreate(t, i, test.body)
+		assert.Equal(t, test.hostname, container["Hostname"], test.template)
+		assert.Equal(t, "weave.local", container["Domainname"], test.template)
+	}
+}
@@ -9,6 +9,36 @@ import (
 	"strings"
 )
 
+// Add our host:ip entries to the user's, except for hosts the user has
+// given an address for themselves.
+func mergeExtraHosts(user, ours []string) []string {
+	hostName := func(entry string) string {
+		return strings.SplitN(entry, ":", 2)[0]
+	}
+	names := make(map[string]bool)
+	for _, entry := range user {
+		names[hostName(entry)] = true
+	}
+	merged := user
+	for _, entry := range ours {
+		if !names[hostName(entry)] {
+			names[hostName(entry)] = true
+			merged = append(merged, entry)
+		}
+	}
+	return merged
+}
+
+func validateExtraHosts(extraHosts []string) error {
+	for _, entry := range extraHosts {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+			return fmt.Errorf("invalid extra host %q: must be host:ip", entry)
+		}
+	}
+	return nil
+}
+
 // rewrite /etc/hosts, unlinking the file (so Docker does not modify it again) but
 // leaving it with valid contents...
 func (proxy *Proxy) RewriteEtcHosts(hostsPath, fqdn string, ips []*net.IPNet, extraHosts []string) error {
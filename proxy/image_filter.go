@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"path"
+)
+
+// ErrImageNotSelected is returned for containers whose image the proxy
+// was told, with --include-image or --exclude-image, to leave alone.
+type ErrImageNotSelected struct {
+	Image, Reason string
+}
+
+func (err *ErrImageNotSelected) Error() string {
+	return fmt.Sprintf("its image %s %s", err.Image, err.Reason)
+}
+
+// Image patterns are globs, as for path.Match, against the image name
+// just as it was given in the create request, e.g. 'myorg/*' matches
+// 'myorg/web' and 'myorg/web:1.2' but not 'myorg/web/db'.
+func validateImagePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid image pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchImage(patterns []string, image string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, image); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// imageSelected returns an error if containers from image should not be
+// put on weave: exclusions take precedence over inclusions, and if any
+// inclusions are given then only images matching one of them qualify.
+func (proxy *Proxy) imageSelected(image string) error {
+	if pattern, excluded := matchImage(proxy.ExcludeImages, image); excluded {
+		return &ErrImageNotSelected{image, fmt.Sprintf("matches --exclude-image %q", pattern)}
+	}
+	if len(proxy.IncludeImages) > 0 {
+		if _, included := matchImage(proxy.IncludeImages, image); !included {
+			return &ErrImageNotSelected{image, "matches no --include-image"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageSelected(t *testing.T) {
+	for _, test := range []struct {
+		include, exclude []string
+		image            string
+		selected         bool
+	}{
+		{nil, nil, "nginx", true},
+		{[]string{"myorg/*"}, nil, "myorg/web", true},
+		{[]string{"myorg/*"}, nil, "myorg/web:1.2", true},
+		{[]string{"myorg/*"}, nil, "nginx", false},
+		{[]string{"myorg/*"}, nil, "myorg/web/db", false},
+		{nil, []string{"*/debug*"}, "myorg/debug-tools", false},
+		{nil, []string{"*/debug*"}, "myorg/web", true},
+		// exclusions win over inclusions
+		{[]string{"myorg/*"}, []string{"myorg/debug*"}, "myorg/debug-tools", false},
+		{[]string{"myorg/*"}, []string{"myorg/debug*"}, "myorg/web", true},
+	} {
+		proxy := &Proxy{Config: Config{IncludeImages: test.include, ExcludeImages: test.exclude}}
+		err := proxy.imageSelected(test.image)
+		if test.selected {
+			assert.NoError(t, err, "image %s include %q exclude %q", test.image, test.include, test.exclude)
+		} else {
+			assert.IsType(t, &ErrImageNotSelected{}, err, "image %s include %q exclude %q", test.image, test.include, test.exclude)
+		}
+	}
+
+	assert.NoError(t, validateImagePatterns([]string{"myorg/*", "nginx:1.1[0-3]"}))
+	assert.Error(t, validateImagePatterns([]string{"myorg/[web"}))
+}
+
+func TestCreateWithExcludedImage(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, FailClosed: true, ExcludeImages: []string{"myorg/debug*"}})
+
+	const body = `{"Image": "myorg/debug-tools", "Entrypoint": ["/bin/sh"]}`
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+	require.NoError(t, i.InterceptRequest(r), "deliberately left alone, so not refused even when failing closed")
+	forwarded, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(forwarded))
+
+	container := interceptCreate(t, i, `{"Image": "myorg/web", "Entrypoint": ["/bin/sh"]}`)
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, container["Entrypoint"])
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// platformInspectAPIVersion is the first version of the Docker API in
+// which inspecting an image can be asked for a particular platform's
+// variant of it, as kept by the containerd image store.
+const platformInspectAPIVersion = "1.49"
+
+// platform is what a create request asks to run with ?platform=, as
+// os[/arch[/variant]].
+type platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p platform) String() string {
+	return strings.TrimRight(strings.Join([]string{p.OS, p.Architecture, p.Variant}, "/"), "/")
+}
+
+// Docker's names for the architectures that go by others, e.g. in
+// `uname -m`
+var platformArchitectures = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"aarch64": "arm64",
+}
+
+// parsePlatform parses the platform a create request asks for, or
+// returns nil if it doesn't ask for one.
+func parsePlatform(value string) (*platform, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(strings.ToLower(value), "/")
+	if len(parts) > 3 {
+		return nil, &ErrInvalidQueryParam{"platform", value}
+	}
+	for _, part := range parts {
+		if part == "" {
+			return nil, &ErrInvalidQueryParam{"platform", value}
+		}
+	}
+	p := &platform{OS: parts[0]}
+	if len(parts) > 1 {
+		p.Architecture = parts[1]
+		if arch, found := platformArchitectures[p.Architecture]; found {
+			p.Architecture = arch
+		}
+	}
+	if len(parts) > 2 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// matches reports whether image was built for p, as far as inspecting
+// it tells.
+func (p *platform) matches(image *docker.Image) bool {
+	return (image.OS == "" || image.OS == p.OS) &&
+		(p.Architecture == "" || image.Architecture == p.Architecture)
+}
+
+// inspectImageForPlatform inspects the image as inspectImageWithRetry
+// does, but if a create asked for a platform, p, other than the one
+// Docker inspects by default, as it may for an image from a manifest
+// list, then asks for p's variant, whose Cmd and Entrypoint are the
+// ones that will run. Should Docker not know which that is, we make do
+// with the default.
+func (proxy *Proxy) inspectImageForPlatform(ctx context.Context, name string, p *platform) (*docker.Image, error) {
+	image, err := proxy.inspectImageWithRetry(ctx, name)
+	if err != nil || p == nil || p.matches(image) {
+		return image, err
+	}
+	variant, err := proxy.cachedImage(ctx, name+" "+p.String(), func() (*docker.Image, error) {
+		return proxy.inspectImageVariant(ctx, name, p)
+	})
+	if err != nil {
+		proxy.warnings.Warningf("Using the %s/%s config of image %s for its command, since inspecting it for %s failed: %s", image.OS, image.Architecture, name, p, err)
+		return image, nil
+	}
+	if !p.matches(variant) {
+		proxy.warnings.Warningf("Using the %s/%s config of image %s for its command, since Docker has none for %s", variant.OS, variant.Architecture, name, p)
+	}
+	return variant, nil
+}
+
+// errPlatformInspectTooOld is returned by inspectImageVariant once
+// Docker has said it doesn't have platformInspectAPIVersion, so that it
+// isn't asked again on every create.
+var errPlatformInspectTooOld = fmt.Errorf("Docker is older than API version %s", platformInspectAPIVersion)
+
+// inspectImageVariant asks Docker directly, since our client's API
+// version is too old to, for p's variant of the image.
+func (proxy *Proxy) inspectImageVariant(ctx context.Context, name string, p *platform) (*docker.Image, error) {
+	proxy.Lock()
+	tooOld := proxy.platformInspectTooOld
+	proxy.Unlock()
+	if tooOld {
+		return nil, errPlatformInspectTooOld
+	}
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"platform": {string(encoded)}}
+	req, err := http.NewRequest("GET", "http://docker/v"+platformInspectAPIVersion+"/images/"+name+"/json?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := proxy.dockerHTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if apiVersionTooNew(resp.StatusCode, string(body)) {
+			proxy.Lock()
+			proxy.platformInspectTooOld = true
+			proxy.Unlock()
+			return nil, errPlatformInspectTooOld
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var image docker.Image
+	if err := json.NewDecoder(resp.Body).Decode(&image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// apiVersionTooNew tells whether Docker answered as it does a request
+// for an API version newer than its own.
+func apiVersionTooNew(status int, body string) bool {
+	return status == http.StatusBadRequest &&
+		(strings.Contains(body, "is too new") || strings.Contains(body, "is newer than server"))
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for value, expected := range map[string]*platform{
+		"":               nil,
+		"linux":          {OS: "linux"},
+		"linux/arm64":    {OS: "linux", Architecture: "arm64"},
+		"Linux/aarch64":  {OS: "linux", Architecture: "arm64"},
+		"linux/arm/v7":   {OS: "linux", Architecture: "arm", Variant: "v7"},
+		"windows/x86_64": {OS: "windows", Architecture: "amd64"},
+	} {
+		p, err := parsePlatform(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, expected, p, value)
+	}
+	for _, value := range []string{"/arm64", "linux/", "linux/arm/v7/extra"} {
+		_, err := parsePlatform(value)
+		assert.IsType(t, &ErrInvalidQueryParam{}, err, value)
+	}
+}
+
+func TestCreateWithPlatform(t *testing.T) {
+	var variantInspects int32
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&variantInspects, 1)
+		var p platform
+		require.NoError(t, json.Unmarshal([]byte(r.URL.Query().Get("platform")), &p))
+		switch {
+		case r.URL.Path == "/v1.49/images/multi/json" && p == platform{OS: "linux", Architecture: "arm64"}:
+			fmt.Fprint(w, `{"Os": "linux", "Architecture": "arm64", "Config": {"Entrypoint": ["/arm64/server"]}}`)
+		case r.URL.Path == "/v1.49/images/cmdonly/json" && p == platform{OS: "linux", Architecture: "arm64"}:
+			fmt.Fprint(w, `{"Os": "linux", "Architecture": "arm64", "Config": {"Cmd": ["/arm64/server", "--serve"]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer daemon.Close()
+	amd64 := &docker.Image{OS: "linux", Architecture: "amd64", Config: &docker.Config{Entrypoint: []string{"/amd64/server"}}}
+	cmdOnly := &docker.Image{OS: "linux", Architecture: "amd64", Config: &docker.Config{Cmd: []string{"/amd64/server", "--serve"}}}
+	client := &fakeDockerClient{images: map[string]*docker.Image{"multi": amd64, "cmdonly": cmdOnly}}
+	proxy, err := newTestProxy(Config{WeaveWaitMountPath: "/w", WithoutDNS: true, DockerHost: "tcp://" + strings.TrimPrefix(daemon.URL, "http://")}, client)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		image, platform string
+		entrypoint      []interface{}
+		inspects        int32
+	}{
+		{"multi", "", []interface{}{"/w/w", "/amd64/server"}, 0},
+		{"multi", "linux/amd64", []interface{}{"/w/w", "/amd64/server"}, 0},
+		{"multi", "linux/arm64", []interface{}{"/w/w", "/arm64/server"}, 1},
+		{"multi", "linux/aarch64", []interface{}{"/w/w", "/arm64/server"}, 1}, // cached
+		{"multi", "linux/s390x", []interface{}{"/w/w", "/amd64/server"}, 2},   // Docker has none, so as before
+	} {
+		i := &createContainerInterceptor{proxy: proxy}
+		path := "/v1.41/containers/create"
+		if test.platform != "" {
+			path += "?platform=" + test.platform
+		}
+		r := httptest.NewRequest("POST", path, strings.NewReader(`{"Image": "`+test.image+`"}`))
+		require.NoError(t, i.InterceptRequest(r), path)
+		container := jsonObject{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+		assert.Equal(t, test.entrypoint, container["Entrypoint"], path)
+		assert.Equal(t, test.inspects, atomic.LoadInt32(&variantInspects), path)
+	}
+
+	// an image with no entrypoint, only a Cmd, which is taken from the
+	// same variant
+	for requested, cmd := range map[string][]interface{}{
+		"":            {"/amd64/server", "--serve"},
+		"linux/arm64": {"/arm64/server", "--serve"},
+	} {
+		i := &createContainerInterceptor{proxy: proxy}
+		r := httptest.NewRequest("POST", "/v1.41/containers/create?platform="+requested, strings.NewReader(`{"Image": "cmdonly"}`))
+		require.NoError(t, i.InterceptRequest(r), requested)
+		container := jsonObject{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+		assert.Equal(t, []interface{}{"/w/w"}, container["Entrypoint"], requested)
+		assert.Equal(t, cmd, container["Cmd"], requested)
+	}
+
+	i := &createContainerInterceptor{proxy: proxy}
+	r := httptest.NewRequest("POST", "/v1.41/containers/create?platform=/arm64", strings.NewReader(`{"Image": "multi"}`))
+	assert.IsType(t, &ErrInvalidQueryParam{}, i.InterceptRequest(r))
+}
+
+func TestCreateWithPlatformOldDocker(t *testing.T) {
+	var variantInspects int32
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&variantInspects, 1)
+		http.Error(w, `{"message": "client version 1.49 is too new. Maximum supported API version is 1.41"}`, http.StatusBadRequest)
+	}))
+	defer daemon.Close()
+	amd64 := &docker.Image{OS: "linux", Architecture: "amd64", Config: &docker.Config{Entrypoint: []string{"/amd64/server"}}}
+	client := &fakeDockerClient{images: map[string]*docker.Image{"multi": amd64, "other": amd64}}
+	proxy, err := newTestProxy(Config{WeaveWaitMountPath: "/w", WithoutDNS: true, DockerHost: "tcp://" + strings.TrimPrefix(daemon.URL, "http://")}, client)
+	require.NoError(t, err)
+
+	// Docker can't say, so as before; and isn't asked again, for any image
+	for _, image := range []string{"multi", "multi", "other"} {
+		i := &createContainerInterceptor{proxy: proxy}
+		r := httptest.NewRequest("POST", "/v1.41/containers/create?platform=linux/arm64", strings.NewReader(`{"Image": "`+image+`"}`))
+		require.NoError(t, i.InterceptRequest(r), image)
+		container := jsonObject{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+		assert.Equal(t, []interface{}{"/w/w", "/amd64/server"}, container["Entrypoint"], image)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&variantInspects))
+
+	assert.True(t, apiVersionTooNew(http.StatusBadRequest, "client is newer than server (client API version: 1.49, server API version: 1.24)"))
+	assert.False(t, apiVersionTooNew(http.StatusNotFound, "No such image: multi"))
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// defaultRegistry is where Docker pulls images whose name doesn't say.
+const defaultRegistry = "docker.io"
+
+// imagesCreateInterceptor notes, for the audit log, which image is
+// pulled from which registry. The pull itself, and its streamed
+// progress, pass through untouched.
+type imagesCreateInterceptor struct {
+	proxy *Proxy
+	// set by InterceptRequest for pulls, as opposed to imports
+	ref, registry string
+}
+
+func (i *imagesCreateInterceptor) InterceptRequest(r *http.Request) error {
+	query := r.URL.Query()
+	if query.Get("fromImage") == "" {
+		return nil
+	}
+	i.ref = imageRef(query.Get("fromImage"), query.Get("tag"))
+	i.registry = imageRegistry(i.ref)
+	i.proxy.auditPull(i.ref, i.registry)
+	return nil
+}
+
+func (i *imagesCreateInterceptor) InterceptResponse(r *http.Response) error {
+	return nil
+}
+
+// imageRef is the reference Docker pulls for ?fromImage=image&tag=tag:
+// image itself if it has a tag or digest, or else with tag, which may
+// be a digest.
+func imageRef(image, tag string) string {
+	name := image[strings.LastIndex(image, "/")+1:]
+	if tag == "" || strings.ContainsAny(name, ":@") {
+		return image
+	}
+	if strings.Contains(tag, ":") {
+		return image + "@" + tag
+	}
+	return image + ":" + tag
+}
+
+// imageRegistry is the registry ref names, as Docker tells them apart
+// from the first part of a repository's path.
+func imageRegistry(ref string) string {
+	slash := strings.Index(ref, "/")
+	if slash < 0 {
+		return defaultRegistry
+	}
+	if first := ref[:slash]; strings.ContainsAny(first, ".:") || first == "localhost" {
+		return first
+	}
+	return defaultRegistry
+}
+
+func (proxy *Proxy) auditPull(ref, registry string) {
+	proxy.audit().WithFields(logrus.Fields{
+		"event":    "pull",
+		"image":    ref,
+		"registry": registry,
+	}).Info("Pulling image")
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageRef(t *testing.T) {
+	for _, test := range []struct {
+		image, tag, ref, registry string
+	}{
+		{"nginx", "", "nginx", "docker.io"},
+		{"nginx", "1.13", "nginx:1.13", "docker.io"},
+		{"nginx:1.13", "", "nginx:1.13", "docker.io"},
+		{"weaveworks/weave", "latest", "weaveworks/weave:latest", "docker.io"},
+		{"nginx", "sha256:3f2a", "nginx@sha256:3f2a", "docker.io"},
+		{"quay.io/coreos/etcd", "v3.2", "quay.io/coreos/etcd:v3.2", "quay.io"},
+		{"localhost/app", "", "localhost/app", "localhost"},
+		{"registry.local:5000/app", "1", "registry.local:5000/app:1", "registry.local:5000"},
+		{"registry.local:5000/app:2", "1", "registry.local:5000/app:2", "registry.local:5000"},
+	} {
+		ref := imageRef(test.image, test.tag)
+		assert.Equal(t, test.ref, ref, test.image+" "+test.tag)
+		assert.Equal(t, test.registry, imageRegistry(ref), ref)
+	}
+}
+
+func TestImagesCreateInterceptor(t *testing.T) {
+	var buf bytes.Buffer
+	proxy := &Proxy{auditLog: logrus.New()}
+	proxy.auditLog.Out = &buf
+	proxy.auditLog.Formatter = &logrus.JSONFormatter{}
+
+	const path = "/v1.24/images/create?fromImage=quay.io%2Fcoreos%2Fetcd&tag=v3.2"
+	r := httptest.NewRequest("POST", path, nil)
+	r.Header.Set("X-Registry-Auth", "e30=")
+	i := &imagesCreateInterceptor{proxy: proxy}
+	require.NoError(t, i.InterceptRequest(r))
+	assert.Equal(t, "quay.io/coreos/etcd:v3.2", i.ref)
+	assert.Equal(t, "quay.io", i.registry)
+	assert.Equal(t, path, r.URL.String(), "the pull is passed on as it was")
+	assert.Equal(t, "e30=", r.Header.Get("X-Registry-Auth"))
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "pull", entry["event"])
+	assert.Equal(t, "quay.io/coreos/etcd:v3.2", entry["image"])
+	assert.Equal(t, "quay.io", entry["registry"])
+
+	// an import streams the image as the body, which is left alone
+	buf.Reset()
+	r = httptest.NewRequest("POST", "/v1.24/images/create?fromSrc=-&repo=app", strings.NewReader("tarball"))
+	i = &imagesCreateInterceptor{proxy: proxy}
+	require.NoError(t, i.InterceptRequest(r))
+	assert.Equal(t, "", i.ref)
+	assert.Equal(t, 0, buf.Len())
+	assert.False(t, buffersBody(i))
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "tarball", string(body))
+}
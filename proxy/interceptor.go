@@ -2,7 +2,11 @@ package proxy
 
 import "net/http"
 
-type interceptor interface {
+// An Interceptor gets to inspect and modify each request on its way
+// to Docker, and the corresponding response on its way back to the
+// client. An error from InterceptRequest stops the request from being
+// forwarded at all.
+type Interceptor interface {
 	InterceptRequest(*http.Request) error
 	InterceptResponse(*http.Response) error
 }
@@ -17,3 +21,27 @@ func (i nullInterceptor) InterceptRequest(r *http.Request) error {
 func (i nullInterceptor) InterceptResponse(r *http.Response) error {
 	return nil
 }
+
+// interceptorChain runs several Interceptors over the same request.
+// Both requests and responses are passed to each Interceptor in the
+// order they appear in the chain, and the first one to return an error
+// short-circuits the rest of the chain.
+type interceptorChain []Interceptor
+
+func (c interceptorChain) InterceptRequest(r *http.Request) error {
+	for _, i := range c {
+		if err := i.InterceptRequest(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c interceptorChain) InterceptResponse(r *http.Response) error {
+	for _, i := range c {
+		if err := i.InterceptResponse(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingInterceptor struct {
+	name  string
+	calls *[]string
+	err   error
+}
+
+func (i recordingInterceptor) InterceptRequest(r *http.Request) error {
+	*i.calls = append(*i.calls, i.name+" request")
+	return i.err
+}
+
+func (i recordingInterceptor) InterceptResponse(r *http.Response) error {
+	*i.calls = append(*i.calls, i.name+" response")
+	return i.err
+}
+
+func TestInterceptorChainOrder(t *testing.T) {
+	var calls []string
+	chain := interceptorChain{recordingInterceptor{"a", &calls, nil}, recordingInterceptor{"b", &calls, nil}}
+	assert.NoError(t, chain.InterceptRequest(httptest.NewRequest("POST", "/containers/create", nil)))
+	assert.NoError(t, chain.InterceptResponse(&http.Response{}))
+	assert.Equal(t, []string{"a request", "b request", "a response", "b response"}, calls)
+}
+
+func TestInterceptorChainShortCircuit(t *testing.T) {
+	var calls []string
+	err := errors.New("denied")
+	chain := interceptorChain{recordingInterceptor{"a", &calls, err}, recordingInterceptor{"b", &calls, nil}}
+	assert.Equal(t, err, chain.InterceptRequest(httptest.NewRequest("POST", "/containers/create", nil)))
+	assert.Equal(t, []string{"a request"}, calls)
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// How addresses are picked for containers which don't ask for one
+const (
+	ipAllocationSequential = "sequential" // whichever IPAM hands out next
+	ipAllocationRandom     = "random"     // picked by IPAM at random from its free space, so hard to guess
+)
+
+// An empty strategy is taken as ipAllocationSequential, the default
+func validateIPAllocation(strategy string) error {
+	switch strategy {
+	case "", ipAllocationSequential, ipAllocationRandom:
+		return nil
+	}
+	return fmt.Errorf("Invalid IP allocation strategy '%s': must be %s or %s", strategy, ipAllocationSequential, ipAllocationRandom)
+}
+
+// allocateIP gives containerID an address in subnet, or IPAM's default
+// subnet if that is nil, as the allocation strategy says.
+func (proxy *Proxy) allocateIP(containerID string, subnet *net.IPNet) (*net.IPNet, error) {
+	if proxy.IPAllocation == ipAllocationRandom {
+		return proxy.weave.AllocateRandomIP(containerID, subnet, true)
+	}
+	if subnet == nil {
+		return proxy.weave.AllocateIP(containerID, true)
+	}
+	return proxy.weave.AllocateIPInSubnet(containerID, subnet, true)
+}
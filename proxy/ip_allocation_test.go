@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAllocator hands out addresses in 10.32.0.0/24 in sequence,
+// counting the requests which asked for a random one.
+type fakeAllocator struct {
+	sync.Mutex
+	next   int
+	random int
+}
+
+func (f *fakeAllocator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/ip/"):
+		if r.FormValue("random") == "true" {
+			f.random++
+		}
+		f.next++
+		fmt.Fprintf(w, "10.32.0.%d/24", f.next)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRandomIPAllocation(t *testing.T) {
+	ipam := &fakeAllocator{}
+	ts := httptest.NewServer(ipam)
+	defer ts.Close()
+	proxy, err := newTestProxy(Config{IPAllocation: "random"}, nil, withWeave(strings.TrimPrefix(ts.URL, "http://")))
+	require.NoError(t, err)
+
+	for i, cidrs := range [][]string{nil, {"net:default"}, {"net:10.32.0.0/24"}} {
+		ips, err := proxy.allocateCIDRs(context.Background(), fmt.Sprintf("c%d", i), cidrs)
+		require.NoError(t, err, "%v", cidrs)
+		require.Len(t, ips, 1)
+		assert.Equal(t, fmt.Sprintf("10.32.0.%d/24", i+1), ips[0].String())
+	}
+	// IPAM picks them, from the space this peer owns
+	assert.Equal(t, 3, ipam.random)
+}
+
+func TestSequentialIPAllocation(t *testing.T) {
+	ipam := &fakeAllocator{}
+	ts := httptest.NewServer(ipam)
+	defer ts.Close()
+	proxy, err := newTestProxy(Config{}, nil, withWeave(strings.TrimPrefix(ts.URL, "http://")))
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		ips, err := proxy.allocateCIDRs(context.Background(), fmt.Sprintf("c%d", i), nil)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("10.32.0.%d/24", i), ips[0].String())
+	}
+	assert.Equal(t, 0, ipam.random)
+
+	_, err = newTestProxy(Config{IPAllocation: "shuffled"}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// What to do when IPAM can't be reached, or says it is unavailable,
+// e.g. while the router restarts
+const (
+	ipamUnavailableFail = "fail" // give up on the container straight away
+	ipamUnavailableWait = "wait" // ask again, backing off, for up to IPAMWaitTimeout
+
+	defaultIPAMWaitTimeout = 30 * time.Second
+	ipamRetryDelay         = 100 * time.Millisecond
+	maxIPAMRetryDelay      = 2 * time.Second
+)
+
+// ErrIPAMUnavailable is returned when IPAM was still unavailable after
+// waiting for it for as long as we were told to.
+type ErrIPAMUnavailable struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (err *ErrIPAMUnavailable) Error() string {
+	return fmt.Sprintf("IPAM still unavailable after %s: %s", err.Timeout, err.Err)
+}
+
+// An empty policy is taken as ipamUnavailableFail, the default
+func validateIPAMUnavailable(policy string, timeout time.Duration) error {
+	switch policy {
+	case "", ipamUnavailableFail, ipamUnavailableWait:
+	default:
+		return fmt.Errorf("Invalid IPAM unavailable policy '%s': must be %s or %s", policy, ipamUnavailableFail, ipamUnavailableWait)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("Invalid IPAM wait timeout %s: must not be negative", timeout)
+	}
+	return nil
+}
+
+// ipamUnavailable tells errors which may go away by themselves, because
+// the router isn't answering or has said it can't yet, from those which
+// won't, such as an address already being taken.
+func ipamUnavailable(err error) bool {
+	if isConnectionRefused(err) {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return strings.HasPrefix(err.Error(), "503 ")
+}
+
+// withIPAM runs op, which asks IPAM something, and if IPAM is
+// unavailable and the policy is to wait, runs it again until it gets an
+// answer or the wait times out.
+func (proxy *Proxy) withIPAM(ctx context.Context, op func() error) error {
+	err := op()
+	if err == nil || proxy.IPAMUnavailable != ipamUnavailableWait || !ipamUnavailable(err) {
+		return err
+	}
+	timeout := proxy.IPAMWaitTimeout
+	if timeout == 0 {
+		timeout = defaultIPAMWaitTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for delay := ipamRetryDelay; ; delay *= 2 {
+		if delay > maxIPAMRetryDelay {
+			delay = maxIPAMRetryDelay
+		}
+		if remaining := deadline.Sub(time.Now()); remaining <= 0 {
+			return &ErrIPAMUnavailable{Timeout: timeout, Err: err}
+		} else if delay > remaining {
+			delay = remaining
+		}
+		proxy.warnings.Warningf("IPAM unavailable, asking again: %s", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err = op(); err == nil || !ipamUnavailable(err) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyIPAM answers allocations with 503 until it has been asked
+// unavailable times.
+func flakyIPAM(unavailable int32, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= unavailable {
+			http.Error(w, "IPAM not ready", http.StatusServiceUnavailable)
+			return
+		}
+		switch {
+		case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/ip/"):
+			fmt.Fprint(w, "10.32.0.5/12")
+		case r.Method == "PUT" && r.URL.Path == "/ip/c1/10.32.0.9/12":
+			http.Error(w, "address 10.32.0.9 is already owned by c0", http.StatusBadRequest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestIPAMUnavailable(t *testing.T) {
+	for _, test := range []struct {
+		policy      string
+		timeout     time.Duration
+		unavailable int32
+		cidrs       []string
+		requests    int32
+		allocated   bool
+		timedOut    bool
+	}{
+		{"", 0, 0, nil, 1, true, false},
+		{"fail", 0, 2, nil, 1, false, false},
+		{"wait", time.Second, 2, nil, 3, true, false},
+		{"wait", time.Second, 2, []string{"net:10.32.0.0/12"}, 3, true, false},
+		{"wait", 250 * time.Millisecond, 1000, nil, 0, false, true},
+		// not something waiting will fix
+		{"wait", time.Second, 0, []string{"10.32.0.9/12"}, 1, false, false},
+	} {
+		var requests int32
+		ts := flakyIPAM(test.unavailable, &requests)
+		proxy, err := newTestProxy(Config{IPAMUnavailable: test.policy, IPAMWaitTimeout: test.timeout}, nil, withWeave(strings.TrimPrefix(ts.URL, "http://")))
+		require.NoError(t, err)
+
+		start := time.Now()
+		ips, err := proxy.allocateCIDRs(context.Background(), "c1", test.cidrs)
+		took := time.Since(start)
+		ts.Close()
+
+		context := fmt.Sprintf("%s %s %v", test.policy, test.timeout, test.cidrs)
+		if test.allocated {
+			require.NoError(t, err, context)
+			require.Len(t, ips, 1, context)
+			assert.Equal(t, "10.32.0.5/12", ips[0].String(), context)
+		} else {
+			assert.Error(t, err, context)
+		}
+		_, timedOut := errors.Cause(err).(*ErrIPAMUnavailable)
+		assert.Equal(t, test.timedOut, timedOut, context)
+		if test.timedOut {
+			assert.True(t, took >= test.timeout && took < test.timeout+time.Second, "took %s", took)
+		} else {
+			assert.Equal(t, test.requests, atomic.LoadInt32(&requests), context)
+		}
+	}
+
+	_, err := newTestProxy(Config{IPAMUnavailable: "retry"}, nil)
+	assert.Error(t, err)
+	_, err = newTestProxy(Config{IPAMUnavailable: "wait", IPAMWaitTimeout: -time.Second}, nil)
+	assert.Error(t, err)
+}
+
+func TestIsIPAMUnavailable(t *testing.T) {
+	assert.True(t, ipamUnavailable(errors.New("503 Service Unavailable: IPAM not ready")))
+	assert.False(t, ipamUnavailable(errors.New("400 Bad Request: address already owned")))
+	assert.False(t, ipamUnavailable(errors.New("5030 things")))
+}
+
+func TestIPAMWaitGivesUpWithClient(t *testing.T) {
+	var requests int32
+	ts := flakyIPAM(1000, &requests)
+	defer ts.Close()
+	proxy, err := newTestProxy(Config{IPAMUnavailable: "wait", IPAMWaitTimeout: time.Minute}, nil, withWeave(strings.TrimPrefix(ts.URL, "http://")))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = proxy.allocateCIDRs(ctx, "c1", nil)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.True(t, time.Since(start) < 5*time.Second, "took %s", time.Since(start))
+}
+
+func TestStaticCIDRIPAMTimeout(t *testing.T) {
+	var requests int32
+	ts := flakyIPAM(1000, &requests)
+	defer ts.Close()
+	proxy, err := newTestProxy(Config{IPAMUnavailable: "wait", IPAMWaitTimeout: 250 * time.Millisecond}, nil, withWeave(strings.TrimPrefix(ts.URL, "http://")))
+	require.NoError(t, err)
+
+	_, err = proxy.staticCIDR(context.Background(), "10.32.0.9")
+	require.Error(t, err)
+	_, timedOut := errors.Cause(err).(*ErrIPAMUnavailable)
+	assert.True(t, timedOut, "%s", err)
+}
@@ -1,8 +1,12 @@
 package proxy
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 type UnmarshalWrongTypeError struct {
@@ -11,11 +15,27 @@ type UnmarshalWrongTypeError struct {
 }
 
 func (e *UnmarshalWrongTypeError) Error() string {
-	return fmt.Sprintf("Wrong type for %s field, expected %s, but got %T", e.Field, e.Expected, e.Got)
+	return fmt.Sprintf("Wrong type for %s field, expected %s, but got %s", e.Field, e.Expected, jsonTypeName(e.Got))
 }
 
 type jsonObject map[string]interface{}
 
+// keyFor returns the key under which j holds the field called name.
+// Docker matches field names case-insensitively, so a client may have
+// sent e.g. DNSSearch where the API documents DnsSearch; if j has no
+// such field, name itself is returned.
+func (j jsonObject) keyFor(name string) string {
+	if _, found := j[name]; found {
+		return name
+	}
+	for key := range j {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
 func (j jsonObject) Object(key string) (jsonObject, error) {
 	iface, ok := j[key]
 	if !ok || iface == nil {
@@ -46,6 +66,20 @@ func (j jsonObject) String(key string) (string, error) {
 	return result, nil
 }
 
+func (j jsonObject) Bool(key string) (bool, error) {
+	iface, ok := j[key]
+	if !ok || iface == nil {
+		return false, nil
+	}
+
+	result, ok := iface.(bool)
+	if !ok {
+		return false, &UnmarshalWrongTypeError{key, "bool", iface}
+	}
+
+	return result, nil
+}
+
 func (j jsonObject) Int(key string) (int, error) {
 	iface, ok := j[key]
 	if !ok || iface == nil {
@@ -90,3 +124,140 @@ func (j jsonObject) StringArray(key string) ([]string, error) {
 
 	return nil, &UnmarshalWrongTypeError{key, "string or array of strings", iface}
 }
+
+func (j jsonObject) StringMap(key string) (map[string]string, error) {
+	iface, ok := j[key]
+	if !ok || iface == nil {
+		return nil, nil
+	}
+
+	switch o := iface.(type) {
+	case map[string]string:
+		return o, nil
+	case map[string]interface{}:
+		result := map[string]string{}
+		for k, v := range o {
+			if s, ok := v.(string); ok {
+				result[k] = s
+			} else {
+				return nil, &UnmarshalWrongTypeError{key, "object of strings", iface}
+			}
+		}
+		return result, nil
+	}
+
+	return nil, &UnmarshalWrongTypeError{key, "object of strings", iface}
+}
+
+func asJSONObject(v interface{}) (jsonObject, bool) {
+	switch o := v.(type) {
+	case jsonObject:
+		return o, true
+	case map[string]interface{}:
+		return jsonObject(o), true
+	}
+	return nil, false
+}
+
+// mergeJSON marshals modified, copying the original bytes of any value
+// which is unchanged and keeping object keys in their original order,
+// so that what we pass on to Docker differs from what the client sent
+// only where we changed it. New keys are added at the end of their
+// object, in sorted order.
+func mergeJSON(original json.RawMessage, modified interface{}) ([]byte, error) {
+	if obj, ok := asJSONObject(modified); ok && isJSONObject(original) {
+		keys, fields, err := orderedFields(original)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		write := func(key string, value []byte) {
+			if buf.Len() > 0 {
+				buf.WriteByte(',')
+			} else {
+				buf.WriteByte('{')
+			}
+			name, _ := json.Marshal(key)
+			buf.Write(name)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		for _, key := range keys {
+			if value, found := obj[key]; found {
+				b, err := mergeJSON(fields[key], value)
+				if err != nil {
+					return nil, err
+				}
+				write(key, b)
+			}
+		}
+		var added []string
+		for key := range obj {
+			if _, found := fields[key]; !found {
+				added = append(added, key)
+			}
+		}
+		sort.Strings(added)
+		for _, key := range added {
+			b, err := json.Marshal(obj[key])
+			if err != nil {
+				return nil, err
+			}
+			write(key, b)
+		}
+		if buf.Len() == 0 {
+			return []byte("{}"), nil
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	}
+
+	b, err := json.Marshal(modified)
+	if err != nil {
+		return nil, err
+	}
+	if original != nil && jsonEqual(original, b) {
+		return original, nil
+	}
+	return b, nil
+}
+
+func isJSONObject(raw json.RawMessage) bool {
+	trimmed := bytes.TrimLeft(raw, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// orderedFields splits a JSON object into its values, and its keys in
+// the order they appear.
+func orderedFields(raw json.RawMessage) ([]string, map[string]json.RawMessage, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := d.Token(); err != nil { // opening brace
+		return nil, nil, err
+	}
+	var keys []string
+	fields := map[string]json.RawMessage{}
+	for d.More() {
+		token, err := d.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, _ := token.(string)
+		var value json.RawMessage
+		if err := d.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		if _, found := fields[key]; !found {
+			keys = append(keys, key)
+		}
+		fields[key] = value
+	}
+	return keys, fields, nil
+}
+
+func jsonEqual(a, b []byte) bool {
+	var va, vb interface{}
+	if unmarshalBody(a, &va) != nil || unmarshalBody(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
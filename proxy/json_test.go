@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLookupObject(t *testing.T) {
@@ -114,3 +115,68 @@ func TestLookupStringArray(t *testing.T) {
 		assert.Equal(t, test.err, gotErr, msg)
 	}
 }
+
+func TestLookupStringMap(t *testing.T) {
+	tests := []struct {
+		root   jsonObject
+		key    string
+		result map[string]string
+		err    error
+	}{
+		{
+			jsonObject{},
+			"a",
+			nil,
+			nil,
+		},
+		{
+			jsonObject{"a": map[string]interface{}{"b": "c"}},
+			"a",
+			map[string]string{"b": "c"},
+			nil,
+		},
+		{
+			jsonObject{"a": map[string]interface{}{"b": 5}},
+			"a",
+			nil,
+			&UnmarshalWrongTypeError{Field: "a", Expected: "object of strings", Got: map[string]interface{}{"b": 5}},
+		},
+		{
+			jsonObject{"int": 5},
+			"int",
+			nil,
+			&UnmarshalWrongTypeError{Field: "int", Expected: "object of strings", Got: 5},
+		},
+	}
+	for _, test := range tests {
+		gotResult, gotErr := test.root.StringMap(test.key)
+		msg := fmt.Sprintf("%q.StringMap(%q) => %q, %q", test.root, test.key, gotResult, gotErr)
+		assert.Equal(t, test.result, gotResult, msg)
+		assert.Equal(t, test.err, gotErr, msg)
+	}
+}
+
+func TestMergeJSON(t *testing.T) {
+	original := []byte(`{"Image":"nginx","Zebra":{"b":2,"a":1.50},"Entrypoint":["/bin/sh"],"HostConfig":{"Memory":1e9,"Binds":null},"Removed":true}`)
+	modified := jsonObject{}
+	require.NoError(t, unmarshalBody(original, &modified))
+	modified["Entrypoint"] = []string{"/w/w", "/bin/sh"}
+	hostConfig, err := modified.Object("HostConfig")
+	require.NoError(t, err)
+	hostConfig["Binds"] = []string{"/var/lib/weavewait:/w:ro"}
+	hostConfig["Dns"] = []string{"172.17.0.1"}
+	modified["Hostname"] = "web"
+	delete(modified, "Removed")
+
+	merged, err := mergeJSON(original, modified)
+	require.NoError(t, err)
+	// Unknown fields keep their position and exact bytes, including
+	// key order within them and number formatting
+	assert.Equal(t, `{"Image":"nginx","Zebra":{"b":2,"a":1.50},"Entrypoint":["/w/w","/bin/sh"],"HostConfig":{"Memory":1e9,"Binds":["/var/lib/weavewait:/w:ro"],"Dns":["172.17.0.1"]},"Hostname":"web"}`, string(merged))
+
+	unchanged := jsonObject{}
+	require.NoError(t, unmarshalBody(original, &unchanged))
+	merged, err = mergeJSON(original, unchanged)
+	require.NoError(t, err)
+	assert.Equal(t, string(original), string(merged))
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrLabelSkipped is returned for containers with a label the proxy
+// was told, with --skip-label, to leave alone.
+type ErrLabelSkipped struct {
+	Selector string
+}
+
+func (err *ErrLabelSkipped) Error() string {
+	return fmt.Sprintf("it matches --skip-label %q", err.Selector)
+}
+
+// labelSelector matches containers with the label key, and if hasValue
+// then only with that value.
+type labelSelector struct {
+	key, value string
+	hasValue   bool
+}
+
+func (s labelSelector) String() string {
+	if s.hasValue {
+		return s.key + "=" + s.value
+	}
+	return s.key
+}
+
+func (s labelSelector) matches(labels map[string]string) bool {
+	value, found := labels[s.key]
+	return found && (!s.hasValue || value == s.value)
+}
+
+// parseLabelSelector turns "key=value", or just "key" for any value,
+// into a selector, or returns false if the key is missing.
+func parseLabelSelector(entry string) (labelSelector, bool) {
+	parts := strings.SplitN(entry, "=", 2)
+	if parts[0] == "" {
+		return labelSelector{}, false
+	}
+	selector := labelSelector{key: parts[0]}
+	if len(parts) == 2 {
+		selector.value, selector.hasValue = parts[1], true
+	}
+	return selector, true
+}
+
+// parseSkipLabels turns "key=value", or just "key" for any value, into
+// selectors for containers to leave off the weave network.
+func parseSkipLabels(entries []string) ([]labelSelector, error) {
+	var selectors []labelSelector
+	for _, entry := range entries {
+		selector, ok := parseLabelSelector(entry)
+		if !ok {
+			return nil, fmt.Errorf("invalid skip label %q: must be key=value or key", entry)
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+// labelsSelected returns an error if a container with labels should be
+// left alone, i.e. if any of the skip selectors matches them.
+func (proxy *Proxy) labelsSelected(labels map[string]string) error {
+	for _, selector := range proxy.skipLabels {
+		if selector.matches(labels) {
+			return &ErrLabelSkipped{selector.String()}
+		}
+	}
+	return nil
+}
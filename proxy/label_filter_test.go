@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelsSelected(t *testing.T) {
+	selectors, err := parseSkipLabels([]string{"tenant=internal", "io.example.no-weave", "tier="})
+	require.NoError(t, err)
+	proxy := &Proxy{skipLabels: selectors}
+
+	for _, test := range []struct {
+		labels   map[string]string
+		selected bool
+	}{
+		{nil, true},
+		{map[string]string{"app": "web"}, true},
+		{map[string]string{"tenant": "customer-a"}, true},
+		{map[string]string{"tenant": "internal"}, false},
+		// any one selector is enough
+		{map[string]string{"app": "web", "io.example.no-weave": "yes"}, false},
+		{map[string]string{"io.example.no-weave": ""}, false},
+		// an empty value only matches an empty value
+		{map[string]string{"tier": ""}, false},
+		{map[string]string{"tier": "db"}, true},
+	} {
+		err := proxy.labelsSelected(test.labels)
+		if test.selected {
+			assert.NoError(t, err, "labels %q", test.labels)
+		} else {
+			assert.IsType(t, &ErrLabelSkipped{}, err, "labels %q", test.labels)
+		}
+	}
+
+	_, err = parseSkipLabels([]string{"=internal"})
+	assert.Error(t, err)
+}
+
+func TestCreateWithSkipLabel(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, FailClosed: true})
+	var err error
+	i.proxy.skipLabels, err = parseSkipLabels([]string{"tenant=internal"})
+	require.NoError(t, err)
+
+	const body = `{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Labels": {"tenant": "internal"}}`
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(body))
+	require.NoError(t, i.InterceptRequest(r), "deliberately left alone, so not refused even when failing closed")
+	forwarded, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(forwarded))
+
+	container := interceptCreate(t, i, `{"Image": "nginx", "Entrypoint": ["/bin/sh"], "Labels": {"tenant": "customer-a"}}`)
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, container["Entrypoint"])
+}
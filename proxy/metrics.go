@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type proxyMetrics struct {
+	interceptDuration *prometheus.HistogramVec
+	weaveCIDRErrors   prometheus.Counter
+	noSuchImageErrors prometheus.Counter
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		interceptDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "weave_proxy_intercept_request_duration_seconds",
+			Help: "Time taken by the proxy to intercept requests to Docker.",
+		}, []string{"interceptor"}),
+		weaveCIDRErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "weave_proxy_weave_cidr_errors_total",
+			Help: "Number of containers created without weave networking because their WEAVE_CIDR could not be used.",
+		}),
+		noSuchImageErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "weave_proxy_no_such_image_errors_total",
+			Help: "Number of container creations rejected because the image was not found.",
+		}),
+	}
+}
+
+// Metrics returns the proxy's metrics, for registering with a
+// Prometheus registry.
+func (proxy *Proxy) Metrics() prometheus.Collector {
+	return proxy.metrics
+}
+
+func (m *proxyMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.interceptDuration.Describe(ch)
+	m.weaveCIDRErrors.Describe(ch)
+	m.noSuchImageErrors.Describe(ch)
+}
+
+func (m *proxyMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.interceptDuration.Collect(ch)
+	m.weaveCIDRErrors.Collect(ch)
+	m.noSuchImageErrors.Collect(ch)
+}
+
+// The methods below may be called on a nil *proxyMetrics, for proxies
+// constructed without one in tests.
+
+func (m *proxyMetrics) observeIntercept(i Interceptor, start time.Time) {
+	if m != nil {
+		m.interceptDuration.WithLabelValues(interceptorName(i)).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *proxyMetrics) weaveCIDRError() {
+	if m != nil {
+		m.weaveCIDRErrors.Inc()
+	}
+}
+
+func (m *proxyMetrics) noSuchImageError() {
+	if m != nil {
+		m.noSuchImageErrors.Inc()
+	}
+}
+
+// A chain is named after the built-in interceptor at its head
+func interceptorName(i Interceptor) string {
+	if c, ok := i.(interceptorChain); ok && len(c) > 0 {
+		i = c[0]
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(fmt.Sprintf("%T", i), "*"), "proxy.")
+}
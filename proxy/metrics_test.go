@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	proxy := &Proxy{metrics: newProxyMetrics()}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(proxy.Metrics())
+
+	proxy.Intercept(failingInterceptor{&ErrNoSuchImage{"busybox"}}, httptest.NewRecorder(), httptest.NewRequest("POST", "/containers/create", nil))
+
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `weave_proxy_intercept_request_duration_seconds_count{interceptor="failingInterceptor"} 1`)
+	assert.Contains(t, string(body), "weave_proxy_weave_cidr_errors_total 0")
+	assert.Contains(t, string(body), "weave_proxy_no_such_image_errors_total 1")
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// networkConnectInterceptor handles 'docker network connect' and
+// 'docker network disconnect' for the network named by
+// Config.AttachNetwork, attaching the container to weave or detaching
+// it again.
+type networkConnectInterceptor struct {
+	proxy       *Proxy
+	containerID string
+	disconnect  bool
+}
+
+func (i *networkConnectInterceptor) InterceptRequest(r *http.Request) error {
+	if i.proxy.AttachNetwork == "" {
+		return nil
+	}
+	subs := networkIDRegexp.FindStringSubmatch(r.URL.Path)
+	if subs == nil || !i.proxy.isAttachNetwork(subs[2]) {
+		return nil
+	}
+
+	body := jsonObject{}
+	if err := unmarshalRequestBody(r, &body); err != nil {
+		return err
+	}
+	containerID, err := body.String("Container")
+	if err != nil {
+		return err
+	}
+	i.containerID = containerID
+	i.disconnect = subs[3] != ""
+	return nil
+}
+
+func (i *networkConnectInterceptor) InterceptResponse(r *http.Response) error {
+	if i.containerID == "" || r.StatusCode < 200 || r.StatusCode >= 300 {
+		return nil
+	}
+	// The request may name the container rather than give its ID, and
+	// we key everything on the ID
+	container, err := i.proxy.client.InspectContainer(i.containerID)
+	if err != nil {
+		Log.Warningf("Error inspecting container %s: %v", i.containerID, err)
+		return nil
+	}
+	if i.disconnect {
+		err = i.proxy.detach(container.ID)
+	} else if container.State.Running {
+		err = i.proxy.attachContainer(r.Request.Context(), container)
+	}
+	if err != nil {
+		// Docker has already done what it was asked; don't report
+		// failure to the client for something it didn't request
+		Log.Warningf("Error handling network change for container %s: %s", container.ID, err)
+	}
+	return nil
+}
+
+// isAttachNetwork returns true if the network given, by name or ID, is
+// the one named by Config.AttachNetwork.
+func (proxy *Proxy) isAttachNetwork(network string) bool {
+	if network == proxy.AttachNetwork {
+		return true
+	}
+	info, err := proxy.client.NetworkInfo(network)
+	if err != nil {
+		Log.Debugf("Error inspecting network %s: %v", network, err)
+		return false
+	}
+	return info.Name == proxy.AttachNetwork
+}
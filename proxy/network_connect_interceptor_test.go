@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	weaveapi "github.com/weaveworks/weave/api"
+)
+
+// networkDocker answers just the inspect calls the network interceptor makes
+func networkDocker() *fakeDockerClient {
+	c1 := &docker.Container{ID: "c1", State: docker.State{Running: true}}
+	return &fakeDockerClient{
+		containers: map[string]*docker.Container{"web": c1, "c1": c1},
+		networks:   map[string]*docker.Network{"4f1c7a": {Name: "weave", ID: "4f1c7a"}},
+	}
+}
+
+func TestIsAttachNetwork(t *testing.T) {
+	client := networkDocker()
+	proxy := &Proxy{Config: Config{AttachNetwork: "weave"}, client: client}
+
+	assert.True(t, proxy.isAttachNetwork("weave"))
+	assert.True(t, proxy.isAttachNetwork("4f1c7a"))
+	assert.False(t, proxy.isAttachNetwork("bridge"))
+}
+
+func TestNetworkConnectInterceptRequest(t *testing.T) {
+	client := networkDocker()
+	proxy := &Proxy{Config: Config{AttachNetwork: "weave"}, client: client}
+
+	for _, test := range []struct {
+		path        string
+		containerID string
+		disconnect  bool
+	}{
+		{"/v1.24/networks/weave/connect", "web", false},
+		{"/networks/4f1c7a/disconnect", "web", true},
+		{"/v1.24/networks/bridge/connect", "", false},
+	} {
+		i := &networkConnectInterceptor{proxy: proxy}
+		r := httptest.NewRequest("POST", test.path, strings.NewReader(`{"Container": "web"}`))
+		require.NoError(t, i.InterceptRequest(r))
+		assert.Equal(t, test.containerID, i.containerID, test.path)
+		assert.Equal(t, test.disconnect, i.disconnect, test.path)
+	}
+
+	// disabled unless a network is configured
+	proxy.AttachNetwork = ""
+	i := &networkConnectInterceptor{proxy: proxy}
+	require.NoError(t, i.InterceptRequest(httptest.NewRequest("POST", "/networks/weave/connect", strings.NewReader(`{"Container": "web"}`))))
+	assert.Equal(t, "", i.containerID)
+}
+
+func TestNetworkDisconnectDetaches(t *testing.T) {
+	client := networkDocker()
+
+	var mu sync.Mutex
+	var weaveCalls []string
+	weave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		weaveCalls = append(weaveCalls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+	}))
+	defer weave.Close()
+
+	var weaveUtilArgs []string
+	defer func(f func(...string) ([]byte, error)) { runWeaveUtil = f }(runWeaveUtil)
+	runWeaveUtil = func(args ...string) ([]byte, error) {
+		weaveUtilArgs = args
+		return nil, nil
+	}
+
+	proxy := &Proxy{
+		Config:        Config{AttachNetwork: "weave"},
+		client:        client,
+		weave:         weaveapi.NewClient(strings.TrimPrefix(weave.URL, "http://"), Log),
+		attachedCIDRs: make(map[string][]string),
+		attachedIPs:   make(map[string][]*net.IPNet),
+	}
+	_, ipnet, _ := net.ParseCIDR("10.32.0.0/12")
+	ipnet.IP = net.ParseIP("10.32.0.5")
+	proxy.rememberCIDRs("c1", nil, []*net.IPNet{ipnet})
+
+	i := &networkConnectInterceptor{proxy: proxy}
+	r := httptest.NewRequest("POST", "/networks/weave/disconnect", strings.NewReader(`{"Container": "web"}`))
+	require.NoError(t, i.InterceptRequest(r))
+	require.NoError(t, i.InterceptResponse(&http.Response{StatusCode: http.StatusOK, Request: r}))
+
+	assert.Equal(t, []string{"detach-container", "c1", "10.32.0.5/12"}, weaveUtilArgs)
+	assert.Equal(t, []string{"DELETE /name/c1/10.32.0.5", "DELETE /ip/c1"}, weaveCalls)
+	assert.Empty(t, proxy.reattachCIDRs("c1", nil), "released addresses must not be reclaimed on restart")
+
+	// nothing attached any more, so a second disconnect is a no-op
+	weaveUtilArgs = nil
+	require.NoError(t, proxy.detach("c1"))
+	assert.Nil(t, weaveUtilArgs)
+}
@@ -2,18 +2,26 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/pkg/errors"
 
@@ -30,6 +38,36 @@ const (
 	weaveSock     = "/var/run/weave/weave.sock"
 	weaveSockUnix = "unix://" + weaveSock
 
+	defaultWeaveWaitMountPath = "/w"
+	defaultDNSDomainTimeout   = 2 * time.Second
+	defaultDNSDomainCacheTTL  = 5 * time.Second
+	defaultWeaveDNSIdleConns  = 2
+	weaveDNSIdleConnTimeout   = 90 * time.Second
+	dnsDomainRetryDelay       = 200 * time.Millisecond
+	imageCacheTTL             = 5 * time.Second
+	imageInspectRetryDelay    = 100 * time.Millisecond
+	maxDNSTTL                 = 24 * 60 * 60 // seconds
+
+	// How containers get a DNS search path when they don't ask for one
+	dnsSearchFQDN   = "fqdn"   // "." if the container has a hostname, which is then fully qualified; else the weaveDNS domain
+	dnsSearchDomain = "domain" // always the weaveDNS domain
+	dnsSearchNone   = "none"   // leave the search path alone
+
+	// Stands for the container's weaveDNS domain in --dns-search
+	dnsSearchWeaveDomain = "@weave"
+
+	// Resolver option to query over TCP, for answers too big for UDP
+	dnsOptionUseVC = "use-vc"
+
+	// How weavewait is put in front of a container's command
+	waitPositionPrepend = "prepend" // as the entrypoint, followed by the container's own
+	waitPositionWrap    = "wrap"    // as the whole entrypoint, with the container's entrypoint and command as its arguments
+
+	// weavewait argument naming the weaveDNS name it waits to resolve
+	waitDNSArg = "--wait-dns="
+	// weavewait argument telling it not to wait for the multicast route
+	noMulticastRouteArg = "--no-multicast-route"
+
 	initialInterval = 2 * time.Second
 	maxInterval     = 1 * time.Minute
 )
@@ -40,7 +78,12 @@ var (
 	containerInspectRegexp = dockerAPIEndpoint("containers/[^/]*/json")
 	execCreateRegexp       = dockerAPIEndpoint("containers/[^/]*/exec")
 	execInspectRegexp      = dockerAPIEndpoint("exec/[^/]*/json")
+	networkConnectRegexp   = dockerAPIEndpoint("networks/[^/]*/(dis)?connect")
+	containerRemoveRegexp  = dockerAPIEndpoint("containers/[^/]*")
+	imagesCreateRegexp     = dockerAPIEndpoint("images/create")
 
+	// ErrWeaveCIDRNone is not a failure but the container opting out
+	// of weave: the create request is passed on exactly as it was sent
 	ErrWeaveCIDRNone = errors.New("the container was created with the '-e WEAVE_CIDR=none' option")
 	ErrNoDefaultIPAM = errors.New("the container was created without specifying an IP address with '-e WEAVE_CIDR=...' and the proxy was started with the '--no-default-ipalloc' option")
 )
@@ -50,21 +93,89 @@ func dockerAPIEndpoint(endpoint string) *regexp.Regexp {
 }
 
 type Config struct {
-	Enabled             bool
-	HostnameFromLabel   string
-	HostnameMatch       string
-	HostnameReplacement string
-	Image               string
-	ListenAddrs         []string
-	RewriteInspect      bool
-	NoDefaultIPAM       bool
-	NoRewriteHosts      bool
-	TLSConfig           TLSConfig
-	WithoutDNS          bool
-	NoMulticastRoute    bool
-	KeepTXOn            bool
-	DockerBridge        string
-	DockerHost          string
+	Enabled              bool            `yaml:"proxy"`
+	HostnameFromLabel    string          `yaml:"hostname-from-label"`
+	HostnameMatch        string          `yaml:"hostname-match"`
+	HostnameReplacement  string          `yaml:"hostname-replacement"`
+	HostnameTemplate     string          `yaml:"hostname-template"`
+	HostnameCollision    string          `yaml:"hostname-collision"`
+	Image                string          `yaml:"-"`
+	ListenAddrs          []string        `yaml:"H"`
+	RewriteInspect       bool            `yaml:"rewrite-inspect"`
+	NoDefaultIPAM        bool            `yaml:"no-default-ipalloc"`
+	IPAMUnavailable      string          `yaml:"ipam-unavailable"`
+	IPAMWaitTimeout      time.Duration   `yaml:"ipam-wait-timeout"`
+	IPAllocation         string          `yaml:"ip-allocation"`
+	NoRewriteHosts       bool            `yaml:"no-rewrite-hosts"`
+	TLSConfig            TLSConfig       `yaml:",inline"`
+	WithoutDNS           bool            `yaml:"without-dns"`
+	NoMulticastRoute     bool            `yaml:"no-multicast-route"`
+	KeepTXOn             bool            `yaml:"-"`
+	DockerBridge         string          `yaml:"-"`
+	DockerHost           string          `yaml:"-"`
+	DockerTLSConfig      DockerTLSConfig `yaml:",inline"`
+	WeaveWaitMountPath   string          `yaml:"wait-mount"`
+	WaitEntrypoint       string          `yaml:"wait-entrypoint"`
+	WaitPosition         string          `yaml:"wait-position"`
+	WaitForDNS           bool            `yaml:"wait-for-dns"`
+	ExecEnv              []string        `yaml:"exec-env"`
+	Env                  []string        `yaml:"env"`
+	ExtraHosts           []string        `yaml:"extra-host"`
+	MaxConcurrentCreates int             `yaml:"max-concurrent-creates"`
+	IncludeImages        []string        `yaml:"include-image"`
+	ExcludeImages        []string        `yaml:"exclude-image"`
+	DNSDomainTimeout     time.Duration   `yaml:"dns-domain-timeout"`
+	WeaveDNSHTTPPort     int             `yaml:"weavedns-http-port"`
+	WeaveDNSIdleConns    int             `yaml:"weavedns-max-idle-conns"`
+	DNSDomainCacheTTL    time.Duration   `yaml:"-"`
+	DockerBridgeIPv6     string          `yaml:"-"`
+	DNSOptions           []string        `yaml:"dns-option"`
+	DNSUseTCP            bool            `yaml:"dns-use-tcp"`
+	DNSServers           []string        `yaml:"dns-server"`
+	DNSServerCheck       string          `yaml:"dns-server-check"`
+	DeriveMAC            bool            `yaml:"derive-mac"`
+	AttachNetwork        string          `yaml:"attach-network"`
+	AuditLog             string          `yaml:"audit-log"`
+	DryRun               bool            `yaml:"dry-run"`
+	FailClosed           bool            `yaml:"fail-closed"`
+	DNSTTL               int             `yaml:"proxy-dns-ttl"`
+	DNSSearchMode        string          `yaml:"dns-search-mode"`
+	DNSSearch            []string        `yaml:"dns-search"`
+	HostID               string          `yaml:"host-id"`
+	AttachWebhook        string          `yaml:"attach-webhook"`
+	ArchWaitVolumes      []string        `yaml:"arch-wait-volume"`
+	DNSServerRefresh     time.Duration   `yaml:"dns-server-refresh"`
+	Sysctls              []string        `yaml:"sysctl"`
+	Init                 bool            `yaml:"init"`
+	ImageInspectRetries  int             `yaml:"image-inspect-retries"`
+	Socket               string          `yaml:"socket"`
+	SocketMode           string          `yaml:"socket-mode"`
+	DNSDrainSignal       string          `yaml:"dns-drain-signal"`
+	WaitTimeout          time.Duration   `yaml:"wait-timeout"`
+	SkipLabels           []string        `yaml:"skip-label"`
+	CapAdd               []string        `yaml:"cap-add"`
+	Ulimits              []string        `yaml:"ulimit"`
+	ReadonlyTmpfs        string          `yaml:"readonly-tmpfs"`
+	PublishOnWeave       bool            `yaml:"publish-on-weave"`
+	WeaveContainer       string          `yaml:"weave-container"`
+	WeaveContainerLabel  string          `yaml:"weave-container-label"`
+	MaxBodyBytes         int64           `yaml:"max-body-bytes"`
+}
+
+type dnsDomainCache struct {
+	sync.Mutex
+	domain  string
+	expires time.Time
+}
+
+type imageCache struct {
+	sync.Mutex
+	images map[string]cachedImage
+}
+
+type cachedImage struct {
+	image   *docker.Image
+	expires time.Time
 }
 
 type wait struct {
@@ -76,16 +187,45 @@ type wait struct {
 type Proxy struct {
 	sync.Mutex
 	Config
-	client                 *weavedocker.Client
+	client                 DockerClient
+	dockerTLS              *tls.Config
 	weave                  *weaveapi.Client
-	dockerBridgeIP         string
+	weaveDNS               *weaveapi.Client
+	dnsDomain              dnsDomainCache
+	images                 imageCache
+	dnsServers             []string
 	hostnameMatchRegexp    *regexp.Regexp
+	hostnameTemplate       *template.Template
 	weaveWaitVolume        string
+	archWaitVolumes        map[string]weaveWaitVolumes
+	sysctls                map[string]string
+	capAdd                 []string
+	ulimits                []docker.ULimit
+	readonlyTmpfs          *tmpfsMount
+	skipLabels             []labelSelector
 	weaveWaitNoopVolume    string
 	weaveWaitNomcastVolume string
 	normalisedAddrs        []string
+	socketMode             os.FileMode
 	waiters                map[*http.Request]*wait
 	attachJobs             map[string]*attachJob
+	attachedCIDRs          map[string][]string
+	attachedIPs            map[string][]*net.IPNet
+	autoRemove             map[string]struct{}
+	aliases                map[string][]string
+	dnsRecords             map[string]*dnsRecord
+	managed                map[string]*managedContainer
+	drainSignal            os.Signal
+	createInterceptors     []Interceptor
+	metrics                *proxyMetrics
+	warnings               warnLimiter
+	auditLog               *logrus.Logger
+	webhookClient          *http.Client
+	dockerHTTP             *http.Client // for calls our Docker client's API version is too old for
+	platformInspectTooOld  bool         // whether Docker refused those of inspectImageVariant
+	interceptions          sync.WaitGroup
+	createSlots            chan struct{}
+	shuttingDown           bool
 	quit                   chan struct{}
 }
 
@@ -124,13 +264,207 @@ func (j attachJob) Stop() {
 	j.timer.Stop()
 }
 
-func StubProxy(c Config) (*Proxy, error) {
+// newProxy makes a proxy from c, checked, with everything but its
+// Docker client.
+func newProxy(c Config) (*Proxy, error) {
 	p := &Proxy{
-		Config:     c,
-		waiters:    make(map[*http.Request]*wait),
-		attachJobs: make(map[string]*attachJob),
-		quit:       make(chan struct{}),
-		weave:      weaveapi.NewClient(os.Getenv("WEAVE_HTTP_ADDR"), Log),
+		Config:        c,
+		waiters:       make(map[*http.Request]*wait),
+		attachJobs:    make(map[string]*attachJob),
+		attachedCIDRs: make(map[string][]string),
+		attachedIPs:   make(map[string][]*net.IPNet),
+		autoRemove:    make(map[string]struct{}),
+		aliases:       make(map[string][]string),
+		quit:          make(chan struct{}),
+		weave:         weaveapi.NewClient(os.Getenv("WEAVE_HTTP_ADDR"), Log),
+		metrics:       newProxyMetrics(),
+	}
+	if p.WeaveWaitMountPath == "" {
+		p.WeaveWaitMountPath = defaultWeaveWaitMountPath
+	}
+	if err := validateWaitEntrypoint(c.WaitEntrypoint); err != nil {
+		return nil, err
+	}
+	if err := validateWaitPosition(c.WaitPosition); err != nil {
+		return nil, err
+	}
+	if err := validateHostnameCollision(c.HostnameCollision); err != nil {
+		return nil, err
+	}
+	if err := validateIPAMUnavailable(c.IPAMUnavailable, c.IPAMWaitTimeout); err != nil {
+		return nil, err
+	}
+	if err := validateIPAllocation(c.IPAllocation); err != nil {
+		return nil, err
+	}
+	if err := validateDNSServerCheck(c.DNSServerCheck); err != nil {
+		return nil, err
+	}
+	if err := validateDNSTTL(c.DNSTTL); err != nil {
+		return nil, err
+	}
+	if err := validateDNSSearchMode(c.DNSSearchMode); err != nil {
+		return nil, err
+	}
+	if err := validateDNSSearch(c.DNSSearch, c.DNSSearchMode); err != nil {
+		return nil, err
+	}
+	if err := validateExecEnv(c.ExecEnv); err != nil {
+		return nil, err
+	}
+	if err := validateEnv(c.Env, "environment variable"); err != nil {
+		return nil, err
+	}
+	if err := validateNoControlEnv(c.Env); err != nil {
+		return nil, err
+	}
+	if err := validateExtraHosts(c.ExtraHosts); err != nil {
+		return nil, err
+	}
+	if err := validateImagePatterns(c.IncludeImages); err != nil {
+		return nil, err
+	}
+	if err := validateImagePatterns(c.ExcludeImages); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.archWaitVolumes, err = parseArchWaitVolumes(c.ArchWaitVolumes); err != nil {
+		return nil, err
+	}
+	if p.sysctls, err = parseSysctls(c.Sysctls); err != nil {
+		return nil, err
+	}
+	if p.capAdd, err = parseCapabilities(c.CapAdd); err != nil {
+		return nil, err
+	}
+	if p.ulimits, err = parseUlimits(c.Ulimits); err != nil {
+		return nil, err
+	}
+	if p.readonlyTmpfs, err = parseTmpfs(c.ReadonlyTmpfs); err != nil {
+		return nil, err
+	} else if p.readonlyTmpfs != nil && p.readonlyTmpfs.path == p.WeaveWaitMountPath {
+		return nil, fmt.Errorf("invalid tmpfs %q: %s is where weavewait is mounted", c.ReadonlyTmpfs, p.WeaveWaitMountPath)
+	}
+	if p.skipLabels, err = parseSkipLabels(c.SkipLabels); err != nil {
+		return nil, err
+	}
+	if p.hostnameTemplate, err = parseHostnameTemplate(c.HostnameTemplate); err != nil {
+		return nil, err
+	}
+	if p.HostID == "" {
+		// Tags our weaveDNS records, so that stale ones can be traced
+		// back to us
+		p.HostID, _ = os.Hostname()
+	}
+	if p.WeaveContainer == "" {
+		p.WeaveContainer = defaultWeaveContainer
+	}
+	if c.WeaveContainerLabel != "" {
+		if _, ok := parseLabelSelector(c.WeaveContainerLabel); !ok {
+			return nil, fmt.Errorf("invalid weave container label %q: must be key=value or key", c.WeaveContainerLabel)
+		}
+	}
+	if p.drainSignal, err = parseDrainSignal(c.DNSDrainSignal); err != nil {
+		return nil, err
+	}
+	if p.socketMode, err = parseSocketMode(c.SocketMode); err != nil {
+		return nil, err
+	}
+	if err := validateWebhookURL(c.AttachWebhook); err != nil {
+		return nil, err
+	} else if c.AttachWebhook != "" {
+		p.webhookClient = &http.Client{Timeout: attachWebhookTimeout}
+	}
+	// Shared, so that its idle connection is reused rather than one
+	// left open for every call
+	p.dockerHTTP = &http.Client{Transport: &http.Transport{
+		Dial:            func(network, addr string) (net.Conn, error) { return p.Dial() },
+		IdleConnTimeout: 90 * time.Second,
+	}}
+	if c.WaitTimeout < 0 {
+		return nil, fmt.Errorf("invalid wait timeout %s", c.WaitTimeout)
+	}
+	if c.ImageInspectRetries < 0 {
+		return nil, fmt.Errorf("invalid number of image inspect retries %d", c.ImageInspectRetries)
+	}
+	if c.MaxConcurrentCreates < 0 {
+		return nil, fmt.Errorf("invalid maximum of concurrent creates %d", c.MaxConcurrentCreates)
+	} else if c.MaxConcurrentCreates > 0 {
+		p.createSlots = make(chan struct{}, c.MaxConcurrentCreates)
+	}
+	if c.DNSUseTCP {
+		p.DNSOptions = append(append([]string{}, c.DNSOptions...), dnsOptionUseVC)
+	}
+	if p.DNSDomainTimeout == 0 {
+		p.DNSDomainTimeout = defaultDNSDomainTimeout
+	}
+	if p.DNSDomainCacheTTL == 0 {
+		p.DNSDomainCacheTTL = defaultDNSDomainCacheTTL
+	}
+	if c.MaxBodyBytes < 0 {
+		return nil, fmt.Errorf("invalid maximum body size %d", c.MaxBodyBytes)
+	} else if c.MaxBodyBytes == 0 {
+		p.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if c.WeaveDNSHTTPPort < 0 || c.WeaveDNSHTTPPort > 65535 {
+		return nil, fmt.Errorf("invalid weaveDNS HTTP port %d", c.WeaveDNSHTTPPort)
+	}
+	if c.WeaveDNSIdleConns < 0 {
+		return nil, fmt.Errorf("invalid maximum idle weaveDNS connections %d", c.WeaveDNSIdleConns)
+	} else if c.WeaveDNSIdleConns == 0 {
+		p.WeaveDNSIdleConns = defaultWeaveDNSIdleConns
+	}
+	p.weaveDNS = weaveapi.NewClient(weaveDNSAddr(os.Getenv("WEAVE_HTTP_ADDR"), c.WeaveDNSHTTPPort), Log)
+	p.weaveDNS.SetHTTPClient(newWeaveDNSHTTPClient(p.DNSDomainTimeout, p.WeaveDNSIdleConns))
+
+	if p.dockerTLS, err = c.DockerTLSConfig.ClientConfig(); err != nil {
+		return nil, err
+	}
+	if p.auditLog, err = newAuditLog(c.AuditLog); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// newWeaveDNSHTTPClient makes the client for calls to weaveDNS. Looking
+// up the domain happens on every container creation, so a hung weaveDNS
+// must not be allowed to block it for long, and keeping connections
+// alive between calls saves setting one up each time; a burst of
+// creations can keep up to maxIdle of them open.
+func newWeaveDNSHTTPClient(timeout time.Duration, maxIdle int) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        maxIdle,
+			MaxIdleConnsPerHost: maxIdle,
+			IdleConnTimeout:     weaveDNSIdleConnTimeout,
+		},
+	}
+}
+
+// weaveDNSAddr is the address of weaveDNS's HTTP API: that of the
+// router, addr, unless port is given, in which case that port on the
+// router's host.
+func weaveDNSAddr(addr string, port int) string {
+	if port == 0 {
+		return addr
+	}
+	host := addr
+	if i := strings.LastIndex(addr, ":"); i >= 0 {
+		host = addr[:i]
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
+
+func StubProxy(c Config) (*Proxy, error) {
+	p, err := newProxy(c)
+	if err != nil {
+		return nil, err
 	}
 
 	// We pin the protocol version to 1.18 (which corresponds to
@@ -138,7 +472,12 @@ func StubProxy(c Config) (*Proxy, error) {
 	// to insulate ourselves from breaking changes to the API, as
 	// happened in 1.20 (Docker 1.8.0) when the presentation of
 	// volumes changed in `inspect`.
-	client, err := weavedocker.NewVersionedClient(c.DockerHost, "1.18")
+	var client *weavedocker.Client
+	if p.dockerTLS != nil {
+		client, err = weavedocker.NewVersionedTLSClient(c.DockerHost, c.DockerTLSConfig.Cert, c.DockerTLSConfig.Key, c.DockerTLSConfig.CACert, "1.18")
+	} else {
+		client, err = weavedocker.NewVersionedClient(c.DockerHost, "1.18")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -158,13 +497,28 @@ func NewProxy(c Config) (*Proxy, error) {
 
 	Log.Info(p.client.Info())
 
-	if !p.WithoutDNS {
-		ip, err := weavenet.FindBridgeIP(c.DockerBridge, nil)
-		if err != nil {
+	// Containers can ask for weaveDNS with WEAVE_DNS=on even when the
+	// proxy runs without it, so its DNS servers are needed either way
+	if p.dnsServers, err = dnsServers(c); err != nil {
+		if !p.WithoutDNS {
 			return nil, err
 		}
-		p.dockerBridgeIP = ip.String()
-		Log.Infof("Using docker bridge IP for DNS: %v", p.dockerBridgeIP)
+		Log.Infof("Containers asking for WEAVE_DNS=on will not get weaveDNS: %s", err)
+		p.dnsServers = nil
+	} else {
+		Log.Infof("Using DNS servers: %v", p.dnsServers)
+		if len(c.DNSServers) == 0 {
+			// Found from the Docker bridge, rather than given to us
+			if err := p.checkDNSServers(p.dnsServers); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.DNSServerRefresh > 0 && len(c.DNSServers) == 0 {
+		go p.refreshDNSServersEvery(c.DNSServerRefresh)
+	}
+	if p.drainSignal != nil {
+		p.drainDNSOn(p.drainSignal)
 	}
 
 	p.hostnameMatchRegexp, err = regexp.Compile(c.HostnameMatch)
@@ -199,27 +553,77 @@ func (proxy *Proxy) Dial() (net.Conn, error) {
 	case strings.HasPrefix(addr, "tcp://"):
 		addr = strings.TrimPrefix(addr, "tcp://")
 	}
+	if proxy.dockerTLS != nil && proto == "tcp" {
+		return tls.Dial(proto, addr, proxy.dockerTLS)
+	}
 	return net.Dial(proto, addr)
 }
 
 func (proxy *Proxy) findWeaveWaitVolumes() error {
-	var err error
-	if proxy.weaveWaitVolume, err = proxy.findVolume("/w"); err != nil {
+	container, err := proxy.findWeaveContainer()
+	if err != nil {
+		return fmt.Errorf("Could not find the weavewait volume: %s", err)
+	}
+	if proxy.weaveWaitVolume, err = findVolume(container, "/w"); err != nil {
 		return err
 	}
-	if proxy.weaveWaitNoopVolume, err = proxy.findVolume("/w-noop"); err != nil {
+	if proxy.weaveWaitNoopVolume, err = findVolume(container, "/w-noop"); err != nil {
 		return err
 	}
-	proxy.weaveWaitNomcastVolume, err = proxy.findVolume("/w-nomcast")
+	proxy.weaveWaitNomcastVolume, err = findVolume(container, "/w-nomcast")
 	return err
 }
 
-func (proxy *Proxy) findVolume(v string) (string, error) {
-	container, err := proxy.client.InspectContainer("weave")
-	if err != nil {
-		return "", fmt.Errorf("Could not find the weavewait volume: %s", err)
+// weaveWaitVolumes are the volumes holding each build of weavewait for
+// one architecture.
+type weaveWaitVolumes struct {
+	wait    string // waits for the weave interface and multicast route
+	noop    string // for containers on another's network, or the host's
+	nomcast string // waits for the interface alone, for --no-multicast-route
+}
+
+// parseArchWaitVolumes turns "arch=wait:noop:nomcast" entries into a map
+// from image architecture, e.g. "arm64", to the weavewait volumes
+// holding binaries built for it.
+func parseArchWaitVolumes(entries []string) (map[string]weaveWaitVolumes, error) {
+	volumes := make(map[string]weaveWaitVolumes)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 && parts[0] != "" {
+			if names := strings.Split(parts[1], ":"); len(names) == 3 && names[0] != "" && names[1] != "" && names[2] != "" {
+				volumes[parts[0]] = weaveWaitVolumes{wait: names[0], noop: names[1], nomcast: names[2]}
+				continue
+			}
+		}
+		return nil, fmt.Errorf("Invalid weavewait volume '%s': must be arch=wait-volume:noop-volume:nomcast-volume", entry)
 	}
+	return volumes, nil
+}
 
+// weaveWaitVolumeFor returns the weavewait volume to mount in
+// containers created from image: that with the build for a container
+// on another's network if noop, or else for how we attach containers,
+// from the volumes configured for the image's architecture if there
+// are some, or else from the weave container's own.
+func (proxy *Proxy) weaveWaitVolumeFor(ctx context.Context, image string, noop bool) string {
+	volumes := weaveWaitVolumes{wait: proxy.weaveWaitVolume, noop: proxy.weaveWaitNoopVolume, nomcast: proxy.weaveWaitNomcastVolume}
+	if len(proxy.archWaitVolumes) > 0 {
+		if img, err := proxy.inspectImageWithRetry(ctx, image); err != nil {
+			Log.Debugf("Using the default weavewait volume for image %s, since inspecting it failed: %s", image, err)
+		} else if archVolumes, found := proxy.archWaitVolumes[img.Architecture]; found {
+			volumes = archVolumes
+		}
+	}
+	switch {
+	case noop:
+		return volumes.noop
+	case proxy.NoMulticastRoute:
+		return volumes.nomcast
+	}
+	return volumes.wait
+}
+
+func findVolume(container *docker.Container, v string) (string, error) {
 	if container.Volumes == nil {
 		return "", fmt.Errorf("Could not find the weavewait volume")
 	}
@@ -235,10 +639,20 @@ func (proxy *Proxy) findVolume(v string) (string, error) {
 func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	Log.Infof("%s %s", r.Method, r.URL)
 	path := r.URL.Path
-	var i interceptor
+	var i Interceptor
 	switch {
+	case path == "/status" && r.Method == "GET":
+		// Not part of the Docker API, so answered by the proxy itself
+		proxy.HealthHTTP(w, r)
+		return
+	case path == "/containers" && r.Method == "GET":
+		proxy.ContainersHTTP(w, r)
+		return
+	case path == "/dns/reregister" && r.Method == "POST":
+		proxy.ReregisterDNSHTTP(w, r)
+		return
 	case containerCreateRegexp.MatchString(path):
-		i = &createContainerInterceptor{proxy}
+		i = append(interceptorChain{&createContainerInterceptor{proxy: proxy}}, proxy.createContainerInterceptors()...)
 	case containerStartRegexp.MatchString(path):
 		i = &startContainerInterceptor{proxy}
 	case containerInspectRegexp.MatchString(path):
@@ -247,12 +661,40 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		i = &createExecInterceptor{proxy}
 	case execInspectRegexp.MatchString(path):
 		i = &inspectExecInterceptor{proxy}
+	case networkConnectRegexp.MatchString(path):
+		i = &networkConnectInterceptor{proxy: proxy}
+	case r.Method == "DELETE" && containerRemoveRegexp.MatchString(path):
+		i = &removeContainerInterceptor{proxy: proxy}
+	case r.Method == "POST" && imagesCreateRegexp.MatchString(path):
+		i = &imagesCreateInterceptor{proxy: proxy}
 	default:
 		i = &nullInterceptor{}
 	}
+	if buffersBody(i) && r.Body != nil {
+		// Intercepted bodies are read whole, and must not be allowed
+		// to take all our memory; anything else, e.g. a build
+		// context, is streamed straight through.
+		r.Body = newLimitedBody(r.Body, proxy.MaxBodyBytes)
+	}
 	proxy.Intercept(i, w, r)
 }
 
+// AddCreateContainerInterceptor registers an Interceptor to be run on
+// every container creation, after the built-in one which sets up
+// weave networking (so it sees the request as weave has modified it)
+// and after any Interceptors registered previously.
+func (proxy *Proxy) AddCreateContainerInterceptor(i Interceptor) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	proxy.createInterceptors = append(proxy.createInterceptors, i)
+}
+
+func (proxy *Proxy) createContainerInterceptors() []Interceptor {
+	proxy.Lock()
+	defer proxy.Unlock()
+	return proxy.createInterceptors
+}
+
 func (proxy *Proxy) Listen() []net.Listener {
 	listeners := []net.Listener{}
 	proxy.normalisedAddrs = []string{}
@@ -284,6 +726,15 @@ func (proxy *Proxy) Listen() []net.Listener {
 		proxy.normalisedAddrs = append(proxy.normalisedAddrs, weaveSockUnix)
 	}
 
+	if proxy.Socket != "" {
+		listener, err := proxy.listenSocket()
+		if err != nil {
+			Log.Fatalf("Cannot listen on %s: %s", proxy.Socket, err)
+		}
+		listeners = append(listeners, listener)
+		proxy.normalisedAddrs = append(proxy.normalisedAddrs, "unix://"+proxy.Socket)
+	}
+
 	for _, addr := range proxy.normalisedAddrs {
 		Log.Infoln("proxy listening on", addr)
 	}
@@ -379,22 +830,62 @@ func (proxy *Proxy) listen(protoAndAddr string) (net.Listener, string, error) {
 	return &MalformedHostHeaderOverride{listener}, fmt.Sprintf("%s://%s", proto, addr), nil
 }
 
+// parseSocketMode parses the octal permissions for Config.Socket,
+// defaulting to owner and group only.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0660, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm&^0777 != 0 {
+		return 0, fmt.Errorf("Invalid socket mode '%s': must be octal permissions, e.g. 0660", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// listenSocket listens on Config.Socket: a unix socket of its own,
+// rather than a symlink to weave.sock, so it can be mounted into
+// containers with permissions other than those of the Docker socket.
+func (proxy *Proxy) listenSocket() (net.Listener, error) {
+	if err := os.Remove(proxy.Socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Never let the socket exist with looser permissions than asked
+	// for, not even between creating it and the chmod
+	oldUmask := syscall.Umask(int(^proxy.socketMode & 0777))
+	listener, err := net.Listen("unix", proxy.Socket)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(proxy.Socket, proxy.socketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &MalformedHostHeaderOverride{listener}, nil
+}
+
 // weavedocker.ContainerObserver interface
 func (proxy *Proxy) ContainerStarted(ident string) {
-	err := proxy.attach(ident)
+	container, err := proxy.inspectAndAttach(proxy.waitContext(ident), ident)
 	if err != nil {
 		var e error
 		// attach failed: if we have a request waiting on the start, kill the container,
 		// otherwise assume it is a Docker-initated restart and kill the process inside.
 		if proxy.waitChan(ident) != nil {
 			e = proxy.client.KillContainer(docker.KillContainerOptions{ID: ident})
+		} else if restartsAutomatically(container) {
+			// Docker restarted it under its restart policy, and weavewait
+			// inside is still waiting; killing it would only make Docker
+			// restart it again, so keep trying to attach it instead.
+			// Nobody is waiting, so there is nobody to notify either.
+			Log.Warningf("Unable to attach restarted container %s, retrying: %s", ident, err)
+			proxy.attachWithRetry(ident)
+			return
 		} else {
-			var c *docker.Container
-			if c, e = proxy.client.InspectContainer(ident); e == nil {
-				var process *os.Process
-				if process, e = os.FindProcess(c.State.Pid); e == nil {
-					e = process.Kill()
-				}
+			var process *os.Process
+			if process, e = os.FindProcess(container.State.Pid); e == nil {
+				e = process.Kill()
 			}
 		}
 		if e != nil {
@@ -404,8 +895,48 @@ func (proxy *Proxy) ContainerStarted(ident string) {
 	proxy.notifyWaiters(ident, err)
 }
 
-func containerShouldAttach(container *docker.Container) bool {
-	return len(container.Config.Entrypoint) > 0 && container.Config.Entrypoint[0] == weaveWaitEntrypoint[0]
+// The weavewait binary, as seen from inside a container where the
+// weavewait volume has been mounted, or else the configured
+// replacement for it, with any arguments
+func (proxy *Proxy) weaveWaitEntrypoint() []string {
+	if proxy.WaitEntrypoint != "" {
+		return strings.Fields(proxy.WaitEntrypoint)
+	}
+	return []string{path.Join(proxy.WeaveWaitMountPath, "w")}
+}
+
+// ownWeaveWait tells whether containers wait with our weavewait, which
+// understands arguments such as --wait-timeout, rather than with an
+// entrypoint of the user's own choosing, which may not.
+func (proxy *Proxy) ownWeaveWait() bool {
+	return proxy.WaitEntrypoint == ""
+}
+
+func validateWaitEntrypoint(entrypoint string) error {
+	if entrypoint != "" && len(strings.Fields(entrypoint)) == 0 {
+		return fmt.Errorf("invalid wait entrypoint %q: no binary given", entrypoint)
+	}
+	return nil
+}
+
+// An empty position is taken as waitPositionPrepend, the default
+func validateWaitPosition(position string) error {
+	switch position {
+	case "", waitPositionPrepend, waitPositionWrap:
+		return nil
+	}
+	return fmt.Errorf("Invalid wait position '%s': must be %s or %s", position, waitPositionPrepend, waitPositionWrap)
+}
+
+func (proxy *Proxy) containerShouldAttach(container *docker.Container) bool {
+	if container.Config == nil {
+		return false
+	}
+	if len(container.Config.Entrypoint) > 0 && container.Config.Entrypoint[0] == proxy.weaveWaitEntrypoint()[0] {
+		return true
+	}
+	_, hasWeaveWait := container.Volumes[proxy.WeaveWaitMountPath]
+	return hasWeaveWait && noWeaveWait(container.Config.Env, container.Config.Labels)
 }
 
 func (proxy *Proxy) createWait(r *http.Request, ident string) {
@@ -462,6 +993,20 @@ func (proxy *Proxy) waitChan(ident string) chan error {
 	return nil
 }
 
+// waitContext is the context of a start request waiting on the
+// container, so that attaching it gives up once that client has gone,
+// or else the background context.
+func (proxy *Proxy) waitContext(ident string) context.Context {
+	proxy.Lock()
+	defer proxy.Unlock()
+	for r, wait := range proxy.waiters {
+		if ident == wait.ident && !wait.done {
+			return r.Context()
+		}
+	}
+	return context.Background()
+}
+
 // If some other operation is waiting for a container to start, join in the wait
 func (proxy *Proxy) waitForStartByIdent(ident string) error {
 	if ch := proxy.waitChan(ident); ch != nil {
@@ -471,34 +1016,150 @@ func (proxy *Proxy) waitForStartByIdent(ident string) error {
 	return nil
 }
 
-func (proxy *Proxy) ContainerDied(ident string)      {}
-func (proxy *Proxy) ContainerDestroyed(ident string) {}
+// A container created with '--rm' is about to be removed by Docker, so
+// release its addresses now rather than waiting for it to be destroyed.
+func (proxy *Proxy) ContainerDied(ident string) {
+	proxy.Lock()
+	_, autoRemove := proxy.autoRemove[ident]
+	proxy.Unlock()
+	if autoRemove {
+		proxy.release(ident)
+	}
+}
+
+func (proxy *Proxy) ContainerDestroyed(ident string) {
+	proxy.forget(ident)
+}
+
+// forget drops everything we keep about a container, saying whether
+// it had addresses from us, or was run with --rm, for release.
+func (proxy *Proxy) forget(containerID string) (attached, autoRemove bool) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	_, attached = proxy.attachedIPs[containerID]
+	_, autoRemove = proxy.autoRemove[containerID]
+	delete(proxy.attachedCIDRs, containerID)
+	delete(proxy.attachedIPs, containerID)
+	delete(proxy.autoRemove, containerID)
+	delete(proxy.aliases, containerID)
+	delete(proxy.dnsRecords, containerID)
+	delete(proxy.managed, containerID)
+	return
+}
+
+func (proxy *Proxy) trackAutoRemove(containerID string) {
+	proxy.Lock()
+	proxy.autoRemove[containerID] = struct{}{}
+	proxy.Unlock()
+}
+
+// restartsAutomatically tells whether Docker will restart the
+// container by itself, under its restart policy, so that we know to
+// reattach it then. This is read from the container, rather than from
+// its create, so that it holds for containers created before we
+// started, or behind our back.
+func restartsAutomatically(container *docker.Container) bool {
+	if container == nil || container.HostConfig == nil {
+		return false
+	}
+	switch container.HostConfig.RestartPolicy.Name {
+	case "always", "unless-stopped", "on-failure":
+		return true
+	}
+	return false
+}
+
+// release forgets everything we know about a container, by its full
+// ID, which is going away, and frees its addresses. It is safe to call
+// more than once.
+func (proxy *Proxy) release(containerID string) {
+	attached, autoRemove := proxy.forget(containerID)
+	if !attached && !autoRemove {
+		return
+	}
+	Log.Infof("Releasing addresses of container %s", containerID)
+	if err := proxy.weave.ReleaseIPsFor(containerID); err != nil {
+		Log.Warningf("unable to release addresses of container %s: %s", containerID, err)
+	}
+}
+
+// If the container was given its addresses dynamically the last time
+// we attached it, claim those same addresses again so that a
+// container which is stopped and later restarted comes back with the
+// IP it had before, even if IPAM has since released it.
+func (proxy *Proxy) reattachCIDRs(containerID string, cidrs []string) []string {
+	if len(cidrs) > 0 {
+		return cidrs
+	}
+	proxy.Lock()
+	defer proxy.Unlock()
+	return proxy.attachedCIDRs[containerID]
+}
+
+func (proxy *Proxy) rememberCIDRs(containerID string, cidrs []string, ips []*net.IPNet) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	proxy.attachedIPs[containerID] = ips
+	if len(cidrs) > 0 {
+		return
+	}
+	var claims []string
+	for _, ip := range ips {
+		claims = append(claims, "ip:"+ip.String())
+	}
+	proxy.attachedCIDRs[containerID] = claims
+}
 
 // Check if this container needs to be attached, if so then attach it,
 // and return nil on success or not needed.
 func (proxy *Proxy) attach(containerID string) error {
+	_, err := proxy.inspectAndAttach(context.Background(), containerID)
+	return err
+}
+
+// inspectAndAttach is attach, also giving the container as inspected,
+// which is never nil if attaching it failed. Waiting on IPAM gives up
+// when ctx is done.
+func (proxy *Proxy) inspectAndAttach(ctx context.Context, containerID string) (*docker.Container, error) {
 	container, err := proxy.client.InspectContainer(containerID)
 	if err != nil {
 		if _, ok := err.(*docker.NoSuchContainer); !ok {
 			Log.Warningf("unable to attach existing container %s since inspecting it failed: %v", containerID, err)
 		}
-		return nil
+		return nil, nil
 	}
-	if !containerShouldAttach(container) || !container.State.Running {
-		return nil
+	if !proxy.containerShouldAttach(container) || !container.State.Running {
+		return container, nil
 	}
+	return container, proxy.attachContainer(ctx, container)
+}
 
-	cidrs, err := proxy.weaveCIDRs(container.HostConfig.NetworkMode, container.Config.Env)
+func (proxy *Proxy) attachContainer(ctx context.Context, container *docker.Container) error {
+	containerID := container.ID
+	cidrs, err := proxy.weaveCIDRsFromConfig(ctx, container.Config, container.HostConfig)
 	if err != nil {
 		Log.Infof("Leaving container %s alone because %s", containerID, err)
+		image := ""
+		if container.Config != nil {
+			image = container.Config.Image
+		}
+		proxy.trackSkipped(containerID, container.Name, image, err)
 		return nil
 	}
-	Log.Infof("Attaching container %s with WEAVE_CIDR \"%s\" to weave network", container.ID, strings.Join(cidrs, " "))
-	ips, err := proxy.allocateCIDRs(container.ID, cidrs)
+	Log.WithFields(logrus.Fields{
+		"id":         container.ID,
+		"name":       strings.TrimPrefix(container.Name, "/"),
+		"weave_cidr": strings.Join(cidrs, " "),
+	}).Infof("Attaching container %s with WEAVE_CIDR \"%s\" to weave network", container.ID, strings.Join(cidrs, " "))
+	ips, err := proxy.allocateCIDRs(ctx, container.ID, proxy.reattachCIDRs(container.ID, cidrs))
 	if err != nil {
 		return err
 	}
 
+	if container.Config == nil {
+		// read as empty by weaveCIDRsFromConfig, so likewise here
+		container.Config = &docker.Config{}
+	}
 	fqdn := container.Config.Hostname + "." + container.Config.Domainname
 	if !proxy.NoRewriteHosts {
 		var extraHosts []string
@@ -517,19 +1178,105 @@ func (proxy *Proxy) attach(containerID string) error {
 	if err != nil {
 		return err
 	}
+	proxy.rememberCIDRs(container.ID, cidrs, ips)
+	proxy.trackAttached(container, cidrs, ips)
+	proxy.auditAttach(container, ips)
+	proxy.notifyAttached(container, ips)
+
+	if proxy.usesWeaveDNS(container.Config.Env) {
+		return proxy.registerWithDNS(container.ID, fqdn, container.Config.Domainname, ips)
+	}
 
-	if !proxy.WithoutDNS {
+	return err
+}
+
+// registerWithDNS registers the container's name, and any network
+// aliases it was created with, for each of its addresses. weaveDNS
+// answers for a name registered by several containers with all of
+// their addresses, so aliases shared between the containers of a
+// service give round-robin records. Only the container's own name is
+// given out for reverse (PTR) lookups of its addresses, and an alias
+// which is that name too, as DNSNames often are, is not registered
+// again.
+func (proxy *Proxy) registerWithDNS(containerID, fqdn, domainname string, ips []*net.IPNet) error {
+	aliases := proxy.dnsAliases(containerID)
+	proxy.trackDNS(containerID, fqdn, domainname, ips)
+	for _, ip := range ips {
+		if err := proxy.weave.RegisterWithDNSOptions(containerID, fqdn, ip.IP.String(), weaveapi.DNSRegistration{TTL: proxy.DNSTTL, Host: proxy.HostID}); err != nil {
+			return errors.Wrapf(err, "unable to register %s with weaveDNS: %s", containerID, err)
+		}
+		for _, alias := range aliases {
+			if alias+"."+domainname == fqdn {
+				continue
+			}
+			if err := proxy.weave.RegisterWithDNSOptions(containerID, alias+"."+domainname, ip.IP.String(), weaveapi.DNSRegistration{TTL: proxy.DNSTTL, Alias: true, Host: proxy.HostID}); err != nil {
+				return errors.Wrapf(err, "unable to register %s with weaveDNS: %s", containerID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// A TTL of 0 leaves records with weaveDNS's default TTL
+func validateDNSTTL(ttl int) error {
+	if ttl < 0 || ttl > maxDNSTTL {
+		return fmt.Errorf("Invalid DNS TTL %d: must be between 1 and %d seconds, or 0 for weaveDNS's default", ttl, maxDNSTTL)
+	}
+	return nil
+}
+
+func (proxy *Proxy) rememberDNSAliases(containerID string, aliases []string) {
+	proxy.Lock()
+	proxy.aliases[containerID] = aliases
+	proxy.Unlock()
+}
+
+func (proxy *Proxy) dnsAliases(containerID string) []string {
+	proxy.Lock()
+	defer proxy.Unlock()
+	return proxy.aliases[containerID]
+}
+
+// detach undoes attachContainer for a container which carries on
+// running, e.g. after 'docker network disconnect': the weave interface
+// is removed, and its addresses deregistered from weaveDNS and released.
+func (proxy *Proxy) detach(containerID string) error {
+	proxy.Lock()
+	ips := proxy.attachedIPs[containerID]
+	delete(proxy.attachedIPs, containerID)
+	delete(proxy.attachedCIDRs, containerID)
+	proxy.Unlock()
+	if len(ips) == 0 {
+		return nil
+	}
+	proxy.trackDetached(containerID)
+
+	Log.Infof("Detaching container %s from weave network", containerID)
+	args := []string{"detach-container", containerID}
+	for _, ip := range ips {
+		args = append(args, ip.String())
+	}
+	// weavenet.DetachContainer switches network namespace in a way
+	// that is only safe in a process which exits straight afterwards
+	if out, err := runWeaveUtil(args...); err != nil {
+		return fmt.Errorf("unable to detach container %s: %s: %s", containerID, err, out)
+	}
+
+	if registered := proxy.forgetDNS(containerID); registered || !proxy.WithoutDNS {
 		for _, ip := range ips {
-			if err := proxy.weave.RegisterWithDNS(container.ID, fqdn, ip.IP.String()); err != nil {
-				return errors.Wrapf(err, "unable to register %s with weaveDNS: %s", container.ID, err)
+			if err := proxy.weave.DeregisterWithDNS(containerID, ip.IP.String()); err != nil {
+				Log.Warningf("unable to deregister %s from weaveDNS: %s", containerID, err)
 			}
 		}
 	}
+	return proxy.weave.ReleaseIPsFor(containerID)
+}
 
-	return err
+var runWeaveUtil = func(args ...string) ([]byte, error) {
+	return exec.Command(weavenet.WeaveUtilCmd, args...).CombinedOutput()
 }
 
-func (proxy *Proxy) allocateCIDRs(containerID string, cidrs []string) ([]*net.IPNet, error) {
+func (proxy *Proxy) allocateCIDRs(ctx context.Context, containerID string, cidrs []string) ([]*net.IPNet, error) {
 	if len(cidrs) == 0 {
 		cidrs = []string{"net:default"}
 	}
@@ -537,21 +1284,24 @@ func (proxy *Proxy) allocateCIDRs(containerID string, cidrs []string) ([]*net.IP
 	var err error
 	var ipnets []*net.IPNet
 	for _, cidr := range cidrs {
-		switch {
-		case cidr == "net:default":
-			ipnet, err = proxy.weave.AllocateIP(containerID, true)
-		case strings.HasPrefix(cidr, "net:"):
-			var subnet *net.IPNet
-			_, subnet, err = net.ParseCIDR(strings.TrimPrefix(cidr, "net:"))
-			if err != nil {
-				break
+		err = proxy.withIPAM(ctx, func() (err error) {
+			switch {
+			case cidr == "net:default":
+				ipnet, err = proxy.allocateIP(containerID, nil)
+			case strings.HasPrefix(cidr, "net:"):
+				var subnet *net.IPNet
+				_, subnet, err = net.ParseCIDR(strings.TrimPrefix(cidr, "net:"))
+				if err != nil {
+					break
+				}
+				ipnet, err = proxy.allocateIP(containerID, subnet)
+			case strings.HasPrefix(cidr, "ip:"):
+				ipnet, err = proxy.claimCIDR(containerID, strings.TrimPrefix(cidr, "ip:"))
+			default:
+				ipnet, err = proxy.claimCIDR(containerID, cidr)
 			}
-			ipnet, err = proxy.weave.AllocateIPInSubnet(containerID, subnet, true)
-		case strings.HasPrefix(cidr, "ip:"):
-			ipnet, err = proxy.claimCIDR(containerID, strings.TrimPrefix(cidr, "ip:"))
-		default:
-			ipnet, err = proxy.claimCIDR(containerID, cidr)
-		}
+			return
+		})
 		if err != nil {
 			return nil, errors.Wrapf(err, "for %q", cidr)
 		}
@@ -570,19 +1320,43 @@ func (proxy *Proxy) claimCIDR(containerID, cidr string) (*net.IPNet, error) {
 	return ipnet, err
 }
 
-func (proxy *Proxy) weaveCIDRs(networkMode string, env []string) ([]string, error) {
+// weaveCIDRs works out the addresses a container asked for, from its
+// environment, then its labels, then the labels of the image it is
+// created from. Pass an empty image when the container already exists,
+// since Docker has merged the image's labels into its own by then.
+// "none" in any of them gives ErrWeaveCIDRNone, so that the container
+// is left alone.
+func (proxy *Proxy) weaveCIDRs(ctx context.Context, networkMode, image string, env []string, labels map[string]string) ([]string, error) {
 	if networkMode == "host" || strings.HasPrefix(networkMode, "container:") ||
 		// Anything else, other than blank/none/default/bridge, is some sort of network plugin
 		(networkMode != "" && networkMode != "none" && networkMode != "default" && networkMode != "bridge") {
-		return nil, fmt.Errorf("the container has '--net=%s'", networkMode)
+		return nil, &ErrNetworkMode{networkMode}
 	}
+	// The environment takes precedence over labels
+	cidrs, found := "", false
 	for _, e := range env {
 		if strings.HasPrefix(e, "WEAVE_CIDR=") {
-			if e[11:] == "none" {
-				return nil, ErrWeaveCIDRNone
+			cidrs, found = e[11:], true
+			break
+		}
+	}
+	if !found {
+		cidrs, found = labels[weaveCIDRLabel]
+	}
+	if !found && image != "" {
+		cidrs, found = proxy.imageLabel(ctx, image, weaveCIDRLabel)
+	}
+	if found {
+		if cidrs == "none" {
+			return nil, ErrWeaveCIDRNone
+		}
+		fields := strings.Fields(cidrs)
+		for _, cidr := range fields {
+			if err := validateWeaveCIDR(cidr); err != nil {
+				return nil, err
 			}
-			return strings.Fields(e[11:]), nil
 		}
+		return fields, nil
 	}
 	if proxy.NoDefaultIPAM {
 		return nil, ErrNoDefaultIPAM
@@ -590,36 +1364,473 @@ func (proxy *Proxy) weaveCIDRs(networkMode string, env []string) ([]string, erro
 	return nil, nil
 }
 
-func (proxy *Proxy) setWeaveDNS(hostConfig jsonObject, hostname, dnsDomain string) error {
-	dns, err := hostConfig.StringArray("Dns")
+// weaveCIDRsFromConfig is weaveCIDRs for a container which already
+// exists. Docker fills in both configs when inspecting one, but should
+// either be missing it is read as empty: the default network mode, and
+// no WEAVE_CIDR, rather than a panic.
+func (proxy *Proxy) weaveCIDRsFromConfig(ctx context.Context, config *docker.Config, hostConfig *docker.HostConfig) ([]string, error) {
+	var (
+		networkMode string
+		env         []string
+		labels      map[string]string
+	)
+	if hostConfig != nil {
+		networkMode = hostConfig.NetworkMode
+	}
+	if config != nil {
+		env, labels = config.Env, config.Labels
+	}
+	return proxy.weaveCIDRs(ctx, networkMode, "", env, labels)
+}
+
+func (proxy *Proxy) imageLabel(ctx context.Context, name, label string) (string, bool) {
+	image, err := proxy.inspectImageWithRetry(ctx, name)
+	if err != nil {
+		// The image may not have been pulled yet; Docker will say so
+		Log.Debugf("Unable to inspect image %s for labels: %s", name, err)
+		return "", false
+	}
+	if image.Config == nil {
+		return "", false
+	}
+	value, found := image.Config.Labels[label]
+	return value, found
+}
+
+// inspectImage returns the image with the given name, caching it
+// briefly since a single create looks at the image more than once.
+func (proxy *Proxy) inspectImage(ctx context.Context, name string) (*docker.Image, error) {
+	return proxy.cachedImage(ctx, name, func() (*docker.Image, error) {
+		return proxy.client.InspectImage(name)
+	})
+}
+
+// cachedImage returns the image cached under key, or else the one
+// inspect returns, which is cached.
+func (proxy *Proxy) cachedImage(ctx context.Context, key string, inspect func() (*docker.Image, error)) (*docker.Image, error) {
+	cache := &proxy.images
+	now := time.Now()
+	cache.Lock()
+	cached, found := cache.images[key]
+	cache.Unlock()
+	if found && now.Before(cached.expires) {
+		return cached.image, nil
+	}
+	// Don't hold the lock while Docker answers, so as not to hold up
+	// creations from other images. If our client gives up, the answer
+	// is still cached for the next one.
+	var image *docker.Image
+	err := callWithContext(ctx, func() error {
+		inspected, err := inspect()
+		if err != nil {
+			return err
+		}
+		cache.Lock()
+		defer cache.Unlock()
+		if cache.images == nil {
+			cache.images = make(map[string]cachedImage)
+		}
+		for k, cached := range cache.images {
+			if !now.Before(cached.expires) {
+				delete(cache.images, k)
+			}
+		}
+		cache.images[key] = cachedImage{image: inspected, expires: now.Add(imageCacheTTL)}
+		image = inspected
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// inspectImageWithRetry inspects the image, asking again a few times,
+// backing off, if Docker says there is no such image: it may be a
+// 'docker pull' that is about to finish.
+func (proxy *Proxy) inspectImageWithRetry(ctx context.Context, name string) (*docker.Image, error) {
+	delay := imageInspectRetryDelay
+	for retries := 0; ; retries++ {
+		image, err := proxy.inspectImage(ctx, name)
+		if err != docker.ErrNoSuchImage || retries >= proxy.ImageInspectRetries {
+			return image, err
+		}
+		Log.Debugf("No image %s yet; asking again in %s", name, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// checkAddressesFree returns an error if IPAM has already allocated any
+// of the specific addresses among cidrs. If IPAM can't be asked, the
+// claim made on attaching the container has the final say.
+func (proxy *Proxy) checkAddressesFree(ctx context.Context, cidrs []string) error {
+	var wanted []net.IP
+	for _, cidr := range cidrs {
+		if strings.HasPrefix(cidr, "net:") {
+			continue
+		}
+		if ip, _, err := net.ParseCIDR(strings.TrimPrefix(cidr, "ip:")); err == nil {
+			wanted = append(wanted, ip)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	var owned map[string][]*net.IPNet
+	err := callWithContext(ctx, func() (err error) {
+		owned, err = proxy.weave.OwnedIPs()
+		return
+	})
+	if err != nil {
+		Log.Debugf("Unable to check for addresses already in use: %s", err)
+		return nil
+	}
+	for owner, ipnets := range owned {
+		for _, ipnet := range ipnets {
+			for _, ip := range wanted {
+				if ipnet.IP.Equal(ip) {
+					return &ErrAddressInUse{Addr: ip.String(), Owner: owner}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ErrInvalidCIDR is returned for a WEAVE_CIDR entry, from the
+// environment or a label, which is neither an address nor a subnet.
+type ErrInvalidCIDR struct {
+	CIDR string
+}
+
+func (err *ErrInvalidCIDR) Error() string {
+	return fmt.Sprintf("invalid WEAVE_CIDR entry %q", err.CIDR)
+}
+
+// Each entry is one of net:default, net:<subnet>, ip:<address> or a
+// bare <address>; subnets and addresses may be IPv4 or IPv6.
+func validateWeaveCIDR(cidr string) error {
+	if cidr == "net:default" {
+		return nil
+	}
+	addr := strings.TrimPrefix(strings.TrimPrefix(cidr, "net:"), "ip:")
+	if _, _, err := net.ParseCIDR(addr); err != nil {
+		return &ErrInvalidCIDR{cidr}
+	}
+	return nil
+}
+
+// dnsServers returns the servers, in order, that containers should use
+// to reach weaveDNS: those configured explicitly, or else the docker
+// bridge IP (plus its IPv6 address, if given).
+func dnsServers(c Config) ([]string, error) {
+	for _, server := range c.DNSServers {
+		if net.ParseIP(server) == nil {
+			return nil, fmt.Errorf("Invalid DNS server address '%s'", server)
+		}
+	}
+	if len(c.DNSServers) > 0 {
+		return c.DNSServers, nil
+	}
+
+	ip, err := findBridgeIP(c.DockerBridge, nil)
+	if err != nil {
+		return nil, err
+	}
+	servers := []string{ip.String()}
+	if c.DockerBridgeIPv6 != "" {
+		if ip := net.ParseIP(c.DockerBridgeIPv6); ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("Invalid docker bridge IPv6 address '%s'", c.DockerBridgeIPv6)
+		}
+		servers = append(servers, c.DockerBridgeIPv6)
+	}
+	return servers, nil
+}
+
+// Overridden in tests
+var findBridgeIP = weavenet.FindBridgeIP
+
+// RefreshDNSServers looks up the docker bridge IP again, for when the
+// Docker daemon has been restarted with a different bridge since we
+// started; containers created from then on are given the new address.
+// Servers configured explicitly never change.
+func (proxy *Proxy) RefreshDNSServers() error {
+	servers, err := dnsServers(proxy.Config)
 	if err != nil {
 		return err
 	}
-	hostConfig["Dns"] = append(dns, proxy.dockerBridgeIP)
+	proxy.Lock()
+	defer proxy.Unlock()
+	if !reflect.DeepEqual(servers, proxy.dnsServers) {
+		Log.Infof("Using DNS servers: %v", servers)
+		proxy.dnsServers = servers
+	}
+	return nil
+}
+
+func (proxy *Proxy) refreshDNSServersEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := proxy.RefreshDNSServers(); err != nil {
+				Log.Warningf("Unable to refresh DNS servers, carrying on with %v: %s", proxy.currentDNSServers(), err)
+			}
+		case <-proxy.quit:
+			return
+		}
+	}
+}
+
+func (proxy *Proxy) currentDNSServers() []string {
+	proxy.Lock()
+	defer proxy.Unlock()
+	return proxy.dnsServers
+}
 
-	dnsSearch, err := hostConfig.StringArray("DnsSearch")
+func (proxy *Proxy) setWeaveDNS(hostConfig jsonObject, version apiVersion, hostname, dnsDomain string) error {
+	dnsKey := hostConfig.keyFor("Dns")
+	dns, err := hostConfig.StringArray(dnsKey)
 	if err != nil {
 		return err
 	}
-	if len(dnsSearch) == 0 {
-		if hostname == "" {
-			hostConfig["DnsSearch"] = []string{dnsDomain}
+	// Servers already there may have been added by another weave
+	// proxy in front of us, so don't repeat them
+	for _, server := range proxy.currentDNSServers() {
+		if !containsString(dns, server) {
+			dns = append(dns, server)
+		}
+	}
+	hostConfig[dnsKey] = dns
+
+	if len(proxy.DNSOptions) > 0 && version.hasDNSOptions() {
+		dnsOptionsKey := hostConfig.keyFor("DnsOptions")
+		dnsOptions, err := hostConfig.StringArray(dnsOptionsKey)
+		if err != nil {
+			return err
+		}
+		hostConfig[dnsOptionsKey] = mergeDNSOptions(dnsOptions, proxy.DNSOptions)
+	}
+
+	if proxy.DNSSearchMode == dnsSearchNone {
+		return nil
+	}
+	dnsSearchKey := hostConfig.keyFor("DnsSearch")
+	dnsSearch, err := hostConfig.StringArray(dnsSearchKey)
+	if err != nil {
+		return err
+	}
+	if len(proxy.DNSSearch) > 0 {
+		// The operator's list, in their order, for containers which
+		// don't give their own
+		if len(dnsSearch) == 0 {
+			hostConfig[dnsSearchKey] = dnsSearchList(proxy.DNSSearch, dnsDomain)
+		}
+	} else if len(dnsSearch) == 0 {
+		// A search path of just "." makes Docker write no search
+		// line at all, so the resolver falls back to the domain part
+		// of the container's fully-qualified hostname. Some resolvers
+		// mishandle that, for which there is --dns-search-mode=domain.
+		if hostname == "" || proxy.DNSSearchMode == dnsSearchDomain {
+			hostConfig[dnsSearchKey] = []string{dnsDomain}
 		} else {
-			hostConfig["DnsSearch"] = []string{"."}
+			hostConfig[dnsSearchKey] = []string{"."}
+		}
+	} else if !containsString(dnsSearch, dnsDomain) && !(len(dnsSearch) == 1 && dnsSearch[0] == "." && hostname != "") {
+		// Keep the user's own search domains, but make sure ours is
+		// among them; a lone "." is what we (or a proxy in front of
+		// us) set above
+		hostConfig[dnsSearchKey] = append(dnsSearch, dnsDomain)
+	}
+
+	return nil
+}
+
+// An empty mode is taken as dnsSearchFQDN, the default
+func validateDNSSearchMode(mode string) error {
+	switch mode {
+	case "", dnsSearchFQDN, dnsSearchDomain, dnsSearchNone:
+		return nil
+	}
+	return fmt.Errorf("Invalid DNS search mode '%s': must be one of %s, %s or %s", mode, dnsSearchFQDN, dnsSearchDomain, dnsSearchNone)
+}
+
+// dnsSearchList is search with dnsSearchWeaveDomain replaced by
+// dnsDomain.
+func dnsSearchList(search []string, dnsDomain string) []string {
+	list := make([]string, len(search))
+	for i, domain := range search {
+		if domain == dnsSearchWeaveDomain {
+			domain = dnsDomain
 		}
+		list[i] = domain
 	}
+	return list
+}
 
+func validateDNSSearch(search []string, mode string) error {
+	if len(search) > 0 && mode == dnsSearchNone {
+		return fmt.Errorf("DNS search domains cannot be given with DNS search mode '%s'", dnsSearchNone)
+	}
+	for _, domain := range search {
+		if domain == dnsSearchWeaveDomain {
+			continue
+		}
+		if err := validateDNSDomain(domain); err != nil {
+			return fmt.Errorf("Invalid DNS search domain '%s': must be a domain, or %s for the weaveDNS one", domain, dnsSearchWeaveDomain)
+		}
+	}
 	return nil
 }
 
-func (proxy *Proxy) getDNSDomain() string {
+// Add our options to the user's, except for those the user has set a
+// value for themselves, e.g. we leave "ndots:5" alone if we wanted
+// "ndots:0".
+func mergeDNSOptions(user, ours []string) []string {
+	optionName := func(option string) string {
+		return strings.SplitN(option, ":", 2)[0]
+	}
+	names := make(map[string]bool)
+	for _, option := range user {
+		names[optionName(option)] = true
+	}
+	merged := user
+	for _, option := range ours {
+		if !names[optionName(option)] {
+			merged = append(merged, option)
+			names[optionName(option)] = true
+		}
+	}
+	return merged
+}
+
+func (proxy *Proxy) getDNSDomain(ctx context.Context) string {
 	if proxy.WithoutDNS {
 		return ""
 	}
-	domain, _ := proxy.weave.DNSDomain()
+	return proxy.cachedDNSDomain(ctx)
+}
+
+// cachedDNSDomain looks up the weaveDNS domain, whether or not the
+// proxy uses weaveDNS by default, at most once every DNSDomainCacheTTL.
+func (proxy *Proxy) cachedDNSDomain(ctx context.Context) string {
+	var domain string
+	if err := callWithContext(ctx, func() error {
+		cache := &proxy.dnsDomain
+		cache.Lock()
+		defer cache.Unlock()
+		if !time.Now().Before(cache.expires) {
+			cache.domain = proxy.lookupDNSDomain()
+			cache.expires = time.Now().Add(proxy.DNSDomainCacheTTL)
+		}
+		domain = cache.domain
+		return nil
+	}); err != nil {
+		return ""
+	}
+	return domain
+}
+
+// containerDNSDomain returns the domain a container should be given:
+// the one in its WEAVE_DNS_DOMAIN, if any, or else the weaveDNS one.
+// If the container doesn't use weaveDNS, neither is.
+func (proxy *Proxy) containerDNSDomain(ctx context.Context, env []string) string {
+	if !proxy.usesWeaveDNS(env) {
+		return ""
+	}
+	dnsDomain := proxy.cachedDNSDomain(ctx)
+	if dnsDomain == "" {
+		return ""
+	}
+	for _, e := range env {
+		if strings.HasPrefix(e, "WEAVE_DNS_DOMAIN=") {
+			override := strings.TrimSuffix(e[len("WEAVE_DNS_DOMAIN="):], ".") + "."
+			if err := validateDNSDomain(override); err != nil {
+				proxy.warnings.Warningf("Ignoring WEAVE_DNS_DOMAIN: %s", err)
+				break
+			}
+			return override
+		}
+	}
+	return dnsDomain
+}
+
+// usesWeaveDNS tells whether a container is to use weaveDNS: as its
+// WEAVE_DNS=on or WEAVE_DNS=off says, if it has either, or else unless
+// the proxy is running without weaveDNS.
+func (proxy *Proxy) usesWeaveDNS(env []string) bool {
+	// Docker keeps the last of any duplicates, so that is what counts
+	value, found := "", false
+	for _, e := range env {
+		if strings.HasPrefix(e, "WEAVE_DNS=") {
+			value, found = e[len("WEAVE_DNS="):], true
+		}
+	}
+	if found {
+		switch strings.ToLower(value) {
+		case "on":
+			if len(proxy.currentDNSServers()) == 0 {
+				proxy.warnings.Warningf("Ignoring WEAVE_DNS=%s: no DNS servers for weaveDNS are known", value)
+				return false
+			}
+			return true
+		case "off":
+			return false
+		default:
+			proxy.warnings.Warningf("Ignoring WEAVE_DNS=%s: must be on or off", value)
+		}
+	}
+	return !proxy.WithoutDNS
+}
+
+var dnsLabelRegexp = regexp.MustCompile("^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$")
+
+func validateDNSDomain(domain string) error {
+	name := strings.TrimSuffix(domain, ".")
+	if name == "" || len(name) > MaxDNSName {
+		return &ErrInvalidDNSName{domain, "not a valid domain"}
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > MaxDNSLabel || !dnsLabelRegexp.MatchString(label) {
+			return &ErrInvalidDNSName{domain, "not a valid domain"}
+		}
+	}
+	return nil
+}
+
+func (proxy *Proxy) lookupDNSDomain() string {
+	domain, err := proxy.weaveDNS.DNSDomain()
+	if err != nil && isConnectionRefused(err) {
+		// weaveDNS may still be starting up; give it one more chance
+		time.Sleep(dnsDomainRetryDelay)
+		domain, err = proxy.weaveDNS.DNSDomain()
+	}
+	if err != nil {
+		proxy.warnings.Warningf("Unable to get weaveDNS domain: %s", err)
+		return ""
+	}
 	return domain
 }
 
+func isConnectionRefused(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
+
 func (proxy *Proxy) updateContainerNetworkSettings(container jsonObject) error {
 	containerID, err := container.String("Id")
 	if err != nil {
@@ -731,8 +1942,68 @@ func (proxy *Proxy) runTransientContainer(entrypoint, cmd, binds []string) (err
 	return
 }
 
+// Shutdown stops the proxy taking on new requests, and waits for
+// those it is already intercepting to finish, or for ctx to be done.
+func (proxy *Proxy) Shutdown(ctx context.Context) error {
+	proxy.Lock()
+	proxy.shuttingDown = true
+	proxy.Unlock()
+	// weaver exits on SIGTERM, quite possibly before the signal gets
+	// to drainDNSOn, so drain here instead
+	if proxy.drainSignal == syscall.SIGTERM {
+		proxy.DrainDNS()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		proxy.interceptions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitCreates waits, if need be, until fewer than MaxConcurrentCreates
+// container creations are being intercepted, and so making calls to
+// Docker; the returned func must be called once this one is done. It
+// gives up with ctx's error if ctx is done first, e.g. because the
+// client went away, so as not to hold up those queued behind it.
+func (proxy *Proxy) limitCreates(ctx context.Context) (func(), error) {
+	if proxy.createSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case proxy.createSlots <- struct{}{}:
+		return func() { <-proxy.createSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// startInterception registers an interception, unless the proxy is
+// shutting down; the returned func must be called once it is over.
+func (proxy *Proxy) startInterception() (func(), bool) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	if proxy.shuttingDown {
+		return nil, false
+	}
+	proxy.interceptions.Add(1)
+	var once sync.Once
+	return func() { once.Do(proxy.interceptions.Done) }, true
+}
+
 func (proxy *Proxy) Stop() {
 	close(proxy.quit)
+	if proxy.Socket != "" {
+		if err := os.Remove(proxy.Socket); err != nil && !os.IsNotExist(err) {
+			Log.Warningf("Unable to remove proxy socket: %s", err)
+		}
+	}
 	proxy.Lock()
 	defer proxy.Unlock()
 	for _, j := range proxy.attachJobs {
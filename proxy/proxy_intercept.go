@@ -2,24 +2,53 @@ package proxy
 
 import (
 	"bufio"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"sync"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
 )
 
-func (proxy *Proxy) Intercept(i interceptor, w http.ResponseWriter, r *http.Request) {
-	if err := i.InterceptRequest(r); err != nil {
-		switch err.(type) {
+func (proxy *Proxy) Intercept(i Interceptor, w http.ResponseWriter, r *http.Request) {
+	finished, ok := proxy.startInterception()
+	if !ok {
+		dockerError(w, "the weave proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	// Streamed responses can go on indefinitely, so the interception
+	// is over once the response has been intercepted
+	defer finished()
+
+	start := time.Now()
+	err := i.InterceptRequest(r)
+	proxy.metrics.observeIntercept(i, start)
+	if err != nil && r.Context().Err() != nil {
+		// Nobody left to tell
+		Log.Infof("Client went away while intercepting %s %s", r.Method, r.URL)
+		return
+	}
+	if err != nil {
+		// Interceptors wrap errors with what they were doing at the
+		// time; the type underneath says what to tell the client
+		switch errors.Cause(err).(type) {
 		case *docker.NoSuchContainer:
 			http.Error(w, err.Error(), http.StatusNotFound)
 		case *ErrNoSuchImage:
-			http.Error(w, err.Error(), http.StatusNotFound)
+			proxy.metrics.noSuchImageError()
+			dockerError(w, err.Error(), http.StatusNotFound)
+		case *ErrInvalidQueryParam, *ErrMalformedBody, *UnmarshalWrongTypeError, *ErrInvalidPortBinding:
+			dockerError(w, err.Error(), http.StatusBadRequest)
+		case *ErrBodyTooLarge:
+			dockerError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case *ErrFailClosed:
+			Log.Warning(err)
+			dockerError(w, err.Error(), http.StatusBadRequest)
 		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			Log.Warning("Error intercepting request: ", err)
@@ -43,6 +72,7 @@ func (proxy *Proxy) Intercept(i interceptor, w http.ResponseWriter, r *http.Requ
 		return
 	}
 	err = i.InterceptResponse(resp)
+	finished()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		Log.Warning("Error intercepting response: ", err)
@@ -69,6 +99,17 @@ func (proxy *Proxy) Intercept(i interceptor, w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// dockerError replies in the same way as the Docker daemon does, so
+// that clients present the error to the user just as they would if
+// the proxy was not there.
+func dockerError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]string{"message": message}); err != nil {
+		Log.Warning(err)
+	}
+}
+
 func doRawStream(w http.ResponseWriter, resp *http.Response, client *httputil.ClientConn) {
 	down, downBuf, up, remaining, err := hijack(w, client)
 	if err != nil {
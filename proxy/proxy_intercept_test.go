@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingInterceptor struct{ err error }
+
+func (i failingInterceptor) InterceptRequest(r *http.Request) error {
+	return i.err
+}
+
+func (i failingInterceptor) InterceptResponse(r *http.Response) error {
+	return nil
+}
+
+func TestNoSuchImageResponse(t *testing.T) {
+	// As sent by the Docker daemon for `docker create busybox:latest`
+	// when the image has not been pulled
+	const daemonBody = `{"message":"No such image: busybox:latest"}` + "\n"
+
+	proxy := &Proxy{}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", nil)
+	proxy.Intercept(failingInterceptor{&ErrNoSuchImage{"busybox:latest"}}, w, r)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, daemonBody, w.Body.String())
+}
+
+func TestFailClosedResponse(t *testing.T) {
+	proxy := &Proxy{}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", nil)
+	proxy.Intercept(failingInterceptor{&ErrFailClosed{ErrNoDefaultIPAM}}, w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "--fail-closed")
+}
+
+func TestMalformedBodyResponse(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	r := httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image": `))
+	err := i.InterceptRequest(r)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "decoding create request")
+	malformed, ok := errors.Cause(err).(*ErrMalformedBody)
+	require.True(t, ok, "%T", errors.Cause(err))
+	assert.Equal(t, `{"Image": `, string(malformed.Body))
+
+	// wrapped or not, the client is told it sent a bad request
+	for _, err := range []error{malformed, err, &UnmarshalWrongTypeError{"Env", "array", "PATH=/bin"}} {
+		w := httptest.NewRecorder()
+		i.proxy.Intercept(failingInterceptor{err}, w, httptest.NewRequest("POST", "/v1.24/containers/create", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, err.Error())
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	}
+}
+
+// blockingInterceptor fails each request, but only once it is released
+type blockingInterceptor struct {
+	started, release chan struct{}
+}
+
+func (i blockingInterceptor) InterceptRequest(r *http.Request) error {
+	close(i.started)
+	<-i.release
+	return &ErrNoSuchImage{"busybox:latest"}
+}
+
+func (i blockingInterceptor) InterceptResponse(r *http.Response) error {
+	return nil
+}
+
+func TestShutdownDrainsInterceptions(t *testing.T) {
+	proxy := &Proxy{}
+	blocker := blockingInterceptor{make(chan struct{}), make(chan struct{})}
+	inFlight := httptest.NewRecorder()
+	intercepted := make(chan struct{})
+	go func() {
+		proxy.Intercept(blocker, inFlight, httptest.NewRequest("POST", "/v1.24/containers/create", nil))
+		close(intercepted)
+	}()
+	<-blocker.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, proxy.Shutdown(ctx), "an interception is still in flight")
+
+	w := httptest.NewRecorder()
+	proxy.Intercept(failingInterceptor{}, w, httptest.NewRequest("POST", "/v1.24/containers/create", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	shutdown := make(chan error)
+	go func() { shutdown <- proxy.Shutdown(context.Background()) }()
+	close(blocker.release)
+	require.NoError(t, <-shutdown)
+	<-intercepted
+	assert.Equal(t, http.StatusNotFound, inFlight.Code, "the in-flight request should finish as normal")
+}
+
+// labellingInterceptor adds a field to every response body, as the
+// inspect interceptors do
+type labellingInterceptor struct{}
+
+func (i labellingInterceptor) InterceptRequest(r *http.Request) error {
+	return nil
+}
+
+func (i labellingInterceptor) InterceptResponse(r *http.Response) error {
+	body := jsonObject{}
+	if err := unmarshalResponseBody(r, &body); err != nil {
+		return err
+	}
+	body["Weave"] = true
+	return marshalResponseBody(r, body)
+}
+
+func TestGzipModifiedResponse(t *testing.T) {
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Id":"a1"}`)
+	}))
+	defer daemon.Close()
+	proxy := &Proxy{Config: Config{DockerHost: "tcp://" + strings.TrimPrefix(daemon.URL, "http://")}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxy.Intercept(labellingInterceptor{}, w, r)
+	}))
+	defer ts.Close()
+	const modified = `{"Id":"a1","Weave":true}`
+
+	get := func(acceptEncoding string) *http.Response {
+		r, err := http.NewRequest("GET", ts.URL+"/v1.24/containers/a1/json", nil)
+		require.NoError(t, err)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		// so that we see the body as sent
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		resp, err := client.Do(r)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("gzip, deflate")
+	compressed, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, int64(len(compressed)), resp.ContentLength)
+	body, err := gunzip(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, modified, string(body))
+
+	for _, acceptEncoding := range []string{"", "gzip;q=0", "identity"} {
+		resp := get(acceptEncoding)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "", resp.Header.Get("Content-Encoding"), acceptEncoding)
+		assert.Equal(t, int64(len(modified)), resp.ContentLength, acceptEncoding)
+		assert.Equal(t, modified, string(body), acceptEncoding)
+	}
+
+	// as Go's own client asks for it, and decompresses it
+	resp, err = http.Get(ts.URL + "/v1.24/containers/a1/json")
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.True(t, resp.Uncompressed)
+	assert.Equal(t, modified, string(body))
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for acceptEncoding, expected := range map[string]bool{
+		"":                   false,
+		"gzip":               true,
+		"deflate, GZIP":      true,
+		"gzip;q=0.5, br":     true,
+		"gzip;q=0":           false,
+		"*":                  true,
+		"*;q=0":              false,
+		"*, gzip;q=0":        false,
+		"*;q=0, gzip":        true,
+		"identity, deflate":  false,
+		"gzip;q=nonsense, *": false,
+	} {
+		h := http.Header{}
+		if acceptEncoding != "" {
+			h.Set("Accept-Encoding", acceptEncoding)
+		}
+		assert.Equal(t, expected, acceptsGzip(h), "Accept-Encoding: %s", acceptEncoding)
+	}
+}
@@ -0,0 +1,670 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	weaveapi "github.com/weaveworks/weave/api"
+	weavedocker "github.com/weaveworks/weave/common/docker"
+)
+
+// newStubProxy makes a proxy from c as StubProxy does, with a Docker
+// daemon which answers just enough for it to start.
+func newStubProxy(t *testing.T, c Config) *Proxy {
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Version": "17.03.0"}`)
+	}))
+	c.DockerHost = docker.URL
+	proxy, err := StubProxy(c)
+	require.NoError(t, err)
+	return proxy
+}
+
+func TestReattachCIDRs(t *testing.T) {
+	proxy := &Proxy{attachedCIDRs: make(map[string][]string), attachedIPs: make(map[string][]*net.IPNet)}
+	_, ipnet, _ := net.ParseCIDR("10.32.0.0/12")
+	ipnet.IP = net.ParseIP("10.32.0.5")
+
+	// never attached, so nothing to reclaim
+	assert.Empty(t, proxy.reattachCIDRs("c1", nil))
+
+	// dynamically allocated addresses are claimed again on restart
+	proxy.rememberCIDRs("c1", nil, []*net.IPNet{ipnet})
+	assert.Equal(t, []string{"ip:10.32.0.5/12"}, proxy.reattachCIDRs("c1", nil))
+
+	// an explicit WEAVE_CIDR always wins
+	assert.Equal(t, []string{"10.2.1.1/24"}, proxy.reattachCIDRs("c1", []string{"10.2.1.1/24"}))
+
+	// explicit WEAVE_CIDRs are not remembered
+	proxy.rememberCIDRs("c2", []string{"10.2.1.2/24"}, []*net.IPNet{ipnet})
+	assert.Empty(t, proxy.reattachCIDRs("c2", nil))
+
+	proxy.ContainerDestroyed("c1")
+	assert.Empty(t, proxy.reattachCIDRs("c1", nil))
+}
+
+func TestWeaveCIDRs(t *testing.T) {
+	tests := []struct {
+		env    []string
+		labels map[string]string
+		cidrs  []string
+		err    error
+	}{
+		{nil, nil, nil, nil},
+		{[]string{"WEAVE_CIDR=10.2.1.1/24"}, nil, []string{"10.2.1.1/24"}, nil},
+		{nil, map[string]string{weaveCIDRLabel: "10.2.1.1/24 net:10.2.2.0/24"}, []string{"10.2.1.1/24", "net:10.2.2.0/24"}, nil},
+		{[]string{"WEAVE_CIDR=10.2.1.1/24"}, map[string]string{weaveCIDRLabel: "10.2.3.1/24"}, []string{"10.2.1.1/24"}, nil},
+		{nil, map[string]string{weaveCIDRLabel: "none"}, nil, ErrWeaveCIDRNone},
+		{[]string{"WEAVE_CIDR=fd00::1/64"}, nil, []string{"fd00::1/64"}, nil},
+		{[]string{"WEAVE_CIDR=ip:10.2.1.1/24 net:fd00:1::/64 net:default"}, nil, []string{"ip:10.2.1.1/24", "net:fd00:1::/64", "net:default"}, nil},
+		{[]string{"WEAVE_CIDR=10.2.1.1/24 fd00::1"}, nil, nil, &ErrInvalidCIDR{"fd00::1"}},
+		{[]string{"WEAVE_CIDR=net:10.2.1.300/24"}, nil, nil, &ErrInvalidCIDR{"net:10.2.1.300/24"}},
+	}
+	proxy := &Proxy{}
+	for _, test := range tests {
+		cidrs, err := proxy.weaveCIDRs(context.Background(), "", "", test.env, test.labels)
+		assert.Equal(t, test.cidrs, cidrs, "env %q labels %q", test.env, test.labels)
+		assert.Equal(t, test.err, err, "env %q labels %q", test.env, test.labels)
+	}
+}
+
+func TestWeaveCIDRsFromConfig(t *testing.T) {
+	tests := []struct {
+		config     *docker.Config
+		hostConfig *docker.HostConfig
+		cidrs      []string
+		err        error
+	}{
+		{nil, nil, nil, nil},
+		{nil, &docker.HostConfig{NetworkMode: "bridge"}, nil, nil},
+		{nil, &docker.HostConfig{NetworkMode: "host"}, nil, &ErrNetworkMode{"host"}},
+		{&docker.Config{Env: []string{"WEAVE_CIDR=10.2.1.1/24"}}, nil, []string{"10.2.1.1/24"}, nil},
+		{&docker.Config{Labels: map[string]string{weaveCIDRLabel: "none"}}, nil, nil, ErrWeaveCIDRNone},
+	}
+	proxy := &Proxy{}
+	for _, test := range tests {
+		cidrs, err := proxy.weaveCIDRsFromConfig(context.Background(), test.config, test.hostConfig)
+		assert.Equal(t, test.cidrs, cidrs, "config %+v host config %+v", test.config, test.hostConfig)
+		assert.Equal(t, test.err, err, "config %+v host config %+v", test.config, test.hostConfig)
+	}
+
+	proxy.NoDefaultIPAM = true
+	_, err := proxy.weaveCIDRsFromConfig(context.Background(), nil, nil)
+	assert.Equal(t, ErrNoDefaultIPAM, err)
+}
+
+func TestWeaveCIDRsFromImage(t *testing.T) {
+	inspections := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/withcidr/json":
+			inspections++
+			fmt.Fprintf(w, `{"Id": "a1", "Config": {"Labels": {%q: "10.2.5.1/24"}}}`, weaveCIDRLabel)
+		case "/images/plain/json":
+			fmt.Fprint(w, `{"Id": "b2", "Config": {}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	dc, err := docker.NewClient(ts.URL)
+	require.NoError(t, err)
+	proxy := &Proxy{client: &weavedocker.Client{Client: dc}}
+
+	tests := []struct {
+		image  string
+		env    []string
+		labels map[string]string
+		cidrs  []string
+	}{
+		{"withcidr", nil, nil, []string{"10.2.5.1/24"}},
+		{"withcidr", []string{"WEAVE_CIDR=10.2.1.1/24"}, nil, []string{"10.2.1.1/24"}},
+		{"withcidr", nil, map[string]string{weaveCIDRLabel: "10.2.3.1/24"}, []string{"10.2.3.1/24"}},
+		{"plain", nil, nil, nil},
+		{"missing", nil, nil, nil},
+	}
+	for _, test := range tests {
+		cidrs, err := proxy.weaveCIDRs(context.Background(), "", test.image, test.env, test.labels)
+		require.NoError(t, err, "image %s", test.image)
+		assert.Equal(t, test.cidrs, cidrs, "image %s env %q labels %q", test.image, test.env, test.labels)
+	}
+
+	_, err = proxy.weaveCIDRs(context.Background(), "", "withcidr", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, inspections, "image inspection should be cached")
+}
+
+func TestGetDNSDomain(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/domain", r.URL.Path)
+		fmt.Fprint(w, "weave.local.")
+	}))
+	defer ts.Close()
+	proxy := &Proxy{weaveDNS: weaveapi.NewClient(strings.TrimPrefix(ts.URL, "http://"), Log)}
+	assert.Equal(t, "weave.local.", proxy.getDNSDomain(context.Background()))
+}
+
+func TestGetDNSDomainTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer ts.Close()
+	defer close(hang)
+	proxy := &Proxy{weaveDNS: weaveapi.NewClient(strings.TrimPrefix(ts.URL, "http://"), Log)}
+	proxy.weaveDNS.SetHTTPClient(&http.Client{Timeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	assert.Equal(t, "", proxy.getDNSDomain(context.Background()))
+	assert.True(t, time.Since(start) < time.Second, "lookup should give up after the timeout")
+}
+
+func TestWeaveDNSAddr(t *testing.T) {
+	assert.Equal(t, "", weaveDNSAddr("", 0))
+	assert.Equal(t, "10.0.0.1:6784", weaveDNSAddr("10.0.0.1:6784", 0))
+	assert.Equal(t, ":6790", weaveDNSAddr("", 6790))
+	assert.Equal(t, "10.0.0.1:6790", weaveDNSAddr("10.0.0.1:6784", 6790))
+	assert.Equal(t, "10.0.0.1:6790", weaveDNSAddr("10.0.0.1", 6790))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "weave.local.")
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	defer os.Setenv("WEAVE_HTTP_ADDR", os.Getenv("WEAVE_HTTP_ADDR"))
+	os.Setenv("WEAVE_HTTP_ADDR", "127.0.0.1:1")
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	proxy := newStubProxy(t, Config{WeaveDNSHTTPPort: p})
+	assert.Equal(t, "weave.local.", proxy.getDNSDomain(context.Background()), "from weaveDNS on its own port")
+
+	_, err = StubProxy(Config{WeaveDNSHTTPPort: 65536})
+	assert.Error(t, err)
+}
+
+func TestWeaveDNSConnectionReuse(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "weave.local.")
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	proxy, err := newTestProxy(Config{}, nil, withWeaveDNS(strings.TrimPrefix(ts.URL, "http://")))
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "weave.local.", proxy.lookupDNSDomain())
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns), "lookups should share one kept-alive connection")
+
+	_, err = StubProxy(Config{WeaveDNSIdleConns: -1})
+	assert.Error(t, err)
+}
+
+func TestIsConnectionRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = http.Get("http://" + addr)
+	assert.True(t, isConnectionRefused(err))
+	assert.False(t, isConnectionRefused(errors.New("foo")))
+}
+
+func TestGetDNSDomainCached(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, "weave.local.")
+	}))
+	defer ts.Close()
+	proxy := &Proxy{
+		Config:   Config{DNSDomainCacheTTL: 100 * time.Millisecond},
+		weaveDNS: weaveapi.NewClient(strings.TrimPrefix(ts.URL, "http://"), Log),
+	}
+
+	assert.Equal(t, "weave.local.", proxy.getDNSDomain(context.Background()))
+	assert.Equal(t, "weave.local.", proxy.getDNSDomain(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "weaveDNS should only be asked once within the TTL")
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, "weave.local.", proxy.getDNSDomain(context.Background()))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestSetWeaveDNS(t *testing.T) {
+	proxy := &Proxy{dnsServers: []string{"172.17.0.1"}}
+	hostConfig := jsonObject{"Dns": []string{"8.8.8.8"}}
+	require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, "foo", "weave.local."))
+	assert.Equal(t, []string{"8.8.8.8", "172.17.0.1"}, hostConfig["Dns"])
+
+	proxy.dnsServers = []string{"10.0.0.1", "10.0.0.2", "fd00::1"}
+	hostConfig = jsonObject{}
+	require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, "foo", "weave.local."))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, hostConfig["Dns"])
+}
+
+func TestDNSServers(t *testing.T) {
+	servers, err := dnsServers(Config{DNSServers: []string{"10.0.0.1"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, servers)
+
+	servers, err = dnsServers(Config{DNSServers: []string{"10.0.0.2", "10.0.0.1", "fd00::1"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.1", "fd00::1"}, servers, "order must be preserved")
+
+	_, err = dnsServers(Config{DNSServers: []string{"10.0.0.1", "weave.local"}})
+	assert.Error(t, err)
+}
+
+func TestRefreshDNSServers(t *testing.T) {
+	bridgeIP := net.ParseIP("172.17.0.1")
+	defer func(f func(string, *net.IPNet) (net.IP, error)) { findBridgeIP = f }(findBridgeIP)
+	findBridgeIP = func(string, *net.IPNet) (net.IP, error) {
+		if bridgeIP == nil {
+			return nil, fmt.Errorf("bridge not found")
+		}
+		return bridgeIP, nil
+	}
+
+	proxy := &Proxy{Config: Config{DockerBridge: "docker0"}}
+	require.NoError(t, proxy.RefreshDNSServers())
+	hostConfig := jsonObject{}
+	require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, "foo", "weave.local."))
+	assert.Equal(t, []string{"172.17.0.1"}, hostConfig["Dns"])
+
+	// the daemon comes back with a different bridge
+	bridgeIP = net.ParseIP("172.18.0.1")
+	require.NoError(t, proxy.RefreshDNSServers())
+	hostConfig = jsonObject{}
+	require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, "foo", "weave.local."))
+	assert.Equal(t, []string{"172.18.0.1"}, hostConfig["Dns"])
+
+	// failing to find it keeps the last one we knew
+	bridgeIP = nil
+	assert.Error(t, proxy.RefreshDNSServers())
+	assert.Equal(t, []string{"172.18.0.1"}, proxy.currentDNSServers())
+
+	// nor do explicitly configured servers change
+	proxy.DNSServers = []string{"10.0.0.1"}
+	require.NoError(t, proxy.RefreshDNSServers())
+	assert.Equal(t, []string{"10.0.0.1"}, proxy.currentDNSServers())
+}
+
+func TestRefreshDNSServersEvery(t *testing.T) {
+	var lookups int32
+	defer func(f func(string, *net.IPNet) (net.IP, error)) { findBridgeIP = f }(findBridgeIP)
+	findBridgeIP = func(string, *net.IPNet) (net.IP, error) {
+		return net.IPv4(172, 17, 0, byte(atomic.AddInt32(&lookups, 1))), nil
+	}
+
+	proxy := &Proxy{quit: make(chan struct{})}
+	stopped := make(chan struct{})
+	go func() {
+		proxy.refreshDNSServersEvery(10 * time.Millisecond)
+		close(stopped)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	proxy.Stop()
+	<-stopped
+	assert.True(t, atomic.LoadInt32(&lookups) >= 2, "looked up %d times", atomic.LoadInt32(&lookups))
+	require.Len(t, proxy.currentDNSServers(), 1)
+}
+
+func TestSetWeaveDNSSearch(t *testing.T) {
+	tests := []struct {
+		mode      string
+		hostname  string
+		dnsSearch []string
+		result    []string
+	}{
+		{"", "", nil, []string{"weave.local."}},
+		{"", "foo", nil, []string{"."}},
+		{"fqdn", "", nil, []string{"weave.local."}},
+		{"fqdn", "foo", nil, []string{"."}},
+		{"fqdn", "foo", []string{"corp.example.com"}, []string{"corp.example.com", "weave.local."}},
+		{"fqdn", "", []string{"corp.example.com", "weave.local."}, []string{"corp.example.com", "weave.local."}},
+		{"fqdn", "foo", []string{"."}, []string{"."}},
+		{"domain", "", nil, []string{"weave.local."}},
+		{"domain", "foo", nil, []string{"weave.local."}},
+		{"domain", "foo", []string{"corp.example.com"}, []string{"corp.example.com", "weave.local."}},
+		{"none", "", nil, nil},
+		{"none", "foo", nil, nil},
+		{"none", "foo", []string{"corp.example.com"}, []string{"corp.example.com"}},
+	}
+	for _, test := range tests {
+		proxy := &Proxy{Config: Config{DNSSearchMode: test.mode}, dnsServers: []string{"172.17.0.1"}}
+		hostConfig := jsonObject{}
+		if test.dnsSearch != nil {
+			hostConfig["DnsSearch"] = test.dnsSearch
+		}
+		require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, test.hostname, "weave.local."))
+		if test.result == nil {
+			assert.NotContains(t, hostConfig, "DnsSearch", "mode %q hostname %q", test.mode, test.hostname)
+		} else {
+			assert.Equal(t, test.result, hostConfig["DnsSearch"], "mode %q hostname %q search %q", test.mode, test.hostname, test.dnsSearch)
+		}
+	}
+
+	for mode, valid := range map[string]bool{"": true, "fqdn": true, "domain": true, "none": true, "FQDN": false, ".": false} {
+		assert.Equal(t, valid, validateDNSSearchMode(mode) == nil, "mode %q", mode)
+	}
+}
+
+func TestSetWeaveDNSSearchList(t *testing.T) {
+	tests := []struct {
+		search    []string
+		dnsSearch []string
+		result    []string
+	}{
+		{[]string{"corp.example.com", "example.com"}, nil, []string{"corp.example.com", "example.com"}},
+		{[]string{"@weave", "corp.example.com", "example.com"}, nil, []string{"weave.local.", "corp.example.com", "example.com"}},
+		{[]string{"corp.example.com", "@weave", "example.com"}, nil, []string{"corp.example.com", "weave.local.", "example.com"}},
+		{[]string{"example.com", "@weave"}, nil, []string{"example.com", "weave.local."}},
+		// the container's own, left alone
+		{[]string{"@weave", "example.com"}, []string{"mine.example.org"}, []string{"mine.example.org"}},
+	}
+	for _, test := range tests {
+		proxy := &Proxy{Config: Config{DNSSearch: test.search}, dnsServers: []string{"172.17.0.1"}}
+		hostConfig := jsonObject{}
+		if test.dnsSearch != nil {
+			hostConfig["DnsSearch"] = test.dnsSearch
+		}
+		require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, "foo", "weave.local."))
+		assert.Equal(t, test.result, hostConfig["DnsSearch"], "search %q", test.search)
+	}
+
+	assert.NoError(t, validateDNSSearch([]string{"@weave", "corp.example.com"}, ""))
+	assert.NoError(t, validateDNSSearch(nil, dnsSearchNone))
+	assert.Error(t, validateDNSSearch([]string{"@weave"}, dnsSearchNone))
+	assert.Error(t, validateDNSSearch([]string{"not a domain"}, ""))
+	assert.Error(t, validateDNSSearch([]string{"@corp"}, ""))
+}
+
+func TestContainerShouldAttach(t *testing.T) {
+	proxy := &Proxy{Config: Config{WeaveWaitMountPath: "/w"}}
+	container := func(entrypoint []string, labels map[string]string, volumes map[string]string) *docker.Container {
+		return &docker.Container{
+			Config:  &docker.Config{Entrypoint: entrypoint, Labels: labels},
+			Volumes: volumes,
+		}
+	}
+	assert.True(t, proxy.containerShouldAttach(container([]string{"/w/w", "/bin/sh"}, nil, nil)))
+	assert.False(t, proxy.containerShouldAttach(container([]string{"/bin/sh"}, nil, nil)))
+	assert.True(t, proxy.containerShouldAttach(container([]string{"/sbin/tini"}, map[string]string{weaveNoWaitLabel: ""}, map[string]string{"/w": "/var/lib/weavewait"})))
+	assert.False(t, proxy.containerShouldAttach(container([]string{"/sbin/tini"}, map[string]string{weaveNoWaitLabel: ""}, nil)))
+	assert.False(t, proxy.containerShouldAttach(&docker.Container{Volumes: map[string]string{"/w": "/var/lib/weavewait"}}))
+}
+
+func TestSetWeaveDNSOptions(t *testing.T) {
+	tests := []struct {
+		user   []string
+		result []string
+	}{
+		{nil, []string{"ndots:0", "timeout:1"}},
+		{[]string{"rotate"}, []string{"rotate", "ndots:0", "timeout:1"}},
+		{[]string{"ndots:5"}, []string{"ndots:5", "timeout:1"}},
+	}
+	proxy := &Proxy{Config: Config{DNSOptions: []string{"ndots:0", "timeout:1"}}, dnsServers: []string{"172.17.0.1"}}
+	for _, test := range tests {
+		hostConfig := jsonObject{}
+		if test.user != nil {
+			hostConfig["DnsOptions"] = test.user
+		}
+		require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, "foo", "weave.local."))
+		assert.Equal(t, test.result, hostConfig["DnsOptions"], "user options %q", test.user)
+	}
+
+	// no options configured: leave the user's alone
+	proxy.DNSOptions = nil
+	hostConfig := jsonObject{}
+	require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, "foo", "weave.local."))
+	assert.NotContains(t, hostConfig, "DnsOptions")
+}
+
+func TestDNSUseTCP(t *testing.T) {
+	options := []string{"ndots:0"}
+	proxy := newStubProxy(t, Config{DNSOptions: options, DNSUseTCP: true})
+	proxy.dnsServers = []string{"172.17.0.1"}
+	assert.Equal(t, []string{"ndots:0"}, options, "the config given must be left as it was")
+
+	for _, test := range []struct {
+		user   []string
+		result []string
+	}{
+		{nil, []string{"ndots:0", "use-vc"}},
+		{[]string{"use-vc", "ndots:2"}, []string{"use-vc", "ndots:2"}},
+	} {
+		hostConfig := jsonObject{}
+		if test.user != nil {
+			hostConfig["DnsOptions"] = test.user
+		}
+		require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, "foo", "weave.local."))
+		assert.Equal(t, test.result, hostConfig["DnsOptions"], "user options %q", test.user)
+	}
+
+	proxy = newStubProxy(t, Config{DNSUseTCP: true})
+	proxy.dnsServers = []string{"172.17.0.1"}
+	hostConfig := jsonObject{}
+	require.NoError(t, proxy.setWeaveDNS(hostConfig, apiVersion{}, "foo", "weave.local."))
+	assert.Equal(t, []string{"use-vc"}, hostConfig["DnsOptions"])
+}
+
+func TestContainerDNSDomain(t *testing.T) {
+	proxy := &Proxy{Config: Config{DNSDomainCacheTTL: time.Hour}}
+	proxy.dnsDomain.domain = "weave.local."
+	proxy.dnsDomain.expires = time.Now().Add(time.Hour)
+
+	tests := []struct {
+		env    []string
+		domain string
+	}{
+		{nil, "weave.local."},
+		{[]string{"WEAVE_DNS_DOMAIN=tenant-a.weave.local"}, "tenant-a.weave.local."},
+		{[]string{"WEAVE_DNS_DOMAIN=tenant-a.weave.local."}, "tenant-a.weave.local."},
+		{[]string{"WEAVE_DNS_DOMAIN=bad_domain..local"}, "weave.local."},
+		{[]string{"WEAVE_DNS_DOMAIN=-tenant.local"}, "weave.local."},
+		{[]string{"WEAVE_DNS_DOMAIN="}, "weave.local."},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.domain, proxy.containerDNSDomain(context.Background(), test.env), "env %q", test.env)
+	}
+
+	// no weaveDNS, no domain, whatever the container asks for
+	proxy.WithoutDNS = true
+	assert.Equal(t, "", proxy.containerDNSDomain(context.Background(), []string{"WEAVE_DNS_DOMAIN=tenant-a.weave.local"}))
+}
+
+func TestValidateDNSDomain(t *testing.T) {
+	assert.NoError(t, validateDNSDomain("tenant-a.weave.local."))
+	for _, domain := range []string{"bad_domain..local.", "-tenant.local.", ".", strings.Repeat("a", 64) + ".local."} {
+		assert.Equal(t, &ErrInvalidDNSName{domain, "not a valid domain"}, validateDNSDomain(domain), domain)
+	}
+}
+
+func TestRegisterWithDNSTTL(t *testing.T) {
+	var ttls []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		ttls = append(ttls, r.Form.Get("ttl"))
+	}))
+	defer ts.Close()
+	proxy := &Proxy{weave: weaveapi.NewClient(strings.TrimPrefix(ts.URL, "http://"), Log)}
+	_, ipnet, _ := net.ParseCIDR("10.32.0.5/12")
+
+	require.NoError(t, proxy.registerWithDNS("c1", "foo.weave.local", "weave.local", []*net.IPNet{ipnet}))
+	proxy.DNSTTL = 5
+	require.NoError(t, proxy.registerWithDNS("c1", "foo.weave.local", "weave.local", []*net.IPNet{ipnet}))
+	assert.Equal(t, []string{"", "5"}, ttls, "no TTL sent unless one is configured")
+
+	for ttl, valid := range map[int]bool{0: true, 1: true, 30: true, maxDNSTTL: true, -1: false, maxDNSTTL + 1: false} {
+		assert.Equal(t, valid, validateDNSTTL(ttl) == nil, "ttl %d", ttl)
+	}
+	// also without weaveDNS, for containers with WEAVE_DNS=on
+	_, err := newTestProxy(Config{WithoutDNS: true, DNSTTL: -1}, nil)
+	assert.Error(t, err)
+}
+
+func TestRegisterWithDNSHost(t *testing.T) {
+	var registrations []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		registrations = append(registrations, r.Form)
+	}))
+	defer ts.Close()
+	proxy := &Proxy{
+		Config:  Config{HostID: "host1"},
+		weave:   weaveapi.NewClient(strings.TrimPrefix(ts.URL, "http://"), Log),
+		aliases: map[string][]string{"c1": {"app"}},
+	}
+	_, ipnet, _ := net.ParseCIDR("10.32.0.5/12")
+
+	require.NoError(t, proxy.registerWithDNS("c1", "foo.weave.local", "weave.local", []*net.IPNet{ipnet}))
+	require.Len(t, registrations, 2)
+	for _, form := range registrations {
+		assert.Equal(t, "host1", form.Get("host"), form.Get("fqdn"))
+	}
+	assert.Equal(t, "true", registrations[1].Get("alias"), "aliases too")
+
+	registrations = nil
+	proxy.HostID = ""
+	require.NoError(t, proxy.registerWithDNS("c1", "foo.weave.local", "weave.local", []*net.IPNet{ipnet}))
+	assert.NotContains(t, registrations[0], "host")
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, hostname, newStubProxy(t, Config{DNSServers: []string{"172.17.0.1"}}).HostID, "by default")
+}
+
+func TestRestartPolicyReattach(t *testing.T) {
+	killed := make(chan string, 10)
+	dockerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/c1/json"):
+			// created before the proxy started, so it never saw the policy
+			fmt.Fprint(w, `{"Id": "c1", "Config": {"Entrypoint": ["/w/w", "/bin/sh"]}, "HostConfig": {"RestartPolicy": {"Name": "always"}}, "State": {"Running": true, "Pid": 4242}}`)
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/kill"):
+			killed <- r.URL.Path
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer dockerServer.Close()
+	allocations := make(chan struct{}, 10)
+	weave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allocations <- struct{}{}
+		http.Error(w, "IPAM not ready", http.StatusServiceUnavailable)
+	}))
+	defer weave.Close()
+
+	dc, err := docker.NewClient(dockerServer.URL)
+	require.NoError(t, err)
+	proxy := newTestCreateInterceptor(Config{WithoutDNS: true, NoRewriteHosts: true}).proxy
+	proxy.client = &weavedocker.Client{Client: dc}
+	proxy.weave = weaveapi.NewClient(strings.TrimPrefix(weave.URL, "http://"), Log)
+	proxy.waiters = make(map[*http.Request]*wait)
+	proxy.attachJobs = make(map[string]*attachJob)
+	proxy.quit = make(chan struct{})
+	defer proxy.Stop()
+
+	// Docker restarts c1 by itself, with nobody waiting on the start,
+	// and attaching fails: we keep trying rather than kill it
+	proxy.ContainerStarted("c1")
+	for n := 0; n < 2; n++ {
+		select {
+		case <-allocations:
+		case <-time.After(5 * time.Second):
+			t.Fatal("attach was not retried")
+		}
+	}
+	assert.Empty(t, killed)
+}
+
+func TestRestartsAutomatically(t *testing.T) {
+	for policy, expected := range map[string]bool{"always": true, "unless-stopped": true, "on-failure": true, "no": false, "": false} {
+		container := &docker.Container{HostConfig: &docker.HostConfig{RestartPolicy: docker.RestartPolicy{Name: policy}}}
+		assert.Equal(t, expected, restartsAutomatically(container), policy)
+	}
+	assert.False(t, restartsAutomatically(&docker.Container{}), "not inspected with a HostConfig")
+}
+
+func TestParseSocketMode(t *testing.T) {
+	for mode, expected := range map[string]os.FileMode{"": 0660, "0600": 0600, "666": 0666} {
+		parsed, err := parseSocketMode(mode)
+		require.NoError(t, err, mode)
+		assert.Equal(t, expected, parsed, mode)
+	}
+	for _, mode := range []string{"rw-rw----", "0999", "01777"} {
+		_, err := parseSocketMode(mode)
+		assert.Error(t, err, mode)
+	}
+}
+
+func TestSocketListener(t *testing.T) {
+	var forwarded jsonObject
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"Id": "c1"}`)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "weave-proxy-socket")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "proxy.sock")
+
+	proxy := newTestCreateInterceptor(Config{
+		WithoutDNS: true,
+		DockerHost: "tcp://" + strings.TrimPrefix(ts.URL, "http://"),
+		Socket:     socket,
+	}).proxy
+	proxy.socketMode = 0600
+	proxy.quit = make(chan struct{})
+	listener, err := proxy.listenSocket()
+	require.NoError(t, err)
+	defer listener.Close()
+	go (&http.Server{Handler: proxy}).Serve(listener)
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket|0600, info.Mode())
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) { return net.Dial("unix", socket) },
+	}}
+	resp, err := client.Post("http://proxy/v1.24/containers/create", "application/json", strings.NewReader(`{"Image": "nginx", "Entrypoint": ["/bin/sh"]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, forwarded["Entrypoint"], "intercepted just as over TCP")
+
+	proxy.Stop()
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err), "socket left behind on shutdown")
+}
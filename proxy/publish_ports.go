@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidPortBinding is returned, with --publish-on-weave, for a
+// published port which could not be moved onto the weave network.
+type ErrInvalidPortBinding struct {
+	Port, Reason string
+}
+
+func (err *ErrInvalidPortBinding) Error() string {
+	return fmt.Sprintf("invalid port binding %q: %s", err.Port, err.Reason)
+}
+
+// e.g. 80, 80/tcp or 8000-8010/udp for the container's side, and the
+// same without the protocol for the host's
+var (
+	containerPortRegexp = regexp.MustCompile(`^([0-9]+)(-([0-9]+))?(/(tcp|udp|sctp))?$`)
+	hostPortRegexp      = regexp.MustCompile(`^([0-9]+)(-([0-9]+))?$`)
+)
+
+// requestedIP returns the first address explicitly requested in a
+// container's WEAVE_CIDR, or nil if it leaves them all to IPAM, which
+// only allocates when the container starts.
+func requestedIP(cidrs []string) net.IP {
+	for _, cidr := range cidrs {
+		if strings.HasPrefix(cidr, "net:") {
+			continue
+		}
+		if ip, _, err := net.ParseCIDR(strings.TrimPrefix(cidr, "ip:")); err == nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// publishOnWeave binds the container's published ports to ip, its
+// weave address, rather than to every address of the host. Ports
+// bound to a particular host address already are left where they are.
+// If ip is not known yet, the bindings are only checked.
+func publishOnWeave(hostConfig jsonObject, ip net.IP) error {
+	value, found := hostConfig[hostConfig.keyFor("PortBindings")]
+	if !found || value == nil {
+		return nil
+	}
+	bindings, ok := asJSONObject(value)
+	if !ok {
+		return &UnmarshalWrongTypeError{"HostConfig.PortBindings", "object", value}
+	}
+	ports := make([]string, 0, len(bindings))
+	for port := range bindings {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+
+	var (
+		unbound      []jsonObject
+		unboundPorts []string
+	)
+	for _, port := range ports {
+		if err := checkPortRange(containerPortRegexp, port); err != nil {
+			return &ErrInvalidPortBinding{port, err.Error()}
+		}
+		if bindings[port] == nil {
+			continue
+		}
+		list, ok := bindings[port].([]interface{})
+		if !ok {
+			return &UnmarshalWrongTypeError{"HostConfig.PortBindings." + port, "array", bindings[port]}
+		}
+		for _, item := range list {
+			binding, ok := asJSONObject(item)
+			if !ok {
+				return &UnmarshalWrongTypeError{"HostConfig.PortBindings." + port, "array of objects", bindings[port]}
+			}
+			hostIPKey, hostPortKey := binding.keyFor("HostIp"), binding.keyFor("HostPort")
+			hostIP, err := binding.String(hostIPKey)
+			if err != nil {
+				return err
+			}
+			hostPort, err := binding.String(hostPortKey)
+			if err != nil {
+				return err
+			}
+			if hostPort != "" {
+				if err := checkPortRange(hostPortRegexp, hostPort); err != nil {
+					return &ErrInvalidPortBinding{port, "host port " + err.Error()}
+				}
+			}
+			switch parsed := net.ParseIP(hostIP); {
+			case hostIP == "" || parsed.IsUnspecified():
+				unbound = append(unbound, binding)
+				if !containsString(unboundPorts, port) {
+					unboundPorts = append(unboundPorts, port)
+				}
+			case parsed == nil:
+				return &ErrInvalidPortBinding{port, fmt.Sprintf("host address %q is not an IP address", hostIP)}
+			}
+		}
+	}
+	if len(unbound) == 0 {
+		return nil
+	}
+	if ip == nil {
+		Log.Warningf("Leaving published ports %s on all host addresses, since the container's weave address is not known until it starts", strings.Join(unboundPorts, ", "))
+		return nil
+	}
+	for _, binding := range unbound {
+		binding[binding.keyFor("HostIp")] = ip.String()
+	}
+	return nil
+}
+
+// checkPortRange checks s, matched by re, is a port or range of ports
+// in the right order.
+func checkPortRange(re *regexp.Regexp, s string) error {
+	match := re.FindStringSubmatch(s)
+	if match == nil {
+		return fmt.Errorf("%q is not a port or range of ports", s)
+	}
+	first, err := strconv.Atoi(match[1])
+	if err != nil || first < 1 || first > 65535 {
+		return fmt.Errorf("%q is out of range", s)
+	}
+	if match[3] != "" {
+		last, err := strconv.Atoi(match[3])
+		if err != nil || last < first || last > 65535 {
+			return fmt.Errorf("%q is out of range", s)
+		}
+	}
+	return nil
+}
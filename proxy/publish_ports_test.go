@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishOnWeave(t *testing.T) {
+	hostConfig := jsonObject{}
+	require.NoError(t, json.Unmarshal([]byte(`{"PortBindings": {
+		"80/tcp": [{"HostIp": "", "HostPort": "8080"}],
+		"53/udp": [{"HostIp": "0.0.0.0", "HostPort": ""}, {"HostIp": "127.0.0.1", "HostPort": "5353"}],
+		"9000-9001": [{"HostPort": "19000-19001"}]
+	}}`), &hostConfig))
+	require.NoError(t, publishOnWeave(hostConfig, net.ParseIP("10.2.1.1")))
+
+	bindings, err := hostConfig.Object("PortBindings")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{map[string]interface{}{"HostIp": "10.2.1.1", "HostPort": "8080"}}, bindings["80/tcp"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"HostIp": "10.2.1.1", "HostPort": ""},
+		map[string]interface{}{"HostIp": "127.0.0.1", "HostPort": "5353"},
+	}, bindings["53/udp"], "a particular host address is left alone")
+	assert.Equal(t, []interface{}{map[string]interface{}{"HostIp": "10.2.1.1", "HostPort": "19000-19001"}}, bindings["9000-9001"])
+
+	// not known until the container starts, so left as they are
+	hostConfig = jsonObject{"PortBindings": map[string]interface{}{"80/tcp": []interface{}{map[string]interface{}{"HostIp": "", "HostPort": "8080"}}}}
+	require.NoError(t, publishOnWeave(hostConfig, nil))
+	assert.Equal(t, jsonObject{"PortBindings": map[string]interface{}{"80/tcp": []interface{}{map[string]interface{}{"HostIp": "", "HostPort": "8080"}}}}, hostConfig)
+
+	// nothing published
+	hostConfig = jsonObject{}
+	require.NoError(t, publishOnWeave(hostConfig, net.ParseIP("10.2.1.1")))
+	assert.Empty(t, hostConfig)
+}
+
+func TestPublishOnWeaveInvalid(t *testing.T) {
+	for _, body := range []string{
+		`{"PortBindings": {"http": [{"HostPort": "8080"}]}}`,
+		`{"PortBindings": {"0/tcp": [{"HostPort": "8080"}]}}`,
+		`{"PortBindings": {"80/icmp": [{"HostPort": "8080"}]}}`,
+		`{"PortBindings": {"9001-9000": [{"HostPort": "8080"}]}}`,
+		`{"PortBindings": {"80/tcp": [{"HostPort": "70000"}]}}`,
+		`{"PortBindings": {"80/tcp": [{"HostIp": "localhost", "HostPort": "8080"}]}}`,
+	} {
+		hostConfig := jsonObject{}
+		require.NoError(t, json.Unmarshal([]byte(body), &hostConfig))
+		assert.IsType(t, &ErrInvalidPortBinding{}, publishOnWeave(hostConfig, net.ParseIP("10.2.1.1")), body)
+	}
+	for _, body := range []string{
+		`{"PortBindings": ["80/tcp"]}`,
+		`{"PortBindings": {"80/tcp": {"HostPort": "8080"}}}`,
+		`{"PortBindings": {"80/tcp": [{"HostPort": 8080}]}}`,
+	} {
+		hostConfig := jsonObject{}
+		require.NoError(t, json.Unmarshal([]byte(body), &hostConfig))
+		assert.IsType(t, &UnmarshalWrongTypeError{}, publishOnWeave(hostConfig, net.ParseIP("10.2.1.1")), body)
+	}
+}
+
+func TestCreateWithPublishOnWeave(t *testing.T) {
+	i := newTestCreateInterceptor(Config{WithoutDNS: true, PublishOnWeave: true})
+	container := interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "Env": ["WEAVE_CIDR=10.2.1.1/24"], "HostConfig": {"PortBindings": {"80/tcp": [{"HostIp": "", "HostPort": "8080"}]}}}`)
+	hostConfig, err := container.Object("HostConfig")
+	require.NoError(t, err)
+	bindings, err := hostConfig.Object("PortBindings")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{map[string]interface{}{"HostIp": "10.2.1.1", "HostPort": "8080"}}, bindings["80/tcp"])
+
+	// allocated by IPAM on start
+	container = interceptCreate(t, i, `{"Entrypoint": ["/bin/sh"], "HostConfig": {"PortBindings": {"80/tcp": [{"HostIp": "", "HostPort": "8080"}]}}}`)
+	hostConfig, err = container.Object("HostConfig")
+	require.NoError(t, err)
+	bindings, err = hostConfig.Object("PortBindings")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{map[string]interface{}{"HostIp": "", "HostPort": "8080"}}, bindings["80/tcp"])
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// removeContainerInterceptor releases a container's addresses as soon
+// as Docker has removed it. Containers run with --rm are removed by
+// the daemon itself, without a request through us, so they are
+// released when they die instead.
+type removeContainerInterceptor struct {
+	proxy *Proxy
+	// set by InterceptRequest, since the path may give a name or a
+	// short ID, and once the container is gone there is nothing left
+	// to ask which one it was
+	containerID string
+}
+
+func (i *removeContainerInterceptor) InterceptRequest(r *http.Request) error {
+	subs := containerRmRegexp.FindStringSubmatch(r.URL.Path)
+	if subs == nil {
+		return nil
+	}
+	container, err := i.proxy.client.InspectContainer(subs[2])
+	if err != nil {
+		// Docker will tell the client what is wrong
+		Log.Debugf("Error inspecting container %s to remove: %v", subs[2], err)
+		return nil
+	}
+	i.containerID = container.ID
+	return nil
+}
+
+func (i *removeContainerInterceptor) InterceptResponse(r *http.Response) error {
+	if i.containerID == "" || r.StatusCode < 200 || r.StatusCode >= 300 {
+		return nil
+	}
+	i.proxy.release(i.containerID)
+	return nil
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	weaveapi "github.com/weaveworks/weave/api"
+)
+
+// fakeIPAM records the addresses released through the weave API
+type fakeIPAM struct {
+	sync.Mutex
+	released []string
+}
+
+func (f *fakeIPAM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/ip/") {
+		f.Lock()
+		f.released = append(f.released, strings.TrimPrefix(r.URL.Path, "/ip/"))
+		f.Unlock()
+	}
+}
+
+func newReleaseTestProxy(t *testing.T) (*Proxy, *fakeIPAM, func()) {
+	ipam := &fakeIPAM{}
+	ts := httptest.NewServer(ipam)
+	i := newTestCreateInterceptor(Config{WithoutDNS: true})
+	proxy := i.proxy
+	proxy.weave = weaveapi.NewClient(strings.TrimPrefix(ts.URL, "http://"), Log)
+	proxy.attachedCIDRs = make(map[string][]string)
+	proxy.attachedIPs = make(map[string][]*net.IPNet)
+	proxy.autoRemove = make(map[string]struct{})
+	return proxy, ipam, ts.Close
+}
+
+func createContainer(t *testing.T, proxy *Proxy, body, id string) {
+	i := &createContainerInterceptor{proxy: proxy}
+	r := httptest.NewRequest("POST", "/v1.25/containers/create", strings.NewReader(body))
+	require.NoError(t, i.InterceptRequest(r))
+	require.NoError(t, i.InterceptResponse(&http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"Id": "` + id + `"}`)),
+		Request:    r,
+	}))
+}
+
+func TestAutoRemoveReleasedOnDeath(t *testing.T) {
+	proxy, ipam, done := newReleaseTestProxy(t)
+	defer done()
+
+	createContainer(t, proxy, `{"Entrypoint": ["/bin/sh"], "HostConfig": {"AutoRemove": true}}`, "rm1")
+	createContainer(t, proxy, `{"Entrypoint": ["/bin/sh"]}`, "keep1")
+
+	proxy.ContainerDied("keep1")
+	assert.Empty(t, ipam.released, "containers without --rm keep their address to restart with")
+
+	proxy.ContainerDied("rm1")
+	assert.Equal(t, []string{"rm1"}, ipam.released)
+
+	// Docker then removes it; we have nothing left to release
+	proxy.ContainerDestroyed("rm1")
+	proxy.ContainerDied("rm1")
+	assert.Equal(t, []string{"rm1"}, ipam.released)
+}
+
+func TestRemoveContainerReleases(t *testing.T) {
+	proxy, ipam, done := newReleaseTestProxy(t)
+	defer done()
+	_, ipnet, _ := net.ParseCIDR("10.32.0.5/12")
+	c1 := &docker.Container{ID: "c1", Name: "/web"}
+	c2 := &docker.Container{ID: "c2", Name: "/db"}
+	// Docker finds containers by name or ID alike
+	proxy.client = &fakeDockerClient{containers: map[string]*docker.Container{
+		"c1": c1, "web": c1, "c2": c2, "db": c2,
+		"never-attached": {ID: "never-attached"},
+	}}
+	proxy.rememberCIDRs("c1", nil, []*net.IPNet{ipnet})
+	proxy.rememberCIDRs("c2", nil, []*net.IPNet{ipnet})
+
+	remove := func(path string, status int) {
+		i := &removeContainerInterceptor{proxy: proxy}
+		r := httptest.NewRequest("DELETE", path, nil)
+		require.NoError(t, i.InterceptRequest(r))
+		require.NoError(t, i.InterceptResponse(&http.Response{StatusCode: status, Request: r}))
+	}
+	remove("/v1.24/containers/c1", http.StatusConflict)
+	assert.Empty(t, ipam.released, "not released if Docker refused to remove it")
+
+	remove("/v1.24/containers/c1", http.StatusNoContent)
+	assert.Equal(t, []string{"c1"}, ipam.released)
+	assert.Empty(t, proxy.reattachCIDRs("c1", nil))
+
+	remove("/v1.24/containers/db", http.StatusNoContent)
+	assert.Equal(t, []string{"c1", "c2"}, ipam.released, "released by ID when removed by name")
+	assert.Empty(t, proxy.reattachCIDRs("c2", nil))
+
+	remove("/v1.24/containers/never-attached", http.StatusNoContent)
+	remove("/v1.24/containers/no-such-container", http.StatusNotFound)
+	assert.Equal(t, []string{"c1", "c2"}, ipam.released)
+}
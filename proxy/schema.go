@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// jsonKind is what a field of a request body must hold, as it reads in
+// an error message.
+type jsonKind string
+
+const (
+	jsonString              jsonKind = "string"
+	jsonBool                jsonKind = "boolean"
+	jsonStringArray         jsonKind = "array of strings"
+	jsonStringOrStringArray jsonKind = "string or array of strings"
+	jsonStringMap           jsonKind = "object of strings"
+	jsonObjectArray         jsonKind = "array of objects"
+)
+
+// jsonSchema gives, for each field it names, a jsonKind, a nested
+// jsonSchema the field's object must match, or a jsonSchemaMap. Fields
+// it does not name may hold anything.
+type jsonSchema map[string]interface{}
+
+// jsonSchemaMap is an object whose every value must match the schema,
+// e.g. EndpointsConfig, keyed by network.
+type jsonSchemaMap struct {
+	jsonSchema
+}
+
+// The fields of a create body which we read or change, with the types
+// Docker expects of them. Anything else is left for Docker to check.
+var createBodySchema = jsonSchema{
+	"Image":      jsonString,
+	"Hostname":   jsonString,
+	"Domainname": jsonString,
+	"MacAddress": jsonString,
+	"Env":        jsonStringArray,
+	// Docker's strslice takes either
+	"Cmd":        jsonStringOrStringArray,
+	"Entrypoint": jsonStringOrStringArray,
+	"Labels":     jsonStringMap,
+	"Platform":   jsonString,
+	"HostConfig": jsonSchema{
+		"NetworkMode":    jsonString,
+		"Isolation":      jsonString,
+		"Binds":          jsonStringArray,
+		"ExtraHosts":     jsonStringArray,
+		"Dns":            jsonStringArray,
+		"DnsOptions":     jsonStringArray,
+		"DnsSearch":      jsonStringArray,
+		"Sysctls":        jsonStringMap,
+		"CapAdd":         jsonStringArray,
+		"Ulimits":        jsonObjectArray,
+		"Tmpfs":          jsonStringMap,
+		"ReadonlyRootfs": jsonBool,
+		"Init":           jsonBool,
+		"AutoRemove":     jsonBool,
+		"RestartPolicy":  jsonSchema{"Name": jsonString},
+	},
+	"NetworkingConfig": jsonSchema{
+		"EndpointsConfig": jsonSchemaMap{jsonSchema{
+			"Aliases":    jsonStringArray,
+			"DNSNames":   jsonStringArray,
+			"IPAMConfig": jsonSchema{"IPv4Address": jsonString},
+		}},
+	},
+}
+
+// validateCreateBody checks the fields of a create body we are about
+// to work with, so that a hand-crafted request with, say, Env as a
+// single string is told which field is wrong rather than failing part
+// way through being changed.
+func validateCreateBody(container jsonObject) error {
+	return createBodySchema.validate(container, "")
+}
+
+func (schema jsonSchema) validate(obj jsonObject, path string) error {
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := obj.keyFor(name)
+		value, found := obj[key]
+		if !found || value == nil {
+			continue
+		}
+		field := path + key
+		switch want := schema[name].(type) {
+		case jsonKind:
+			if !want.matches(value) {
+				return &UnmarshalWrongTypeError{field, string(want), value}
+			}
+		case jsonSchema:
+			nested, ok := asJSONObject(value)
+			if !ok {
+				return &UnmarshalWrongTypeError{field, "object", value}
+			}
+			if err := want.validate(nested, field+"."); err != nil {
+				return err
+			}
+		case jsonSchemaMap:
+			nested, ok := asJSONObject(value)
+			if !ok {
+				return &UnmarshalWrongTypeError{field, "object", value}
+			}
+			if err := want.validate(nested, field+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (schema jsonSchemaMap) validate(obj jsonObject, path string) error {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if obj[key] == nil {
+			continue
+		}
+		nested, ok := asJSONObject(obj[key])
+		if !ok {
+			return &UnmarshalWrongTypeError{path + key, "object", obj[key]}
+		}
+		if err := schema.jsonSchema.validate(nested, path+key+"."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kind jsonKind) matches(value interface{}) bool {
+	switch kind {
+	case jsonString:
+		_, ok := value.(string)
+		return ok
+	case jsonBool:
+		_, ok := value.(bool)
+		return ok
+	case jsonStringOrStringArray:
+		if _, ok := value.(string); ok {
+			return true
+		}
+		return isStringArray(value)
+	case jsonStringArray:
+		return isStringArray(value)
+	case jsonStringMap:
+		obj, ok := asJSONObject(value)
+		if !ok {
+			return false
+		}
+		for _, v := range obj {
+			if _, ok := v.(string); !ok {
+				return false
+			}
+		}
+		return true
+	case jsonObjectArray:
+		a, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range a {
+			if _, ok := asJSONObject(v); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func isStringArray(value interface{}) bool {
+	switch a := value.(type) {
+	case []string:
+		return true
+	case []interface{}:
+		for _, v := range a {
+			if _, ok := v.(string); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// jsonTypeName describes a decoded JSON value the way a user who wrote
+// it would, rather than as the Go type it was decoded into.
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case json.Number, float64, int:
+		return "a number"
+	case []interface{}, []string:
+		return "an array"
+	case map[string]interface{}, jsonObject, map[string]string:
+		return "an object"
+	}
+	return "a value"
+}
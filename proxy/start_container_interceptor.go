@@ -8,16 +8,20 @@ import (
 type startContainerInterceptor struct{ proxy *Proxy }
 
 func (i *startContainerInterceptor) InterceptRequest(r *http.Request) error {
-	container, err := inspectContainerInPath(i.proxy.client, r.URL.Path)
+	container, err := inspectContainerInPath(r.Context(), i.proxy.client, r.URL.Path)
 	if err != nil {
 		return err
 	}
 
 	// If the client has sent some JSON which might be a HostConfig, add our
 	// parameters back into it, otherwise Docker will consider them overwritten
-	if containerShouldAttach(container) && r.Header.Get("Content-Type") == "application/json" && r.ContentLength > 0 {
+	if i.proxy.containerShouldAttach(container) && r.Header.Get("Content-Type") == "application/json" && r.ContentLength > 0 {
+		body, err := readRequestBody(r)
+		if err != nil {
+			return err
+		}
 		params := map[string]interface{}{}
-		if err := unmarshalRequestBody(r, &params); err != nil {
+		if err := unmarshalBody(body, &params); err != nil {
 			return err
 		}
 		// HostConfig can be sent either as a struct named HostConfig, or unnamed at top level
@@ -36,29 +40,21 @@ func (i *startContainerInterceptor) InterceptRequest(r *http.Request) error {
 			if err != nil {
 				return err
 			}
-			if strings.HasPrefix(networkMode, "container:") || networkMode == "host" {
-				if err := addVolume(hostConfig, i.proxy.weaveWaitNoopVolume, "/w", "ro"); err != nil {
-					return err
-				}
-			} else {
-				if i.proxy.NoMulticastRoute {
-					if err := addVolume(hostConfig, i.proxy.weaveWaitNomcastVolume, "/w", "ro"); err != nil {
-						return err
-					}
-				} else {
-					if err := addVolume(hostConfig, i.proxy.weaveWaitVolume, "/w", "ro"); err != nil {
-						return err
-					}
-				}
-				if dnsDomain := i.proxy.getDNSDomain(); dnsDomain != "" {
-					if err := i.proxy.setWeaveDNS(hostConfig, container.Config.Hostname, dnsDomain); err != nil {
+			noop := strings.HasPrefix(networkMode, "container:") || networkMode == "host"
+			if err := addVolume(hostConfig, i.proxy.weaveWaitVolumeFor(r.Context(), container.Config.Image, noop), i.proxy.WeaveWaitMountPath, "ro"); err != nil {
+				return err
+			}
+			if !noop {
+				if dnsDomain := i.proxy.containerDNSDomain(r.Context(), container.Config.Env); dnsDomain != "" {
+					if err := i.proxy.setWeaveDNS(hostConfig, requestAPIVersion(r.URL.Path), container.Config.Hostname, dnsDomain); err != nil {
 						return err
 					}
 				}
 			}
 
-			// Note we marshal the original top-level dictionary to avoid disturbing anything else
-			if err := marshalRequestBody(r, params); err != nil {
+			// Merge into what was sent, so that fields we don't
+			// touch, e.g. LogConfig, go to Docker exactly as they were
+			if err := mergeRequestBody(r, body, params); err != nil {
 				return err
 			}
 		}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartPreservesHostConfig(t *testing.T) {
+	client := &fakeDockerClient{containers: map[string]*docker.Container{
+		"web": {
+			ID:     "web",
+			Config: &docker.Config{Image: "nginx", Entrypoint: []string{"/w/w", "nginx"}},
+		},
+	}}
+	proxy, err := newTestProxy(Config{WeaveWaitMountPath: "/w", WithoutDNS: true}, client)
+	require.NoError(t, err)
+	i := &startContainerInterceptor{proxy}
+
+	// as sent by clients of APIs before 1.24, which put the HostConfig here
+	for _, body := range []string{
+		`{"HostConfig":{"LogConfig":{"Type":"syslog","Config":{"tag":"web"}},"FutureHostField":[1.50],"Binds":["/data:/data"]}}`,
+		`{"LogConfig":{"Type":"syslog","Config":{"tag":"web"}},"FutureHostField":[1.50],"Binds":["/data:/data"]}`,
+	} {
+		r := httptest.NewRequest("POST", "/v1.23/containers/web/start", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		require.NoError(t, i.InterceptRequest(r))
+		forwarded, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Replace(body, `"/data:/data"`, `"/data:/data","/var/lib/weavewait:/w:ro"`, 1), string(forwarded))
+		proxy.removeWait(r)
+	}
+}
+
+// slowDockerClient holds inspections until released
+type slowDockerClient struct {
+	fakeDockerClient
+	release chan struct{}
+}
+
+func (f *slowDockerClient) InspectContainer(id string) (*docker.Container, error) {
+	<-f.release
+	return f.fakeDockerClient.InspectContainer(id)
+}
+
+func TestInspectContainerInPathClientGoesAway(t *testing.T) {
+	client := &slowDockerClient{
+		fakeDockerClient: fakeDockerClient{containers: map[string]*docker.Container{"web": {ID: "web"}}},
+		release:          make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	container, err := inspectContainerInPath(ctx, client, "/v1.24/containers/web/start")
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, container)
+	// the abandoned inspection finishes after we have returned
+	close(client.release)
+
+	container, err = inspectContainerInPath(context.Background(), client, "/v1.24/containers/web/start")
+	require.NoError(t, err)
+	assert.Equal(t, "web", container.ID)
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The network name the weave Docker plugin creates, which is what
+// 'docker run --net=weave --ip=...' names in NetworkingConfig.
+const defaultWeaveNetwork = "weave"
+
+// ErrStaticAddress is returned for containers asking, through
+// NetworkingConfig, for an address weave can't give them.
+type ErrStaticAddress struct {
+	Addr   string
+	Subnet string
+}
+
+func (err *ErrStaticAddress) Error() string {
+	if err.Subnet == "" {
+		return fmt.Sprintf("the static address %q is not an IPv4 address", err.Addr)
+	}
+	return fmt.Sprintf("the static address %s is outside the weave subnet %s", err.Addr, err.Subnet)
+}
+
+// weaveNetwork is the name of the network whose endpoint config, in a
+// create request, applies to the container's weave interface.
+func (proxy *Proxy) weaveNetwork() string {
+	if proxy.AttachNetwork != "" {
+		return proxy.AttachNetwork
+	}
+	return defaultWeaveNetwork
+}
+
+// staticAddress returns the IPv4Address asked for on the named network
+// in the container's NetworkingConfig, if any. Unlike jsonObject.Object
+// it leaves out objects which are missing, rather than adding an
+// endpoint for a network the container never asked to be on.
+func staticAddress(container jsonObject, network string) (string, error) {
+	object := container
+	for _, key := range []string{"NetworkingConfig", "EndpointsConfig", network, "IPAMConfig"} {
+		if value, found := object[key]; !found || value == nil {
+			return "", nil
+		}
+		var err error
+		if object, err = object.Object(key); err != nil {
+			return "", err
+		}
+	}
+	return object.String("IPv4Address")
+}
+
+// staticCIDR checks addr is within the default IPAM subnet, returning
+// it as a WEAVE_CIDR entry with that subnet's prefix length.
+func (proxy *Proxy) staticCIDR(ctx context.Context, addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() == nil {
+		return "", &ErrStaticAddress{Addr: addr}
+	}
+	var subnet *net.IPNet
+	err := proxy.withIPAM(ctx, func() error {
+		return callWithContext(ctx, func() (err error) {
+			subnet, err = proxy.weave.DefaultSubnet()
+			return
+		})
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to check static address %s against the weave subnet", addr)
+	}
+	if !subnet.Contains(ip) {
+		return "", &ErrStaticAddress{Addr: addr, Subnet: subnet.String()}
+	}
+	ones, _ := subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones), nil
+}
+
+// hasWeaveCIDR returns true if the container says which addresses it
+// wants itself, which takes precedence over any static address.
+func hasWeaveCIDR(env []string, labels map[string]string) bool {
+	for _, e := range env {
+		if strings.HasPrefix(e, "WEAVE_CIDR=") {
+			return true
+		}
+	}
+	_, found := labels[weaveCIDRLabel]
+	return found
+}
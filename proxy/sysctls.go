@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// e.g. net.ipv4.ip_forward, or net.ipv4.conf.eth0.rp_filter
+var sysctlKeyRegexp = regexp.MustCompile(`^[a-z0-9_]+(\.[A-Za-z0-9_-]+)+$`)
+
+// parseSysctls turns "key=value" entries into the sysctls to give
+// containers on the weave network.
+func parseSysctls(entries []string) (map[string]string, error) {
+	sysctls := make(map[string]string)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !sysctlKeyRegexp.MatchString(parts[0]) || parts[1] == "" {
+			return nil, fmt.Errorf("invalid sysctl %q: must be key=value, e.g. net.ipv4.ip_forward=1", entry)
+		}
+		sysctls[parts[0]] = parts[1]
+	}
+	return sysctls, nil
+}
+
+// Add our sysctls to the user's, except for those the user has set a
+// value for themselves.
+func mergeSysctls(user, ours map[string]string) map[string]string {
+	merged := make(map[string]string, len(user)+len(ours))
+	for key, value := range ours {
+		merged[key] = value
+	}
+	for key, value := range user {
+		merged[key] = value
+	}
+	return merged
+}
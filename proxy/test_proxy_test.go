@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	weaveapi "github.com/weaveworks/weave/api"
+)
+
+// testProxyOption changes how newTestProxy makes a proxy.
+type testProxyOption func(*Proxy)
+
+// withWeave points the proxy's calls to the weave router, for IPAM and
+// attaching containers, at addr, e.g. that of an httptest.Server.
+func withWeave(addr string) testProxyOption {
+	return func(p *Proxy) {
+		p.weave = weaveapi.NewClient(addr, Log)
+	}
+}
+
+// withWeaveDNS points the proxy's calls to weaveDNS at addr.
+func withWeaveDNS(addr string) testProxyOption {
+	return func(p *Proxy) {
+		client := weaveapi.NewClient(addr, Log)
+		client.SetHTTPClient(newWeaveDNSHTTPClient(p.DNSDomainTimeout, p.WeaveDNSIdleConns))
+		p.weaveDNS = client
+	}
+}
+
+// withDNSServers sets the nameservers given to containers using
+// weaveDNS, which a real proxy finds from the Docker bridge.
+func withDNSServers(servers ...string) testProxyOption {
+	return func(p *Proxy) {
+		p.dnsServers = servers
+	}
+}
+
+// newTestProxy makes a proxy from c as StubProxy does, but asking
+// client rather than a Docker daemon, so that interceptors can be
+// tested with a fake. The weavewait volumes, which a real proxy finds
+// on the weave container, are given fixed names, and hostnames are
+// made from container names as by default with flags.
+func newTestProxy(c Config, client DockerClient, opts ...testProxyOption) (*Proxy, error) {
+	if c.HostnameMatch == "" && c.HostnameReplacement == "" {
+		c.HostnameMatch, c.HostnameReplacement = "(.*)", "$1"
+	}
+	p, err := newProxy(c)
+	if err != nil {
+		return nil, err
+	}
+	if p.hostnameMatchRegexp, err = regexp.Compile(c.HostnameMatch); err != nil {
+		return nil, err
+	}
+	p.client = client
+	p.weaveWaitVolume = "/var/lib/weavewait"
+	p.weaveWaitNoopVolume = "/var/lib/weavewait-noop"
+	p.weaveWaitNomcastVolume = "/var/lib/weavewait-nomcast"
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p, nil
+}
+
+func TestNewTestProxyCreate(t *testing.T) {
+	dns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/domain", r.URL.Path)
+		fmt.Fprint(w, "weave.local.")
+	}))
+	defer dns.Close()
+	client := &fakeDockerClient{images: map[string]*docker.Image{
+		"nginx": {Config: &docker.Config{Entrypoint: []string{"nginx", "-g", "daemon off;"}}},
+	}}
+	proxy, err := newTestProxy(Config{WeaveWaitMountPath: "/w"}, client,
+		withWeaveDNS(strings.TrimPrefix(dns.URL, "http://")), withDNSServers("172.17.0.1"))
+	require.NoError(t, err)
+	i := &createContainerInterceptor{proxy: proxy}
+
+	r := httptest.NewRequest("POST", "/v1.24/containers/create?name=web", strings.NewReader(`{"Image": "nginx"}`))
+	require.NoError(t, i.InterceptRequest(r))
+	container := jsonObject{}
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&container))
+	assert.Equal(t, []interface{}{"/w/w", "nginx", "-g", "daemon off;"}, container["Entrypoint"], "from the fake's image")
+	assert.Equal(t, "web", container["Hostname"])
+	assert.Equal(t, "weave.local", container["Domainname"], "from the stubbed weaveDNS")
+	hostConfig, err := container.Object("HostConfig")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"172.17.0.1"}, hostConfig["Dns"])
+
+	r = httptest.NewRequest("POST", "/v1.24/containers/create", strings.NewReader(`{"Image": "missing"}`))
+	assert.IsType(t, &ErrNoSuchImage{}, i.InterceptRequest(r))
+}
+
+func TestNewTestProxyExec(t *testing.T) {
+	client := &fakeDockerClient{containers: map[string]*docker.Container{
+		"weavey": {
+			ID:         "weavey",
+			Config:     &docker.Config{},
+			HostConfig: &docker.HostConfig{},
+			Volumes:    map[string]string{"/w": "/var/lib/weavewait"},
+		},
+	}}
+	proxy, err := newTestProxy(Config{WeaveWaitMountPath: "/w", WithoutDNS: true}, client)
+	require.NoError(t, err)
+	i := &createExecInterceptor{proxy}
+
+	r := httptest.NewRequest("POST", "/v1.24/containers/weavey/exec", strings.NewReader(`{"Cmd": ["/bin/sh"]}`))
+	require.NoError(t, i.InterceptRequest(r))
+	options := jsonObject{}
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&options))
+	assert.Equal(t, []interface{}{"/w/w", "/bin/sh"}, options["Cmd"])
+
+	_, err = newTestProxy(Config{HostnameMatch: "("}, client)
+	assert.Error(t, err)
+}
@@ -12,9 +12,12 @@ import (
 )
 
 type TLSConfig struct {
-	Enabled, Verify   bool
-	Cert, Key, CACert string
-	*tls.Config
+	Enabled     bool   `yaml:"tls"`
+	Verify      bool   `yaml:"tlsverify"`
+	Cert        string `yaml:"tlscert"`
+	Key         string `yaml:"tlskey"`
+	CACert      string `yaml:"tlscacert"`
+	*tls.Config `yaml:"-"`
 }
 
 // IsEnabled returns true if TLS is enable, according to the config.
@@ -76,3 +79,51 @@ func (c *TLSConfig) LoadCerts() error {
 	c.Config = tlsConfig
 	return nil
 }
+
+// DockerTLSConfig holds the client certificate and CA with which the
+// proxy talks to a Docker daemon that requires TLS.
+type DockerTLSConfig struct {
+	CACert string `yaml:"docker-tlscacert"`
+	Cert   string `yaml:"docker-tlscert"`
+	Key    string `yaml:"docker-tlskey"`
+}
+
+// IsEnabled returns true if any of the certificate paths are set.
+func (c DockerTLSConfig) IsEnabled() bool {
+	return c.CACert != "" || c.Cert != "" || c.Key != ""
+}
+
+// ClientConfig loads the certificates into a tls.Config suitable for
+// dialling the Docker daemon, or returns nil if TLS is not enabled.
+func (c DockerTLSConfig) ClientConfig() (*tls.Config, error) {
+	if !c.IsEnabled() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		// Avoid fallback on insecure SSL protocols
+		MinVersion: tls.VersionTLS10,
+	}
+
+	if c.CACert != "" {
+		certPool := x509.NewCertPool()
+		file, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read Docker CA certificate: %v", err)
+		}
+		if !certPool.AppendCertsFromPEM(file) {
+			return nil, fmt.Errorf("No certificates found in %s", c.CACert)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load Docker client X509 key pair: %q", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
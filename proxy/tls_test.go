@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, path, typ string, bytes []byte) {
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: bytes}), 0600))
+}
+
+// writeClientCert generates a self-signed client certificate and key
+// in dir, returning their paths.
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "weave-proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func TestDockerTLSClientConfig(t *testing.T) {
+	tlsConfig, err := DockerTLSConfig{}.ClientConfig()
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig, "no certs means plain connections")
+
+	dir, err := ioutil.TempDir("", "weave-proxy-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var presented int
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented = len(r.TLS.PeerCertificates)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	c := DockerTLSConfig{CACert: caFile, Cert: certFile, Key: keyFile}
+	tlsConfig, err = c.ClientConfig()
+	require.NoError(t, err)
+	require.NotNil(t, tlsConfig)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.NotNil(t, tlsConfig.RootCAs)
+
+	// The proxy's own connections to the daemon must use the same
+	// config, presenting the client cert and verifying the server
+	proxy := &Proxy{
+		Config:    Config{DockerHost: "tcp://" + strings.TrimPrefix(ts.URL, "https://")},
+		dockerTLS: tlsConfig,
+	}
+	conn, err := proxy.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	req, err := http.NewRequest("GET", ts.URL+"/version", nil)
+	require.NoError(t, err)
+	req.Close = true
+	require.NoError(t, req.Write(conn))
+	_, err = ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, 1, presented)
+
+	_, err = DockerTLSConfig{CACert: filepath.Join(dir, "missing.pem")}.ClientConfig()
+	assert.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// tmpfsMount is a tmpfs to mount in containers, as HostConfig.Tmpfs
+// has them: the path, and mount options such as "rw,size=1m".
+type tmpfsMount struct {
+	path    string
+	options string
+}
+
+// parseTmpfs turns "path" or "path:options", as given to 'docker run
+// --tmpfs', into the tmpfs to give containers on the weave network with
+// a read-only root filesystem.
+func parseTmpfs(entry string) (*tmpfsMount, error) {
+	if entry == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(entry, ":", 2)
+	mount := &tmpfsMount{path: parts[0]}
+	if len(parts) == 2 {
+		mount.options = parts[1]
+	}
+	if !path.IsAbs(mount.path) || path.Clean(mount.path) != mount.path || mount.path == "/" {
+		return nil, fmt.Errorf("invalid tmpfs %q: must be an absolute path other than /, optionally followed by :options, e.g. /run/weave:rw,size=1m", entry)
+	}
+	return mount, nil
+}
+
+// addReadonlyTmpfs mounts the proxy's tmpfs in a container which has a
+// read-only root filesystem, and so nowhere else to write, unless the
+// container already mounts something there, or its image has a volume
+// there.
+func (proxy *Proxy) addReadonlyTmpfs(ctx context.Context, container, hostConfig jsonObject) error {
+	if proxy.readonlyTmpfs == nil {
+		return nil
+	}
+	readonly, err := hostConfig.Bool(hostConfig.keyFor("ReadonlyRootfs"))
+	if err != nil || !readonly {
+		return err
+	}
+	if mounted, err := proxy.mountsAt(ctx, container, hostConfig, proxy.readonlyTmpfs.path); err != nil || mounted {
+		return err
+	}
+	tmpfsKey := hostConfig.keyFor("Tmpfs")
+	tmpfs, err := hostConfig.StringMap(tmpfsKey)
+	if err != nil {
+		return err
+	}
+	if _, found := tmpfs[proxy.readonlyTmpfs.path]; found {
+		return nil
+	}
+	merged := map[string]string{proxy.readonlyTmpfs.path: proxy.readonlyTmpfs.options}
+	for mountPath, options := range tmpfs {
+		merged[mountPath] = options
+	}
+	hostConfig[tmpfsKey] = merged
+	return nil
+}
+
+// mountsAt tells whether the container has anything mounted at
+// mountPath other than a tmpfs: a bind, a mount, as API 1.25 added,
+// or a volume of its own or of its image.
+func (proxy *Proxy) mountsAt(ctx context.Context, container, hostConfig jsonObject, mountPath string) (bool, error) {
+	binds, err := hostConfig.StringArray(hostConfig.keyFor("Binds"))
+	if err != nil {
+		return false, err
+	}
+	for _, bind := range binds {
+		if s := strings.Split(bind, ":"); len(s) >= 2 && path.Clean(s[1]) == mountPath {
+			return true, nil
+		}
+	}
+
+	mounts, _ := hostConfig[hostConfig.keyFor("Mounts")].([]interface{})
+	for _, m := range mounts {
+		if mount, ok := m.(map[string]interface{}); ok {
+			if target, err := jsonObject(mount).String(jsonObject(mount).keyFor("Target")); err == nil && path.Clean(target) == mountPath {
+				return true, nil
+			}
+		}
+	}
+
+	volumes, _ := container[container.keyFor("Volumes")].(map[string]interface{})
+	for volume := range volumes {
+		if path.Clean(volume) == mountPath {
+			return true, nil
+		}
+	}
+
+	if name, err := container.String("Image"); err == nil && name != "" {
+		image, err := proxy.inspectImageWithRetry(ctx, name)
+		if err != nil {
+			// The image may not have been pulled yet; Docker will say so
+			Log.Debugf("Unable to inspect image %s for volumes: %s", name, err)
+		} else if image.Config != nil {
+			for volume := range image.Config.Volumes {
+				if path.Clean(volume) == mountPath {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// The ulimits Docker accepts, as named in Ulimits
+var knownUlimits = map[string]struct{}{
+	"as": {}, "core": {}, "cpu": {}, "data": {}, "fsize": {}, "locks": {},
+	"memlock": {}, "msgqueue": {}, "nice": {}, "nofile": {}, "nproc": {},
+	"rss": {}, "rtprio": {}, "rttime": {}, "sigpending": {}, "stack": {},
+}
+
+// parseUlimits turns "name=soft:hard" entries, or "name=soft" for a
+// hard limit the same as the soft one, as given to 'docker run
+// --ulimit', into the ulimits to give containers on the weave network.
+func parseUlimits(entries []string) ([]docker.ULimit, error) {
+	var ulimits []docker.ULimit
+	seen := make(map[string]struct{})
+	for _, entry := range entries {
+		ulimit, err := parseUlimit(entry)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := seen[ulimit.Name]; found {
+			return nil, fmt.Errorf("invalid ulimit %q: %s is given more than once", entry, ulimit.Name)
+		}
+		seen[ulimit.Name] = struct{}{}
+		ulimits = append(ulimits, ulimit)
+	}
+	return ulimits, nil
+}
+
+func parseUlimit(entry string) (docker.ULimit, error) {
+	invalid := func(reason string) (docker.ULimit, error) {
+		return docker.ULimit{}, fmt.Errorf("invalid ulimit %q: %s", entry, reason)
+	}
+	parts := strings.SplitN(entry, "=", 2)
+	if len(parts) != 2 {
+		return invalid("must be name=soft:hard, e.g. nofile=65536:65536")
+	}
+	name := parts[0]
+	if _, known := knownUlimits[name]; !known {
+		return invalid(fmt.Sprintf("unknown ulimit %q", name))
+	}
+	limits := strings.SplitN(parts[1], ":", 2)
+	soft, err := strconv.ParseInt(limits[0], 10, 64)
+	if err != nil || soft < 0 {
+		return invalid("soft limit must be a number, zero or more")
+	}
+	hard := soft
+	if len(limits) == 2 {
+		if hard, err = strconv.ParseInt(limits[1], 10, 64); err != nil || hard < 0 {
+			return invalid("hard limit must be a number, zero or more")
+		}
+	}
+	if soft > hard {
+		return invalid("soft limit must not be more than the hard limit")
+	}
+	return docker.ULimit{Name: name, Soft: soft, Hard: hard}, nil
+}
+
+// Add our ulimits to the user's, except for those the user has set
+// themselves, whose entries are left as they are.
+func mergeUlimits(user []interface{}, ours []docker.ULimit) []interface{} {
+	set := make(map[string]struct{}, len(user))
+	for _, entry := range user {
+		if ulimit, ok := asJSONObject(entry); ok {
+			if name, ok := ulimit["Name"].(string); ok {
+				set[name] = struct{}{}
+			}
+		}
+	}
+	merged := append([]interface{}{}, user...)
+	for _, ulimit := range ours {
+		if _, found := set[ulimit.Name]; !found {
+			merged = append(merged, ulimit)
+		}
+	}
+	return merged
+}
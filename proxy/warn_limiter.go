@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// How many warnings of a kind are logged straight away, and how
+	// often another is allowed after that
+	warnBurst    = 5
+	warnInterval = 10 * time.Second
+)
+
+// warnLimiter logs warnings which may repeat on every request, e.g.
+// while weaveDNS is down, through a token bucket per format string, so
+// that a run of them is not logged in full. The number of warnings
+// suppressed is added to the next one of that kind which is logged.
+// The zero value allows warnBurst warnings, then one per warnInterval.
+type warnLimiter struct {
+	sync.Mutex
+	burst    int
+	interval time.Duration
+	now      func() time.Time
+	buckets  map[string]*warnBucket
+}
+
+type warnBucket struct {
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+func (l *warnLimiter) Warningf(format string, args ...interface{}) {
+	suppressed, ok := l.take(format)
+	if !ok {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (suppressed %d similar warnings)", msg, suppressed)
+	}
+	Log.Warning(msg)
+}
+
+// take reports whether a warning for key may be logged now and, if so,
+// how many have been suppressed since the last one that was.
+func (l *warnLimiter) take(key string) (int, bool) {
+	l.Lock()
+	defer l.Unlock()
+	burst, interval, now := l.burst, l.interval, time.Now()
+	if burst == 0 {
+		burst = warnBurst
+	}
+	if interval == 0 {
+		interval = warnInterval
+	}
+	if l.now != nil {
+		now = l.now()
+	}
+	if l.buckets == nil {
+		l.buckets = make(map[string]*warnBucket)
+	}
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &warnBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens += float64(now.Sub(bucket.last)) / float64(interval)
+	if bucket.tokens > float64(burst) {
+		bucket.tokens = float64(burst)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		bucket.suppressed++
+		return 0, false
+	}
+	bucket.tokens--
+	suppressed := bucket.suppressed
+	bucket.suppressed = 0
+	return suppressed, true
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	weaveapi "github.com/weaveworks/weave/api"
+)
+
+func captureLog() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	out, level := Log.Out, Log.Level
+	Log.Out, Log.Level = &buf, logrus.WarnLevel
+	return &buf, func() { Log.Out, Log.Level = out, level }
+}
+
+func logLines(buf *bytes.Buffer) []string {
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestWarnLimiter(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	now := time.Now()
+	l := &warnLimiter{burst: 2, interval: time.Minute, now: func() time.Time { return now }}
+	for n := 0; n < 10; n++ {
+		l.Warningf("Unable to frob %d", n)
+	}
+	l.Warningf("Something else")
+	lines := logLines(buf)
+	require.Len(t, lines, 3, buf.String())
+	assert.Contains(t, lines[0], "Unable to frob 0")
+	assert.Contains(t, lines[1], "Unable to frob 1")
+	assert.Contains(t, lines[2], "Something else", "counted separately")
+
+	buf.Reset()
+	now = now.Add(time.Minute)
+	l.Warningf("Unable to frob %d", 10)
+	l.Warningf("Unable to frob %d", 11)
+	lines = logLines(buf)
+	require.Len(t, lines, 1, buf.String())
+	assert.Contains(t, lines[0], "Unable to frob 10 (suppressed 8 similar warnings)")
+
+	buf.Reset()
+	now = now.Add(time.Hour)
+	for n := 0; n < 3; n++ {
+		l.Warningf("Unable to frob %d", n)
+	}
+	lines = logLines(buf)
+	require.Len(t, lines, 2, "no more than the burst after a long quiet spell")
+	assert.Contains(t, lines[0], "(suppressed 1 similar warnings)")
+	assert.NotContains(t, lines[1], "suppressed")
+}
+
+func TestDNSDomainFailuresAreRateLimited(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	proxy := &Proxy{
+		Config:   Config{DNSDomainCacheTTL: time.Nanosecond},
+		weaveDNS: weaveapi.NewClient(strings.TrimPrefix(ts.URL, "http://"), Log),
+	}
+
+	for n := 0; n < 100; n++ {
+		assert.Equal(t, "", proxy.getDNSDomain(context.Background()))
+	}
+	lines := logLines(buf)
+	assert.Len(t, lines, warnBurst, buf.String())
+	for _, line := range lines {
+		assert.Contains(t, line, "Unable to get weaveDNS domain")
+	}
+}
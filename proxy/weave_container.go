@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// defaultWeaveContainer is the name `weave launch` gives the router's
+// container, which also runs weaveDNS and holds the weavewait volumes.
+const defaultWeaveContainer = "weave"
+
+// findWeaveContainer inspects the weave container: the one with
+// Config.WeaveContainerLabel, if set and any container has it, or else
+// the one named Config.WeaveContainer, for when e.g. compose has
+// prefixed its name.
+func (proxy *Proxy) findWeaveContainer() (*docker.Container, error) {
+	if proxy.WeaveContainerLabel != "" {
+		containers, err := proxy.client.ListContainers(docker.ListContainersOptions{
+			Filters: map[string][]string{"label": {proxy.WeaveContainerLabel}},
+		})
+		switch {
+		case err != nil:
+			Log.Warningf("Unable to list containers with label %s, looking for %s by name: %s", proxy.WeaveContainerLabel, proxy.WeaveContainer, err)
+		case len(containers) == 0:
+			Log.Warningf("No container has label %s, looking for %s by name", proxy.WeaveContainerLabel, proxy.WeaveContainer)
+		default:
+			if len(containers) > 1 {
+				Log.Warningf("%d containers have label %s, using %s", len(containers), proxy.WeaveContainerLabel, containers[0].ID)
+			}
+			return proxy.client.InspectContainer(containers[0].ID)
+		}
+	}
+	return proxy.client.InspectContainer(proxy.WeaveContainer)
+}
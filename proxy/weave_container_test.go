@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func weaveContainer(id string, labels map[string]string) *docker.Container {
+	return &docker.Container{
+		ID:     id,
+		Config: &docker.Config{Labels: labels},
+		Volumes: map[string]string{
+			"/w":         "/var/lib/" + id + "/w",
+			"/w-noop":    "/var/lib/" + id + "/w-noop",
+			"/w-nomcast": "/var/lib/" + id + "/w-nomcast",
+		},
+	}
+}
+
+func TestFindWeaveContainerByName(t *testing.T) {
+	client := &fakeDockerClient{containers: map[string]*docker.Container{
+		"weave":           weaveContainer("weave", nil),
+		"project_weave_1": weaveContainer("project_weave_1", nil),
+	}}
+
+	proxy, err := newTestProxy(Config{}, client)
+	require.NoError(t, err)
+	require.NoError(t, proxy.findWeaveWaitVolumes())
+	assert.Equal(t, "/var/lib/weave/w", proxy.weaveWaitVolume, "by default, the container named weave")
+
+	proxy, err = newTestProxy(Config{WeaveContainer: "project_weave_1"}, client)
+	require.NoError(t, err)
+	require.NoError(t, proxy.findWeaveWaitVolumes())
+	assert.Equal(t, "/var/lib/project_weave_1/w", proxy.weaveWaitVolume)
+	assert.Equal(t, "/var/lib/project_weave_1/w-noop", proxy.weaveWaitNoopVolume)
+	assert.Equal(t, "/var/lib/project_weave_1/w-nomcast", proxy.weaveWaitNomcastVolume)
+
+	proxy, err = newTestProxy(Config{WeaveContainer: "missing"}, client)
+	require.NoError(t, err)
+	assert.Error(t, proxy.findWeaveWaitVolumes())
+}
+
+func TestFindWeaveContainerByLabel(t *testing.T) {
+	client := &fakeDockerClient{containers: map[string]*docker.Container{
+		"weave":    weaveContainer("weave", nil),
+		"3e5f9b0a": weaveContainer("3e5f9b0a", map[string]string{"com.docker.compose.service": "weave"}),
+		"77c1d2e4": weaveContainer("77c1d2e4", map[string]string{"com.docker.compose.service": "web"}),
+	}}
+
+	for _, test := range []struct{ label, id string }{
+		{"com.docker.compose.service=weave", "3e5f9b0a"},
+		{"com.docker.compose.service=mesh", "weave"}, // none has it, so by name
+	} {
+		proxy, err := newTestProxy(Config{WeaveContainerLabel: test.label}, client)
+		require.NoError(t, err)
+		container, err := proxy.findWeaveContainer()
+		require.NoError(t, err, test.label)
+		assert.Equal(t, test.id, container.ID, test.label)
+	}
+
+	_, err := newTestProxy(Config{WeaveContainerLabel: "=weave"}, client)
+	assert.Error(t, err)
+}
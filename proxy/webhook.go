@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const attachWebhookTimeout = 5 * time.Second
+
+// attachNotice is what we POST to the attach webhook once a container
+// is on the weave network with its final addresses.
+type attachNotice struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Image string   `json:"image"`
+	CIDRs []string `json:"cidrs"`
+}
+
+func validateWebhookURL(webhook string) error {
+	if webhook == "" {
+		return nil
+	}
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid attach webhook '%s': must be an http or https URL", webhook)
+	}
+	return nil
+}
+
+// notifyAttached tells the attach webhook, if there is one, about a
+// container we have just attached. It doesn't wait for the webhook,
+// which is only given attachWebhookTimeout to answer, and failures
+// are just logged: they must never hold up or fail the container.
+func (proxy *Proxy) notifyAttached(container *docker.Container, ips []*net.IPNet) {
+	if proxy.webhookClient == nil {
+		return
+	}
+	notice := attachNotice{
+		ID:    container.ID,
+		Name:  strings.TrimPrefix(container.Name, "/"),
+		Image: container.Config.Image,
+		CIDRs: make([]string, len(ips)),
+	}
+	for i, ip := range ips {
+		notice.CIDRs[i] = ip.String()
+	}
+	body, err := json.Marshal(notice)
+	if err != nil {
+		Log.Warningf("Unable to encode attach notice for container %s: %s", container.ID, err)
+		return
+	}
+	go func() {
+		resp, err := proxy.webhookClient.Post(proxy.AttachWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			Log.Warningf("Unable to notify attach webhook of container %s: %s", container.ID, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			Log.Warningf("Attach webhook answered %s for container %s", resp.Status, container.ID)
+		}
+	}()
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyAttached(t *testing.T) {
+	notices := make(chan map[string]interface{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var notice map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&notice))
+		notices <- notice
+	}))
+	defer ts.Close()
+
+	proxy := &Proxy{Config: Config{AttachWebhook: ts.URL + "/attached"}, webhookClient: &http.Client{Timeout: time.Second}}
+	_, ip1, _ := net.ParseCIDR("10.32.0.0/12")
+	ip1.IP = net.ParseIP("10.32.0.5")
+	_, ip2, _ := net.ParseCIDR("10.2.1.7/24")
+	container := &docker.Container{ID: "c1", Name: "/web", Config: &docker.Config{Image: "nginx:latest"}}
+	proxy.notifyAttached(container, []*net.IPNet{ip1, ip2})
+
+	select {
+	case notice := <-notices:
+		assert.Equal(t, map[string]interface{}{
+			"id":    "c1",
+			"name":  "web",
+			"image": "nginx:latest",
+			"cidrs": []interface{}{"10.32.0.5/12", "10.2.1.0/24"},
+		}, notice)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+}
+
+func TestNotifyAttachedDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	proxy := &Proxy{Config: Config{AttachWebhook: ts.URL}, webhookClient: &http.Client{Timeout: 100 * time.Millisecond}}
+	container := &docker.Container{ID: "c1", Config: &docker.Config{}}
+	done := make(chan struct{})
+	go func() {
+		proxy.notifyAttached(container, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a hung webhook held up the attach")
+	}
+
+	// and no webhook configured, nothing to do
+	(&Proxy{}).notifyAttached(container, nil)
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	for webhook, valid := range map[string]bool{
+		"":                           true,
+		"http://cmdb.example.com/x":  true,
+		"https://10.0.0.1:8443/hook": true,
+		"cmdb.example.com":           false,
+		"ftp://cmdb.example.com":     false,
+		"http://":                    false,
+	} {
+		assert.Equal(t, valid, validateWebhookURL(webhook) == nil, "webhook %q", webhook)
+	}
+}